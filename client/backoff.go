@@ -0,0 +1,35 @@
+package client
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// backoff spaces out reconnect attempts: the delay doubles with each
+// consecutive failure up to max, with ±20% jitter so that clients cut off
+// by the same server restart don't all come back at once.
+type backoff struct {
+	base time.Duration
+	max  time.Duration
+
+	attempt int
+}
+
+func (b *backoff) next() time.Duration {
+	d := b.base
+	for i := 0; i < b.attempt && d < b.max; i++ {
+		d *= 2
+	}
+	if d >= b.max {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+
+	jitter := (rand.Float64()*0.4 - 0.2) * float64(d)
+	return d + time.Duration(jitter)
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+// within reports whether d is within the ±20% jitter of want.
+func within(d, want time.Duration) bool {
+	return d >= want*8/10 && d <= want*12/10
+}
+
+func TestBackoffGrows(t *testing.T) {
+	b := &backoff{base: time.Second, max: 30 * time.Second}
+	for _, want := range []time.Duration{1, 2, 4, 8, 16, 30, 30, 30} {
+		want *= time.Second
+		if d := b.next(); !within(d, want) {
+			t.Errorf("delay %s, want %s ±20%%", d, want)
+		}
+	}
+}
+
+func TestBackoffResets(t *testing.T) {
+	b := &backoff{base: time.Second, max: time.Minute}
+	for range 5 {
+		b.next()
+	}
+	b.reset()
+	if d := b.next(); !within(d, time.Second) {
+		t.Errorf("delay after reset %s, want 1s ±20%%", d)
+	}
+	if d := b.next(); !within(d, 2*time.Second) {
+		t.Errorf("second delay after reset %s, want 2s ±20%%", d)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	seen := make(map[time.Duration]bool)
+	for range 20 {
+		b := &backoff{base: time.Second, max: time.Minute}
+		seen[b.next()] = true
+	}
+	if len(seen) < 2 {
+		t.Error("every client got the same delay")
+	}
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker stops sending requests to a local API that keeps failing. After
+// threshold consecutive failures it opens, and requests are refused until
+// cooldown has passed. Then a single probe is let through: if it succeeds
+// the breaker closes again, otherwise it stays open for another cooldown.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time // zero while closed
+	probing  bool
+}
+
+// allow reports whether a request may go to the local API. Every allowed
+// request must be followed by a call to done.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openedAt.IsZero() {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// done records the outcome of a request that allow let through. It
+// reports whether the breaker changed state, for logging.
+func (b *breaker) done(ok bool) (opened, closed bool) {
+	if b == nil {
+		return false, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasOpen := !b.openedAt.IsZero()
+	b.probing = false
+	if ok {
+		b.failures = 0
+		b.openedAt = time.Time{}
+		return false, wasOpen
+	}
+
+	b.failures++
+	if wasOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		return !wasOpen, false
+	}
+	return false, false
+}
+
+// breakers keeps one breaker per local API, so a failing route target
+// doesn't cut off the others.
+type breakers struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu sync.Mutex
+	m  map[string]*breaker
+}
+
+// newBreakers returns nil, which never trips, if threshold is not positive.
+func newBreakers(threshold int, cooldown time.Duration) *breakers {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		m:         make(map[string]*breaker),
+	}
+}
+
+func (bs *breakers) get(target string) *breaker {
+	if bs == nil {
+		return nil
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b, ok := bs.m[target]
+	if !ok {
+		b = &breaker{threshold: bs.threshold, cooldown: bs.cooldown}
+		bs.m[target] = b
+	}
+	return b
+}
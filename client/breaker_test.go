@@ -0,0 +1,104 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+// fail sends n failing requests through b.
+func fail(t *testing.T, b *breaker, n int) {
+	t.Helper()
+	for i := range n {
+		if !b.allow() {
+			t.Fatalf("request %d refused before the threshold", i)
+		}
+		b.done(false)
+	}
+}
+
+func TestBreakerOpens(t *testing.T) {
+	b := &breaker{threshold: 3, cooldown: time.Hour}
+	fail(t, b, 2)
+	if !b.allow() {
+		t.Fatal("refused below the threshold")
+	}
+	if opened, _ := b.done(false); !opened {
+		t.Error("the third failure didn't report opening")
+	}
+	if b.allow() {
+		t.Error("an open breaker let a request through")
+	}
+}
+
+func TestBreakerSuccessResets(t *testing.T) {
+	b := &breaker{threshold: 3, cooldown: time.Hour}
+	fail(t, b, 2)
+	b.allow()
+	b.done(true)
+	// The count starts again, so two more failures don't open it
+	fail(t, b, 2)
+	if !b.allow() {
+		t.Error("failures before a success counted towards opening")
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b := &breaker{threshold: 1, cooldown: 50 * time.Millisecond}
+	fail(t, b, 1)
+	if b.allow() {
+		t.Fatal("let a request through during the cooldown")
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	// One probe, and nothing else while it runs
+	if !b.allow() {
+		t.Fatal("no probe after the cooldown")
+	}
+	if b.allow() {
+		t.Error("a second request went alongside the probe")
+	}
+
+	// A failed probe opens it for another cooldown
+	if opened, closed := b.done(false); opened || closed {
+		t.Errorf("failed probe reported opened %v closed %v, want no change", opened, closed)
+	}
+	if b.allow() {
+		t.Error("let a request through after a failed probe")
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	// A successful one closes it
+	if !b.allow() {
+		t.Fatal("no second probe")
+	}
+	if _, closed := b.done(true); !closed {
+		t.Error("successful probe didn't report closing")
+	}
+	for range 5 {
+		if !b.allow() {
+			t.Fatal("refused once closed")
+		}
+		b.done(true)
+	}
+}
+
+func TestBreakersPerTarget(t *testing.T) {
+	bs := newBreakers(1, time.Hour)
+	a := bs.get("http://a")
+	fail(t, a, 1)
+	if bs.get("http://a") != a {
+		t.Error("a target got a second breaker")
+	}
+	if !bs.get("http://b").allow() {
+		t.Error("one target's failures cut off another")
+	}
+
+	disabled := newBreakers(0, time.Hour)
+	b := disabled.get("http://a")
+	for range 10 {
+		if !b.allow() {
+			t.Fatal("a disabled breaker refused")
+		}
+		b.done(false)
+	}
+}
@@ -0,0 +1,1076 @@
+// Package client runs the home-server end of an intunja tunnel: it
+// registers with a tunnel server and forwards the requests that arrive
+// through it to a local API.
+//
+//	c, err := client.New(client.Options{
+//		Remote: "tunnel.example.com:8080",
+//		Local:  "http://localhost:3000",
+//		Name:   "myapp",
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	c.Start(ctx)
+//	defer c.Stop()
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/internal/compress"
+	"github.com/mindsgn-studio/intunja/internal/limit"
+	"github.com/mindsgn-studio/intunja/internal/mux"
+	"github.com/mindsgn-studio/intunja/internal/protocol"
+	"github.com/mindsgn-studio/intunja/internal/quicconn"
+	"github.com/mindsgn-studio/intunja/internal/relay"
+	"github.com/mindsgn-studio/intunja/internal/sockopt"
+	"github.com/mindsgn-studio/intunja/internal/version"
+)
+
+// Options configures a Client. Zero values get the defaults noted on each
+// field.
+type Options struct {
+	// Remote is the tunnel server's host:port.
+	Remote string
+	// Local is the local API's base URL, or its host:port in tcp mode. In
+	// http mode it may instead be a Unix socket, as unix:///path/to.sock.
+	Local string
+	// Mode is "http" (the default), or "tcp" to splice streams onto Local
+	// without parsing HTTP.
+	Mode string
+	// Name is the tunnel to register under; "default" if empty. Names are
+	// chosen by the client, not handed out by the server, so a client
+	// restarted with the same Name takes over the same routing at once;
+	// there is nothing to persist between runs. The server's
+	// -reconnect-grace holds requests that arrive in between.
+	Name      string
+	AuthToken string
+
+	// TLS, if set, is used to connect to the tunnel server. An empty
+	// ServerName is taken from Remote.
+	TLS *tls.Config
+	// QUIC runs the tunnel over QUIC instead of TCP, so it survives the
+	// client's address changing. QUIC is always encrypted: without TLS the
+	// server's certificate is checked against the system roots.
+	QUIC bool
+	// Transport makes requests to the local API; http.DefaultTransport if
+	// nil.
+	Transport http.RoundTripper
+	// LocalTLS, if set, is used to connect to https local APIs, e.g. to
+	// trust a private CA.
+	LocalTLS *tls.Config
+	// DNSCacheTTL, if positive, caches the local APIs' DNS lookups for
+	// that long instead of resolving them for every connection.
+	DNSCacheTTL time.Duration
+	// Routes send paths under a prefix, or requests by the value of their
+	// RouteHeader, to other local APIs, which may also be Unix sockets. A
+	// request whose header value has a route goes there whatever its path.
+	Routes      []Route
+	RouteHeader string
+	// PreserveHost sends the local API the Host the public client asked
+	// for instead of the local API's own. HostOverride, if set, is sent
+	// instead of either.
+	PreserveHost bool
+	HostOverride string
+
+	// Compress asks the server to gzip the tunnel connection.
+	Compress bool
+	// Echo answers every request with a JSON description of it instead of
+	// forwarding it.
+	Echo bool
+	// AllowConnect lets the server have the client dial TCP targets for
+	// public clients using it as a CONNECT proxy.
+	AllowConnect bool
+
+	// ReconnectDelay is the initial delay between reconnect attempts
+	// (5s), doubling up to MaxReconnectDelay (2m).
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+	// KeepAlive is the tunnel keep-alive interval (10s).
+	KeepAlive time.Duration
+	// TCPKeepAlive is the TCP keep-alive probe period on the tunnel
+	// connection (15s); negative turns keep-alives off.
+	TCPKeepAlive time.Duration
+	// Nagle lets the tunnel connection coalesce small writes. By default
+	// TCP_NODELAY is set so they go out at once.
+	Nagle bool
+	// Timeout bounds each request to the local API (30s), from dialing
+	// to the end of the response body.
+	Timeout time.Duration
+	// LocalConnectTimeout, if positive, bounds connecting to the local API,
+	// TLS handshake included, and LocalResponseHeaderTimeout waiting for
+	// its response headers once the request is sent. Both fail a request
+	// sooner than Timeout would, which still caps it as a whole.
+	LocalConnectTimeout        time.Duration
+	LocalResponseHeaderTimeout time.Duration
+	// MaxConcurrent caps requests handled at once; 0 for no limit.
+	MaxConcurrent int
+	// Workers, if positive, serves requests on a fixed pool of goroutines
+	// fed from a queue of QueueSize (100). Requests that find the queue
+	// full are refused with 503. Otherwise each request gets its own
+	// goroutine.
+	Workers   int
+	QueueSize int
+	// LocalRetries is how many more times an idempotent request is sent
+	// when the local API answers 502 or 503 or the connection fails, with
+	// a short backoff between tries. Bodies over 1MB aren't retried.
+	LocalRetries int
+	// After BreakerThreshold consecutive failures a local API is refused
+	// requests for BreakerCooldown (30s). 0 disables the breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// CopyBufferSize is the buffer size for the raw copies in tcp mode and
+	// on upgraded or CONNECT connections (32KB).
+	CopyBufferSize int
+
+	// MaxHeaderBytes is the largest request head accepted from the tunnel
+	// (1MB). A bigger one has its stream reset.
+	MaxHeaderBytes int
+
+	// Logger receives the client's logs; slog.Default() if nil.
+	Logger *slog.Logger
+	// OnError, if set, is also given every failure the client logs: each
+	// failed or lost connection and each request the local API couldn't
+	// answer, as a *TunnelError. It may be called from several goroutines
+	// at once.
+	OnError func(error)
+}
+
+// Client keeps a tunnel registered, reconnecting whenever it drops, and
+// serves the requests that come through it.
+type Client struct {
+	opts     Options
+	log      *slog.Logger
+	local    *http.Client
+	upgrade  *http.Client
+	grpc     *http.Client // speaks HTTP/2 to the local API
+	base     *url.URL     // Local, in http mode
+	routes   routeList
+	sockets  unixSockets
+	dns      *dnsCache // nil without DNSCacheTTL
+	inFlight limit.Semaphore
+	queue    chan queued // nil without Workers
+	breakers *breakers
+	buffers  *relay.BufferPool
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	wg      sync.WaitGroup
+}
+
+// New checks opts and returns a Client ready to Start.
+func New(opts Options) (*Client, error) {
+	if opts.Remote == "" {
+		return nil, errors.New("remote address is required")
+	}
+	if opts.Local == "" {
+		return nil, errors.New("local address is required")
+	}
+	switch opts.Mode {
+	case "":
+		opts.Mode = "http"
+	case "http", "tcp":
+	default:
+		return nil, fmt.Errorf("unknown mode %q, want http or tcp", opts.Mode)
+	}
+	if opts.QUIC && opts.TLS == nil {
+		opts.TLS = &tls.Config{}
+	}
+	if opts.Name == "" {
+		opts.Name = "default"
+	}
+	if opts.ReconnectDelay <= 0 {
+		opts.ReconnectDelay = 5 * time.Second
+	}
+	if opts.MaxReconnectDelay <= 0 {
+		opts.MaxReconnectDelay = 2 * time.Minute
+	}
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = 10 * time.Second
+	}
+	if opts.TCPKeepAlive == 0 {
+		opts.TCPKeepAlive = 15 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 100
+	}
+	if opts.BreakerCooldown <= 0 {
+		opts.BreakerCooldown = 30 * time.Second
+	}
+	if opts.MaxHeaderBytes <= 0 {
+		opts.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+
+	// Local APIs on Unix sockets are reached through placeholder URLs
+	sockets := make(unixSockets)
+	var base *url.URL
+	var routes routeList
+	if opts.Mode == "http" {
+		local, err := sockets.rewrite(opts.Local)
+		if err != nil {
+			return nil, err
+		}
+		if base, err = parseLocalURL(local); err != nil {
+			return nil, err
+		}
+		targets := make([]Route, len(opts.Routes))
+		for i, r := range opts.Routes {
+			if r.Value != "" && opts.RouteHeader == "" {
+				return nil, fmt.Errorf("route %s needs a route header", r)
+			}
+			if r.Target, err = sockets.rewrite(r.Target); err != nil {
+				return nil, err
+			}
+			targets[i] = r
+		}
+		if routes, err = newRouteList(targets); err != nil {
+			return nil, err
+		}
+	}
+	if opts.LocalTLS != nil {
+		var err error
+		if opts.Transport, err = localTLS(opts.Transport, opts.LocalTLS); err != nil {
+			return nil, err
+		}
+	}
+	var dns *dnsCache
+	if opts.DNSCacheTTL > 0 {
+		dns = newDNSCache(opts.DNSCacheTTL, net.DefaultResolver, opts.Logger)
+		var err error
+		if opts.Transport, err = dns.transport(opts.Transport); err != nil {
+			return nil, err
+		}
+	}
+	if len(sockets) > 0 {
+		var err error
+		if opts.Transport, err = sockets.transport(opts.Transport); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.LocalConnectTimeout > 0 || opts.LocalResponseHeaderTimeout > 0 {
+		var err error
+		if opts.Transport, err = localTimeouts(opts.Transport, opts.LocalConnectTimeout, opts.LocalResponseHeaderTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	// Redirects are passed back to the public client, not followed
+	noRedirect := func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	c := &Client{
+		opts: opts,
+		log:  opts.Logger,
+		local: &http.Client{
+			Transport:     opts.Transport,
+			Timeout:       opts.Timeout,
+			CheckRedirect: noRedirect,
+		},
+		// No overall timeout: an upgraded connection lives as long as it's used
+		upgrade: &http.Client{
+			Transport:     opts.Transport,
+			CheckRedirect: noRedirect,
+		},
+		// gRPC streams, like upgraded connections, last as long as they're used
+		grpc: &http.Client{
+			Transport:     grpcTransport(opts.Transport),
+			CheckRedirect: noRedirect,
+		},
+		base:     base,
+		routes:   routes,
+		sockets:  sockets,
+		dns:      dns,
+		inFlight: limit.New(opts.MaxConcurrent),
+		breakers: newBreakers(opts.BreakerThreshold, opts.BreakerCooldown),
+		buffers:  relay.NewBufferPool(opts.CopyBufferSize),
+	}
+	return c, nil
+}
+
+// Start connects to the tunnel server in the background and keeps doing so
+// until ctx is cancelled or Stop is called.
+func (c *Client) Start(ctx context.Context) {
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.stopped = make(chan struct{})
+	if c.opts.Workers > 0 {
+		c.queue = make(chan queued, c.opts.QueueSize)
+		for range c.opts.Workers {
+			go c.worker()
+		}
+	}
+	go func() {
+		defer close(c.stopped)
+		c.run()
+	}()
+}
+
+// Stop disconnects and waits for requests being handled to finish.
+func (c *Client) Stop() {
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	<-c.stopped
+}
+
+// errRotated means the server asked for a new connection, e.g. because
+// this one reached its maximum lifetime.
+var errRotated = errors.New("tunnel rotated by server")
+
+// A connection that stays up this long is considered healthy, so losing it
+// backs off again from the initial delay.
+const stableConnection = time.Minute
+
+func (c *Client) run() {
+	retry := &backoff{base: c.opts.ReconnectDelay, max: c.opts.MaxReconnectDelay}
+	defer func() {
+		c.dropQueued()
+		c.wg.Wait()
+	}()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			c.log.Info("tunnel client stopped")
+			return
+		default:
+			start := time.Now()
+			if err := c.connect(); err != nil {
+				if c.ctx.Err() != nil {
+					continue
+				}
+				if errors.Is(err, errRotated) {
+					retry.reset()
+					c.log.Info("server is rotating the tunnel, reconnecting")
+					continue
+				}
+				c.log.Error("tunnel error", "err", err)
+				var te *TunnelError
+				if errors.As(err, &te) {
+					c.report(te)
+				}
+				if time.Since(start) >= stableConnection {
+					// A healthy connection dropped: start again from the
+					// initial delay, still jittered so that clients cut off
+					// together don't all come back at once
+					retry.reset()
+				}
+				delay := retry.next()
+				c.log.Info("reconnecting", "delay", delay.Round(time.Millisecond))
+
+				select {
+				case <-c.ctx.Done():
+				case <-time.After(delay):
+				}
+			}
+		}
+	}
+}
+
+func (c *Client) connect() error {
+	c.log.Info("connecting to tunnel server", "remote", c.opts.Remote)
+
+	// Connect to remote tunnel server
+	conn, err := c.dial()
+	if err != nil {
+		return &TunnelError{Kind: DialFailed, Err: err}
+	}
+
+	// Authenticate, then register under our tunnel name and version
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := fmt.Fprintf(conn, "AUTH %s\n", c.opts.AuthToken); err != nil {
+		conn.Close()
+		return &TunnelError{Kind: Closed, Err: fmt.Errorf("failed to send token: %w", err)}
+	}
+	// Asking about compression gets an answer from servers that predate
+	// versioned handshakes too; the features say whether we want it
+	hello := protocol.Hello{Flags: protocol.FlagHello | protocol.FlagGzip, Version: protocol.Current}
+	if c.opts.Compress {
+		hello.Features |= protocol.FeatureGzip
+	}
+	if err := mux.WriteFrame(conn, hello.Register(), []byte(c.opts.Name+" "+version.Version)); err != nil {
+		conn.Close()
+		return &TunnelError{Kind: Closed, Err: fmt.Errorf("failed to register: %w", err)}
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	agreed, err := c.negotiate(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	var zconn *compress.Conn
+	if agreed.Flags&protocol.FlagGzip != 0 {
+		// A Version1 server compresses whenever it is configured to
+		zconn = compress.Gzip(conn)
+		conn = zconn
+	} else if c.opts.Compress {
+		c.log.Warn("server declined compression, continuing uncompressed")
+	}
+
+	config := mux.DefaultConfig()
+	config.KeepAliveInterval = c.opts.KeepAlive
+	session := mux.Client(conn, config)
+
+	c.log.Info("tunnel established", "tunnel", c.opts.Name, "protocol", agreed.Version, "compressed", zconn != nil)
+	if zconn != nil {
+		go c.logCompression(session, zconn)
+	}
+
+	// Requests on this connection live no longer than it does. Tear the
+	// session down on shutdown so AcceptStream returns, and cut off the
+	// requests still in flight once it is gone, before they write to a
+	// connection the next one has replaced.
+	ctx, cancel := context.WithCancel(c.ctx)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-session.Closed():
+		}
+		session.Close()
+		cancel()
+	}()
+
+	// Handle incoming requests
+	done := make(chan error, 1)
+	go func() { done <- c.handleRequests(ctx, session) }()
+	select {
+	case err := <-done:
+		session.Close()
+		return err
+	case <-session.GoingAway():
+		// Keep serving what is already on this connection; the server
+		// closes it once those requests are done
+		return errRotated
+	}
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	conn, err := c.dialRemote(c.ctx)
+	if err != nil {
+		return nil, err
+	}
+	opts := sockopt.Options{KeepAlive: max(c.opts.TCPKeepAlive, 0), NoDelay: !c.opts.Nagle}
+	if err := opts.Apply(conn); err != nil {
+		c.log.Warn("failed to set socket options", "err", err)
+	}
+	return conn, nil
+}
+
+// CheckRemote dials the tunnel server as Start would, over TCP, TLS or
+// QUIC, and hangs up without registering a tunnel.
+func (c *Client) CheckRemote(ctx context.Context) error {
+	conn, err := c.dialRemote(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (c *Client) dialRemote(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if c.opts.TLS == nil {
+		return dialer.DialContext(ctx, "tcp", c.opts.Remote)
+	}
+
+	config := c.opts.TLS.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(c.opts.Remote)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	if c.opts.QUIC {
+		ctx, cancel := context.WithTimeout(ctx, dialer.Timeout)
+		defer cancel()
+		return quicconn.Dial(ctx, c.opts.Remote, config)
+	}
+	td := &tls.Dialer{NetDialer: dialer, Config: config}
+	return td.DialContext(ctx, "tcp", c.opts.Remote)
+}
+
+// negotiate waits for the server's Hello and checks that it speaks a
+// protocol version we do.
+func (c *Client) negotiate(conn net.Conn) (protocol.Hello, error) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	agreed, err := protocol.ReadAnswer(conn)
+	if err != nil {
+		return agreed, &TunnelError{Kind: Closed, Err: fmt.Errorf("handshake failed: %w", err)}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if agreed.Version == 0 {
+		// Turned away for our version; the reason follows
+		session := mux.Client(conn, mux.DefaultConfig())
+		select {
+		case <-session.Closed():
+		case <-time.After(10 * time.Second):
+			session.Close()
+		}
+		var peer *mux.PeerError
+		if errors.As(session.Err(), &peer) {
+			return agreed, &TunnelError{Kind: Incompatible, Err: errors.New(peer.Reason)}
+		}
+		return agreed, &TunnelError{Kind: Incompatible, Err: session.Err()}
+	}
+	if err := protocol.Check(agreed); err != nil {
+		return agreed, &TunnelError{Kind: Incompatible, Err: fmt.Errorf("%w; upgrade the server", err)}
+	}
+	return agreed, nil
+}
+
+// logCompression reports how well the tunnel's traffic is compressing
+// until the session closes.
+func (c *Client) logCompression(session *mux.Session, conn *compress.Conn) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-session.Closed():
+			return
+		case <-ticker.C:
+			st := conn.Stats()
+			c.log.Info("tunnel compression", "raw_bytes", st.Raw, "wire_bytes", st.Wire, "ratio", fmt.Sprintf("%.2f", st.Ratio()))
+		}
+	}
+}
+
+func (c *Client) handleRequests(ctx context.Context, session *mux.Session) error {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return &TunnelError{Kind: Closed, Err: c.ctx.Err()}
+			}
+			return sessionError(err)
+		}
+
+		if !c.inFlight.TryAcquire() {
+			c.log.Warn("too many requests in flight, rejecting", "max", c.opts.MaxConcurrent)
+			c.refuse(stream, "Service Unavailable - too many requests in flight")
+			continue
+		}
+
+		c.wg.Add(1)
+		if c.queue == nil {
+			// Handle request in separate goroutine
+			go c.serve(ctx, stream)
+			continue
+		}
+		select {
+		case c.queue <- queued{ctx: ctx, stream: stream}:
+		default:
+			c.log.Warn("request queue full, rejecting", "workers", c.opts.Workers, "queue", c.opts.QueueSize)
+			c.inFlight.Release()
+			c.wg.Done()
+			c.refuse(stream, "Service Unavailable - request queue full")
+		}
+	}
+}
+
+// queued is a stream waiting for a worker, with the context of the
+// connection it came in on.
+type queued struct {
+	ctx    context.Context
+	stream *mux.Stream
+}
+
+// worker serves queued streams until the client stops.
+func (c *Client) worker() {
+	for {
+		select {
+		case q := <-c.queue:
+			c.serve(q.ctx, q.stream)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// dropQueued closes streams still waiting for a worker once the client
+// has stopped taking new ones.
+func (c *Client) dropQueued() {
+	for {
+		select {
+		case q := <-c.queue:
+			c.inFlight.Release()
+			q.stream.Close()
+			c.wg.Done()
+		default:
+			return
+		}
+	}
+}
+
+// serve handles stream until it is done or ctx, that of its connection,
+// is cancelled.
+func (c *Client) serve(ctx context.Context, stream *mux.Stream) {
+	defer c.inFlight.Release()
+	if c.opts.Mode == "tcp" {
+		c.handleTCP(ctx, stream)
+	} else {
+		c.handleRequest(ctx, stream)
+	}
+}
+
+// refuse turns a stream away with 503, or just closes it in tcp mode.
+func (c *Client) refuse(stream *mux.Stream, message string) {
+	if c.opts.Mode != "tcp" {
+		resp := newErrorResponse(http.StatusServiceUnavailable, message)
+		resp.Header.Set("Retry-After", "1")
+		stream.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		resp.Write(stream)
+	}
+	stream.Close()
+}
+
+// handleRequest serves the single request the server sends on stream.
+func (c *Client) handleRequest(connCtx context.Context, stream *mux.Stream) {
+	defer c.wg.Done()
+	defer stream.Close()
+
+	start := time.Now()
+	head := relay.NewHeadLimiter(stream, int64(c.opts.MaxHeaderBytes))
+	reader := bufio.NewReader(head)
+	req, err := http.ReadRequest(reader)
+	if errors.Is(err, relay.ErrHeaderTooLarge) {
+		c.log.Warn("request headers from tunnel too large, resetting stream", "max", c.opts.MaxHeaderBytes)
+		stream.Reset()
+		return
+	}
+	if err != nil {
+		c.log.Error("failed to read request from tunnel", "err", err)
+		return
+	}
+	head.Release()
+
+	// The server tags each request so both ends log the same ID
+	logger := c.log
+	if id := req.Header.Get("X-Request-Id"); id != "" {
+		logger = logger.With("request_id", id)
+	}
+
+	if req.Method == http.MethodConnect {
+		c.handleConnect(connCtx, relay.BufferedConn(stream, reader), req, logger)
+		return
+	}
+
+	// The server holds back an expected body until it is asked for
+	expect := relayContinue(req, stream)
+
+	// Build local URL
+	target := c.backend(req)
+	localURL := forwardURL(target, req.URL).String()
+
+	logger.Debug("request from tunnel", "method", req.Method, "path", req.URL.Path)
+
+	if c.opts.Echo {
+		c.sendEcho(stream, req, localURL, logger)
+		return
+	}
+
+	if relay.IsWebSocketUpgrade(req.Header) {
+		c.handleUpgrade(connCtx, relay.BufferedConn(stream, reader), req, localURL, logger)
+		return
+	}
+
+	// Create new request to local API. A gRPC call streams in both
+	// directions for as long as it lasts, so it has no timeout here.
+	grpc := isGRPC(req.Header)
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if grpc {
+		ctx, cancel = context.WithCancel(connCtx)
+	} else {
+		ctx, cancel = context.WithTimeout(connCtx, c.opts.Timeout)
+	}
+	defer cancel()
+	ctx, span := startSpan(ctx, req, localURL)
+	defer span.End()
+
+	localReq, err := http.NewRequestWithContext(ctx, req.Method, localURL, req.Body)
+	if err != nil {
+		logger.Error("failed to create local request", "err", err)
+		c.sendErrorResponse(stream, req, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// The body streams on as it arrives, with the framing it came in:
+	// a known length is kept rather than sent chunked
+	localReq.ContentLength = req.ContentLength
+
+	// Copy headers, apart from those about the tunnel's own hop
+	localReq.Header = req.Header.Clone()
+	relay.RemoveHopByHop(localReq.Header)
+	c.setHost(localReq, req)
+	injectSpan(ctx, localReq.Header)
+
+	// Add/update forwarding headers
+	setForwardedFor(localReq.Header)
+	localReq.Header.Set("X-Forwarded-Proto", "http")
+
+	br := c.breakers.get(target.String())
+	if !br.allow() {
+		logger.Warn("local API failing, rejecting request", "local", target, "method", req.Method, "path", req.URL.Path)
+		spanStatus(span, http.StatusServiceUnavailable)
+		resp := newErrorResponse(http.StatusServiceUnavailable, "Service Unavailable - Local API Failing")
+		resp.Request = req
+		resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(c.opts.BreakerCooldown.Seconds()))))
+		stream.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		resp.Write(stream)
+		return
+	}
+
+	// Forward to local API
+	var resp *http.Response
+	if grpc {
+		resp, err = c.grpc.Do(localReq)
+	} else {
+		resp, err = c.doLocal(localReq, logger)
+	}
+	expect.finish()
+	switch opened, closed := br.done(err == nil); {
+	case opened:
+		logger.Warn("local API failing, opening circuit breaker", "local", target, "cooldown", c.opts.BreakerCooldown)
+	case closed:
+		logger.Info("local API recovered, closing circuit breaker", "local", target)
+	}
+	if err != nil {
+		logger.Error("local API error", "method", req.Method, "path", req.URL.Path, "err", err)
+		c.report(localError(err))
+		spanFailed(span, err)
+		c.sendErrorResponse(stream, req, http.StatusBadGateway, "Bad Gateway - Local API Error")
+		return
+	}
+	defer resp.Body.Close()
+	spanStatus(span, resp.StatusCode)
+	if grpc {
+		frameGRPC(resp)
+	}
+
+	// Send response back through tunnel
+	if err := c.sendResponse(connCtx, stream, req, resp); err != nil {
+		switch {
+		case c.ctx.Err() != nil:
+			logger.Warn("response cut off, client stopping", "method", req.Method, "path", req.URL.Path)
+		case connCtx.Err() != nil:
+			logger.Warn("response cut off, tunnel connection lost", "method", req.Method, "path", req.URL.Path)
+		default:
+			logger.Error("failed to send response through tunnel", "err", err)
+		}
+		c.report(&TunnelError{Kind: Closed, Err: err})
+		spanFailed(span, err)
+		return
+	}
+
+	logger.Info("request",
+		"client_ip", req.Header.Get(clientIPHeader),
+		"method", req.Method,
+		"path", req.URL.Path,
+		"status", resp.StatusCode,
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+}
+
+// echoResponse describes a request as the client would have forwarded it.
+type echoResponse struct {
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	LocalURL   string      `json:"local_url"`
+	Headers    http.Header `json:"headers"`
+	BodyLength int64       `json:"body_length"`
+}
+
+// sendEcho answers req itself, for checking the tunnel without a local API.
+func (c *Client) sendEcho(conn net.Conn, req *http.Request, localURL string, logger *slog.Logger) {
+	n, err := io.Copy(io.Discard, req.Body)
+	if err != nil {
+		logger.Error("failed to read request body", "err", err)
+		return
+	}
+
+	headers := req.Header.Clone()
+	setForwardedFor(headers)
+	headers.Set("X-Forwarded-Proto", "http")
+
+	body, err := json.Marshal(echoResponse{
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		LocalURL:   localURL,
+		Headers:    headers,
+		BodyLength: n,
+	})
+	if err != nil {
+		c.sendErrorResponse(conn, req, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	resp := newResponse(http.StatusOK, "application/json", body)
+	resp.Request = req
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := resp.Write(conn); err != nil {
+		logger.Error("failed to send response through tunnel", "err", err)
+		return
+	}
+	logger.Info("echoed request", "method", req.Method, "path", req.URL.Path, "body_length", n)
+}
+
+// backend picks the local API for req: the route for its RouteHeader
+// value, else the longest route matching its path, or Local if none
+// match.
+func (c *Client) backend(req *http.Request) *url.URL {
+	if c.opts.RouteHeader != "" {
+		if target := c.routes.matchValue(req.Header.Get(c.opts.RouteHeader)); target != nil {
+			return target
+		}
+	}
+	if target := c.routes.match(req.URL.Path); target != nil {
+		return target
+	}
+	return c.base
+}
+
+// setHost picks the Host header localReq carries to the local API for req:
+// HostOverride, the public one with PreserveHost, or else the local API's
+// own.
+func (c *Client) setHost(localReq, req *http.Request) {
+	switch {
+	case c.opts.HostOverride != "":
+		localReq.Host = c.opts.HostOverride
+	case c.opts.PreserveHost:
+		localReq.Host = req.Host
+	default:
+		c.sockets.setHost(localReq)
+	}
+}
+
+// handleTCP splices a stream straight onto a new connection to the local
+// service.
+func (c *Client) handleTCP(ctx context.Context, stream *mux.Stream) {
+	defer c.wg.Done()
+
+	dial := (&net.Dialer{Timeout: 10 * time.Second}).DialContext
+	if c.dns != nil {
+		dial = c.dns.dial(dial)
+	}
+	local, err := dial(ctx, "tcp", c.opts.Local)
+	if err != nil {
+		c.log.Error("failed to dial local service", "local", c.opts.Local, "err", err)
+		c.report(localError(err))
+		stream.Close()
+		return
+	}
+
+	start := time.Now()
+	c.buffers.Splice(stream, local)
+	c.log.Info("TCP connection closed", "duration_ms", time.Since(start).Milliseconds())
+}
+
+// handleUpgrade forwards a WebSocket handshake to the local API and, once
+// it switches protocols, splices the tunnel stream onto the local
+// connection instead of parsing any further.
+func (c *Client) handleUpgrade(ctx context.Context, conn net.Conn, req *http.Request, localURL string, logger *slog.Logger) {
+	localReq, err := http.NewRequestWithContext(ctx, req.Method, localURL, nil)
+	if err != nil {
+		logger.Error("failed to create local request", "err", err)
+		c.sendErrorResponse(conn, req, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	localReq.Header = req.Header.Clone()
+	relay.RemoveHopByHop(localReq.Header)
+	c.setHost(localReq, req)
+	setForwardedFor(localReq.Header)
+
+	resp, err := c.upgrade.Do(localReq)
+	if err != nil {
+		logger.Error("local API error", "method", req.Method, "path", req.URL.Path, "err", err)
+		c.report(localError(err))
+		c.sendErrorResponse(conn, req, http.StatusBadGateway, "Bad Gateway - Local API Error")
+		return
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		if err := c.sendResponse(ctx, conn, req, resp); err != nil {
+			logger.Error("failed to send response through tunnel", "err", err)
+		}
+		return
+	}
+
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		c.sendErrorResponse(conn, req, http.StatusBadGateway, "Bad Gateway - Upgrade Failed")
+		return
+	}
+
+	// Only the response head is HTTP; everything after it is raw bytes
+	conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if err := writeResponseHead(conn, resp); err != nil {
+		logger.Error("failed to send upgrade response through tunnel", "err", err)
+		backend.Close()
+		return
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	logger.Info("upgraded connection", "method", req.Method, "path", req.URL.Path)
+	c.buffers.Splice(conn, backend)
+}
+
+// The server passes the public client's address in this header.
+const clientIPHeader = "X-Intunja-Client-Ip"
+
+// setForwardedFor moves the client address the server passed along onto
+// the end of any X-Forwarded-For chain already present.
+func setForwardedFor(h http.Header) {
+	ip := h.Get(clientIPHeader)
+	h.Del(clientIPHeader)
+	if ip == "" {
+		return
+	}
+	if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	h.Set("X-Forwarded-For", ip)
+}
+
+func writeResponseHead(w io.Writer, resp *http.Response) error {
+	if _, err := fmt.Fprintf(w, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// sendResponse streams resp back through the tunnel as the local API
+// produces it, keeping its Content-Length or chunked framing. Nothing is
+// held back once the body stalls, so server-sent events arrive as they
+// are sent. The write is cut off once ctx, that of the tunnel connection,
+// is cancelled.
+func (c *Client) sendResponse(ctx context.Context, conn net.Conn, req *http.Request, resp *http.Response) error {
+	// Answering the tunnel's request, not the local one, keeps a HEAD
+	// response bodiless whatever the local transport returned
+	resp.Request = req
+	relay.RemoveHopByHop(resp.Header)
+	// Shutting down or losing the connection cuts off a write the tunnel
+	// isn't taking
+	dw := &deadlineWriter{ctx: ctx, conn: conn, timeout: 30 * time.Second}
+	stop := context.AfterFunc(ctx, func() { conn.SetWriteDeadline(time.Now()) })
+	defer stop()
+	bw := bufio.NewWriterSize(dw, 32*1024)
+	resp.Body = &flushingReader{r: resp.Body, w: bw}
+
+	// Hide bufio's ReadFrom: it reads the body straight into the buffer
+	// that flushingReader is flushing.
+	err := resp.Write(struct{ io.Writer }{bw})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		// Part of the response may already be on its way. A reset, unlike
+		// the end of the stream, tells the server it was cut off.
+		if stream, ok := conn.(*mux.Stream); ok {
+			stream.Reset()
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
+
+// deadlineWriter gives each write its own deadline so a long response
+// only fails if the tunnel stops taking data.
+type deadlineWriter struct {
+	ctx     context.Context
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	// Checked after the deadline is set, so a cancellation that comes
+	// later always gets to cut the write short
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.conn.Write(p)
+}
+
+// flushingReader flushes w before every read of the body, sending on what
+// has been buffered before waiting for more.
+type flushingReader struct {
+	r io.ReadCloser
+	w *bufio.Writer
+}
+
+func (f *flushingReader) Read(p []byte) (int, error) {
+	if err := f.w.Flush(); err != nil {
+		return 0, err
+	}
+	return f.r.Read(p)
+}
+
+func (f *flushingReader) Close() error {
+	return f.r.Close()
+}
+
+func (c *Client) sendErrorResponse(conn net.Conn, req *http.Request, statusCode int, message string) {
+	resp := newErrorResponse(statusCode, message)
+	resp.Request = req
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	resp.Write(conn)
+}
+
+func newErrorResponse(statusCode int, message string) *http.Response {
+	return newResponse(statusCode, "text/plain; charset=utf-8", []byte(message))
+}
+
+func newResponse(statusCode int, contentType string, body []byte) *http.Response {
+	resp := &http.Response{
+		StatusCode:    statusCode,
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	return resp
+}
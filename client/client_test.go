@@ -0,0 +1,543 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/internal/mux"
+	"github.com/mindsgn-studio/intunja/internal/protocol"
+)
+
+func TestSetForwardedFor(t *testing.T) {
+	for _, c := range []struct {
+		prior []string
+		ip    string
+		want  string
+	}{
+		{nil, "192.0.2.1", "192.0.2.1"},
+		{[]string{"203.0.113.5"}, "192.0.2.1", "203.0.113.5, 192.0.2.1"},
+		{[]string{"203.0.113.5", "198.51.100.1"}, "192.0.2.1", "203.0.113.5, 198.51.100.1, 192.0.2.1"},
+		{[]string{"203.0.113.5"}, "", "203.0.113.5"},
+	} {
+		h := http.Header{"X-Forwarded-For": c.prior}
+		if c.ip != "" {
+			h.Set(clientIPHeader, c.ip)
+		}
+		setForwardedFor(h)
+		if got := h.Get("X-Forwarded-For"); got != c.want {
+			t.Errorf("%q + %q = %q, want %q", c.prior, c.ip, got, c.want)
+		}
+		if h.Get(clientIPHeader) != "" {
+			t.Errorf("%s left on the request", clientIPHeader)
+		}
+	}
+}
+
+// sendOverPipe runs sendResponse for resp into one end of a pipe and
+// returns the other end to read it from.
+func sendOverPipe(t *testing.T, resp *http.Response) (net.Conn, <-chan error) {
+	t.Helper()
+	tunnelEnd, serverEnd := net.Pipe()
+	t.Cleanup(func() { serverEnd.Close() })
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	sent := make(chan error, 1)
+	go func() {
+		defer tunnelEnd.Close()
+		sent <- new(Client).sendResponse(context.Background(), tunnelEnd, req, resp)
+	}()
+	return serverEnd, sent
+}
+
+// streamedResponse is a local API's response with body, chunked if its
+// length is unknown.
+func streamedResponse(body io.Reader, length int64) *http.Response {
+	var chunked []string
+	if length < 0 {
+		chunked = []string{"chunked"}
+	}
+	return &http.Response{
+		TransferEncoding: chunked,
+		StatusCode:       http.StatusOK,
+		ProtoMajor:       1,
+		ProtoMinor:       1,
+		Header:           http.Header{},
+		Body:             io.NopCloser(body),
+		ContentLength:    length,
+	}
+}
+
+func TestSendResponseFixedLength(t *testing.T) {
+	// Longer than the write buffer, which bufio.Writer.ReadFrom used to
+	// fill from the body while flushingReader flushed it, sending the
+	// head twice
+	body := bytes.Repeat([]byte("0123456789abcdef"), 10_000)
+	conn, sent := sendOverPipe(t, streamedResponse(bytes.NewReader(body), int64(len(body))))
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentLength != int64(len(body)) || len(resp.TransferEncoding) != 0 {
+		t.Errorf("framed with length %d and %q, want Content-Length %d", resp.ContentLength, resp.TransferEncoding, len(body))
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("got %d bytes, not the %d sent", len(got), len(body))
+	}
+	if rest, _ := io.ReadAll(r); len(rest) != 0 {
+		t.Errorf("%d bytes after the body: %.40q", len(rest), rest)
+	}
+	if err := <-sent; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSendResponseIncremental(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	conn, _ := sendOverPipe(t, streamedResponse(pr, -1))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("transfer encoding %q, want chunked", resp.TransferEncoding)
+	}
+	// Each event arrives before the next is written
+	for _, event := range []string{"data: one\n\n", "data: two\n\n", "data: three\n\n"} {
+		go io.WriteString(pw, event)
+		got := make([]byte, len(event))
+		if _, err := io.ReadFull(resp.Body, got); err != nil {
+			t.Fatalf("waiting for %q: %v", event, err)
+		}
+		if string(got) != event {
+			t.Errorf("got %q, want %q", got, event)
+		}
+	}
+}
+
+// endless produces n bytes without holding them.
+// failing is a body whose read fails with err.
+type failing struct{ err error }
+
+func (f failing) Read([]byte) (int, error) { return 0, f.err }
+
+type endless struct{ n int64 }
+
+func (e *endless) Read(p []byte) (int, error) {
+	if e.n <= 0 {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), e.n)]
+	for i := range p {
+		p[i] = 'x'
+	}
+	e.n -= int64(len(p))
+	return len(p), nil
+}
+
+func TestSendResponseResetsStream(t *testing.T) {
+	a, b := net.Pipe()
+	home := mux.Client(a, mux.DefaultConfig())
+	server := mux.Server(b, mux.DefaultConfig())
+	defer home.Close()
+	defer server.Close()
+
+	stream, err := server.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Write(stream)
+	sent := make(chan error, 1)
+	go func() {
+		accepted, err := home.AcceptStream()
+		if err != nil {
+			sent <- err
+			return
+		}
+		// The local API drops its connection after the head
+		body := io.MultiReader(strings.NewReader("partial"), failing{io.ErrUnexpectedEOF})
+		sent <- new(Client).sendResponse(context.Background(), accepted, req, streamedResponse(body, 1000))
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(resp.Body); !errors.Is(err, mux.ErrStreamReset) {
+		t.Errorf("body read ended with %v, want the stream reset", err)
+	}
+	if err := <-sent; err == nil {
+		t.Error("a cut-off response was reported sent")
+	}
+}
+
+func TestSendResponseBoundedMemory(t *testing.T) {
+	const size = 256 << 20
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		var m runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > peak.Load() {
+				peak.Store(m.HeapAlloc)
+			}
+		}
+	}()
+
+	conn, sent := sendOverPipe(t, streamedResponse(&endless{n: size}, -1))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil || n != size {
+		t.Fatalf("read %d bytes, %v; want %d", n, err, size)
+	}
+	if err := <-sent; err != nil {
+		t.Error(err)
+	}
+	if grew := int64(peak.Load()) - int64(before.HeapAlloc); grew > 16<<20 {
+		t.Errorf("heap grew by %d MB streaming %d MB", grew>>20, size>>20)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	c, err := New(Options{Remote: "tunnel.example:7000", Local: "http://localhost:3000", Echo: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/api/things?x=1", strings.NewReader("twelve bytes"))
+	req.Header.Set("X-Custom", "yes")
+	req.Header.Set(clientIPHeader, "192.0.2.1")
+
+	tunnelEnd, serverEnd := net.Pipe()
+	defer serverEnd.Close()
+	go func() {
+		defer tunnelEnd.Close()
+		c.sendEcho(tunnelEnd, req, "http://localhost:3000/api/things?x=1", slog.New(slog.DiscardHandler))
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(serverEnd), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got %s %q, want 200 JSON", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	var echo echoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&echo); err != nil {
+		t.Fatal(err)
+	}
+	if echo.Method != http.MethodPost || echo.Path != "/api/things" || echo.BodyLength != 12 {
+		t.Errorf("echoed %s %s with %d bytes, want POST /api/things with 12", echo.Method, echo.Path, echo.BodyLength)
+	}
+	if echo.LocalURL != "http://localhost:3000/api/things?x=1" {
+		t.Errorf("local URL %q", echo.LocalURL)
+	}
+	if echo.Headers.Get("X-Custom") != "yes" || echo.Headers.Get("X-Forwarded-For") != "192.0.2.1" {
+		t.Errorf("echoed headers %v", echo.Headers)
+	}
+}
+
+// registration is a client's handshake as a fake server saw it.
+type registration struct {
+	token, name string
+	session     *mux.Session
+}
+
+// fakeServer accepts tunnel clients the way intunja's server does and
+// hands over each registration.
+func fakeServer(t *testing.T) (string, <-chan registration) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	registered := make(chan registration, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				reg, err := handshake(conn)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				t.Cleanup(func() { reg.session.Close() })
+				registered <- reg
+			}()
+		}
+	}()
+	return l.Addr().String(), registered
+}
+
+func handshake(conn net.Conn) (registration, error) {
+	// Byte by byte, so nothing of the register frame is read ahead
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) == 0 || line[len(line)-1] != '\n' {
+		if _, err := conn.Read(b); err != nil {
+			return registration{}, err
+		}
+		line = append(line, b[0])
+	}
+	flags, payload, err := mux.ReadFrame(conn)
+	if err != nil {
+		return registration{}, err
+	}
+	agreed, err := protocol.Negotiate(protocol.Hello{Version: protocol.Current}, protocol.ParseRegister(flags))
+	if err != nil {
+		return registration{}, err
+	}
+	if _, err := conn.Write(agreed.Answer()); err != nil {
+		return registration{}, err
+	}
+	name, _, _ := strings.Cut(string(payload), " ")
+	return registration{
+		token:   strings.TrimSuffix(strings.TrimPrefix(string(line), "AUTH "), "\n"),
+		name:    name,
+		session: mux.Server(conn, mux.DefaultConfig()),
+	}, nil
+}
+
+// roundTripFunc is an http.RoundTripper made of a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// startClient starts a client with opts against a fake server and waits
+// for it to register.
+func startClient(t *testing.T, opts Options) (*Client, registration) {
+	t.Helper()
+	remote, registered := fakeServer(t)
+	opts.Remote = remote
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.DiscardHandler)
+	}
+	c, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start(context.Background())
+	t.Cleanup(c.Stop)
+
+	select {
+	case reg := <-registered:
+		return c, reg
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client never registered")
+		return nil, registration{}
+	}
+}
+
+// tunnelDo sends req through the tunnel on session and returns the
+// response with its body read.
+func tunnelDo(t *testing.T, session *mux.Session, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := req.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestProgrammaticClient(t *testing.T) {
+	c, reg := startClient(t, Options{
+		Local:     "http://localhost:3000",
+		Name:      "embedded",
+		AuthToken: "secret",
+		// Nothing listens locally: the transport answers
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			return streamedResponse(strings.NewReader("local "+r.Method+" "+r.URL.String()), -1), nil
+		}),
+	})
+	if reg.token != "secret" || reg.name != "embedded" {
+		t.Errorf("registered %q with token %q", reg.name, reg.token)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "/things?id=1", nil)
+	req.Host = "embedded.example.com"
+	if _, body := tunnelDo(t, reg.session, req); body != "local GET http://localhost:3000/things?id=1" {
+		t.Errorf("got %q, want it answered by the transport", body)
+	}
+
+	// Stop disconnects
+	c.Stop()
+	select {
+	case <-reg.session.Closed():
+	case <-time.After(5 * time.Second):
+		t.Error("the tunnel is still connected after Stop")
+	}
+}
+
+// eventually polls cond until it holds, failing the test after 5s.
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWorkerBackpressure(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		running, most int
+	)
+	release := make(chan struct{})
+	c, reg := startClient(t, Options{
+		Local:     "http://localhost:3000",
+		Workers:   2,
+		QueueSize: 2,
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			mu.Lock()
+			running++
+			most = max(most, running)
+			mu.Unlock()
+			<-release
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return streamedResponse(strings.NewReader("done"), 4), nil
+		}),
+	})
+
+	// Two requests keep the workers busy and two wait in the queue
+	results := make(chan int, 4)
+	for range 4 {
+		stream, err := reg.session.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.Write(stream)
+		go func() {
+			resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+			if err != nil {
+				results <- 0
+				return
+			}
+			results <- resp.StatusCode
+		}()
+	}
+	eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return running == 2 && len(c.queue) == 2
+	})
+
+	// The next is turned away at once
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	resp, body := tunnelDo(t, reg.session, req)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("past the queue: %d %q, want 503 with Retry-After", resp.StatusCode, body)
+	}
+
+	// The queued ones are served once the workers are free
+	close(release)
+	for range 4 {
+		if code := <-results; code != http.StatusOK {
+			t.Errorf("queued request got %d, want 200", code)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if most != 2 {
+		t.Errorf("%d requests reached the local API at once, want the 2 workers", most)
+	}
+}
+
+func TestSendResponseCancelled(t *testing.T) {
+	a, b := net.Pipe()
+	home := mux.Client(a, mux.DefaultConfig())
+	server := mux.Server(b, mux.DefaultConfig())
+	defer home.Close()
+	defer server.Close()
+
+	stream, err := server.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Write(stream)
+	accepted, err := home.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server never reads, so the write stalls once the window is full
+	ctx, cancel := context.WithCancel(context.Background())
+	sent := make(chan error, 1)
+	go func() {
+		sent <- new(Client).sendResponse(ctx, accepted, req, streamedResponse(&endless{n: 64 << 20}, 64<<20))
+	}()
+	select {
+	case err := <-sent:
+		t.Fatalf("a response the tunnel wasn't taking was sent: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case err := <-sent:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("sendResponse returned %v, want the cancellation", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("sendResponse kept writing after its context was cancelled")
+	}
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// handleConnect dials the target of a CONNECT that the server relayed from
+// a public client and splices the stream onto it. The server has already
+// checked the target against its allowlist; the client only dials for the
+// server if AllowConnect is set.
+func (c *Client) handleConnect(ctx context.Context, conn net.Conn, req *http.Request, logger *slog.Logger) {
+	target := req.Host
+	if !c.opts.AllowConnect {
+		logger.Warn("refused CONNECT, not enabled", "target", target)
+		c.sendErrorResponse(conn, req, http.StatusForbidden, "Forbidden - CONNECT Not Enabled")
+		return
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	backend, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		logger.Error("failed to dial CONNECT target", "target", target, "err", err)
+		c.sendErrorResponse(conn, req, http.StatusBadGateway, "Bad Gateway - Target Unreachable")
+		return
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		logger.Error("failed to send CONNECT response through tunnel", "err", err)
+		backend.Close()
+		return
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	start := time.Now()
+	logger.Info("CONNECT opened", "client_ip", req.Header.Get(clientIPHeader), "target", target)
+	c.buffers.Splice(conn, backend)
+	logger.Info("CONNECT closed", "target", target, "duration_ms", time.Since(start).Milliseconds())
+}
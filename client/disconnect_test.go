@@ -0,0 +1,87 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDisconnectCancelsInFlight(t *testing.T) {
+	started := make(chan struct{}, 3)
+	cancelled := make(chan struct{}, 3)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slow" {
+			return
+		}
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(10 * time.Second):
+			io.WriteString(w, "too late")
+		}
+	}))
+	defer backend.Close()
+	remote, registered := fakeServer(t)
+	c, err := New(Options{Remote: remote, Local: backend.URL, Name: "busy", MaxConcurrent: 10, ReconnectDelay: 10 * time.Millisecond, Logger: slog.New(slog.DiscardHandler)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start(context.Background())
+	defer c.Stop()
+	first := <-registered
+
+	var lost []io.Reader
+	for range 3 {
+		stream, err := first.session.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/slow", nil)
+		req.Write(stream)
+		lost = append(lost, bufio.NewReader(stream))
+	}
+	for range 3 {
+		<-started
+	}
+
+	// Losing the connection cuts its requests off at once, rather than
+	// when the local API answers
+	first.session.Close()
+	for range 3 {
+		select {
+		case <-cancelled:
+		case <-time.After(2 * time.Second):
+			t.Fatal("a request outlived its connection")
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(c.inFlight) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests still in flight after the connection was lost", len(c.inFlight))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, r := range lost {
+		if b, _ := io.ReadAll(r); len(b) > 0 {
+			t.Errorf("request %d: %q written to the lost connection", i, b)
+		}
+	}
+
+	// and the next connection starts clean
+	var second registration
+	select {
+	case second = <-registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client never reconnected")
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	if resp, _ := tunnelDo(t, second.session, req); resp.StatusCode != http.StatusOK {
+		t.Errorf("after reconnecting: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// dnsStale is how long past its TTL a cached lookup is still used while
+// it is refreshed, or while the resolver is failing.
+const dnsStale = time.Minute
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// resolver is the part of *net.Resolver the cache uses.
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// dnsCache keeps the local APIs' addresses for a TTL so they aren't
+// looked up for every connection. Expired entries are refreshed in the
+// background and used in the meantime.
+type dnsCache struct {
+	ttl      time.Duration
+	resolver resolver
+	log      *slog.Logger
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs      []net.IPAddr
+	expires    time.Time
+	refreshing bool
+}
+
+func newDNSCache(ttl time.Duration, r resolver, logger *slog.Logger) *dnsCache {
+	return &dnsCache{
+		ttl:      ttl,
+		resolver: r,
+		log:      logger,
+		entries:  make(map[string]*dnsEntry),
+	}
+}
+
+// lookup returns host's addresses, from the cache if it has them.
+func (d *dnsCache) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	now := time.Now()
+	d.mu.Lock()
+	e, ok := d.entries[host]
+	if ok && now.Before(e.expires) {
+		d.mu.Unlock()
+		return e.addrs, nil
+	}
+	if ok && now.Before(e.expires.Add(dnsStale)) {
+		if !e.refreshing {
+			e.refreshing = true
+			go d.refresh(host)
+		}
+		d.mu.Unlock()
+		return e.addrs, nil
+	}
+	d.mu.Unlock()
+
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	d.store(host, addrs)
+	return addrs, nil
+}
+
+// refresh looks host up again, keeping the stale entry if that fails.
+func (d *dnsCache) refresh(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		d.log.Warn("failed to refresh DNS for local API, using the cached addresses", "host", host, "err", err)
+		d.mu.Lock()
+		if e, ok := d.entries[host]; ok {
+			e.refreshing = false
+		}
+		d.mu.Unlock()
+		return
+	}
+	d.store(host, addrs)
+}
+
+func (d *dnsCache) store(host string, addrs []net.IPAddr) {
+	d.mu.Lock()
+	d.entries[host] = &dnsEntry{addrs: addrs, expires: time.Now().Add(d.ttl)}
+	d.mu.Unlock()
+}
+
+// dial wraps next to connect to a host's cached addresses in turn. IP
+// addresses are dialled as they are.
+func (d *dnsCache) dial(next dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return next(ctx, network, addr)
+		}
+		addrs, err := d.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		for _, ip := range addrs {
+			var conn net.Conn
+			if conn, err = next(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// transport extends base, or http.DefaultTransport, to dial through the
+// cache.
+func (d *dnsCache) transport(base http.RoundTripper) (http.RoundTripper, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return nil, errors.New("DNS caching needs an *http.Transport")
+	}
+	t = t.Clone()
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialContext = d.dial(dial)
+	return t, nil
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubResolver answers every lookup with addrs, or fails with err, and
+// counts the lookups.
+type stubResolver struct {
+	mu      sync.Mutex
+	addrs   []net.IPAddr
+	err     error
+	lookups int
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return r.addrs, r.err
+}
+
+func (r *stubResolver) set(ip string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs, r.err = []net.IPAddr{{IP: net.ParseIP(ip)}}, err
+}
+
+func (r *stubResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+func TestDNSCacheAvoidsLookups(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	stub := new(stubResolver)
+	stub.set("127.0.0.1", nil)
+	transport, err := newDNSCache(time.Hour, stub, slog.New(slog.DiscardHandler)).transport(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := &http.Client{Transport: transport}
+
+	for range 5 {
+		resp, err := hc.Get("http://api.home.test:" + port + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// A new connection each time, so each one dials
+		hc.CloseIdleConnections()
+	}
+	if n := stub.count(); n != 1 {
+		t.Errorf("%d lookups for 5 connections, want 1", n)
+	}
+}
+
+func TestDNSCacheRefreshes(t *testing.T) {
+	stub := new(stubResolver)
+	stub.set("192.0.2.1", nil)
+	cache := newDNSCache(10*time.Millisecond, stub, slog.New(slog.DiscardHandler))
+	ctx := context.Background()
+	cache.lookup(ctx, "api")
+
+	// Expired: the old address is served while it is looked up again
+	time.Sleep(20 * time.Millisecond)
+	stub.set("192.0.2.2", nil)
+	if addrs, err := cache.lookup(ctx, "api"); err != nil || !addrs[0].IP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expired lookup gave %v, %v; want the stale address at once", addrs, err)
+	}
+	eventually(t, func() bool {
+		addrs, _ := cache.lookup(ctx, "api")
+		return addrs[0].IP.Equal(net.ParseIP("192.0.2.2"))
+	})
+}
+
+func TestDNSCacheServesStale(t *testing.T) {
+	stub := new(stubResolver)
+	stub.set("192.0.2.1", nil)
+	cache := newDNSCache(10*time.Millisecond, stub, slog.New(slog.DiscardHandler))
+	ctx := context.Background()
+	cache.lookup(ctx, "api")
+
+	// The resolver goes down
+	time.Sleep(20 * time.Millisecond)
+	stub.set("", errors.New("server misbehaving"))
+	for range 3 {
+		if addrs, err := cache.lookup(ctx, "api"); err != nil || !addrs[0].IP.Equal(net.ParseIP("192.0.2.1")) {
+			t.Fatalf("lookup gave %v, %v; want the stale address", addrs, err)
+		}
+	}
+	eventually(t, func() bool { return stub.count() >= 2 })
+
+	// A host never looked up has nothing to fall back on
+	if _, err := cache.lookup(ctx, "other"); err == nil {
+		t.Error("failed lookup of an uncached host succeeded")
+	}
+}
+
+func TestDNSCacheDialsIPs(t *testing.T) {
+	stub := new(stubResolver)
+	stub.set("192.0.2.1", nil)
+	cache := newDNSCache(time.Hour, stub, slog.New(slog.DiscardHandler))
+	var dialled []string
+	dial := cache.dial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialled = append(dialled, addr)
+		return nil, errors.New("not dialling")
+	})
+
+	dial(context.Background(), "tcp", "api.home.test:8080")
+	dial(context.Background(), "tcp", "10.0.0.7:8080")
+	if len(dialled) != 2 || dialled[0] != "192.0.2.1:8080" || dialled[1] != "10.0.0.7:8080" {
+		t.Errorf("dialled %q", dialled)
+	}
+	if n := stub.count(); n != 1 {
+		t.Errorf("%d lookups, want none for an IP address", n-1)
+	}
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/mindsgn-studio/intunja/internal/mux"
+)
+
+// ErrorKind sorts the failures a Client runs into. It is an error itself,
+// so errors.Is(err, client.Timeout) tells whether err is a TunnelError of
+// that kind.
+type ErrorKind int
+
+const (
+	// DialFailed means the tunnel server couldn't be reached.
+	DialFailed ErrorKind = iota + 1
+	// AuthFailed means the server refused to register the tunnel: the
+	// token was wrong, or it had no room for another.
+	AuthFailed
+	// Closed means the tunnel connection, or a request's stream on it,
+	// was lost.
+	Closed
+	// Timeout means the tunnel server or the local API stopped answering.
+	Timeout
+	// LocalUnreachable means the local API couldn't be reached or failed
+	// before answering.
+	LocalUnreachable
+	// Incompatible means the client and server share no protocol version.
+	Incompatible
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case DialFailed:
+		return "failed to connect to tunnel server"
+	case AuthFailed:
+		return "tunnel refused by server"
+	case Closed:
+		return "tunnel closed"
+	case Timeout:
+		return "timed out"
+	case LocalUnreachable:
+		return "local API unreachable"
+	case Incompatible:
+		return "incompatible tunnel protocol"
+	}
+	return "unknown error"
+}
+
+func (k ErrorKind) Error() string { return k.String() }
+
+// TunnelError is a failure of the tunnel or of a request through it, as
+// passed to Options.OnError. errors.As finds it in a wrapped error.
+type TunnelError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *TunnelError) Error() string {
+	if e.Err == nil {
+		return e.Kind.String()
+	}
+	return e.Kind.String() + ": " + e.Err.Error()
+}
+
+func (e *TunnelError) Unwrap() error { return e.Err }
+
+// Is matches the ErrorKind of e as well as what it wraps.
+func (e *TunnelError) Is(target error) bool {
+	k, ok := target.(ErrorKind)
+	return ok && k == e.Kind
+}
+
+// sessionError sorts the error a tunnel session ended with.
+func sessionError(err error) *TunnelError {
+	var peer *mux.PeerError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &peer):
+		// The server only gives a reason when it turns a tunnel away
+		return &TunnelError{Kind: AuthFailed, Err: errors.New(peer.Reason)}
+	case errors.Is(err, mux.ErrKeepAliveTimeout), errors.As(err, &netErr) && netErr.Timeout():
+		return &TunnelError{Kind: Timeout, Err: err}
+	}
+	return &TunnelError{Kind: Closed, Err: err}
+}
+
+// localError sorts the error a request to the local API failed with.
+func localError(err error) *TunnelError {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return &TunnelError{Kind: Timeout, Err: err}
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, mux.ErrStreamReset) || errors.Is(err, mux.ErrSessionClosed) {
+		return &TunnelError{Kind: Closed, Err: err}
+	}
+	return &TunnelError{Kind: LocalUnreachable, Err: err}
+}
+
+// report passes err to Options.OnError.
+func (c *Client) report(err *TunnelError) {
+	if c.opts.OnError != nil {
+		c.opts.OnError(err)
+	}
+}
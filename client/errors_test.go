@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/internal/mux"
+)
+
+var kinds = []ErrorKind{DialFailed, AuthFailed, Closed, Timeout, LocalUnreachable, Incompatible}
+
+// checkKind fails unless err, wrapped once more as a caller would, is a
+// TunnelError of want and of no other kind.
+func checkKind(t *testing.T, name string, err error, want ErrorKind) {
+	t.Helper()
+	err = fmt.Errorf("request: %w", err)
+	var te *TunnelError
+	if !errors.As(err, &te) {
+		t.Errorf("%s: %v is no TunnelError", name, err)
+		return
+	}
+	if te.Kind != want {
+		t.Errorf("%s: kind %v, want %v", name, te.Kind, want)
+	}
+	for _, k := range kinds {
+		if errors.Is(err, k) != (k == want) {
+			t.Errorf("%s: errors.Is(err, %v) = %v", name, k, k != want)
+		}
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		err  *TunnelError
+		want ErrorKind
+	}{
+		{"refused by server", sessionError(&mux.PeerError{Reason: "invalid token"}), AuthFailed},
+		{"keep-alive timeout", sessionError(mux.ErrKeepAliveTimeout), Timeout},
+		{"read timeout", sessionError(os.ErrDeadlineExceeded), Timeout},
+		{"connection lost", sessionError(net.ErrClosed), Closed},
+		{"local deadline", localError(context.DeadlineExceeded), Timeout},
+		{"local read timeout", localError(os.ErrDeadlineExceeded), Timeout},
+		{"cancelled", localError(context.Canceled), Closed},
+		{"stream reset", localError(mux.ErrStreamReset), Closed},
+		{"session closed", localError(mux.ErrSessionClosed), Closed},
+		{"connection refused", localError(errors.New("dial tcp 127.0.0.1:1: connect: connection refused")), LocalUnreachable},
+	} {
+		checkKind(t, c.name, c.err, c.want)
+	}
+
+	// What was wrapped can still be found
+	if err := localError(mux.ErrStreamReset); !errors.Is(err, mux.ErrStreamReset) {
+		t.Errorf("%v lost what it wraps", err)
+	}
+}
+
+// reported starts a client against remote and returns what it passes to
+// OnError.
+func reported(t *testing.T, opts Options) <-chan error {
+	t.Helper()
+	errs := make(chan error, 16)
+	opts.Logger = slog.New(slog.DiscardHandler)
+	opts.ReconnectDelay = 10 * time.Millisecond
+	opts.OnError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	c, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start(context.Background())
+	t.Cleanup(c.Stop)
+	return errs
+}
+
+func nextError(t *testing.T, errs <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error reported")
+		return nil
+	}
+}
+
+func TestReportedErrorKinds(t *testing.T) {
+	t.Run("dial", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		errs := reported(t, Options{Remote: l.Addr().String(), Name: "app", Local: "http://127.0.0.1:1"})
+		checkKind(t, "dial", nextError(t, errs), DialFailed)
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		remote, registered := fakeServer(t)
+		errs := reported(t, Options{Remote: remote, Name: "app", Local: "http://127.0.0.1:1"})
+		select {
+		case reg := <-registered:
+			reg.session.CloseWithReason(errors.New("invalid token"))
+		case <-time.After(5 * time.Second):
+			t.Fatal("the client never registered")
+		}
+		err := nextError(t, errs)
+		checkKind(t, "auth", err, AuthFailed)
+		var te *TunnelError
+		if errors.As(err, &te) && te.Err.Error() != "invalid token" {
+			t.Errorf("reason %q, want the server's", te.Err)
+		}
+	})
+
+	t.Run("local", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		errs := make(chan error, 16)
+		_, reg := startClient(t, Options{
+			Name:  "app",
+			Local: "http://" + l.Addr().String(),
+			OnError: func(err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			},
+		})
+		req, _ := http.NewRequest("GET", "http://app/", nil)
+		if resp, _ := tunnelDo(t, reg.session, req); resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("status %d, want 502", resp.StatusCode)
+		}
+		checkKind(t, "local", nextError(t, errs), LocalUnreachable)
+	})
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// continueRelay stands in for the body of a request sent with
+// "Expect: 100-continue". The server holds the body back until it hears
+// 100 Continue, which is written to the tunnel the first time the body is
+// read: when the local API has asked for it, or the transport has given up
+// waiting and sends it anyway.
+type continueRelay struct {
+	io.ReadCloser
+	w io.Writer
+
+	mu   sync.Mutex
+	done bool // 100 Continue sent, or the final response is on its way
+	err  error
+}
+
+// relayContinue wraps the body of req if its sender is waiting for
+// 100 Continue, and returns nil otherwise.
+func relayContinue(req *http.Request, w io.Writer) *continueRelay {
+	if !strings.EqualFold(req.Header.Get("Expect"), "100-continue") || req.ContentLength == 0 {
+		return nil
+	}
+	c := &continueRelay{ReadCloser: req.Body, w: w}
+	req.Body = c
+	return c
+}
+
+func (c *continueRelay) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	if !c.done {
+		c.done = true
+		_, c.err = io.WriteString(c.w, "HTTP/1.1 100 Continue\r\n\r\n")
+	}
+	err := c.err
+	c.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	return c.ReadCloser.Read(p)
+}
+
+// finish stops a late 100 Continue from following the final response.
+func (c *continueRelay) finish() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.done = true
+	c.mu.Unlock()
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isGRPC reports whether h is for a gRPC call, which needs HTTP/2 to the
+// local API and its trailers carried back. gRPC-Web works over HTTP/1.1
+// and is forwarded like any other request.
+func isGRPC(h http.Header) bool {
+	ct := h.Get("Content-Type")
+	return strings.HasPrefix(ct, "application/grpc") && !strings.HasPrefix(ct, "application/grpc-web")
+}
+
+// grpcTransport returns base, or http.DefaultTransport, set up to speak
+// HTTP/2 to the local API: over TLS for https URLs and with prior
+// knowledge for http ones. Other RoundTrippers are used as they are.
+func grpcTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return base
+	}
+	t = t.Clone()
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetHTTP2(true)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	// A streaming call may not send headers until its first message
+	t.ResponseHeaderTimeout = 0
+	return t
+}
+
+// grpcTrailers are announced on every gRPC response. The status only
+// arrives in trailers, which HTTP/1.1 framing must know of up front.
+var grpcTrailers = []string{"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin"}
+
+// frameGRPC makes resp, read from the local API over HTTP/2, go through
+// the tunnel chunked, so each message is passed on as it arrives and the
+// trailers follow the body.
+func frameGRPC(resp *http.Response) {
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	resp.ContentLength = -1
+	resp.TransferEncoding = []string{"chunked"}
+	if resp.Header.Get("Grpc-Status") != "" {
+		// A call that failed at once has its status in the headers, and
+		// no trailers
+		return
+	}
+	if resp.Trailer == nil {
+		// The transport adds trailers it wasn't told of to this map
+		resp.Trailer = make(http.Header)
+	}
+	for _, k := range grpcTrailers {
+		if _, ok := resp.Trailer[k]; !ok {
+			resp.Trailer[k] = nil
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIsGRPC(t *testing.T) {
+	for ct, want := range map[string]bool{
+		"application/grpc":           true,
+		"application/grpc+proto":     true,
+		"application/grpc-web":       false,
+		"application/grpc-web+proto": false,
+		"application/json":           false,
+		"":                           false,
+	} {
+		if got := isGRPC(http.Header{"Content-Type": {ct}}); got != want {
+			t.Errorf("isGRPC(%q) = %v, want %v", ct, got, want)
+		}
+	}
+}
+
+func TestFrameGRPC(t *testing.T) {
+	resp := &http.Response{ProtoMajor: 2, Header: http.Header{}, ContentLength: 12}
+	frameGRPC(resp)
+	if resp.ProtoMajor != 1 || resp.ContentLength != -1 || len(resp.TransferEncoding) != 1 {
+		t.Errorf("framed as HTTP/%d.%d, length %d, %v", resp.ProtoMajor, resp.ProtoMinor, resp.ContentLength, resp.TransferEncoding)
+	}
+	for _, k := range grpcTrailers {
+		if _, ok := resp.Trailer[k]; !ok {
+			t.Errorf("%s trailer not announced", k)
+		}
+	}
+
+	// A trailers-only answer has nothing to announce
+	failed := &http.Response{Header: http.Header{"Grpc-Status": {"12"}}}
+	frameGRPC(failed)
+	if failed.Trailer != nil {
+		t.Errorf("trailers %v announced for a trailers-only answer", failed.Trailer)
+	}
+}
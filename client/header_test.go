@@ -0,0 +1,47 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/internal/mux"
+)
+
+func TestOversizedRequestHead(t *testing.T) {
+	var reached atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached.Store(true) }))
+	defer backend.Close()
+	_, reg := startClient(t, Options{Local: backend.URL, Name: "limited", MaxHeaderBytes: 4096})
+
+	stream, err := reg.session.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// A head that never ends is cut off at the limit, not buffered
+	line := "X-Filler: " + strings.Repeat("a", 1000) + "\r\n"
+	_, err = fmt.Fprint(stream, "GET / HTTP/1.1\r\nHost: x\r\n")
+	for sent := 0; err == nil && sent < 64<<20; sent += len(line) {
+		_, err = fmt.Fprint(stream, line)
+	}
+	if !errors.Is(err, mux.ErrStreamReset) {
+		t.Fatalf("writing the head ended with %v, want the stream reset", err)
+	}
+	if reached.Load() {
+		t.Error("the oversized request reached the local API")
+	}
+
+	// The tunnel itself is still fine
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	if resp, _ := tunnelDo(t, reg.session, req); resp.StatusCode != http.StatusOK {
+		t.Errorf("next request: %d", resp.StatusCode)
+	}
+}
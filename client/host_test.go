@@ -0,0 +1,37 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLocalHost(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer backend.Close()
+	local := backend.Listener.Addr().String()
+
+	for _, c := range []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"default", Options{}, local},
+		{"preserve", Options{PreserveHost: true}, "app.example.com"},
+		{"override", Options{HostOverride: "internal.lan"}, "internal.lan"},
+		{"override wins", Options{PreserveHost: true, HostOverride: "internal.lan"}, "internal.lan"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opts := c.opts
+			opts.Name, opts.Local = "home", backend.URL
+			_, reg := startClient(t, opts)
+
+			req, _ := http.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+			if _, host := tunnelDo(t, reg.session, req); host != c.want {
+				t.Errorf("local API saw Host %q, want %q", host, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSLocalAPI(t *testing.T) {
+	// Signed by httptest's own CA, which nothing trusts by default
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer backend.Close()
+	ca := x509.NewCertPool()
+	ca.AddCert(backend.Certificate())
+
+	for _, c := range []struct {
+		name string
+		tls  *tls.Config
+		want int
+	}{
+		{"private CA", &tls.Config{RootCAs: ca}, http.StatusOK},
+		{"insecure", &tls.Config{InsecureSkipVerify: true}, http.StatusOK},
+		{"untrusted", nil, http.StatusBadGateway},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, reg := startClient(t, Options{Name: "home", Local: backend.URL, LocalTLS: c.tls})
+			req, _ := http.NewRequest(http.MethodGet, "http://home/", nil)
+			resp, body := tunnelDo(t, reg.session, req)
+			if resp.StatusCode != c.want || (c.want == http.StatusOK && body != "secure") {
+				t.Errorf("status %d %q, want %d", resp.StatusCode, body, c.want)
+			}
+		})
+	}
+}
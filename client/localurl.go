@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// parseLocalURL parses the address of a local API, which must be an
+// absolute http or https URL. It may have a path, which forwarded requests
+// are placed under.
+func parseLocalURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("local URL must be http:// or https:// with a host, got %q", s)
+	}
+	return u, nil
+}
+
+// localTLS extends base, or http.DefaultTransport, to check https local
+// APIs with conf.
+func localTLS(base http.RoundTripper, conf *tls.Config) (http.RoundTripper, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return nil, errors.New("local TLS settings need an *http.Transport")
+	}
+	t = t.Clone()
+	t.TLSClientConfig = conf.Clone()
+	return t, nil
+}
+
+// localTimeouts extends base, or http.DefaultTransport, so connecting to
+// a local API, TLS handshake included, gives up after connect, and waiting
+// for its response headers after header. Zero leaves either as it was.
+func localTimeouts(base http.RoundTripper, connect, header time.Duration) (http.RoundTripper, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return nil, errors.New("local timeouts need an *http.Transport")
+	}
+	t = t.Clone()
+	if connect > 0 {
+		dial := t.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, connect)
+			defer cancel()
+			return dial(ctx, network, addr)
+		}
+		t.TLSHandshakeTimeout = connect
+	}
+	if header > 0 {
+		t.ResponseHeaderTimeout = header
+	}
+	return t, nil
+}
+
+// forwardURL is where a request for target goes on the local API at base:
+// target's path under base's path, with both queries. Only the path and
+// query of an absolute-form target are used, so a request can't pick
+// another host.
+func forwardURL(base, target *url.URL) *url.URL {
+	u := *base
+	u.Path = joinPath(base.Path, target.Path)
+	u.RawPath = joinPath(base.EscapedPath(), target.EscapedPath())
+	switch {
+	case base.RawQuery == "":
+		u.RawQuery = target.RawQuery
+	case target.RawQuery != "":
+		u.RawQuery = base.RawQuery + "&" + target.RawQuery
+	}
+	u.Fragment, u.RawFragment = "", ""
+	return &u
+}
+
+// joinPath joins URL paths with exactly one slash between them. Extra
+// leading slashes on path are dropped too, so it can't be mistaken for a
+// //host reference.
+func joinPath(base, path string) string {
+	if path == "" {
+		if base == "" {
+			return "/"
+		}
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimLeft(path, "/")
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestForwardURL(t *testing.T) {
+	for _, c := range []struct {
+		base, target, want string
+	}{
+		{"http://localhost:3000", "/users", "http://localhost:3000/users"},
+		{"http://localhost:3000/", "/users", "http://localhost:3000/users"},
+		{"http://localhost:3000/api/", "/users", "http://localhost:3000/api/users"},
+		{"http://localhost:3000/api", "/", "http://localhost:3000/api/"},
+		{"http://localhost:3000", "", "http://localhost:3000/"},
+		// Queries
+		{"http://localhost:3000", "/search?q=a+b&page=2", "http://localhost:3000/search?q=a+b&page=2"},
+		{"http://localhost:3000/?key=1", "/search?q=x", "http://localhost:3000/search?key=1&q=x"},
+		{"http://localhost:3000/?key=1", "/search", "http://localhost:3000/search?key=1"},
+		// Double slashes can't become a //host reference
+		{"http://localhost:3000/", "//evil.example/x", "http://localhost:3000/evil.example/x"},
+		{"http://localhost:3000/api/", "///x", "http://localhost:3000/api/x"},
+		// Absolute-form targets keep only their path and query
+		{"http://localhost:3000", "http://evil.example:8080/users?id=7", "http://localhost:3000/users?id=7"},
+		// Escaping is kept as sent
+		{"http://localhost:3000/v%201/", "/a%2Fb", "http://localhost:3000/v%201/a%2Fb"},
+	} {
+		base, err := parseLocalURL(c.base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target, err := url.ParseRequestURI(c.target)
+		if c.target == "" {
+			target, err = &url.URL{}, nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := forwardURL(base, target).String(); got != c.want {
+			t.Errorf("%s + %s = %s, want %s", c.base, c.target, got, c.want)
+		}
+	}
+}
+
+func TestParseLocalURL(t *testing.T) {
+	for _, s := range []string{"localhost:3000", "ftp://localhost", "http://", "/api", "http://local host"} {
+		if _, err := parseLocalURL(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+	for _, s := range []string{"http://localhost:3000", "https://10.0.0.2/api/"} {
+		if _, err := parseLocalURL(s); err != nil {
+			t.Errorf("%q refused: %v", s, err)
+		}
+	}
+}
+
+func TestAbsoluteFormForwarded(t *testing.T) {
+	got := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Host + " " + r.URL.RequestURI()
+	}))
+	defer backend.Close()
+	_, reg := startClient(t, Options{Name: "home", Local: backend.URL + "/api/"})
+
+	stream, err := reg.session.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(stream, "GET http://evil.example/users?id=7 HTTP/1.1\r\nHost: evil.example\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(stream), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	want := backend.Listener.Addr().String() + " /api/users?id=7"
+	if reached := <-got; reached != want {
+		t.Errorf("local API got %q, want %q", reached, want)
+	}
+}
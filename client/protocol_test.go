@@ -0,0 +1,82 @@
+package client
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/internal/mux"
+	"github.com/mindsgn-studio/intunja/internal/protocol"
+)
+
+// answeringServer accepts tunnel clients, answers each registration with
+// answer whatever it asked for, and hands over the sessions that follow.
+func answeringServer(t *testing.T, answer []byte) (string, <-chan *mux.Session) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	sessions := make(chan *mux.Session, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			br := bufio.NewReader(conn)
+			if _, err := br.ReadString('\n'); err != nil {
+				conn.Close()
+				continue
+			}
+			if _, _, err := mux.ReadFrame(br); err != nil {
+				conn.Close()
+				continue
+			}
+			conn.Write(answer)
+			session := mux.Server(conn, mux.DefaultConfig())
+			t.Cleanup(func() { session.Close() })
+			sessions <- session
+		}
+	}()
+	return l.Addr().String(), sessions
+}
+
+func TestOlderServer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	// A version 1 server answers the client's gzip flag with one byte,
+	// here declining
+	remote, sessions := answeringServer(t, []byte{0})
+	errs := reported(t, Options{Remote: remote, Name: "app", Local: backend.URL})
+
+	session := <-sessions
+	req, _ := http.NewRequest("GET", "http://app/", nil)
+	if _, body := tunnelDo(t, session, req); body != "hello" {
+		t.Errorf("got %q through a version 1 server", body)
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("reported %v", err)
+	default:
+	}
+}
+
+func TestNewerServerVersion(t *testing.T) {
+	// A server can't pick a version newer than the client's
+	answer := protocol.Hello{Flags: protocol.FlagHello, Version: protocol.Current + 1}.Answer()
+	remote, _ := answeringServer(t, answer)
+	errs := reported(t, Options{Remote: remote, Name: "app", Local: "http://127.0.0.1:1"})
+
+	err := nextError(t, errs)
+	checkKind(t, "newer server", err, Incompatible)
+	if !strings.Contains(err.Error(), "upgrade the server") {
+		t.Errorf("error %q doesn't say what to do", err)
+	}
+}
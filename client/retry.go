@@ -0,0 +1,106 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxRetryBody is the largest request body kept in memory so the
+	// request can be retried. Requests with bigger bodies are sent once.
+	maxRetryBody = 1 << 20
+
+	retryDelay    = 100 * time.Millisecond
+	maxRetryDelay = time.Second
+)
+
+// doLocal sends localReq to the local API. Idempotent requests that fail
+// with 502, 503 or a refused or reset connection are tried again, up to
+// LocalRetries times.
+func (c *Client) doLocal(localReq *http.Request, logger *slog.Logger) (*http.Response, error) {
+	if c.opts.LocalRetries <= 0 || !idempotent(localReq.Method) {
+		return c.local.Do(localReq)
+	}
+	replayable, err := bufferBody(localReq, maxRetryBody)
+	if err != nil {
+		return nil, err
+	}
+	if !replayable {
+		return c.local.Do(localReq)
+	}
+
+	retry := &backoff{base: retryDelay, max: maxRetryDelay}
+	for attempt := 1; ; attempt++ {
+		resp, err := c.local.Do(localReq)
+		if attempt > c.opts.LocalRetries || !retryable(resp, err) {
+			return resp, err
+		}
+		delay := retry.next()
+		if err != nil {
+			logger.Warn("local API failed, retrying", "method", localReq.Method, "attempt", attempt, "delay", delay.Round(time.Millisecond), "err", err)
+		} else {
+			logger.Warn("local API failed, retrying", "method", localReq.Method, "attempt", attempt, "delay", delay.Round(time.Millisecond), "status", resp.StatusCode)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-localReq.Context().Done():
+			return nil, localReq.Context().Err()
+		}
+		body, _ := localReq.GetBody()
+		localReq = localReq.Clone(localReq.Context())
+		localReq.Body = body
+	}
+}
+
+// idempotent reports whether a request with method may safely be sent
+// more than once.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryable reports whether a local API answer looks like a passing
+// failure worth trying again.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	return resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// bufferBody reads req's body into memory so req can be sent again, and
+// reports whether it could. A body longer than limit is left to stream,
+// with the part already read put back in front of the rest.
+func bufferBody(req *http.Request, limit int64) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return true, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(body)) > limit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return false, nil
+	}
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// flakyBackend fails the first failures requests with 503, then echoes
+// request bodies. It returns the number of requests it has had.
+func flakyBackend(t *testing.T, failures int64) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) <= failures {
+			http.Error(w, "warming up", http.StatusServiceUnavailable)
+			return
+		}
+		io.Copy(w, r.Body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	backend, hits := flakyBackend(t, 2)
+	_, reg := startClient(t, Options{Name: "home", Local: backend.URL, LocalRetries: 3})
+
+	req, _ := http.NewRequest(http.MethodPut, "http://home/item", strings.NewReader("payload"))
+	resp, body := tunnelDo(t, reg.session, req)
+	if resp.StatusCode != http.StatusOK || body != "payload" {
+		t.Errorf("got %d %q, want the body replayed on the third try", resp.StatusCode, body)
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("local API hit %d times, want 3", n)
+	}
+}
+
+func TestRetryNotForPost(t *testing.T) {
+	backend, hits := flakyBackend(t, 1)
+	_, reg := startClient(t, Options{Name: "home", Local: backend.URL, LocalRetries: 3})
+
+	req, _ := http.NewRequest(http.MethodPost, "http://home/orders", strings.NewReader("order"))
+	if resp, _ := tunnelDo(t, reg.session, req); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("POST answered %d, want the first 503", resp.StatusCode)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("POST sent %d times", n)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	for _, c := range []struct {
+		retries int
+		hits    int64
+	}{
+		{0, 1},
+		{2, 3},
+	} {
+		backend, hits := flakyBackend(t, 100)
+		_, reg := startClient(t, Options{Name: "home", Local: backend.URL, LocalRetries: c.retries})
+
+		req, _ := http.NewRequest(http.MethodGet, "http://home/", nil)
+		if resp, _ := tunnelDo(t, reg.session, req); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%d retries: answered %d, want the last 503", c.retries, resp.StatusCode)
+		}
+		if n := hits.Load(); n != c.hits {
+			t.Errorf("%d retries: local API hit %d times, want %d", c.retries, n, c.hits)
+		}
+	}
+}
+
+func TestBufferBodyOverLimit(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPut, "http://home/", strings.NewReader("0123456789"))
+	replayable, err := bufferBody(req, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayable {
+		t.Error("a body over the limit was kept for replay")
+	}
+	// Still sent whole, just once
+	if body, _ := io.ReadAll(req.Body); string(body) != "0123456789" {
+		t.Errorf("body %q", body)
+	}
+}
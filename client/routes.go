@@ -0,0 +1,87 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Route sends requests under a path prefix, or with Value in the
+// Options.RouteHeader header, to a different local API. Only one of
+// Prefix and Value is set.
+type Route struct {
+	Prefix string
+	Value  string
+	Target string
+}
+
+// ParseRoute parses a route written as prefix=localURL or value=localURL,
+// as taken by the client's -route flag. Prefixes start with /.
+func ParseRoute(v string) (Route, error) {
+	key, target, ok := strings.Cut(v, "=")
+	if !ok || key == "" || target == "" {
+		return Route{}, fmt.Errorf("want prefix=localURL or value=localURL, got %q", v)
+	}
+	if strings.HasPrefix(key, "/") {
+		return Route{Prefix: key, Target: target}, nil
+	}
+	return Route{Value: key, Target: target}, nil
+}
+
+func (r Route) String() string {
+	if r.Value != "" {
+		return r.Value + "=" + r.Target
+	}
+	return r.Prefix + "=" + r.Target
+}
+
+// routeList is kept sorted longest prefix first so the first match is the
+// most specific one. Header routes have no prefix, so they come last.
+type routeList []route
+
+type route struct {
+	prefix string
+	value  string
+	target *url.URL
+}
+
+func newRouteList(routes []Route) (routeList, error) {
+	l := make(routeList, len(routes))
+	for i, r := range routes {
+		target, err := parseLocalURL(r.Target)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", r.Prefix+r.Value, err)
+		}
+		l[i] = route{prefix: r.Prefix, value: r.Value, target: target}
+	}
+	sort.SliceStable(l, func(i, j int) bool { return len(l[i].prefix) > len(l[j].prefix) })
+	return l, nil
+}
+
+// match returns the backend for path, or nil if no route covers it. A
+// prefix only matches whole path segments: /api matches /api and /api/x
+// but not /apiary.
+func (l routeList) match(path string) *url.URL {
+	for _, r := range l {
+		if r.prefix == "" {
+			break
+		}
+		rest, ok := strings.CutPrefix(path, r.prefix)
+		if ok && (rest == "" || rest[0] == '/' || strings.HasSuffix(r.prefix, "/")) {
+			return r.target
+		}
+	}
+	return nil
+}
+
+// matchValue returns the backend for a RouteHeader value, or nil if no
+// route names it.
+func (l routeList) matchValue(value string) *url.URL {
+	for _, r := range l {
+		if r.value != "" && r.value == value {
+			return r.target
+		}
+	}
+	return nil
+}
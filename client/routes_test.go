@@ -0,0 +1,158 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	for v, want := range map[string]Route{
+		"/api=http://localhost:3000": {Prefix: "/api", Target: "http://localhost:3000"},
+		"v2=localhost:4000":          {Value: "v2", Target: "localhost:4000"},
+	} {
+		got, err := ParseRoute(v)
+		if err != nil || got != want {
+			t.Errorf("ParseRoute(%q) = %+v, %v; want %+v", v, got, err, want)
+		}
+		if got.String() != v {
+			t.Errorf("%+v prints as %q, want %q", got, got.String(), v)
+		}
+	}
+	for _, bad := range []string{"/api", "=http://localhost", "/api="} {
+		if _, err := ParseRoute(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+// routedClient is a client for the default backend with routes.
+func routedClient(t *testing.T, routes ...string) *Client {
+	t.Helper()
+	return headerRoutedClient(t, "", routes...)
+}
+
+// headerRoutedClient is a routedClient that also routes by header.
+func headerRoutedClient(t *testing.T, header string, routes ...string) *Client {
+	t.Helper()
+	opts := Options{Remote: "tunnel.example:7000", Local: "http://default:80", RouteHeader: header}
+	for _, v := range routes {
+		r, err := ParseRoute(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Routes = append(opts.Routes, r)
+	}
+	c, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRouteByPrefix(t *testing.T) {
+	c := routedClient(t, "/api=http://api:3000", "/media=http://media:8096")
+	for path, want := range map[string]string{
+		"/api":         "api:3000",
+		"/api/users":   "api:3000",
+		"/media/x.mkv": "media:8096",
+		"/apiary":      "default:80", // prefixes match whole segments
+		"/":            "default:80",
+		"/other/api":   "default:80",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		if got := c.backend(req).Host; got != want {
+			t.Errorf("%s went to %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestRouteOverlapping(t *testing.T) {
+	// The longest prefix wins whatever the order given
+	c := routedClient(t, "/api=http://api:3000", "/api/v2/=http://v2:3002", "/api/v2/admin=http://admin:3003")
+	for path, want := range map[string]string{
+		"/api/v1/users":   "api:3000",
+		"/api/v2/users":   "v2:3002",
+		"/api/v2/admin/x": "admin:3003",
+		"/api/v2":         "api:3000", // the /api/v2/ route wants the slash
+	} {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		if got := c.backend(req).Host; got != want {
+			t.Errorf("%s went to %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestRouteInvalidTarget(t *testing.T) {
+	_, err := New(Options{
+		Remote: "tunnel.example:7000",
+		Local:  "http://default:80",
+		Routes: []Route{{Prefix: "/api", Target: "ftp://api"}},
+	})
+	if err == nil {
+		t.Error("took a route to an ftp URL")
+	}
+}
+
+func TestRouteByHeader(t *testing.T) {
+	c := headerRoutedClient(t, "X-Tenant", "acme=http://acme:3000", "globex=http://globex:3001", "/api=http://api:4000")
+	for _, r := range []struct {
+		tenant, path, want string
+	}{
+		{"acme", "/", "acme:3000"},
+		{"globex", "/users", "globex:3001"},
+		{"acme", "/api/users", "acme:3000"}, // the header beats the path
+		{"initech", "/", "default:80"},      // unmatched values fall back
+		{"", "/", "default:80"},
+		{"", "/api/users", "api:4000"},
+		{"ACME", "/", "default:80"}, // values are matched exactly
+	} {
+		req, _ := http.NewRequest(http.MethodGet, r.path, nil)
+		if r.tenant != "" {
+			req.Header.Set("X-Tenant", r.tenant)
+		}
+		if got := c.backend(req).Host; got != r.want {
+			t.Errorf("X-Tenant %q %s went to %s, want %s", r.tenant, r.path, got, r.want)
+		}
+	}
+}
+
+func TestRouteByHeaderNeedsHeader(t *testing.T) {
+	_, err := New(Options{
+		Remote: "tunnel.example:7000",
+		Local:  "http://default:80",
+		Routes: []Route{{Value: "acme", Target: "http://acme:3000"}},
+	})
+	if err == nil {
+		t.Error("took a header route without a route header")
+	}
+}
+
+func TestRouteByHeaderThroughTunnel(t *testing.T) {
+	backend := func(name string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(srv.Close)
+		return srv.URL
+	}
+	_, reg := startClient(t, Options{
+		Name:        "app",
+		Local:       backend("default"),
+		RouteHeader: "X-Tenant",
+		Routes: []Route{
+			{Value: "acme", Target: backend("acme")},
+			{Value: "globex", Target: backend("globex")},
+		},
+	})
+	for tenant, want := range map[string]string{"acme": "acme", "globex": "globex", "initech": "default", "": "default"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://app/", nil)
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		if _, body := tunnelDo(t, reg.session, req); body != want {
+			t.Errorf("X-Tenant %q reached %s, want %s", tenant, body, want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/internal/mux"
+)
+
+// timedDo sends a GET for path through session and returns the status,
+// how much of the body arrived, how long it all took, and the error the
+// body ended with.
+func timedDo(t *testing.T, session *mux.Session, path string) (int, int, time.Duration, error) {
+	t.Helper()
+	start := time.Now()
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(10 * time.Second))
+	req, _ := http.NewRequest(http.MethodGet, "http://app"+path, nil)
+	if err := req.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, len(body), time.Since(start), err
+}
+
+// slowBackend sends its headers after head, then a byte of body every
+// tick, ten times, unless the request is given up first.
+func slowBackend(t *testing.T, head, tick time.Duration) string {
+	t.Helper()
+	wait := func(r *http.Request, d time.Duration) bool {
+		select {
+		case <-time.After(d):
+			return true
+		case <-r.Context().Done():
+			return false
+		}
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !wait(r, head) {
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		for range 10 {
+			w.(http.Flusher).Flush()
+			if !wait(r, tick) {
+				return
+			}
+			w.Write([]byte("x"))
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend.URL
+}
+
+// stalledDial is a transport whose connections never get through.
+func stalledDial() *http.Transport {
+	return &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}}
+}
+
+// silentListener accepts connections and never says anything on them, as
+// a TLS server stuck before its handshake would.
+func silentListener(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestLocalConnectTimeout(t *testing.T) {
+	_, reg := startClient(t, Options{
+		Name:                "app",
+		Local:               "http://backend.invalid",
+		Transport:           stalledDial(),
+		Timeout:             5 * time.Second,
+		LocalConnectTimeout: 100 * time.Millisecond,
+	})
+	code, _, elapsed, _ := timedDo(t, reg.session, "/")
+	if code != http.StatusBadGateway || elapsed > 2*time.Second {
+		t.Errorf("got %d after %s, want 502 once the connect timeout passed", code, elapsed)
+	}
+}
+
+func TestLocalConnectTimeoutTLS(t *testing.T) {
+	// The handshake counts as connecting
+	_, reg := startClient(t, Options{
+		Name:                "app",
+		Local:               "https://" + silentListener(t),
+		Timeout:             5 * time.Second,
+		LocalConnectTimeout: 100 * time.Millisecond,
+	})
+	code, _, elapsed, _ := timedDo(t, reg.session, "/")
+	if code != http.StatusBadGateway || elapsed > 2*time.Second {
+		t.Errorf("got %d after %s, want 502 once the connect timeout passed", code, elapsed)
+	}
+}
+
+func TestLocalResponseHeaderTimeout(t *testing.T) {
+	_, reg := startClient(t, Options{
+		Name:                       "app",
+		Local:                      slowBackend(t, 3*time.Second, 0),
+		Timeout:                    5 * time.Second,
+		LocalResponseHeaderTimeout: 100 * time.Millisecond,
+	})
+	code, _, elapsed, _ := timedDo(t, reg.session, "/")
+	if code != http.StatusBadGateway || elapsed > 2*time.Second {
+		t.Errorf("got %d after %s, want 502 once the header timeout passed", code, elapsed)
+	}
+}
+
+func TestLocalTimeoutsLeaveBodyAlone(t *testing.T) {
+	// Headers inside their timeout and a body streaming well past both
+	// local timeouts, but inside the overall one
+	_, reg := startClient(t, Options{
+		Name:                       "app",
+		Local:                      slowBackend(t, 50*time.Millisecond, 50*time.Millisecond),
+		Timeout:                    5 * time.Second,
+		LocalConnectTimeout:        100 * time.Millisecond,
+		LocalResponseHeaderTimeout: 100 * time.Millisecond,
+	})
+	code, n, elapsed, err := timedDo(t, reg.session, "/")
+	if code != http.StatusOK || n != 10 || err != nil {
+		t.Errorf("got %d with %d bytes after %s, %v; want the whole body", code, n, elapsed, err)
+	}
+}
+
+func TestOverallTimeout(t *testing.T) {
+	// The local timeouts are met, but the body takes longer than -timeout
+	_, reg := startClient(t, Options{
+		Name:                       "app",
+		Local:                      slowBackend(t, 0, 100*time.Millisecond),
+		Timeout:                    300 * time.Millisecond,
+		LocalConnectTimeout:        time.Second,
+		LocalResponseHeaderTimeout: time.Second,
+	})
+	code, n, elapsed, err := timedDo(t, reg.session, "/")
+	if code != http.StatusOK || err == nil || n >= 10 || elapsed > 2*time.Second {
+		t.Errorf("got %d with %d bytes after %s, %v; want the body cut off at the overall timeout", code, n, elapsed, err)
+	}
+}
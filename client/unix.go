@@ -0,0 +1,86 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// unixSockets lets local APIs listen on Unix domain sockets. Each
+// unix:///path/to.sock target is given a placeholder host that the
+// transport dials as the socket.
+type unixSockets map[string]string // placeholder host to socket path
+
+// rewrite returns target with a unix:// socket swapped for its placeholder
+// URL, and any other target unchanged.
+func (s unixSockets) rewrite(target string) (string, error) {
+	path, ok := strings.CutPrefix(target, "unix://")
+	if !ok {
+		return target, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("unix socket path must be absolute, got %q", target)
+	}
+	for host, p := range s {
+		if p == path {
+			return "http://" + host, nil
+		}
+	}
+	host := fmt.Sprintf("unix-socket-%d", len(s))
+	s[host] = path
+	return "http://" + host, nil
+}
+
+// has reports whether host is the placeholder for a socket.
+func (s unixSockets) has(host string) bool {
+	_, ok := s[host]
+	return ok
+}
+
+// transport extends base, or http.DefaultTransport, to dial the sockets.
+func (s unixSockets) transport(base http.RoundTripper) (http.RoundTripper, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return nil, errors.New("unix socket targets need an *http.Transport")
+	}
+	t = t.Clone()
+
+	proxy := t.Proxy
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		if s.has(req.URL.Host) || proxy == nil {
+			return nil, nil
+		}
+		return proxy(req)
+	}
+
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if path, ok := s[host]; ok {
+			return dial(ctx, "unix", path)
+		}
+		return dial(ctx, network, addr)
+	}
+	return t, nil
+}
+
+// setHost gives requests to a socket the Host "localhost" rather than the
+// placeholder, which means nothing to the local API.
+func (s unixSockets) setHost(req *http.Request) {
+	if s.has(req.URL.Host) {
+		req.Host = "localhost"
+	}
+}
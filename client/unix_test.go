@@ -0,0 +1,76 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// unixBackend serves on a Unix socket, answering with its name and the
+// request URI, and returns the socket's path.
+func unixBackend(t *testing.T, dir, name string) string {
+	t.Helper()
+	path := filepath.Join(dir, name+".sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", name, r.URL.RequestURI())
+	}))
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return path
+}
+
+func TestUnixSocket(t *testing.T) {
+	// Socket paths are short, so not under the test's temporary directory
+	dir, err := os.MkdirTemp("", "intunja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	api := unixBackend(t, dir, "api")
+	media := unixBackend(t, dir, "media")
+
+	_, reg := startClient(t, Options{
+		Local:  "unix://" + api,
+		Routes: []Route{{Prefix: "/media", Target: "unix://" + media}},
+	})
+	for path, want := range map[string]string{
+		"/users?page=2": "api /users?page=2",
+		"/":             "api /",
+		"/media/a.mkv":  "media /media/a.mkv",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		resp, body := tunnelDo(t, reg.session, req)
+		if resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("%s: got %d %q, want %q", path, resp.StatusCode, body, want)
+		}
+	}
+}
+
+func TestUnixSocketRelativePath(t *testing.T) {
+	_, err := New(Options{Remote: "tunnel.example:7000", Local: "unix://api.sock"})
+	if err == nil {
+		t.Error("took a relative socket path")
+	}
+}
+
+func TestUnixSocketsRewrite(t *testing.T) {
+	s := make(unixSockets)
+	a, _ := s.rewrite("unix:///run/a.sock")
+	again, _ := s.rewrite("unix:///run/a.sock")
+	b, _ := s.rewrite("unix:///run/b.sock")
+	if a != again || a == b {
+		t.Errorf("rewrote to %q, %q and %q; want one placeholder per socket", a, again, b)
+	}
+	if plain, _ := s.rewrite("http://localhost:3000"); plain != "http://localhost:3000" {
+		t.Errorf("rewrote a TCP target to %q", plain)
+	}
+}
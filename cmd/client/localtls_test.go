@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalTLSConfig(t *testing.T) {
+	backend := httptest.NewTLSServer(nil)
+	defer backend.Close()
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "ca.pem")
+	os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0o600)
+
+	conf, err := localTLSConfig(bundle, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.InsecureSkipVerify || conf.RootCAs == nil {
+		t.Fatalf("config %+v, want the bundle trusted", conf)
+	}
+	if _, err := backend.Certificate().Verify(x509.VerifyOptions{Roots: conf.RootCAs}); err != nil {
+		t.Errorf("bundle's CA not trusted: %v", err)
+	}
+
+	if conf, err := localTLSConfig("", true); err != nil || !conf.InsecureSkipVerify {
+		t.Errorf("-local-insecure gave %+v, %v", conf, err)
+	}
+
+	empty := filepath.Join(dir, "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate"), 0o600)
+	for _, file := range []string{empty, filepath.Join(dir, "missing.pem")} {
+		if _, err := localTLSConfig(file, false); err == nil {
+			t.Errorf("%s accepted", filepath.Base(file))
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+	"github.com/mindsgn-studio/intunja/internal/logging"
+	"github.com/mindsgn-studio/intunja/internal/relay"
+	"github.com/mindsgn-studio/intunja/internal/tracing"
+	"github.com/mindsgn-studio/intunja/internal/version"
+)
+
+var (
+	remoteAddr   = flag.String("remote", "http://localhost:8080", "Remote tunnel server address")
+	localAddr    = flag.String("local", "http://localhost:3000", "Local API server address, or unix:///path/to.sock; host:port in tcp mode")
+	mode         = flag.String("mode", "http", "Tunnel mode: http, or tcp to splice streams onto -local without parsing HTTP")
+	tunnelName   = flag.String("name", "default", "Name to register the tunnel under")
+	authToken    = flag.String("auth-token", "", "Shared secret for the tunnel server (default $INTUNJA_TOKEN)")
+	useTLS       = flag.Bool("tls", false, "Connect to the tunnel server over TLS")
+	transport    = flag.String("transport", "tcp", "Tunnel transport: tcp, or quic to connect over QUIC on UDP, which is always encrypted")
+	tlsInsecure  = flag.Bool("tls-insecure", false, "Skip TLS certificate verification (testing only)")
+	tlsCert      = flag.String("tls-client-cert", "", "Certificate file to present to a tunnel server that requires one")
+	tlsKey       = flag.String("tls-client-key", "", "Key file for -tls-client-cert")
+	logFormat    = flag.String("log-format", "text", "Log format: text or json")
+	logLevel     = flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	reconnect    = flag.Duration("reconnect", 5*time.Second, "Initial reconnect delay")
+	reconnectMax = flag.Duration("reconnect-max", 2*time.Minute, "Maximum reconnect delay")
+	keepalive    = flag.Duration("keepalive", 10*time.Second, "Keep-alive interval")
+	tcpKeepalive = flag.Duration("keepalive-period", 15*time.Second, "TCP keep-alive probe period on the tunnel connection; 0 to disable")
+	noDelay      = flag.Bool("nodelay", true, "Set TCP_NODELAY on the tunnel connection so small responses aren't held back")
+	timeout      = flag.Duration("timeout", 30*time.Second, "Overall cap on each request to the local API, from connecting to the end of the response body; time spent under the -local-* timeouts counts toward it")
+	connTimeout  = flag.Duration("local-connect-timeout", 0, "Give up connecting to the local API, TLS handshake included, after this long; 0 leaves it to -timeout")
+	headTimeout  = flag.Duration("local-response-header-timeout", 0, "Give up waiting for the local API's response headers after this long; 0 leaves it to -timeout")
+	useGzip      = flag.Bool("compress", false, "Ask the server to gzip the tunnel connection")
+	echo         = flag.Bool("echo", false, "Answer every request with a JSON description of it instead of forwarding it")
+	preserveHost = flag.Bool("preserve-host", false, "Send the local API the Host the public client asked for instead of the local address")
+	routeHeader  = flag.String("route-header", "", "Request header whose value picks the local API among -route value=localURL entries, e.g. X-Tenant")
+	hostOverride = flag.String("host-override", "", "Send the local API this Host header on every request")
+	allowConnect = flag.Bool("allow-connect", false, "Dial TCP targets that public clients CONNECT to through the server's proxy")
+	showVersion  = flag.Bool("version", false, "Print the version and exit")
+	runSelfTest  = flag.Bool("selftest", false, "Check that a request to the public endpoint makes it through the tunnel, then exit")
+	publicURL    = flag.String("public", "", "Server's public endpoint for -selftest (default port 9090 on the -remote host)")
+	maxInFlight  = flag.Int("max-concurrent", 1000, "Maximum requests handled at once; 0 for no limit")
+	workers      = flag.Int("workers", 0, "Serve requests on this many workers; 0 starts a goroutine per request")
+	queueSize    = flag.Int("queue", 100, "Requests waiting for a worker before more are refused with 503")
+	localRetries = flag.Int("local-retries", 0, "Retry idempotent requests up to this many times when the local API answers 502 or 503 or drops the connection")
+	localCA      = flag.String("local-ca", "", "PEM bundle of extra CAs to trust for https local APIs")
+	localNoCheck = flag.Bool("local-insecure", false, "Skip TLS certificate verification for https local APIs (testing only)")
+	dnsCacheTTL  = flag.Duration("dns-cache-ttl", 0, "Cache the local API's DNS lookups for this long; 0 resolves on every connection")
+	copyBuffer   = flag.Int("copy-buffer-size", relay.DefaultBufferSize, "Buffer size in bytes for spliced connections")
+	maxHeader    = flag.Int("max-header-bytes", 1<<20, "Largest request head in bytes accepted from the tunnel")
+	tripAfter    = flag.Int("breaker-threshold", 5, "Consecutive local API failures before requests are refused with 503; 0 disables")
+	tripCooldown = flag.Duration("breaker-cooldown", 30*time.Second, "How long to refuse requests before probing the local API again")
+	otlpEndpoint = flag.String("otlp-endpoint", "", "Export request traces to this OTLP/HTTP collector, e.g. http://localhost:4318 (default $OTEL_EXPORTER_OTLP_ENDPOINT)")
+)
+
+// routeFlag is the repeatable -route flag.
+type routeFlag []client.Route
+
+func (f *routeFlag) String() string {
+	parts := make([]string, len(*f))
+	for i, r := range *f {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *routeFlag) Set(v string) error {
+	r, err := client.ParseRoute(v)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, r)
+	return nil
+}
+
+func main() {
+	var routes routeFlag
+	flag.Var(&routes, "route", "Send paths under a prefix, or requests whose -route-header has a value, to another local API, as prefix=localURL or value=localURL (repeatable)")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println("intunja client", version.String())
+		return
+	}
+
+	logger, err := logging.New(os.Stderr, *logFormat, *logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	if *transport != "tcp" && *transport != "quic" {
+		fmt.Fprintf(os.Stderr, "unknown transport %q, want tcp or quic\n", *transport)
+		os.Exit(2)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Fprintln(os.Stderr, "-tls-client-cert and -tls-client-key go together")
+		os.Exit(2)
+	}
+	if *tlsCert != "" && !*useTLS && *transport != "quic" {
+		fmt.Fprintln(os.Stderr, "-tls-client-cert requires -tls")
+		os.Exit(2)
+	}
+
+	if *authToken == "" {
+		*authToken = os.Getenv("INTUNJA_TOKEN")
+	}
+	if *otlpEndpoint == "" {
+		*otlpEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+
+	opts := client.Options{
+		Remote:                     *remoteAddr,
+		Local:                      *localAddr,
+		Mode:                       *mode,
+		QUIC:                       *transport == "quic",
+		Name:                       *tunnelName,
+		AuthToken:                  *authToken,
+		Routes:                     routes,
+		RouteHeader:                *routeHeader,
+		PreserveHost:               *preserveHost,
+		HostOverride:               *hostOverride,
+		DNSCacheTTL:                *dnsCacheTTL,
+		Compress:                   *useGzip,
+		Echo:                       *echo,
+		AllowConnect:               *allowConnect,
+		ReconnectDelay:             *reconnect,
+		MaxReconnectDelay:          *reconnectMax,
+		KeepAlive:                  *keepalive,
+		TCPKeepAlive:               *tcpKeepalive,
+		Nagle:                      !*noDelay,
+		Timeout:                    *timeout,
+		LocalConnectTimeout:        *connTimeout,
+		LocalResponseHeaderTimeout: *headTimeout,
+		MaxConcurrent:              *maxInFlight,
+		Workers:                    *workers,
+		QueueSize:                  *queueSize,
+		LocalRetries:               *localRetries,
+		BreakerThreshold:           *tripAfter,
+		BreakerCooldown:            *tripCooldown,
+		CopyBufferSize:             *copyBuffer,
+		MaxHeaderBytes:             *maxHeader,
+		Logger:                     logger,
+	}
+	if *tcpKeepalive == 0 {
+		opts.TCPKeepAlive = -1
+	}
+	if *useTLS || *transport == "quic" {
+		opts.TLS = &tls.Config{
+			InsecureSkipVerify: *tlsInsecure,
+			MinVersion:         tls.VersionTLS12,
+		}
+		if *tlsCert != "" {
+			cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "failed to load client certificate:", err)
+				os.Exit(2)
+			}
+			opts.TLS.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	if *localCA != "" || *localNoCheck {
+		if opts.LocalTLS, err = localTLSConfig(*localCA, *localNoCheck); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	if *runSelfTest {
+		public := *publicURL
+		if public == "" {
+			public = defaultPublicURL(*remoteAddr)
+		}
+		if !selfTest(opts, public) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	c, err := client.New(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "intunja-client", version.Version, *otlpEndpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	slog.Info("starting tunnel client", "version", version.Version, "remote", *remoteAddr, "tunnel", *tunnelName, "local", *localAddr, "mode", *mode)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Run with auto-reconnect until interrupted
+	c.Start(ctx)
+	<-ctx.Done()
+	slog.Info("shutting down gracefully")
+	c.Stop()
+
+	// Send the spans still waiting to be exported
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Warn("failed to flush traces", "err", err)
+	}
+}
+
+// localTLSConfig trusts the CAs in the PEM file at caFile, as well as the
+// system's, for https local APIs.
+func localTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile == "" {
+		return conf, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local CA bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	conf.RootCAs = pool
+	return conf, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// selfTestTimeout bounds how long the tunnel gets to start answering.
+const selfTestTimeout = 15 * time.Second
+
+// selfTest checks the whole path in one process: it serves a throwaway
+// local API, tunnels it under a temporary name and requests it from the
+// server's public endpoint. It prints a report and returns whether every
+// step passed.
+func selfTest(opts client.Options, publicURL string) bool {
+	nonce := randomHex(8)
+	opts.Name = "selftest-" + nonce
+	opts.Routes = nil
+	opts.Echo = false
+	opts.Mode = "http"
+	opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fmt.Printf("intunja self-test: tunnel server %s, public endpoint %s\n", opts.Remote, publicURL)
+
+	// Local API
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return report("local API", false, 0, err.Error())
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, nonce)
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+	opts.Local = "http://" + ln.Addr().String()
+	report("local API", true, 0, opts.Local)
+
+	c, err := client.New(opts)
+	if err != nil {
+		return report("tunnel", false, 0, err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	// Tunnel server, dialled just as the tunnel will be
+	start := time.Now()
+	if err := c.CheckRemote(ctx); err != nil {
+		return report("tunnel server", false, 0, err.Error())
+	}
+	report("tunnel server", true, time.Since(start), "reachable")
+
+	c.Start(ctx)
+	defer c.Stop()
+
+	// Public endpoint, retried until the tunnel has registered
+	probe := strings.TrimSuffix(publicURL, "/") + "/" + opts.Name + "/intunja-selftest"
+	var last string
+	for ctx.Err() == nil {
+		start := time.Now()
+		body, status, err := get(ctx, probe)
+		latency := time.Since(start)
+		switch {
+		case err != nil:
+			last = err.Error()
+		case status == http.StatusOK && body == nonce:
+			return report("public request", true, latency, probe)
+		case status == http.StatusOK:
+			return report("public request", false, latency, "unexpected body "+fmt.Sprintf("%q", body))
+		default:
+			last = fmt.Sprintf("%d %s", status, strings.TrimSpace(body))
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+	return report("public request", false, 0, "no answer within "+selfTestTimeout.String()+": "+last+" (check -auth-token and -public)")
+}
+
+func report(step string, ok bool, latency time.Duration, detail string) bool {
+	result := "PASS"
+	if !ok {
+		result = "FAIL"
+	}
+	if latency > 0 {
+		detail += fmt.Sprintf(" (%s)", latency.Round(time.Millisecond))
+	}
+	fmt.Printf("  %s  %-15s %s\n", result, step, detail)
+	return ok
+}
+
+func get(ctx context.Context, url string) (body string, status int, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return string(b), resp.StatusCode, err
+}
+
+// defaultPublicURL guesses the public endpoint from the tunnel server's
+// host and the server's default public port.
+func defaultPublicURL(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	return "http://" + net.JoinHostPort(host, "9090")
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+	"github.com/mindsgn-studio/intunja/internal/mux"
+	"github.com/mindsgn-studio/intunja/internal/protocol"
+)
+
+// fakeServer is just enough of an intunja server for the self-test: it
+// registers tunnels and forwards /name/path to them.
+type fakeServer struct {
+	tunnels net.Listener
+	public  *httptest.Server
+
+	mu       sync.Mutex
+	sessions map[string]*mux.Session
+}
+
+func startFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{tunnels: l, sessions: make(map[string]*mux.Session)}
+	s.public = httptest.NewServer(http.HandlerFunc(s.forward))
+	t.Cleanup(func() {
+		l.Close()
+		s.public.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, session := range s.sessions {
+			session.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.register(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) register(conn net.Conn) {
+	// The AUTH line, byte by byte so the register frame isn't read ahead
+	b := make([]byte, 1)
+	for b[0] != '\n' {
+		if _, err := conn.Read(b); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	flags, payload, err := mux.ReadFrame(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	agreed, _ := protocol.Negotiate(protocol.Hello{Version: protocol.Current}, protocol.ParseRegister(flags))
+	conn.Write(agreed.Answer())
+	name, _, _ := strings.Cut(string(payload), " ")
+
+	s.mu.Lock()
+	s.sessions[name] = mux.Server(conn, mux.DefaultConfig())
+	s.mu.Unlock()
+}
+
+func (s *fakeServer) forward(w http.ResponseWriter, r *http.Request) {
+	name, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	s.mu.Lock()
+	session, ok := s.sessions[name]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "No tunnel registered", http.StatusNotFound)
+		return
+	}
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer stream.Close()
+	req, _ := http.NewRequest(r.Method, "/"+path, nil)
+	req.Write(stream)
+	resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+	if err != nil {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// captureStdout runs f and returns what it printed.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	printed := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		printed <- string(b)
+	}()
+	f()
+	w.Close()
+	return <-printed
+}
+
+func TestSelfTest(t *testing.T) {
+	s := startFakeServer(t)
+	var ok bool
+	out := captureStdout(t, func() {
+		ok = selfTest(client.Options{Remote: s.tunnels.Addr().String()}, s.public.URL)
+	})
+	if !ok {
+		t.Errorf("self-test failed against a working server:\n%s", out)
+	}
+	for _, step := range []string{"local API", "tunnel server", "public request"} {
+		if !strings.Contains(out, "PASS  "+step) {
+			t.Errorf("no pass for %s in:\n%s", step, out)
+		}
+	}
+	if strings.Contains(out, "FAIL") {
+		t.Errorf("a step failed:\n%s", out)
+	}
+}
+
+func TestSelfTestUnreachable(t *testing.T) {
+	// A port that was free a moment ago
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := l.Addr().String()
+	l.Close()
+
+	var ok bool
+	out := captureStdout(t, func() {
+		ok = selfTest(client.Options{Remote: remote}, "http://"+remote)
+	})
+	if ok || !strings.Contains(out, "FAIL  tunnel server") {
+		t.Errorf("self-test passed %v without a server:\n%s", ok, out)
+	}
+}
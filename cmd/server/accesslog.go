@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// accessRecord is one line of the -access-log.
+type accessRecord struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	Tunnel     string    `json:"tunnel,omitempty"`
+	ClientIP   string    `json:"client_ip,omitempty"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS int64     `json:"duration_ms"`
+	Aborted    bool      `json:"aborted,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Referer    string    `json:"referer,omitempty"`
+}
+
+// accessLog writes a JSON line for a sample of public requests, and for
+// every one answered with a server error or cut off. A file is rotated to
+// path.1, replacing any before it, once it would grow past maxSize.
+type accessLog struct {
+	sample  float64
+	path    string // empty for stdout
+	maxSize int64  // 0 never rotates
+
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+	size int64
+}
+
+// accesses is nil unless -access-log is set.
+var accesses *accessLog
+
+// openAccessLog appends to the file at path, or writes to stdout if path
+// is "-".
+func openAccessLog(path string, sample float64, maxSize int64) (*accessLog, error) {
+	l := &accessLog{sample: sample, maxSize: maxSize}
+	if path == "-" {
+		l.w = os.Stdout
+		return l, nil
+	}
+	l.path = path
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens l.path for appending. l.mu is held, or l isn't shared yet.
+func (l *accessLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.w, l.file, l.size = f, f, info.Size()
+	return nil
+}
+
+// sampled reports whether a request answered with status, and cut off if
+// aborted, is logged.
+func (l *accessLog) sampled(status int, aborted bool) bool {
+	return status >= 500 || aborted || l.sample >= 1 || rand.Float64() < l.sample
+}
+
+// log records a request, if it is sampled.
+func (l *accessLog) log(r *http.Request, id string, rec *statusRecorder, tunnel string, start time.Time, duration time.Duration) {
+	if l == nil || !l.sampled(rec.status, rec.aborted) {
+		return
+	}
+	entry := accessRecord{
+		Time:       start.UTC(),
+		RequestID:  id,
+		Tunnel:     tunnel,
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		Status:     rec.status,
+		Bytes:      rec.written,
+		DurationMS: duration.Milliseconds(),
+		Aborted:    rec.aborted,
+		UserAgent:  r.UserAgent(),
+		Referer:    r.Referer(),
+	}
+	if ip := clientIP(r); ip != nil {
+		entry.ClientIP = ip.String()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil && l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			slog.Warn("failed to rotate access log", "path", l.path, "err", err)
+		}
+	}
+	n, err := l.w.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		slog.Warn("failed to write access log", "err", err)
+	}
+}
+
+// rotate moves the full file aside and starts a new one. l.mu is held.
+func (l *accessLog) rotate() error {
+	l.file.Close()
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		// Keep appending to the same file rather than lose lines
+		if oerr := l.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	return l.open()
+}
+
+func (l *accessLog) close() {
+	if l == nil || l.file == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Close()
+}
+
+// validAccessSample checks -access-log-sample.
+func validAccessSample(rate float64) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("access_sample must be between 0 and 1, got %v", rate)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// readAccessLog returns the records in the access log at path.
+func readAccessLog(t *testing.T, path string) []accessRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []accessRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec accessRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestAccessLogSampleRate(t *testing.T) {
+	for _, rate := range []float64{0, 0.1, 0.5, 1} {
+		l := &accessLog{sample: rate}
+		const n = 20000
+		logged := 0
+		for range n {
+			if l.sampled(http.StatusOK, false) {
+				logged++
+			}
+		}
+		// Well over five standard deviations either side
+		if got := float64(logged) / n; got < rate-0.02 || got > rate+0.02 {
+			t.Errorf("sample %v logged %v of requests", rate, got)
+		}
+		if !l.sampled(http.StatusBadGateway, false) || !l.sampled(http.StatusOK, true) {
+			t.Errorf("sample %v dropped a 5xx or aborted response", rate)
+		}
+	}
+}
+
+func TestAccessLogAlways5xx(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/fail") {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	path := filepath.Join(t.TempDir(), "access.log")
+	s := startServer(t, "-access-log", path, "-access-log-sample", "0")
+	s.connect(t, client.Options{Name: "app", Local: backend.URL})
+
+	for range 20 {
+		get(t, mustRequest(t, s.url("app", "/ok")))
+	}
+	get(t, mustRequest(t, s.url("app", "/fail/1")))
+	get(t, mustRequest(t, s.url("app", "/fail/2")))
+
+	// A record is written once the response is done
+	var records []accessRecord
+	waitFor(t, func() bool {
+		records = readAccessLog(t, path)
+		return len(records) >= 2
+	})
+	want := map[string]int{"/app/fail/1": 500, "/app/fail/2": 500}
+	for _, rec := range records {
+		if status, ok := want[rec.Path]; !ok || rec.Status != status {
+			t.Errorf("logged %s %d", rec.Path, rec.Status)
+		}
+	}
+	if records[0].Method != "GET" || records[0].Tunnel != "app" || records[0].ClientIP != "127.0.0.1" || records[0].RequestID == "" {
+		t.Errorf("record %+v", records[0])
+	}
+}
+
+func TestAccessLogEveryRequest(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	path := filepath.Join(t.TempDir(), "access.log")
+	// The default sample keeps every request
+	s := startServer(t, "-access-log", path)
+	s.connect(t, client.Options{Name: "app", Local: backend.URL})
+
+	for range 10 {
+		get(t, mustRequest(t, s.url("app", "/")))
+	}
+	waitFor(t, func() bool { return len(readAccessLog(t, path)) == 10 })
+	for _, rec := range readAccessLog(t, path) {
+		if rec.Status != http.StatusOK || rec.Bytes != 5 {
+			t.Errorf("record %+v", rec)
+		}
+	}
+}
+
+func TestAccessLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := openAccessLog(path, 1, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	r := httptest.NewRequest("GET", "/", nil)
+	for range 20 {
+		l.log(r, "id", &statusRecorder{status: http.StatusOK}, "app", time.Now(), 0)
+	}
+
+	for _, p := range []string{path, path + ".1"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() == 0 || info.Size() > 1000 {
+			t.Errorf("%s is %d bytes, want at most 1000", p, info.Size())
+		}
+	}
+}
+
+func TestAccessLogSampleRange(t *testing.T) {
+	for _, rate := range []string{"-0.1", "1.5"} {
+		if _, err := parseConfig("-access-log-sample", rate); err == nil {
+			t.Errorf("-access-log-sample %s accepted", rate)
+		}
+	}
+}
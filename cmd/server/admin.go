@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+)
+
+type tunnelInfo struct {
+	Name        string    `json:"name"`
+	Principal   string    `json:"principal"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	InFlight    int       `json:"in_flight"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	Degraded    bool      `json:"degraded"`
+	HealthError string    `json:"health_error,omitempty"`
+	Bandwidth   int64     `json:"bandwidth_limit"`
+
+	LatencyMS *latencyPercentiles `json:"latency_ms"`
+}
+
+// serveAdmin starts the operator API on its own listener so it is never
+// reachable through the public port.
+func serveAdmin() *http.Server {
+	srv := &http.Server{Addr: cfg.AdminAddr, Handler: adminHandler()}
+	// Shutdown waits for handlers, and the stats streams never finish on
+	// their own
+	srv.RegisterOnShutdown(feed.close)
+
+	slog.Info("admin API listening", "addr", cfg.AdminAddr)
+	go func() {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			fatal("admin server failed", "err", err)
+		}
+	}()
+	return srv
+}
+
+// adminHandler routes the admin API, and pprof with -pprof, behind the
+// auth token.
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/tunnels", handleListTunnels)
+	mux.HandleFunc("DELETE /admin/tunnels/{name}", handleDeleteTunnel)
+	mux.HandleFunc("GET /admin/tunnels/{name}/stats", handleTunnelStats)
+	mux.HandleFunc("PUT /admin/tunnels/{name}/bandwidth", handleSetBandwidth)
+	mux.HandleFunc("DELETE /admin/tunnels/{name}/bandwidth", handleResetBandwidth)
+	if cfg.Pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return requireToken(mux)
+}
+
+// requireToken only lets through requests bearing the auth token.
+func requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !tokensEqual(presented, cfg.AuthToken) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleListTunnels(w http.ResponseWriter, r *http.Request) {
+	tunnels := []tunnelInfo{}
+	for _, t := range registry.List() {
+		degraded, why := t.degraded()
+		tunnels = append(tunnels, tunnelInfo{
+			Name:        t.name,
+			Principal:   t.principal,
+			RemoteAddr:  t.session.RemoteAddr().String(),
+			ConnectedAt: t.connectedAt,
+			InFlight:    t.session.NumStreams(),
+			BytesIn:     t.traffic.in.Load(),
+			BytesOut:    t.traffic.out.Load(),
+			Degraded:    degraded,
+			HealthError: why,
+			Bandwidth:   bandwidth.current(t.name),
+			LatencyMS:   t.latency.percentiles(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"tunnels": tunnels})
+}
+
+func handleDeleteTunnel(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !registry.Unregister(name) {
+		http.Error(w, fmt.Sprintf("No tunnel registered for %q", name), http.StatusNotFound)
+		return
+	}
+
+	slog.Info("tunnel disconnected by admin", "tunnel", name, "remote_addr", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// adminRequest sends an admin API request with the auth token.
+func adminRequest(t *testing.T, admin *httptest.Server, method, path string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, admin.URL+path, nil)
+	req.Header.Set("Authorization", "Bearer "+cfg.AuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAdminListAndDelete(t *testing.T) {
+	s := startServer(t, "-auth-token", "secret")
+	admin := httptest.NewServer(adminHandler())
+	defer admin.Close()
+	s.connect(t, client.Options{Name: "one", Local: newBackend(t, "one").URL})
+	s.connect(t, client.Options{Name: "two", Local: newBackend(t, "two").URL})
+
+	resp := adminRequest(t, admin, http.MethodGet, "/admin/tunnels")
+	var list struct {
+		Tunnels []tunnelInfo `json:"tunnels"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Tunnels) != 2 {
+		t.Fatalf("listed %d tunnels, want 2", len(list.Tunnels))
+	}
+	for _, info := range list.Tunnels {
+		if info.Name != "one" && info.Name != "two" || info.RemoteAddr == "" || info.ConnectedAt.IsZero() {
+			t.Errorf("listed %+v", info)
+		}
+	}
+
+	deleted, _ := registry.Lookup("one")
+	resp = adminRequest(t, admin, http.MethodDelete, "/admin/tunnels/one")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete status %d, want 204", resp.StatusCode)
+	}
+	select {
+	case <-deleted.session.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("deleted tunnel's connection still open")
+	}
+	if disconnectReason(deleted.session.Err()) != "admin" {
+		t.Errorf("closed with %v, want the admin reason", deleted.session.Err())
+	}
+	if _, ok := registry.Lookup("two"); !ok {
+		t.Error("the other tunnel went too")
+	}
+
+	if resp := adminRequest(t, admin, http.MethodDelete, "/admin/tunnels/three"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleting an unknown tunnel: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	setupServer(t, "-auth-token", "secret")
+	admin := httptest.NewServer(adminHandler())
+	defer admin.Close()
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req, _ := http.NewRequest(http.MethodGet, admin.URL+"/admin/tunnels", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status %d, want 401", auth, resp.StatusCode)
+		}
+	}
+}
+
+func TestAdminPprof(t *testing.T) {
+	s := startServer(t, "-auth-token", "secret", "-admin-addr", "127.0.0.1:0", "-pprof")
+	admin := httptest.NewServer(adminHandler())
+	defer admin.Close()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/cmdline"} {
+		if resp := adminRequest(t, admin, http.MethodGet, path); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: %d", path, resp.StatusCode)
+		}
+	}
+	resp, err := http.Get(admin.URL + "/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without the token: %d", resp.StatusCode)
+	}
+
+	// Never on the public listener
+	if code, body := get(t, mustRequest(t, s.public.URL+"/debug/pprof/")); code == http.StatusOK || strings.Contains(body, "goroutine") {
+		t.Errorf("public /debug/pprof/: %d %q", code, body)
+	}
+}
+
+func TestAdminPprofDisabled(t *testing.T) {
+	startServer(t, "-auth-token", "secret", "-admin-addr", "127.0.0.1:0")
+	admin := httptest.NewServer(adminHandler())
+	defer admin.Close()
+	if resp := adminRequest(t, admin, http.MethodGet, "/debug/pprof/"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("without -pprof: %d, want 404", resp.StatusCode)
+	}
+	if _, err := parseConfig("-pprof"); err == nil {
+		t.Error("-pprof accepted without -admin-addr")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// statsInterval is how often the stats stream samples the tunnels.
+const statsInterval = time.Second
+
+// tunnelStats is one event of GET /admin/tunnels/{name}/stats, summed over
+// the connections serving the name.
+type tunnelStats struct {
+	Time              time.Time `json:"time"`
+	Tunnels           int       `json:"tunnels"`
+	InFlight          int       `json:"in_flight"`
+	Requests          int64     `json:"requests"`
+	RequestsPerSecond float64   `json:"requests_per_second"`
+	BytesIn           int64     `json:"bytes_in"`
+	BytesOut          int64     `json:"bytes_out"`
+	BytesInPerSecond  float64   `json:"bytes_in_per_second"`
+	BytesOutPerSecond float64   `json:"bytes_out_per_second"`
+}
+
+// statsFeed samples the tunnels once per statsInterval while anyone is
+// subscribed and hands each subscriber the stats for the name it watches.
+type statsFeed struct {
+	mu      sync.Mutex
+	subs    map[chan tunnelStats]string // to the tunnel name watched
+	running bool
+	closed  bool
+}
+
+var feed = &statsFeed{subs: make(map[chan tunnelStats]string)}
+
+// subscribe returns a channel of stats for name, which is closed if the
+// admin API shuts down. ok is false if it already has.
+func (f *statsFeed) subscribe(name string) (ch chan tunnelStats, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, false
+	}
+	ch = make(chan tunnelStats, 1)
+	f.subs[ch] = name
+	if !f.running {
+		f.running = true
+		go f.run()
+	}
+	return ch, true
+}
+
+func (f *statsFeed) unsubscribe(ch chan tunnelStats) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subs[ch]; ok {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// close ends every subscription so the streams return and the admin
+// server can shut down.
+func (f *statsFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for ch := range f.subs {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// counters is what was last sampled from one tunnel connection, to work
+// out rates from.
+type counters struct {
+	requests, in, out int64
+}
+
+// run samples until the last subscriber has gone.
+func (f *statsFeed) run() {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	// Seeded so the first rates aren't the tunnels' whole lifetime
+	_, prev := sample(nil, 0, time.Now())
+	last := time.Now()
+	for now := range ticker.C {
+		stats, seen := sample(prev, now.Sub(last).Seconds(), now)
+		prev, last = seen, now
+
+		f.mu.Lock()
+		if len(f.subs) == 0 {
+			f.running = false
+			f.mu.Unlock()
+			return
+		}
+		for ch, name := range f.subs {
+			s := stats[name]
+			if s == nil {
+				s = &tunnelStats{Time: now.UTC()}
+			}
+			// A subscriber still writing the last event misses this one
+			select {
+			case ch <- *s:
+			default:
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+// sample sums up the registered tunnels by name, with rates over the
+// elapsed seconds since prev was sampled.
+func sample(prev map[uint64]counters, elapsed float64, now time.Time) (map[string]*tunnelStats, map[uint64]counters) {
+	stats := make(map[string]*tunnelStats)
+	seen := make(map[uint64]counters, len(prev))
+	for _, t := range registry.List() {
+		s := stats[t.name]
+		if s == nil {
+			s = &tunnelStats{Time: now.UTC()}
+			stats[t.name] = s
+		}
+		c := counters{t.requests.Load(), t.traffic.in.Load(), t.traffic.out.Load()}
+		seen[t.id] = c
+
+		s.Tunnels++
+		s.InFlight += t.session.NumStreams()
+		s.Requests += c.requests
+		s.BytesIn += c.in
+		s.BytesOut += c.out
+		if elapsed > 0 {
+			p := prev[t.id] // zero for a connection that is new since then
+			s.RequestsPerSecond += float64(c.requests-p.requests) / elapsed
+			s.BytesInPerSecond += float64(c.in-p.in) / elapsed
+			s.BytesOutPerSecond += float64(c.out-p.out) / elapsed
+		}
+	}
+	return stats, seen
+}
+
+// handleTunnelStats streams the stats of a tunnel as server-sent events,
+// one per statsInterval, until the client goes away.
+func handleTunnelStats(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := registry.Lookup(name); !ok {
+		http.Error(w, fmt.Sprintf("No tunnel registered for %q", name), http.StatusNotFound)
+		return
+	}
+	ch, ok := feed.subscribe(name)
+	if !ok {
+		http.Error(w, "Service Unavailable - server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer feed.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case s, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(s)
+			if _, err := fmt.Fprintf(w, "event: stats\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func subscribers() int {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	return len(feed.subs)
+}
+
+func TestTunnelStatsStream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	s := startServer(t, "-auth-token", "secret")
+	admin := httptest.NewServer(adminHandler())
+	defer admin.Close()
+	s.connect(t, client.Options{Name: "live", Local: backend.URL})
+	for range 3 {
+		get(t, mustRequest(t, s.url("live", "/")))
+	}
+
+	if resp := adminRequest(t, admin, http.MethodGet, "/admin/tunnels/nobody/stats"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown tunnel: %d", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, admin.URL+"/admin/tunnels/live/stats", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	if n := subscribers(); n != 1 {
+		t.Errorf("%d subscribers while streaming", n)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	for events := 0; events < 2 && sc.Scan(); {
+		data, ok := strings.CutPrefix(sc.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		events++
+		var stats tunnelStats
+		if err := json.Unmarshal([]byte(data), &stats); err != nil {
+			t.Fatalf("event %q: %v", data, err)
+		}
+		if stats.Tunnels != 1 || stats.Requests != 3 || stats.BytesOut == 0 {
+			t.Errorf("event %d: %+v", events, stats)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Going away unsubscribes, and the sampling stops with the last one
+	cancel()
+	waitFor(t, func() bool { return subscribers() == 0 })
+	waitFor(t, func() bool {
+		feed.mu.Lock()
+		defer feed.mu.Unlock()
+		return !feed.running
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"hash/maphash"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is how many points each tunnel gets on a hash ring. More
+// points split keys more evenly between tunnels.
+const ringReplicas = 256
+
+var ringSeed = maphash.MakeSeed()
+
+// hashRing spreads affinity keys over the tunnels sharing a name. Keys
+// only move when the tunnel they hash to goes away, and then only those
+// keys.
+type hashRing []ringPoint
+
+type ringPoint struct {
+	hash   uint64
+	tunnel *Tunnel
+}
+
+func newHashRing(tunnels []*Tunnel) hashRing {
+	ring := make(hashRing, 0, len(tunnels)*ringReplicas)
+	for _, t := range tunnels {
+		id := strconv.FormatUint(t.id, 10) + "-"
+		for i := range ringReplicas {
+			ring = append(ring, ringPoint{maphash.String(ringSeed, id+strconv.Itoa(i)), t})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// get returns the first usable tunnel at or after key's place on the ring,
+// or nil if none is.
+func (ring hashRing) get(key string, usable func(*Tunnel) bool) *Tunnel {
+	h := maphash.String(ringSeed, key)
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	for i := range ring {
+		if t := ring[(start+i)%len(ring)].tunnel; usable(t) {
+			return t
+		}
+	}
+	return nil
+}
+
+// affinityKey is what keeps a public client's requests on one tunnel when
+// several share a name: the -affinity-cookie if it was sent, otherwise the
+// -affinity-header.
+func affinityKey(r *http.Request) string {
+	if cfg.AffinityCookie != "" {
+		if c, err := r.Cookie(cfg.AffinityCookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	if cfg.AffinityHeader != "" {
+		return r.Header.Get(cfg.AffinityHeader)
+	}
+	return ""
+}
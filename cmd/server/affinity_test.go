@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+	"github.com/mindsgn-studio/intunja/internal/mux"
+)
+
+func TestHashRingBalanced(t *testing.T) {
+	tunnels := []*Tunnel{{id: 1}, {id: 2}, {id: 3}}
+	ring := newHashRing(tunnels)
+	usable := func(*Tunnel) bool { return true }
+
+	const keys = 3000
+	counts := make(map[*Tunnel]int)
+	placed := make(map[string]*Tunnel)
+	for i := range keys {
+		key := "session-" + strconv.Itoa(i)
+		got := ring.get(key, usable)
+		if again := ring.get(key, usable); again != got {
+			t.Fatalf("%s hashed to tunnel %d, then %d", key, got.id, again.id)
+		}
+		counts[got]++
+		placed[key] = got
+	}
+	for _, tunnel := range tunnels {
+		if share := float64(counts[tunnel]) / keys; share < 0.25 || share > 0.42 {
+			t.Errorf("tunnel %d got %.0f%% of keys, want about a third", tunnel.id, share*100)
+		}
+	}
+
+	// Passing over a tunnel moves its keys, and only its keys
+	gone := tunnels[0]
+	for key, was := range placed {
+		got := ring.get(key, func(t *Tunnel) bool { return t != gone })
+		if got == gone || (was != gone && got != was) {
+			t.Errorf("%s moved from tunnel %d to %d", key, was.id, got.id)
+		}
+	}
+}
+
+// sharedTunnel connects one client per backend name, all registering as
+// "shared".
+func sharedTunnel(t *testing.T, s *testServer, backends ...string) {
+	t.Helper()
+	for _, b := range backends {
+		s.connect(t, client.Options{Name: "shared", Local: newBackend(t, b).URL})
+	}
+	waitFor(t, func() bool { return len(registry.List()) == len(backends) })
+}
+
+// servedBy returns the backend that answered a request sent with set.
+func servedBy(t *testing.T, s *testServer, set func(*http.Request)) string {
+	t.Helper()
+	req := mustRequest(t, s.url("shared", "/"))
+	set(req)
+	code, body := get(t, req)
+	if code != http.StatusOK {
+		t.Fatalf("status %d: %s", code, body)
+	}
+	backend, _, _ := strings.Cut(body, " ")
+	return backend
+}
+
+func TestAffinityHeader(t *testing.T) {
+	s := startServer(t, "-shared-tunnels", "-balance", "affinity")
+	sharedTunnel(t, s, "a", "b")
+
+	used := make(map[string]int)
+	for i := range 40 {
+		key := "user-" + strconv.Itoa(i)
+		set := func(r *http.Request) { r.Header.Set("X-Session", key) }
+		first := servedBy(t, s, set)
+		for range 4 {
+			if got := servedBy(t, s, set); got != first {
+				t.Fatalf("%s went to %s, then %s", key, first, got)
+			}
+		}
+		used[first]++
+	}
+	if used["a"] < 8 || used["b"] < 8 {
+		t.Errorf("40 keys split %v, want both clients used", used)
+	}
+}
+
+func TestAffinityCookie(t *testing.T) {
+	s := startServer(t, "-shared-tunnels", "-balance", "affinity", "-affinity-cookie", "sid")
+	sharedTunnel(t, s, "a", "b")
+
+	for i := range 10 {
+		key := "cookie-" + strconv.Itoa(i)
+		// The cookie wins over a header that changes
+		first := servedBy(t, s, func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: "sid", Value: key})
+			r.Header.Set("X-Session", "first")
+		})
+		got := servedBy(t, s, func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: "sid", Value: key})
+			r.Header.Set("X-Session", "second")
+		})
+		if got != first {
+			t.Errorf("cookie %s went to %s, then %s", key, first, got)
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	for _, balance := range []string{"roundrobin", "random", "affinity"} {
+		t.Run(balance, func(t *testing.T) {
+			s := startServer(t, "-shared-tunnels", "-balance", balance)
+			sharedTunnel(t, s, "a", "b", "c")
+
+			// No affinity key, so even affinity takes turns
+			used := make(map[string]int)
+			for range 90 {
+				used[servedBy(t, s, func(*http.Request) {})]++
+			}
+			for _, b := range []string{"a", "b", "c"} {
+				// Taking turns is exact; random only has to be fair
+				if (balance != "random" && used[b] != 30) || used[b] < 10 {
+					t.Errorf("90 requests split %v, want about 30 each", used)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestRoundRobinSkipsDead(t *testing.T) {
+	setupServer(t, "-shared-tunnels", "-balance", "roundrobin")
+	var live []*Tunnel
+	for range 3 {
+		a, b := net.Pipe()
+		t.Cleanup(func() { b.Close() })
+		session := mux.Server(a, mux.DefaultConfig())
+		t.Cleanup(func() { session.Close() })
+		tunnel, _, err := registry.Register("shared", "", session, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		live = append(live, tunnel)
+	}
+	// Closed, but not yet noticed and removed
+	live[1].session.Close()
+
+	used := make(map[*Tunnel]int)
+	for range 100 {
+		tunnel, _ := registry.Pick("shared", "")
+		used[tunnel]++
+	}
+	if used[live[1]] != 0 {
+		t.Errorf("dead tunnel picked %d times", used[live[1]])
+	}
+	if used[live[0]] < 40 || used[live[2]] < 40 {
+		t.Errorf("live tunnels picked %d and %d times of 100", used[live[0]], used[live[2]])
+	}
+}
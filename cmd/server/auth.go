@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+const maxAuthLineLength = 1024
+
+var errBadToken = errors.New("invalid auth token")
+
+// Handshake is what a tunnel client presents when it connects.
+type Handshake struct {
+	// Token is the credential from the client's AUTH line.
+	Token string
+	// Tunnel is the name the client asked to register.
+	Tunnel     string
+	RemoteAddr net.Addr
+	// Certificate is the client's TLS certificate, verified against
+	// -tls-client-ca; nil if it presented none.
+	Certificate *x509.Certificate
+}
+
+// Authenticator decides whether a client may register its tunnel. The
+// identity it returns is logged as the tunnel's principal.
+type Authenticator interface {
+	Authenticate(ctx context.Context, hs Handshake) (identity string, err error)
+}
+
+// authenticator checks every tunnel registration. Set it from an init
+// function to plug in another scheme; otherwise it is a staticToken for
+// -auth-token.
+var authenticator Authenticator
+
+// staticToken accepts clients presenting the shared secret. An empty token
+// accepts any client.
+type staticToken string
+
+func (t staticToken) Authenticate(ctx context.Context, hs Handshake) (string, error) {
+	if t == "" {
+		return "anonymous", nil
+	}
+	if !tokensEqual(hs.Token, string(t)) {
+		return "", errBadToken
+	}
+	return "shared-token", nil
+}
+
+var errNoClientCert = errors.New("no client certificate with a common name")
+
+// clientCert accepts clients whose certificate was verified against
+// -tls-client-ca, naming them by its common name. A shared token, if set,
+// must be presented as well.
+type clientCert struct {
+	token staticToken
+}
+
+func (a clientCert) Authenticate(ctx context.Context, hs Handshake) (string, error) {
+	if hs.Certificate == nil || hs.Certificate.Subject.CommonName == "" {
+		return "", errNoClientCert
+	}
+	if _, err := a.token.Authenticate(ctx, hs); err != nil {
+		return "", err
+	}
+	return hs.Certificate.Subject.CommonName, nil
+}
+
+// peerCertificate returns the certificate the client at the other end of
+// conn presented over TLS, if any. The handshake is over by the time the
+// AUTH line has been read.
+func peerCertificate(conn net.Conn) *x509.Certificate {
+	tc, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return nil
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+// loadCertPool reads the CA certificates in the PEM file at path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// readAuthLine reads the client's "AUTH <token>\n" line and returns the
+// token.
+func readAuthLine(r io.Reader) (string, error) {
+	line, err := readLine(r, maxAuthLineLength)
+	if err != nil {
+		return "", fmt.Errorf("failed to read auth line: %w", err)
+	}
+
+	token, ok := strings.CutPrefix(line, "AUTH ")
+	if !ok {
+		return "", errors.New("missing AUTH line")
+	}
+	return token, nil
+}
+
+// tokensEqual compares in constant time. Hashing first keeps the
+// comparison from leaking the token's length.
+func tokensEqual(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// readLine reads up to a newline one byte at a time so nothing after it is
+// consumed from the connection.
+func readLine(r io.Reader, max int) (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+	for len(line) < max {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		if buf[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, buf[0])
+	}
+	return "", errors.New("line too long")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/internal/mux"
+	"github.com/mindsgn-studio/intunja/internal/protocol"
+)
+
+// register dials the test server's tunnel listener and goes through the
+// handshake presenting token and name, returning the session that follows.
+func (s *testServer) register(t testing.TB, token, name string) *mux.Session {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.tunnels.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "AUTH %s\n", token)
+	hello := protocol.Hello{Flags: protocol.FlagHello, Version: protocol.Current}
+	if err := mux.WriteFrame(conn, hello.Register(), []byte(name)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protocol.ReadAnswer(conn); err != nil {
+		t.Fatal(err)
+	}
+	return mux.Client(conn, mux.DefaultConfig())
+}
+
+func TestTokensEqual(t *testing.T) {
+	if !tokensEqual("secret", "secret") {
+		t.Error("equal tokens compared unequal")
+	}
+	for _, other := range []string{"", "secreT", "secret2", "secre"} {
+		if tokensEqual("secret", other) {
+			t.Errorf("%q compared equal to secret", other)
+		}
+	}
+}
+
+func TestAuthAccept(t *testing.T) {
+	s := startServer(t, "-auth-token", "secret")
+	s.register(t, "secret", "home")
+	if tunnel := waitTunnel(t, "home"); tunnel.principal != "shared-token" {
+		t.Errorf("principal = %q, want shared-token", tunnel.principal)
+	}
+}
+
+func TestAuthReject(t *testing.T) {
+	s := startServer(t, "-auth-token", "secret")
+	for _, token := range []string{"wrong", ""} {
+		session := s.register(t, token, "home")
+		select {
+		case <-session.Closed():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("token %q: session still open", token)
+		}
+		var peer *mux.PeerError
+		if !errors.As(session.Err(), &peer) || peer.Reason != errAuthFailed.Error() {
+			t.Errorf("token %q: session closed with %v, want %q", token, session.Err(), errAuthFailed)
+		}
+	}
+	if registry.Len() != 0 {
+		t.Errorf("%d tunnels registered, want none", registry.Len())
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	s := startServer(t, "-auth-token", "secret")
+	conn, err := net.Dial("tcp", s.tunnels.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Say nothing; the server hangs up once authTimeout passes
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(authTimeout + 5*time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read = %v, want EOF", err)
+	}
+	if elapsed := time.Since(start); elapsed < authTimeout-time.Second {
+		t.Errorf("closed after %s, before the %s auth timeout", elapsed, authTimeout)
+	}
+}
+
+// jwtAuth accepts HS256 JWTs signed with key whose tunnel claim names the
+// tunnel being registered, identifying the client by its subject.
+type jwtAuth struct{ key []byte }
+
+type jwtClaims struct {
+	Subject string `json:"sub"`
+	Tunnel  string `json:"tunnel"`
+	Expires int64  `json:"exp"`
+}
+
+func (a jwtAuth) Authenticate(ctx context.Context, hs Handshake) (string, error) {
+	parts := strings.Split(hs.Token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("not a JWT")
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", errors.New("bad signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", err
+	}
+	switch {
+	case time.Now().Unix() >= claims.Expires:
+		return "", errors.New("token expired")
+	case claims.Tunnel != hs.Tunnel:
+		return "", fmt.Errorf("token is for tunnel %q", claims.Tunnel)
+	}
+	return claims.Subject, nil
+}
+
+// signJWT issues an HS256 JWT for claims.
+func signJWT(key []byte, claims jwtClaims) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, _ := json.Marshal(claims)
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestCustomAuthenticator(t *testing.T) {
+	s := startServer(t)
+	key := []byte("jwt signing key")
+	authenticator = jwtAuth{key: key}
+	valid := jwtClaims{Subject: "alice@example.com", Tunnel: "home", Expires: time.Now().Add(time.Hour).Unix()}
+
+	s.register(t, signJWT(key, valid), "home")
+	if tunnel := waitTunnel(t, "home"); tunnel.principal != "alice@example.com" {
+		t.Errorf("principal = %q, want the token's subject", tunnel.principal)
+	}
+	registry.Unregister("home")
+
+	expired, other := valid, valid
+	expired.Expires = time.Now().Add(-time.Minute).Unix()
+	other.Tunnel = "someone-else"
+	for name, token := range map[string]string{
+		"forged":        signJWT([]byte("other key"), valid),
+		"expired":       signJWT(key, expired),
+		"other tunnel":  signJWT(key, other),
+		"shared secret": "secret",
+	} {
+		session := s.register(t, token, "home")
+		select {
+		case <-session.Closed():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s token: session still open", name)
+		}
+		var peer *mux.PeerError
+		if !errors.As(session.Err(), &peer) || peer.Reason != errAuthFailed.Error() {
+			t.Errorf("%s token: session closed with %v, want %q", name, session.Err(), errAuthFailed)
+		}
+	}
+	if registry.Len() != 0 {
+		t.Errorf("%d tunnels registered with bad tokens", registry.Len())
+	}
+}
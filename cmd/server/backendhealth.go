@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mindsgn-studio/intunja/internal/version"
+)
+
+// backendHealth is the outcome of a tunnel's last health check.
+type backendHealth struct {
+	healthy   bool
+	err       string
+	checkedAt time.Time
+}
+
+// checkBackend requests -health-path through t every -health-interval
+// until the tunnel closes. The tunnel is degraded while its home API
+// doesn't answer with a 2xx within -health-timeout.
+func checkBackend(t *Tunnel) {
+	ticker := time.NewTicker(cfg.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		h := probeBackend(t)
+		if t.closed() {
+			return
+		}
+		prev := t.health.Swap(&h)
+		switch {
+		case !h.healthy && (prev == nil || prev.healthy):
+			slog.Warn("tunnel backend unhealthy", "tunnel", t.name, "path", cfg.HealthPath, "err", h.err)
+		case h.healthy && prev != nil && !prev.healthy:
+			slog.Info("tunnel backend healthy again", "tunnel", t.name, "path", cfg.HealthPath)
+		}
+
+		select {
+		case <-t.session.Closed():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeBackend sends one health check request through t.
+func probeBackend(t *Tunnel) backendHealth {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.HealthTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.HealthPath, nil)
+	if err != nil {
+		return backendHealth{err: err.Error(), checkedAt: time.Now()}
+	}
+	req.Host = t.name
+	req.Header.Set("User-Agent", "intunja-health/"+version.Version)
+	req.Header.Set(requestIDHeader, uuid.NewString())
+
+	resp, done, err := roundTrip(ctx, t, req, nil, slog.Default())
+	defer done()
+
+	h := backendHealth{checkedAt: time.Now()}
+	switch {
+	case ctx.Err() != nil:
+		h.err = fmt.Sprintf("no answer within %s", cfg.HealthTimeout)
+	case err != nil:
+		h.err = err.Error()
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		h.err = fmt.Sprintf("answered %s", resp.Status)
+	default:
+		h.healthy = true
+	}
+	return h
+}
+
+// degraded reports whether t's last health check failed, and why.
+func (t *Tunnel) degraded() (bool, string) {
+	h := t.health.Load()
+	if h == nil || h.healthy {
+		return false, ""
+	}
+	return true, h.err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// brokenBackend is a local API that reads a request, writes what the path
+// names of a response, and hangs up.
+func brokenBackend(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	answers := map[string]string{
+		"/mid-body":  "HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\npartial",
+		"/mid-chunk": "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n10\r\nonly a few",
+		"/mid-head":  "HTTP/1.1 200 OK\r\nContent-Ty",
+		"/garbage":   "this is not HTTP at all\r\n\r\n",
+		"/nothing":   "",
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				io.WriteString(conn, answers[req.URL.Path])
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func TestBackendClosesMidResponse(t *testing.T) {
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "broken", Local: brokenBackend(t)})
+
+	for _, path := range []string{"/mid-body", "/mid-chunk", "/mid-head", "/garbage", "/nothing"} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			resp, err := http.Get(s.url("broken", path))
+			if err != nil {
+				t.Errorf("%s: %v", path, err)
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Errorf("%s: body cut off with %v, want a whole 502", path, err)
+			}
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("%s: %d %q, want 502", path, resp.StatusCode, body)
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the public client was left hanging", path)
+		}
+	}
+}
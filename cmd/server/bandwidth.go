@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// minBandwidth is the lowest limit allowed. Every frame, up to 32 KiB, has
+// to make it onto the connection within the tunnel's write timeout.
+const minBandwidth = 16 << 10
+
+// minBandwidthBurst keeps the bucket for a low limit big enough that a
+// connection isn't trickled out a few bytes per write.
+const minBandwidthBurst = 4 << 10
+
+// bandwidthLimits caps each tunnel's throughput, in bytes per second each
+// way, shared by the connections registered under its name. A limit set
+// for a name through the admin API outlasts its connections; other
+// tunnels get -bandwidth-limit.
+type bandwidthLimits struct {
+	def int64 // 0 for no limit
+
+	mu        sync.Mutex
+	overrides map[string]int64
+	buckets   map[string]*bandwidthBuckets
+}
+
+// bandwidthBuckets holds one tunnel's token buckets, counted in bytes.
+type bandwidthBuckets struct {
+	in, out *rate.Limiter
+}
+
+var bandwidth *bandwidthLimits
+
+func newBandwidthLimits(bytesPerSecond int64) *bandwidthLimits {
+	return &bandwidthLimits{
+		def:       bytesPerSecond,
+		overrides: make(map[string]int64),
+		buckets:   make(map[string]*bandwidthBuckets),
+	}
+}
+
+// current returns the bytes per second name is held to, 0 for no limit.
+func (b *bandwidthLimits) current(name string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit(name)
+}
+
+// limit is current with b.mu held.
+func (b *bandwidthLimits) limit(name string) int64 {
+	if n, ok := b.overrides[name]; ok {
+		return n
+	}
+	return b.def
+}
+
+// get returns name's buckets, made at its current limit if it has none.
+func (b *bandwidthLimits) get(name string) *bandwidthBuckets {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bk, ok := b.buckets[name]
+	if !ok {
+		limit, burst := bucketRate(b.limit(name))
+		bk = &bandwidthBuckets{in: rate.NewLimiter(limit, burst), out: rate.NewLimiter(limit, burst)}
+		b.buckets[name] = bk
+	}
+	return bk
+}
+
+// set holds name to bytesPerSecond from now on, connected or not; 0 lifts
+// its limit.
+func (b *bandwidthLimits) set(name string, bytesPerSecond int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.overrides[name] = bytesPerSecond
+	b.apply(name)
+}
+
+// reset puts name back on -bandwidth-limit.
+func (b *bandwidthLimits) reset(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.overrides, name)
+	b.apply(name)
+}
+
+// apply changes the buckets of a connected name to its limit. b.mu is
+// held.
+func (b *bandwidthLimits) apply(name string) {
+	bk, ok := b.buckets[name]
+	if !ok {
+		return
+	}
+	limit, burst := bucketRate(b.limit(name))
+	for _, lim := range []*rate.Limiter{bk.in, bk.out} {
+		lim.SetBurst(burst)
+		lim.SetLimit(limit)
+	}
+}
+
+// remove drops name's buckets once no tunnel is left for it, keeping any
+// limit set for it.
+func (b *bandwidthLimits) remove(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.buckets, name)
+}
+
+func validBandwidth(bytesPerSecond int64) bool {
+	return bytesPerSecond == 0 || bytesPerSecond >= minBandwidth
+}
+
+func bucketRate(bytesPerSecond int64) (rate.Limit, int) {
+	if bytesPerSecond <= 0 {
+		return rate.Inf, 0
+	}
+	return rate.Limit(bytesPerSecond), int(max(bytesPerSecond, minBandwidthBurst))
+}
+
+// throttle waits until n bytes may pass lim, in pieces no bigger than its
+// burst, or until ctx is done.
+func throttle(ctx context.Context, lim *rate.Limiter, n int) error {
+	for n > 0 {
+		if lim.Limit() == rate.Inf {
+			return nil
+		}
+		chunk := min(n, lim.Burst())
+		if err := lim.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+type bandwidthRequest struct {
+	BytesPerSecond int64 `json:"bytes_per_second"`
+}
+
+// handleSetBandwidth changes a tunnel's bandwidth limit at runtime.
+func handleSetBandwidth(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !tunnelNamePattern.MatchString(name) {
+		http.Error(w, fmt.Sprintf("Invalid tunnel name %q", name), http.StatusBadRequest)
+		return
+	}
+	var req bandwidthRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil || !validBandwidth(req.BytesPerSecond) {
+		http.Error(w, fmt.Sprintf(`Bad Request - want {"bytes_per_second": n}, n at least %d or 0 for no limit`, minBandwidth), http.StatusBadRequest)
+		return
+	}
+
+	bandwidth.set(name, req.BytesPerSecond)
+	slog.Info("tunnel bandwidth limit set by admin", "tunnel", name, "bytes_per_second", req.BytesPerSecond)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleResetBandwidth puts a tunnel back on the default bandwidth limit.
+func handleResetBandwidth(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	bandwidth.reset(name)
+	slog.Info("tunnel bandwidth limit reset by admin", "tunnel", name, "bytes_per_second", bandwidth.def)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func TestThrottle(t *testing.T) {
+	lim := rate.NewLimiter(1<<20, 64<<10)
+	lim.AllowN(time.Now(), 64<<10) // start with an empty bucket
+	start := time.Now()
+	if err := throttle(context.Background(), lim, 512<<10); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed, want := time.Since(start), 500*time.Millisecond; elapsed < want*8/10 || elapsed > want*13/10 {
+		t.Errorf("512KB at 1MB/s took %s, want about %s", elapsed, want)
+	}
+
+	// A cancelled wait gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := throttle(ctx, lim, 1<<20); err == nil {
+		t.Error("throttle waited out a cancelled context")
+	}
+	if err := throttle(context.Background(), rate.NewLimiter(rate.Inf, 0), 1<<30); err != nil {
+		t.Errorf("no limit: %v", err)
+	}
+}
+
+// download fetches url and returns how long its body took.
+func download(t *testing.T, url string, size int) time.Duration {
+	t.Helper()
+	start := time.Now()
+	code, body := get(t, mustRequest(t, url))
+	if code != http.StatusOK || len(body) != size {
+		t.Fatalf("got %d with %d bytes, want %d", code, len(body), size)
+	}
+	return time.Since(start)
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("transfers for seconds")
+	}
+	const size = 768 << 10
+	body := bytes.Repeat([]byte("x"), size)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer backend.Close()
+	const limit = 256 << 10
+	s := startServer(t, "-auth-token", "secret", "-bandwidth-limit", "262144")
+	admin := httptest.NewServer(adminHandler())
+	defer admin.Close()
+	s.connect(t, client.Options{Name: "capped", Local: backend.URL})
+
+	// A full bucket's worth goes at once, and the rest at the limit
+	elapsed := download(t, s.url("capped", "/"), size)
+	if got := float64(size-limit) / elapsed.Seconds(); got < limit*0.8 || got > limit*1.25 {
+		t.Errorf("moved %.0f B/s past the burst, want about %d", got, limit)
+	}
+
+	// Raised at runtime, through the admin API
+	req, _ := http.NewRequest(http.MethodPut, admin.URL+"/admin/tunnels/capped/bandwidth", strings.NewReader(`{"bytes_per_second": 4194304}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("setting the limit: %d", resp.StatusCode)
+	}
+	if got := bandwidth.current("capped"); got != 4<<20 {
+		t.Errorf("limit is %d after setting it", got)
+	}
+	if faster := download(t, s.url("capped", "/"), size); faster > elapsed/3 {
+		t.Errorf("took %s at 4MB/s, against %s at 256KB/s", faster, elapsed)
+	}
+}
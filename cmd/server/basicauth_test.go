@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func TestBasicAuth(t *testing.T) {
+	authorization := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization <- r.Header.Get("Authorization")
+	}))
+	defer backend.Close()
+	s := startServer(t, "-basic-auth", "alice:wonderland", "-basic-auth", "bob:b:with:colons")
+	s.connect(t, client.Options{Name: "private", Local: backend.URL})
+
+	for _, c := range []struct {
+		name       string
+		user, pass string
+		set        bool
+		want       int
+	}{
+		{"valid", "alice", "wonderland", true, http.StatusOK},
+		{"second user", "bob", "b:with:colons", true, http.StatusOK},
+		{"wrong password", "alice", "looking-glass", true, http.StatusUnauthorized},
+		{"another's password", "alice", "b:with:colons", true, http.StatusUnauthorized},
+		{"unknown user", "mallory", "wonderland", true, http.StatusUnauthorized},
+		{"missing", "", "", false, http.StatusUnauthorized},
+	} {
+		req := mustRequest(t, s.url("private", "/"))
+		if c.set {
+			req.SetBasicAuth(c.user, c.pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Errorf("%s: %d, want %d", c.name, resp.StatusCode, c.want)
+		}
+		if c.want == http.StatusUnauthorized {
+			if resp.Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("%s: 401 without WWW-Authenticate", c.name)
+			}
+			continue
+		}
+		// The credentials are for the edge, not the home server
+		if got := <-authorization; got != "" {
+			t.Errorf("%s: Authorization %q reached the local API", c.name, got)
+		}
+	}
+}
+
+func TestBasicAuthInvalid(t *testing.T) {
+	for _, pair := range []string{"alice", ":nouser"} {
+		if _, err := parseConfig("-basic-auth", pair); err == nil {
+			t.Errorf("%q accepted", pair)
+		}
+	}
+}
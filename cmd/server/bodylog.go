@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// bodyCapture keeps the first limit bytes written to it for -log-bodies.
+// It never fails a write, so teeing a body into it can't disturb the
+// forwarding.
+type bodyCapture struct {
+	buf   bytes.Buffer
+	limit int
+	total int64
+}
+
+func (c *bodyCapture) Write(p []byte) (int, error) {
+	if room := c.limit - c.buf.Len(); room > 0 {
+		c.buf.Write(p[:min(room, len(p))])
+	}
+	c.total += int64(len(p))
+	return len(p), nil
+}
+
+func (c *bodyCapture) LogValue() slog.Value {
+	if c == nil {
+		return slog.StringValue("")
+	}
+	s := c.buf.String()
+	if dropped := c.total - int64(c.buf.Len()); dropped > 0 {
+		s += fmt.Sprintf(" (%d more bytes)", dropped)
+	}
+	return slog.StringValue(s)
+}
+
+// redacted returns a copy of h with the values of -redact-header headers
+// replaced by ***.
+func redacted(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range cfg.Log.Redact {
+		if _, ok := h[http.CanonicalHeaderKey(name)]; ok {
+			h.Set(name, "***")
+		}
+	}
+	return h
+}
+
+// readCloser pairs a wrapped body with the original's Close.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
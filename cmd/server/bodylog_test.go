@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func TestBodyCapture(t *testing.T) {
+	c := &bodyCapture{limit: 8}
+	for _, p := range []string{"0123", "456789", "abcdef"} {
+		if n, err := c.Write([]byte(p)); n != len(p) || err != nil {
+			t.Errorf("Write(%q) = %d, %v", p, n, err)
+		}
+	}
+	if got, want := c.LogValue().String(), "01234567 (8 more bytes)"; got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+	if got := (&bodyCapture{limit: 8}).LogValue().String(); got != "" {
+		t.Errorf("empty body logged as %q", got)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	setupServer(t, "-redact-header", "X-Api-Key")
+	h := http.Header{"X-Api-Key": {"k"}, "Accept": {"*/*"}}
+	got := redacted(h)
+	if got.Get("X-Api-Key") != "***" || got.Get("Accept") != "*/*" {
+		t.Errorf("redacted to %v", got)
+	}
+	if h.Get("X-Api-Key") != "k" {
+		t.Error("redacting changed the headers being forwarded")
+	}
+}
+
+func TestLogBodies(t *testing.T) {
+	var forwarded string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		forwarded = string(body)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3cret"})
+		w.Write([]byte(strings.ToUpper(forwarded)))
+	}))
+	defer backend.Close()
+	s := startServer(t, "-log-bodies", "10")
+	s.connect(t, client.Options{Name: "logged", Local: backend.URL})
+	logs := captureLogs(t)
+
+	body := strings.Repeat("abcdefghij", 10)
+	req, _ := http.NewRequest(http.MethodPost, s.url("logged", "/"), strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer t0ken")
+	req.Header.Set("Cookie", "session=s3cret")
+	_, got := get(t, req)
+
+	// Capturing is cut short, forwarding isn't
+	if forwarded != body || got != strings.ToUpper(body) {
+		t.Fatalf("forwarded %d bytes and answered %d, want all %d", len(forwarded), len(got), len(body))
+	}
+	// The line is logged once the response is done, which can be after
+	// the public client has it all
+	waitFor(t, func() bool { return len(logs.lines(t, "bodies")) > 0 })
+	line := logs.line(t, "bodies")
+	if line["request_body"] != "abcdefghij (90 more bytes)" || line["response_body"] != "ABCDEFGHIJ (90 more bytes)" {
+		t.Errorf("logged bodies %q and %q", line["request_body"], line["response_body"])
+	}
+	reqHeaders := line["request_headers"].(map[string]any)
+	respHeaders := line["response_headers"].(map[string]any)
+	for _, v := range []any{reqHeaders["Authorization"], reqHeaders["Cookie"], respHeaders["Set-Cookie"]} {
+		if v.([]any)[0] != "***" {
+			t.Errorf("logged a secret: %v", v)
+		}
+	}
+	if all := fmt.Sprint(line); strings.Contains(all, "s3cret") || strings.Contains(all, "t0ken") {
+		t.Errorf("secret in the log line: %v", line)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedBody keeps any one response from taking over the cache.
+const maxCachedBody = 1 << 20
+
+// responseCache is an LRU of fresh GET and HEAD responses, so repeated
+// requests for static content don't cross the home server's uplink.
+type responseCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	vary    map[string]string // request header values the response varies on
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// newResponseCache returns nil, which caches nothing, if size is not
+// positive.
+func newResponseCache(size int) *responseCache {
+	if size <= 0 {
+		return nil
+	}
+	return &responseCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func cacheKey(tunnel string, r *http.Request) string {
+	return tunnel + " " + r.Method + " " + r.URL.RequestURI()
+}
+
+// get returns a fresh entry for r, if there is one.
+func (c *responseCache) get(key string, r *http.Request) *cacheEntry {
+	if c == nil || !cacheableRequest(r) {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil
+	}
+	if !e.matches(r) {
+		return nil
+	}
+	c.order.MoveToFront(el)
+	return e
+}
+
+// matches reports whether r sent the same values as the request e was
+// fetched for in the headers e varies on.
+func (e *cacheEntry) matches(r *http.Request) bool {
+	for name, value := range e.vary {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// put stores the response to r if both allow it.
+func (c *responseCache) put(key string, r *http.Request, resp *http.Response, body []byte) {
+	if c == nil {
+		return
+	}
+	if e := newCacheEntry(key, r, resp, body); e != nil {
+		c.store(e)
+	}
+}
+
+// newCacheEntry returns resp, with body, as an entry for key, or nil if
+// either it or r doesn't allow it to be kept.
+func newCacheEntry(key string, r *http.Request, resp *http.Response, body []byte) *cacheEntry {
+	if !cacheableRequest(r) || len(body) > maxCachedBody {
+		return nil
+	}
+	ttl, ok := cacheTTL(resp)
+	if !ok {
+		return nil
+	}
+
+	vary := make(map[string]string)
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				vary[name] = r.Header.Get(name)
+			}
+		}
+	}
+
+	header := make(http.Header, len(resp.Header))
+	for k, v := range resp.Header {
+		if k != requestIDHeader {
+			header[k] = v
+		}
+	}
+
+	now := time.Now()
+	return &cacheEntry{
+		key:     key,
+		vary:    vary,
+		status:  resp.StatusCode,
+		header:  header,
+		body:    body,
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+}
+
+func (c *responseCache) store(e *cacheEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[e.key]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[e.key] = c.order.PushFront(e)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// serve writes e as the response to r, answering a matching If-None-Match
+// with 304. xcache, if set, is sent as X-Cache.
+func (e *cacheEntry) serve(w http.ResponseWriter, r *http.Request, xcache string) {
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	if xcache != "" {
+		w.Header().Set("X-Cache", xcache)
+	}
+
+	if etag := e.header.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+}
+
+// cacheableRequest allows only safe methods, without credentials, whose
+// client hasn't asked to bypass caches.
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Pragma") == "no-cache" {
+		return false
+	}
+	directives := cacheControl(r.Header)
+	_, noCache := directives["no-cache"]
+	_, noStore := directives["no-store"]
+	return !noCache && !noStore
+}
+
+// cacheTTL reports how long resp may be served from a shared cache.
+// Responses are only cached when the origin gives an explicit lifetime.
+func cacheTTL(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" || len(resp.Trailer) > 0 {
+		return 0, false
+	}
+
+	directives := cacheControl(resp.Header)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return 0, false
+		}
+	}
+
+	age, ok := directives["s-maxage"]
+	if !ok {
+		age, ok = directives["max-age"]
+	}
+	if !ok {
+		return 0, false
+	}
+	secs, err := strconv.Atoi(age)
+	if err != nil || secs <= 0 {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// cappedBuffer collects up to limit bytes and notes when more were offered.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if !b.overflow && b.Len()+len(p) <= b.limit {
+		b.Buffer.Write(p)
+	} else {
+		b.overflow = true
+		b.Reset()
+	}
+	return len(p), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// countingBackend answers /nostore/... with no-store and everything else
+// as cacheable for a minute, counting the requests for each path.
+func countingBackend(t *testing.T) (*httptest.Server, func(path string) int) {
+	t.Helper()
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		n := hits[r.URL.Path]
+		mu.Unlock()
+		if r.URL.Path == "/nostore" {
+			w.Header().Set("Cache-Control", "no-store")
+		} else {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			w.Header().Set("ETag", `"v1"`)
+		}
+		fmt.Fprintf(w, "%s #%d", r.URL.Path, n)
+	}))
+	t.Cleanup(backend.Close)
+	return backend, func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits[path]
+	}
+}
+
+// fetch GETs path through the tunnel named cached, returning X-Cache and
+// the body.
+func fetch(t *testing.T, s *testServer, path string) (string, string) {
+	t.Helper()
+	resp, err := http.Get(s.url("cached", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.Header.Get("X-Cache"), string(body)
+}
+
+func TestCacheHit(t *testing.T) {
+	backend, hits := countingBackend(t)
+	s := startServer(t, "-cache-size", "10")
+	s.connect(t, client.Options{Name: "cached", Local: backend.URL})
+
+	if xcache, body := fetch(t, s, "/static"); xcache != "MISS" || body != "/static #1" {
+		t.Errorf("first fetch: %s %q", xcache, body)
+	}
+	if xcache, body := fetch(t, s, "/static"); xcache != "HIT" || body != "/static #1" {
+		t.Errorf("second fetch: %s %q, want the cached copy", xcache, body)
+	}
+	if n := hits("/static"); n != 1 {
+		t.Errorf("the home server was asked %d times, want once", n)
+	}
+
+	// A revalidation is answered from the cache too
+	req := mustRequest(t, s.url("cached", "/static"))
+	req.Header.Set("If-None-Match", `"v1"`)
+	if code, _ := get(t, req); code != http.StatusNotModified {
+		t.Errorf("If-None-Match got %d, want 304", code)
+	}
+
+	// So is nothing the client asked to go past the cache for
+	req = mustRequest(t, s.url("cached", "/static"))
+	req.Header.Set("Cache-Control", "no-cache")
+	if _, body := get(t, req); body != "/static #2" {
+		t.Errorf("no-cache request got %q, want a fresh answer", body)
+	}
+}
+
+func TestCacheNoStore(t *testing.T) {
+	backend, hits := countingBackend(t)
+	s := startServer(t, "-cache-size", "10")
+	s.connect(t, client.Options{Name: "cached", Local: backend.URL})
+
+	for i := 1; i <= 3; i++ {
+		if xcache, body := fetch(t, s, "/nostore"); xcache != "MISS" || body != fmt.Sprintf("/nostore #%d", i) {
+			t.Errorf("fetch %d: %s %q", i, xcache, body)
+		}
+	}
+	if n := hits("/nostore"); n != 3 {
+		t.Errorf("the home server was asked %d times, want every time", n)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	backend, hits := countingBackend(t)
+	s := startServer(t, "-cache-size", "2")
+	s.connect(t, client.Options{Name: "cached", Local: backend.URL})
+
+	fetch(t, s, "/a")
+	fetch(t, s, "/b")
+	fetch(t, s, "/a") // now the most recently used
+	fetch(t, s, "/c") // pushes out /b
+
+	if xcache, _ := fetch(t, s, "/a"); xcache != "HIT" {
+		t.Errorf("/a: %s, want it kept as recently used", xcache)
+	}
+	if xcache, _ := fetch(t, s, "/b"); xcache != "MISS" {
+		t.Errorf("/b: %s, want it evicted", xcache)
+	}
+	if hits("/a") != 1 || hits("/b") != 2 {
+		t.Errorf("home server hits: /a %d, /b %d; want 1 and 2", hits("/a"), hits("/b"))
+	}
+	// The last store can still be running on its handler's goroutine
+	cache.mu.Lock()
+	n := cache.order.Len()
+	cache.mu.Unlock()
+	if n != 2 {
+		t.Errorf("%d entries cached, want the capacity of 2", n)
+	}
+}
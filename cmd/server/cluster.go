@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// clusterTimeout bounds each call to the cluster registry, so a slow
+// store doesn't hold up tunnels or requests for long.
+const clusterTimeout = 2 * time.Second
+
+const (
+	// forwardedByHeader marks a request one instance has forwarded to
+	// another, which must then answer it rather than forward it again.
+	forwardedByHeader = "X-Intunja-Forwarded-By"
+	// clusterTokenHeader carries the cluster secret between instances, so
+	// the cluster listener only takes requests from the others.
+	clusterTokenHeader = "X-Intunja-Cluster-Token"
+)
+
+// ClusterRegistry records which server instance holds each tunnel, so that
+// instances behind one load balancer can forward requests for tunnels
+// connected to another. Claims expire unless renewed, so the tunnels of an
+// instance that dies are soon let go.
+type ClusterRegistry interface {
+	// Claim records node as holding name for ttl, replacing any other
+	// node's claim: the newest connection for a name wins, as it does
+	// on one instance.
+	Claim(ctx context.Context, name, node string, ttl time.Duration) error
+	// Release drops the claim on name if node still holds it.
+	Release(ctx context.Context, name, node string) error
+	// Owner returns the node holding name, or "" if none does.
+	Owner(ctx context.Context, name string) (string, error)
+}
+
+// memoryRegistry is a ClusterRegistry only the instance holding it sees,
+// for tests and for trying clustering out.
+type memoryRegistry struct {
+	mu     sync.Mutex
+	claims map[string]memoryClaim
+}
+
+type memoryClaim struct {
+	node    string
+	expires time.Time
+}
+
+func newMemoryRegistry() *memoryRegistry {
+	return &memoryRegistry{claims: make(map[string]memoryClaim)}
+}
+
+func (m *memoryRegistry) Claim(ctx context.Context, name, node string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.claims[name] = memoryClaim{node: node, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *memoryRegistry) Release(ctx context.Context, name, node string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.claims[name].node == node {
+		delete(m.claims, name)
+	}
+	return nil
+}
+
+func (m *memoryRegistry) Owner(ctx context.Context, name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.claims[name]
+	if !ok {
+		return "", nil
+	}
+	if time.Now().After(c.expires) {
+		delete(m.claims, name)
+		return "", nil
+	}
+	return c.node, nil
+}
+
+// clusterNode is this instance's part in a cluster: it claims the tunnels
+// connected here and forwards requests for those connected elsewhere.
+type clusterNode struct {
+	node     string // this instance's cluster listener, as the others reach it
+	registry ClusterRegistry
+	ttl      time.Duration
+	proxy    *httputil.ReverseProxy
+}
+
+// cluster is nil unless -node-url is set.
+var cluster *clusterNode
+
+// newClusterNode sets up clustering from c, which has been validated.
+func newClusterNode(c ClusterConfig) (*clusterNode, error) {
+	if c.NodeURL == "" {
+		return nil, nil
+	}
+	var reg ClusterRegistry
+	switch c.Registry {
+	case "memory":
+		slog.Warn("the memory cluster registry is only seen by this instance, so no requests will be forwarded between instances; use -cluster-registry redis")
+		reg = newMemoryRegistry()
+	case "redis":
+		r, err := newRedisRegistry(c.Redis)
+		if err != nil {
+			return nil, err
+		}
+		reg = r
+	}
+	n := &clusterNode{node: c.NodeURL, registry: reg, ttl: c.TTL}
+	n.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			owner, _ := url.Parse(pr.In.Context().Value(ownerKey{}).(string))
+			pr.SetURL(owner)
+			// The owner routes by the same host as this instance did, and
+			// takes the client's address from clientIPHeader
+			pr.Out.Host = pr.In.Host
+			pr.Out.Header.Set(forwardedByHeader, n.node)
+			pr.Out.Header.Set(clusterTokenHeader, cfg.clusterSecret())
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			// Already set here, to the same ID
+			resp.Header.Del(requestIDHeader)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Error("failed to forward request to the instance holding its tunnel", "owner", r.Context().Value(ownerKey{}), "err", err)
+			http.Error(w, "Bad Gateway - tunnel error", http.StatusBadGateway)
+		},
+	}
+	return n, nil
+}
+
+// claim records name as held here.
+func (n *clusterNode) claim(name string) {
+	if n == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+	defer cancel()
+	if err := n.registry.Claim(ctx, name, n.node, n.ttl); err != nil {
+		slog.Warn("failed to claim tunnel in cluster registry", "tunnel", name, "err", err)
+	}
+}
+
+// release gives name up, once no tunnel is left for it here.
+func (n *clusterNode) release(name string) {
+	if n == nil {
+		return
+	}
+	if _, ok := registry.Lookup(name); ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+	defer cancel()
+	if err := n.registry.Release(ctx, name, n.node); err != nil {
+		slog.Warn("failed to release tunnel in cluster registry", "tunnel", name, "err", err)
+	}
+}
+
+// renew claims the tunnels connected here again well before their claims
+// expire, until ctx is done.
+func (n *clusterNode) renew(ctx context.Context) {
+	if n == nil {
+		return
+	}
+	ticker := time.NewTicker(n.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var last string
+		for _, t := range registry.List() {
+			if t.name != last {
+				n.claim(t.name)
+				last = t.name
+			}
+		}
+	}
+}
+
+type ownerKey struct{}
+
+// forwardedKey marks the context of a request another instance forwarded
+// here, with the instance's node URL. It is never set from the headers of
+// a public request.
+type forwardedKey struct{}
+
+// forward sends r on to the instance holding the tunnel name, if another
+// one does, and reports whether it did. A request that was itself
+// forwarded is never sent on again.
+func (n *clusterNode) forward(w http.ResponseWriter, r *http.Request, name string) bool {
+	if n == nil || r.Context().Value(forwardedKey{}) != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), clusterTimeout)
+	owner, err := n.registry.Owner(ctx, name)
+	cancel()
+	if err != nil {
+		slog.Warn("failed to look tunnel up in cluster registry", "tunnel", name, "err", err)
+		return false
+	}
+	if owner == "" || owner == n.node {
+		return false
+	}
+	slog.Debug("forwarding request to the instance holding its tunnel", "tunnel", name, "owner", owner)
+	n.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ownerKey{}, owner)))
+	return true
+}
+
+// serveCluster starts the listener for requests other instances forward
+// here. They have been through the policy of the listener they arrived
+// on, so only this instance's main rate limit is applied again.
+func serveCluster() *http.Server {
+	srv := &http.Server{
+		Addr:      cfg.Cluster.Addr,
+		Handler:   http.HandlerFunc(handleClusterRequest),
+		Protocols: new(http.Protocols),
+	}
+	setPublicTimeouts(srv)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+
+	listener, err := net.Listen("tcp", cfg.Cluster.Addr)
+	if err != nil {
+		fatal("failed to start cluster listener", "addr", cfg.Cluster.Addr, "err", err)
+	}
+	slog.Info("cluster listener started", "addr", listener.Addr().String(), "node", cluster.node, "registry", cfg.Cluster.Registry)
+	go func() {
+		if err := srv.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			fatal("cluster listener failed", "err", err)
+		}
+	}()
+	return srv
+}
+
+// handleClusterRequest serves a request another instance forwarded,
+// as if the public client had sent it here.
+func handleClusterRequest(w http.ResponseWriter, r *http.Request) {
+	by := r.Header.Get(forwardedByHeader)
+	if by == "" {
+		http.Error(w, "Forbidden - not a forwarded request", http.StatusForbidden)
+		return
+	}
+	if !tokensEqual(r.Header.Get(clusterTokenHeader), cfg.clusterSecret()) {
+		slog.Warn("rejected forwarded request without a valid token", "remote_addr", r.RemoteAddr, "forwarded_by", by)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// The mark moves to the context, as handlePublicRequest drops the
+	// headers along with any a public client sent
+	r = r.WithContext(context.WithValue(r.Context(), forwardedKey{}, by))
+	if ip := net.ParseIP(r.Header.Get(clientIPHeader)); ip != nil {
+		r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+	}
+	handlePublicRequest(w, r)
+}
+
+// validateNodeURL checks a URL other instances can forward requests to.
+func validateNodeURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid cluster node_url %q, want http(s)://host:port", s)
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// testRegistryContract checks what the cluster expects of any
+// ClusterRegistry.
+func testRegistryContract(t *testing.T, reg ClusterRegistry) {
+	t.Helper()
+	ctx := context.Background()
+	owner := func(name string) string {
+		t.Helper()
+		node, err := reg.Owner(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+
+	if node := owner("home"); node != "" {
+		t.Errorf("unclaimed name owned by %q", node)
+	}
+	if err := reg.Claim(ctx, "home", "http://a:7946", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if node := owner("home"); node != "http://a:7946" {
+		t.Errorf("owner %q after a's claim", node)
+	}
+	// The newest claim wins, and the old owner can't release it
+	reg.Claim(ctx, "home", "http://b:7946", time.Minute)
+	if err := reg.Release(ctx, "home", "http://a:7946"); err != nil {
+		t.Fatal(err)
+	}
+	if node := owner("home"); node != "http://b:7946" {
+		t.Errorf("owner %q after a released b's claim", node)
+	}
+	reg.Release(ctx, "home", "http://b:7946")
+	if node := owner("home"); node != "" {
+		t.Errorf("owner %q after release", node)
+	}
+
+	// A claim that isn't renewed expires
+	reg.Claim(ctx, "brief", "http://a:7946", 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if node := owner("brief"); node != "" {
+		t.Errorf("expired claim still owned by %q", node)
+	}
+}
+
+func TestMemoryRegistry(t *testing.T) {
+	testRegistryContract(t, newMemoryRegistry())
+}
+
+// fakeRedis serves the commands redisRegistry sends, from memory.
+type fakeRedis struct {
+	addr  string
+	delay time.Duration // before answering a GET
+
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+	conns   []net.Conn
+	setup   []string // AUTH and SELECT commands seen
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	f := &fakeRedis{addr: l.Addr().String(), values: make(map[string]string), expires: make(map[string]time.Time)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(f.dropConns)
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		cmd, err := readRedisReply(br)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, a := range cmd.([]any) {
+			args = append(args, a.(string))
+		}
+		if args[0] == "GET" && f.delay > 0 {
+			time.Sleep(f.delay)
+		}
+		fmt.Fprint(conn, f.exec(args))
+	}
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if exp, ok := f.expires[args[len(args)-1]]; ok && time.Now().After(exp) {
+		delete(f.values, args[len(args)-1])
+	}
+	switch args[0] {
+	case "AUTH", "SELECT":
+		f.setup = append(f.setup, fmt.Sprint(args))
+		return "+OK\r\n"
+	case "SET": // key value PX ms
+		ms, _ := strconv.Atoi(args[4])
+		f.values[args[1]] = args[2]
+		f.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return "+OK\r\n"
+	case "GET":
+		v, ok := f.values[args[1]]
+		if !ok || time.Now().After(f.expires[args[1]]) {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "EVAL": // the release script: script 1 key node
+		if f.values[args[3]] == args[4] {
+			delete(f.values, args[3])
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "EXEC": // a transaction with a failed command in the middle
+		return "*3\r\n+OK\r\n-ERR wrong type\r\n:1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (f *fakeRedis) connections() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.conns)
+}
+
+// dropConns closes every connection, as a restarted Redis would.
+func (f *fakeRedis) dropConns() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func TestRedisRegistry(t *testing.T) {
+	f := startFakeRedis(t)
+	reg, err := newRedisRegistry("redis://:pw@" + f.addr + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRegistryContract(t, reg)
+	if fmt.Sprint(f.setup) != "[[AUTH pw] [SELECT 2]]" {
+		t.Errorf("set up with %v", f.setup)
+	}
+	if n := f.connections(); n != 1 {
+		t.Errorf("one caller at a time dialled %d connections", n)
+	}
+
+	// After Redis drops the connection, the next call dials again
+	f.dropConns()
+	ctx := context.Background()
+	reg.Owner(ctx, "home")
+	if err := reg.Claim(ctx, "home", "http://a:7946", time.Minute); err != nil {
+		t.Errorf("after a dropped connection: %v", err)
+	}
+}
+
+func TestRedisRegistryPool(t *testing.T) {
+	f := startFakeRedis(t)
+	f.delay = 50 * time.Millisecond
+	reg, err := newRedisRegistry("redis://" + f.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lookups made at once don't queue up behind one another
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range redisPoolSize {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reg.Owner(context.Background(), "home")
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed >= redisPoolSize*f.delay/2 {
+		t.Errorf("%d lookups took %s, as if made one by one", redisPoolSize, elapsed)
+	}
+
+	// and the connections are kept for the next ones
+	dialled := f.connections()
+	for range 2 * redisPoolSize {
+		reg.Owner(context.Background(), "home")
+	}
+	if n := f.connections(); n != dialled {
+		t.Errorf("%d more connections dialled for lookups made one by one", n-dialled)
+	}
+}
+
+func TestRedisRegistryErrorInArray(t *testing.T) {
+	f := startFakeRedis(t)
+	reg, err := newRedisRegistry("redis://" + f.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := reg.do(ctx, "EXEC"); err == nil || err.Error() != "redis: ERR wrong type" {
+		t.Fatalf("EXEC: %v, want the failed command's error", err)
+	}
+
+	// The connection went back to the pool with nothing left to read
+	if err := reg.Claim(ctx, "home", "http://a:7946", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if owner, err := reg.Owner(ctx, "home"); owner != "http://a:7946" || err != nil {
+		t.Errorf("owner %q, %v after an error in an array", owner, err)
+	}
+	if n := f.connections(); n != 1 {
+		t.Errorf("dialled %d connections, want the first one reused", n)
+	}
+}
+
+func TestReadRedisReply(t *testing.T) {
+	for _, c := range []struct {
+		reply string
+		want  any
+		err   string
+	}{
+		{"+OK\r\n", "OK", ""},
+		{":42\r\n", int64(42), ""},
+		{"$5\r\nhello\r\n", "hello", ""},
+		{"$-1\r\n", nil, ""},
+		{"*2\r\n$1\r\na\r\n:1\r\n", []any{"a", int64(1)}, ""},
+		{"-ERR no\r\n", nil, "redis: ERR no"},
+		{"*3\r\n-ERR first\r\n-ERR second\r\n$2\r\nok\r\n", nil, "redis: ERR first"},
+		{"*2\r\n*1\r\n-ERR nested\r\n:1\r\n", nil, "redis: ERR nested"},
+	} {
+		// Each reply is followed by the next one's, which must be untouched
+		br := bufio.NewReader(strings.NewReader(c.reply + "+NEXT\r\n"))
+		got, err := readRedisReply(br)
+		if fmt.Sprint(got) != fmt.Sprint(c.want) || (err == nil) != (c.err == "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("%q: %#v, %v; want %#v, %s", c.reply, got, err, c.want, c.err)
+		}
+		if next, err := readRedisReply(br); next != "NEXT" || err != nil {
+			t.Errorf("%q: then read %#v, %v", c.reply, next, err)
+		}
+	}
+}
+
+// mockRegistry records what a clusterNode asks of it.
+type mockRegistry struct {
+	mu     sync.Mutex
+	calls  []string
+	owners map[string]string
+}
+
+func (m *mockRegistry) record(call string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, call)
+}
+
+func (m *mockRegistry) called(call string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.calls {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mockRegistry) Claim(ctx context.Context, name, node string, ttl time.Duration) error {
+	m.record(fmt.Sprintf("claim %s %s %s", name, node, ttl))
+	return nil
+}
+
+func (m *mockRegistry) Release(ctx context.Context, name, node string) error {
+	m.record(fmt.Sprintf("release %s %s", name, node))
+	return nil
+}
+
+func (m *mockRegistry) Owner(ctx context.Context, name string) (string, error) {
+	m.record("owner " + name)
+	return m.owners[name], nil
+}
+
+func TestClusterRegistryCalls(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	s := startServer(t, "-auth-token", "secret", "-node-url", "http://127.0.0.1:7946", "-cluster-addr", "127.0.0.1:0", "-cluster-ttl", "1m")
+	mock := &mockRegistry{owners: map[string]string{}}
+	cluster.registry = mock
+
+	c := s.connect(t, client.Options{Name: "home", Local: backend.URL})
+	if !mock.called("claim home http://127.0.0.1:7946 1m0s") {
+		t.Errorf("connecting made %q", mock.calls)
+	}
+
+	// A tunnel held here is served without asking; any other is looked up
+	get(t, mustRequest(t, s.url("home", "/")))
+	if mock.called("owner home") {
+		t.Error("looked up a tunnel connected here")
+	}
+	if code, _ := get(t, mustRequest(t, s.url("away", "/"))); code != http.StatusNotFound {
+		t.Errorf("unowned tunnel: %d", code)
+	}
+	if !mock.called("owner away") {
+		t.Error("didn't look up a tunnel connected nowhere here")
+	}
+
+	c.Stop()
+	waitFor(t, func() bool { return mock.called("release home http://127.0.0.1:7946") })
+}
+
+func TestMemoryRegistryWarns(t *testing.T) {
+	logs := captureLogs(t)
+	if _, err := newClusterNode(ClusterConfig{NodeURL: "http://127.0.0.1:7946", Registry: "memory", TTL: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	logs.line(t, "the memory cluster registry is only seen by this instance, so no requests will be forwarded between instances; use -cluster-registry redis")
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisKeyPrefix namespaces the claims in a shared Redis.
+const redisKeyPrefix = "intunja:tunnel:"
+
+// redisRelease deletes a claim only if it is still the caller's, so an
+// instance can't drop a claim another has since made.
+const redisRelease = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+
+// redisPoolSize is how many idle connections to Redis are kept for
+// reuse. Lookups for tunnels held elsewhere are made per request, so they
+// mustn't all wait on one connection.
+const redisPoolSize = 8
+
+// redisRegistry is a ClusterRegistry kept in Redis, as keys holding the
+// owning node's URL that expire with the claim. It speaks just enough of
+// the protocol for that over a small pool of connections; one is dropped
+// after an error.
+type redisRegistry struct {
+	addr     string
+	username string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+// newRedisRegistry uses the Redis at rawURL,
+// redis://[[user]:password@]host[:port][/db].
+func newRedisRegistry(rawURL string) (*redisRegistry, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis URL %q, want redis://[:password@]host[:port][/db]", rawURL)
+	}
+	r := &redisRegistry{addr: u.Host}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return r, nil
+}
+
+func (r *redisRegistry) Claim(ctx context.Context, name, node string, ttl time.Duration) error {
+	_, err := r.do(ctx, "SET", redisKeyPrefix+name, node, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (r *redisRegistry) Release(ctx context.Context, name, node string) error {
+	_, err := r.do(ctx, "EVAL", redisRelease, "1", redisKeyPrefix+name, node)
+	return err
+}
+
+func (r *redisRegistry) Owner(ctx context.Context, name string) (string, error) {
+	reply, err := r.do(ctx, "GET", redisKeyPrefix+name)
+	if err != nil {
+		return "", err
+	}
+	owner, _ := reply.(string) // nil if unclaimed
+	return owner, nil
+}
+
+// redisError is an error reply from Redis. The connection is still good
+// after one.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// do sends a command and returns its reply: a string, an int64, nil, or a
+// []any of those.
+func (r *redisRegistry) do(ctx context.Context, args ...string) (any, error) {
+	conn, err := r.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(clusterTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	reply, err := conn.roundTrip(args)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		// Whatever was left of the exchange is unreadable now
+		conn.Close()
+		return nil, err
+	}
+	r.put(conn)
+	return reply, err
+}
+
+// get takes an idle connection, or dials a new one if there is none.
+func (r *redisRegistry) get(ctx context.Context) (*redisConn, error) {
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		conn := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return conn, nil
+	}
+	r.mu.Unlock()
+	return r.connect(ctx)
+}
+
+// put keeps conn for reuse, unless the pool is full.
+func (r *redisRegistry) put(conn *redisConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.idle) >= redisPoolSize {
+		conn.Close()
+		return
+	}
+	r.idle = append(r.idle, conn)
+}
+
+// connect dials Redis and logs in and selects the database as the URL
+// said.
+func (r *redisRegistry) connect(ctx context.Context) (*redisConn, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	conn := &redisConn{Conn: nc, br: bufio.NewReader(nc)}
+
+	var setup [][]string
+	switch {
+	case r.username != "":
+		setup = append(setup, []string{"AUTH", r.username, r.password})
+	case r.password != "":
+		setup = append(setup, []string{"AUTH", r.password})
+	}
+	if r.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.db)})
+	}
+	for _, args := range setup {
+		if _, err := conn.roundTrip(args); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to set up redis connection: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisConn) roundTrip(args []string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.br)
+}
+
+func readRedisReply(br *bufio.Reader) (any, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	kind, rest := line[0], line[1:]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", rest)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad array length %q", rest)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		// An error in an element is the reply's, but only once the rest
+		// of it is read, or the next command would get it as its answer
+		items := make([]any, n)
+		var replyErr error
+		for i := range items {
+			items[i], err = readRedisReply(br)
+			var rerr redisError
+			switch {
+			case errors.As(err, &rerr):
+				if replyErr == nil {
+					replyErr = err
+				}
+			case err != nil:
+				return nil, err
+			}
+		}
+		if replyErr != nil {
+			return nil, replyErr
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/mindsgn-studio/intunja/internal/relay"
+	"golang.org/x/sync/singleflight"
+)
+
+// flights holds the -coalesce requests crossing the tunnel, by cache key.
+var flights singleflight.Group
+
+// fetchFunc sends a request through the tunnel, as roundTrip does.
+type fetchFunc func() (resp *http.Response, done func(), err error)
+
+// coalesce makes the first of a burst of identical cacheable requests to
+// key the only one to cross the tunnel, with fetch. If its response can be
+// cached, it is read in full and returned as shared to every request in
+// the burst. Otherwise the first request gets its own response, or error,
+// to deal with as usual, and the rest get nothing and must send their own.
+func coalesce(key string, r *http.Request, fetch fetchFunc) (shared *cacheEntry, leader bool, resp *http.Response, done func(), err error) {
+	v, _, _ := flights.Do(key, func() (any, error) {
+		leader = true
+		resp, done, err = fetch()
+		if err != nil {
+			return (*cacheEntry)(nil), nil
+		}
+		e := readShared(key, r, resp)
+		if e != nil {
+			done()
+			resp, done = nil, nil
+		}
+		return e, nil
+	})
+	shared = v.(*cacheEntry)
+	if shared != nil && !leader && !shared.matches(r) {
+		// The response varies on a header this request sent differently
+		return nil, false, nil, nil, nil
+	}
+	return shared, leader, resp, done, err
+}
+
+// readShared reads resp into an entry for key if it may be cached. A
+// response that may not, or that is over -max-response-bytes, keeps what
+// was read of its body.
+func readShared(key string, r *http.Request, resp *http.Response) *cacheEntry {
+	if _, ok := cacheTTL(resp); !ok || resp.ContentLength > maxCachedBody || overResponseLimit(resp.ContentLength) {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCachedBody+1))
+	if err != nil || len(body) > maxCachedBody || overResponseLimit(int64(len(body))) {
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+
+	// Set up the headers as forwardRequest would, leaving resp's alone
+	shared := *resp
+	shared.Header = resp.Header.Clone()
+	relay.RemoveHopByHop(shared.Header)
+	rewriteHeaders(shared.Header, r)
+	e := newCacheEntry(key, r, &shared, body)
+	if e == nil {
+		resp.Body = readCloser{bytes.NewReader(body), resp.Body}
+	}
+	return e
+}
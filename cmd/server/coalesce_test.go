@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// heldBackend answers every request once release is closed, with
+// Cache-Control set to cacheControl, and counts the requests it gets.
+func heldBackend(t *testing.T, cacheControl string) (*httptest.Server, *atomic.Int32, chan struct{}) {
+	t.Helper()
+	var hits atomic.Int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		io.WriteString(w, "report for "+r.URL.RawQuery)
+	}))
+	t.Cleanup(backend.Close)
+	return backend, &hits, release
+}
+
+// burst sends n identical requests at once and returns their bodies once
+// release has let the backend answer.
+func burst(n int, method, url string, release chan struct{}) []string {
+	bodies := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Go(func() {
+			req, _ := http.NewRequest(method, url, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				bodies[i] = err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			bodies[i] = string(body)
+		})
+	}
+	// Long enough for every request to join the first one
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return bodies
+}
+
+func TestCoalesceIdenticalGETs(t *testing.T) {
+	backend, hits, release := heldBackend(t, "max-age=60")
+	s := startServer(t, "-coalesce")
+	s.connect(t, client.Options{Name: "reports", Local: backend.URL})
+
+	bodies := burst(20, http.MethodGet, s.url("reports", "/daily?q=1"), release)
+	if n := hits.Load(); n != 1 {
+		t.Errorf("the tunnel saw %d of 20 identical GETs, want 1", n)
+	}
+	for i, body := range bodies {
+		if body != "report for q=1" {
+			t.Errorf("request %d got %q", i, body)
+		}
+	}
+}
+
+func TestCoalesceOnlyCacheable(t *testing.T) {
+	for _, c := range []struct {
+		name, method, cacheControl string
+	}{
+		{"uncacheable response", http.MethodGet, "no-store"},
+		{"POST", http.MethodPost, "max-age=60"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			backend, hits, release := heldBackend(t, c.cacheControl)
+			s := startServer(t, "-coalesce")
+			s.connect(t, client.Options{Name: "reports", Local: backend.URL})
+
+			bodies := burst(5, c.method, s.url("reports", "/daily?q=1"), release)
+			if n := hits.Load(); n != 5 {
+				t.Errorf("%s: the tunnel saw %d of 5 requests, want them all", c.name, n)
+			}
+			for i, body := range bodies {
+				if !strings.HasPrefix(body, "report for") {
+					t.Errorf("%s: request %d got %q", c.name, i, body)
+				}
+			}
+		})
+	}
+}
+
+func TestCoalesceOff(t *testing.T) {
+	backend, hits, release := heldBackend(t, "max-age=60")
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "reports", Local: backend.URL})
+
+	burst(5, http.MethodGet, s.url("reports", "/daily"), release)
+	if n := hits.Load(); n != 5 {
+		t.Errorf("without -coalesce the tunnel saw %d of 5 GETs", n)
+	}
+}
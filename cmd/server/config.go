@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/internal/relay"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Mode          string        `yaml:"mode"`
+	TunnelAddr    string        `yaml:"tunnel_addr"`
+	Transport     string        `yaml:"transport"`
+	PublicAddr    string        `yaml:"public_addr"`
+	AuthToken     string        `yaml:"auth_token"`
+	Domain        string        `yaml:"domain"`
+	TLS           TLSConfig     `yaml:"tls"`
+	HTTPS         HTTPSConfig   `yaml:"https"`
+	TCP           TCPConfig     `yaml:"tcp"`
+	Connect       ConnectConfig `yaml:"connect"`
+	CORS          CORSConfig    `yaml:"cors"`
+	Cluster       ClusterConfig `yaml:"cluster"`
+	H2C           bool          `yaml:"h2c"`
+	ProxyProtocol bool          `yaml:"proxy_protocol"`
+	MetricsAddr   string        `yaml:"metrics_addr"`
+	AdminAddr     string        `yaml:"admin_addr"`
+	Pprof         bool          `yaml:"pprof"`
+	OTLPEndpoint  string        `yaml:"otlp_endpoint"`
+	Record        string        `yaml:"record"`
+	OfflinePage   string        `yaml:"offline_page"`
+	WellKnown     bool          `yaml:"intercept_wellknown"`
+	RobotsTxt     string        `yaml:"robots_txt"`
+	BasicAuth     []string      `yaml:"basic_auth"`
+	Log           LogConfig     `yaml:"log"`
+
+	AllowCIDRs     []string `yaml:"allow_cidr"`
+	DenyCIDRs      []string `yaml:"deny_cidr"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	RewriteHeaders []string `yaml:"rewrite_headers"`
+
+	// Listeners are public listeners besides -public-addr, each with its
+	// own rules. They are only set in the config file.
+	Listeners []ListenerConfig `yaml:"listeners"`
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	DrainTimeout    time.Duration `yaml:"drain_timeout"`
+	RequestTimeout  time.Duration `yaml:"request_timeout"`
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	HeaderTimeout   time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	ReconnectGrace  time.Duration `yaml:"reconnect_grace"`
+	MaxLifetime     time.Duration `yaml:"max_tunnel_lifetime"`
+	PingInterval    time.Duration `yaml:"ping_interval"`
+	PingTimeout     time.Duration `yaml:"ping_timeout"`
+	TunnelIdle      time.Duration `yaml:"tunnel_idle_timeout"`
+	TCPKeepAlive    time.Duration `yaml:"tcp_keepalive"`
+	NoDelay         bool          `yaml:"nodelay"`
+	MaxConcurrent   int           `yaml:"max_concurrent"`
+	MaxTunnels      int           `yaml:"max_tunnels"`
+	BandwidthLimit  int64         `yaml:"bandwidth_limit"`
+	MaxBodyBytes    int64         `yaml:"max_body_bytes"`
+	MaxHeaderBytes  int           `yaml:"max_header_bytes"`
+	CopyBufferSize  int           `yaml:"copy_buffer_size"`
+	Compress        bool          `yaml:"compress"`
+	Rate            float64       `yaml:"rate"`
+	Burst           int           `yaml:"burst"`
+	CacheSize       int           `yaml:"cache_size"`
+	Coalesce        bool          `yaml:"coalesce"`
+
+	MaxResponseBytes  int64  `yaml:"max_response_bytes"`
+	MaxResponsePolicy string `yaml:"max_response_policy"`
+	RecompressLevel   int    `yaml:"recompress_level"`
+
+	HealthPath     string        `yaml:"health_path"`
+	HealthInterval time.Duration `yaml:"health_interval"`
+	HealthTimeout  time.Duration `yaml:"health_timeout"`
+
+	SharedTunnels  bool   `yaml:"shared_tunnels"`
+	Balance        string `yaml:"balance"`
+	AffinityCookie string `yaml:"affinity_cookie"`
+	AffinityHeader string `yaml:"affinity_header"`
+
+	// TunnelPort and PublicPort are the keys tunnel_addr and public_addr
+	// used to have, still read from older config files. loadFile moves
+	// them over and notes them in deprecated.
+	TunnelPort string `yaml:"tunnel_port"`
+	PublicPort string `yaml:"public_port"`
+	deprecated []deprecatedKey
+}
+
+// deprecatedKey is an old config key a file was found using.
+type deprecatedKey struct {
+	key, use string
+}
+
+// warnDeprecated logs the old keys the config file used. It waits for the
+// logger loadConfig runs before.
+func (c *Config) warnDeprecated() {
+	for _, d := range c.deprecated {
+		slog.Warn("deprecated config key", "key", d.key, "use", d.use)
+	}
+}
+
+type TLSConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"`
+}
+
+type HTTPSConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Addr      string `yaml:"addr"`
+	ACMECache string `yaml:"acme_cache"`
+}
+
+type TCPConfig struct {
+	Addr   string `yaml:"addr"`
+	Tunnel string `yaml:"tunnel"`
+}
+
+type ConnectConfig struct {
+	Allow  []string `yaml:"allow"`
+	Tunnel string   `yaml:"tunnel"`
+}
+
+// CORSConfig turns on CORS handling at the public server when Origins is
+// set. Headers left empty allows whatever a preflight asks for.
+type CORSConfig struct {
+	Origins []string `yaml:"origins"`
+	Methods []string `yaml:"methods"`
+	Headers []string `yaml:"headers"`
+}
+
+// ClusterConfig lets several instances behind one load balancer forward
+// requests for tunnels connected to each other over a listener of their
+// own. Setting NodeURL turns it on.
+type ClusterConfig struct {
+	Addr string `yaml:"addr"`
+	// NodeURL is the cluster listener at Addr as the others reach it.
+	NodeURL string `yaml:"node_url"`
+	// Registry is where the instances record their tunnels: memory, for
+	// one instance, or redis.
+	Registry string        `yaml:"registry"`
+	Redis    string        `yaml:"redis"`
+	TTL      time.Duration `yaml:"ttl"`
+	// Token is the secret the instances present to each other; the auth
+	// token if empty.
+	Token string `yaml:"token"`
+}
+
+// clusterSecret is what instances present to each other's cluster
+// listeners.
+func (c *Config) clusterSecret() string {
+	if c.Cluster.Token != "" {
+		return c.Cluster.Token
+	}
+	return c.AuthToken
+}
+
+type LogConfig struct {
+	Format string   `yaml:"format"`
+	Level  string   `yaml:"level"`
+	Bodies int      `yaml:"bodies"`
+	Redact []string `yaml:"redact"`
+
+	Access        string  `yaml:"access"`
+	AccessSample  float64 `yaml:"access_sample"`
+	AccessMaxSize int64   `yaml:"access_max_size"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Mode:       "http",
+		TunnelAddr: ":8080",
+		Transport:  "tcp",
+		PublicAddr: ":9090",
+		HTTPS: HTTPSConfig{
+			Addr:      ":443",
+			ACMECache: "certs",
+		},
+		TCP: TCPConfig{
+			Addr:   ":9091",
+			Tunnel: "default",
+		},
+		Connect: ConnectConfig{
+			Tunnel: "default",
+		},
+		Log: LogConfig{
+			Format:       "text",
+			Level:        "info",
+			AccessSample: 1,
+			Redact:       []string{"Authorization", "Cookie", "Set-Cookie"},
+		},
+		ShutdownTimeout: 30 * time.Second,
+		DrainTimeout:    30 * time.Second,
+		RequestTimeout:  60 * time.Second,
+		HeaderTimeout:   10 * time.Second,
+		IdleTimeout:     2 * time.Minute,
+		PingInterval:    10 * time.Second,
+		PingTimeout:     5 * time.Second,
+		TunnelIdle:      30 * time.Second,
+		TCPKeepAlive:    15 * time.Second,
+		NoDelay:         true,
+		MaxConcurrent:   1000,
+		CopyBufferSize:  relay.DefaultBufferSize,
+		MaxHeaderBytes:  1 << 20,
+		Burst:           20,
+		Balance:         "affinity",
+		AffinityHeader:  "X-Session",
+		HealthInterval:  30 * time.Second,
+		HealthTimeout:   5 * time.Second,
+		CORS: CORSConfig{
+			Methods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+		},
+		Cluster: ClusterConfig{
+			Registry: "memory",
+			TTL:      30 * time.Second,
+		},
+		MaxResponsePolicy: "fail",
+	}
+}
+
+// loadConfig builds the configuration from defaults, then the -config file
+// if one is given, then any flags set on the command line.
+func loadConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := defaultConfig()
+
+	// The file has to be read before parsing so its values become the
+	// flag defaults, letting explicitly set flags win.
+	if path := configPath(args); path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	fs.String("config", "", "YAML config file; flags override its values")
+	cfg.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if cfg.AuthToken == "" {
+		cfg.AuthToken = os.Getenv("INTUNJA_TOKEN")
+	}
+	if cfg.OTLPEndpoint == "" {
+		cfg.OTLPEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Mode, "mode", c.Mode, "Tunnel mode: http, or tcp to also forward raw TCP connections")
+	fs.StringVar(&c.TunnelAddr, "tunnel-addr", c.TunnelAddr, "Listen address for tunnel clients, as host:port")
+	fs.StringVar(&c.PublicAddr, "public-addr", c.PublicAddr, "Listen address for the public API, as host:port")
+	fs.StringVar(&c.Transport, "transport", c.Transport, "Tunnel transport: tcp, or quic to accept tunnels over QUIC on UDP (requires -tls)")
+	fs.StringVar(&c.TunnelAddr, "tunnel-port", c.TunnelAddr, "Deprecated: use -tunnel-addr")
+	fs.StringVar(&c.PublicAddr, "public-port", c.PublicAddr, "Deprecated: use -public-addr")
+	fs.StringVar(&c.AuthToken, "auth-token", c.AuthToken, "Shared secret tunnel clients must present (default $INTUNJA_TOKEN)")
+	fs.StringVar(&c.Domain, "domain", c.Domain, "Base domain for subdomain routing, e.g. example.com")
+	fs.BoolVar(&c.TLS.Enabled, "tls", c.TLS.Enabled, "Serve the tunnel listener over TLS")
+	fs.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "TLS certificate file for the tunnel listener")
+	fs.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "TLS key file for the tunnel listener")
+	fs.StringVar(&c.TLS.ClientCA, "tls-client-ca", c.TLS.ClientCA, "Require tunnel clients to present a certificate signed by a CA in this PEM file, and name them by its common name")
+	fs.BoolVar(&c.HTTPS.Enabled, "https", c.HTTPS.Enabled, "Serve the public API over HTTPS with Let's Encrypt certificates (requires -domain)")
+	fs.BoolVar(&c.H2C, "h2c", c.H2C, "Also accept unencrypted HTTP/2 on the public listener")
+	fs.BoolVar(&c.ProxyProtocol, "proxy-protocol", c.ProxyProtocol, "Take client addresses from PROXY protocol v1/v2 headers sent by a load balancer in front of the public listeners")
+	fs.StringVar(&c.HTTPS.Addr, "https-addr", c.HTTPS.Addr, "Listen address for the public HTTPS server")
+	fs.StringVar(&c.HTTPS.ACMECache, "acme-cache", c.HTTPS.ACMECache, "Directory to cache ACME certificates in")
+	fs.StringVar(&c.TCP.Addr, "tcp-addr", c.TCP.Addr, "Listen address for raw TCP connections in tcp mode")
+	fs.StringVar(&c.TCP.Tunnel, "tcp-tunnel", c.TCP.Tunnel, "Tunnel that raw TCP connections are forwarded to in tcp mode")
+	fs.Var(&stringList{values: &c.Connect.Allow}, "connect-allow", "Let public clients CONNECT to this host:port through the tunnel; * or *.domain hosts and * ports match more (repeatable)")
+	fs.StringVar(&c.Connect.Tunnel, "connect-tunnel", c.Connect.Tunnel, "Tunnel whose client dials CONNECT targets")
+	fs.Var(&stringList{values: &c.AllowCIDRs}, "allow-cidr", "Only accept public requests from this network (repeatable)")
+	fs.Var(&stringList{values: &c.DenyCIDRs}, "deny-cidr", "Refuse public requests from this network (repeatable)")
+	fs.Var(&stringList{values: &c.TrustedProxies}, "trusted-proxy", "Trust X-Forwarded-For from this network (repeatable)")
+	fs.Var(&commaList{values: &c.TrustedProxies}, "trusted-proxies", "Comma-separated networks to trust X-Forwarded-For from; it is dropped from any other peer")
+	fs.Var(&stringList{values: &c.RewriteHeaders}, "rewrite-header", "Replace text in a response header as Name:from=>to, where {host} in to is the public host (repeatable)")
+	fs.Var(&commaList{values: &c.CORS.Origins}, "cors-origins", "Answer CORS preflights at the edge for these comma-separated origins, or *")
+	fs.Var(&commaList{values: &c.CORS.Methods}, "cors-methods", "Comma-separated methods allowed by -cors-origins preflights")
+	fs.Var(&commaList{values: &c.CORS.Headers}, "cors-headers", "Comma-separated request headers allowed by -cors-origins preflights (default whatever is asked for)")
+	fs.StringVar(&c.Cluster.Addr, "cluster-addr", c.Cluster.Addr, "Listen address for requests other instances forward for tunnels connected here")
+	fs.StringVar(&c.Cluster.NodeURL, "node-url", c.Cluster.NodeURL, "The -cluster-addr listener as other instances reach it, e.g. http://10.0.0.5:7946; turns on forwarding requests between instances")
+	fs.StringVar(&c.Cluster.Registry, "cluster-registry", c.Cluster.Registry, "Where instances record which tunnels they hold: redis, or memory, which only this instance sees (testing only)")
+	fs.StringVar(&c.Cluster.Redis, "redis-url", c.Cluster.Redis, "Redis for -cluster-registry redis, as redis://[:password@]host[:port][/db]")
+	fs.StringVar(&c.Cluster.Token, "cluster-token", c.Cluster.Token, "Secret instances present to each other's -cluster-addr listeners (default -auth-token)")
+	fs.DurationVar(&c.Cluster.TTL, "cluster-ttl", c.Cluster.TTL, "How long an instance's claim on a tunnel outlives it if it stops renewing")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "Serve /metrics on this address instead of the public listener")
+	fs.StringVar(&c.AdminAddr, "admin-addr", c.AdminAddr, "Serve the admin API on this address (requires -auth-token)")
+	fs.BoolVar(&c.Pprof, "pprof", c.Pprof, "Serve runtime profiles at /debug/pprof/ on the admin API")
+	fs.Var(&stringList{values: &c.BasicAuth}, "basic-auth", "Ask public clients for this user:pass with HTTP Basic auth (repeatable)")
+	fs.StringVar(&c.OfflinePage, "offline-page", c.OfflinePage, "Answer requests for tunnels that aren't connected with this HTML or JSON file and a 503")
+	fs.BoolVar(&c.WellKnown, "intercept-wellknown", c.WellKnown, "Answer /robots.txt and /favicon.ico (with 204) here instead of through the tunnels")
+	fs.StringVar(&c.RobotsTxt, "robots-txt", c.RobotsTxt, "File served as /robots.txt with -intercept-wellknown (default disallows everything)")
+	fs.StringVar(&c.Record, "record", c.Record, "Append every public request to this file, as JSON lines for the replay subcommand")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", c.OTLPEndpoint, "Export request traces to this OTLP/HTTP collector, e.g. http://localhost:4318 (default $OTEL_EXPORTER_OTLP_ENDPOINT)")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "Log format: text or json")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "Minimum log level: debug, info, warn or error")
+	fs.IntVar(&c.Log.Bodies, "log-bodies", c.Log.Bodies, "Log up to this many bytes of each request and response body; 0 disables")
+	fs.StringVar(&c.Log.Access, "access-log", c.Log.Access, "Write a JSON line per public request to this file, or - for stdout")
+	fs.Float64Var(&c.Log.AccessSample, "access-log-sample", c.Log.AccessSample, "Fraction of requests written to -access-log, from 0 to 1; 5xx and aborted responses always are")
+	fs.Int64Var(&c.Log.AccessMaxSize, "access-log-max-size", c.Log.AccessMaxSize, "Rotate -access-log to FILE.1 once it would grow past this many bytes; 0 never rotates")
+	fs.Var(&stringList{values: &c.Log.Redact}, "redact-header", "Header whose values are logged as *** with -log-bodies (repeatable; default Authorization, Cookie, Set-Cookie)")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "How long to wait for in-flight requests when shutting down")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", c.DrainTimeout, "How long a replaced or rotated tunnel gets to finish its in-flight requests before it is closed")
+	fs.DurationVar(&c.RequestTimeout, "request-timeout", c.RequestTimeout, "How long to wait for a tunnel to start responding; 0 for no limit")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "How long a public client gets to send a whole request, body included; 0 for no limit")
+	fs.DurationVar(&c.HeaderTimeout, "read-header-timeout", c.HeaderTimeout, "How long a public client gets to send request headers; 0 for no limit")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "How long a public response may take to send, streams included; 0 for no limit")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "How long an idle public keep-alive connection is kept open; 0 uses -read-timeout")
+	fs.DurationVar(&c.ReconnectGrace, "reconnect-grace", c.ReconnectGrace, "How long to hold requests for a tunnel that dropped, such as a client restarting, waiting for it to reconnect; 0 answers at once")
+	fs.DurationVar(&c.MaxLifetime, "max-tunnel-lifetime", c.MaxLifetime, "Make each tunnel client reconnect and authenticate again after this long, once its in-flight requests finish; 0 for no limit")
+	fs.DurationVar(&c.PingInterval, "ping-interval", c.PingInterval, "How often to ping each tunnel client; 0 to disable")
+	fs.DurationVar(&c.PingTimeout, "ping-timeout", c.PingTimeout, "Disconnect a tunnel whose client doesn't answer a ping within this long")
+	fs.DurationVar(&c.TunnelIdle, "tunnel-idle-timeout", c.TunnelIdle, "Evict a tunnel that sends nothing, not even a ping answer, for this long; 0 to disable")
+	fs.DurationVar(&c.TCPKeepAlive, "keepalive-period", c.TCPKeepAlive, "TCP keep-alive probe period on tunnel connections; 0 to disable")
+	fs.BoolVar(&c.NoDelay, "nodelay", c.NoDelay, "Set TCP_NODELAY on tunnel connections so small responses aren't held back")
+	fs.IntVar(&c.MaxConcurrent, "max-concurrent", c.MaxConcurrent, "Maximum public requests forwarded at once; 0 for no limit")
+	fs.Int64Var(&c.BandwidthLimit, "bandwidth-limit", c.BandwidthLimit, "Maximum bytes per second each tunnel may move each way; 0 for no limit")
+	fs.IntVar(&c.MaxTunnels, "max-tunnels", c.MaxTunnels, "Maximum tunnel connections registered at once, counting each client sharing a name; a client replacing its name's connection keeps its place; 0 for no limit")
+	fs.Int64Var(&c.MaxBodyBytes, "max-body-bytes", c.MaxBodyBytes, "Reject request bodies larger than this many bytes; 0 for no limit")
+	fs.Int64Var(&c.MaxResponseBytes, "max-response-bytes", c.MaxResponseBytes, "Stop response bodies at this many bytes, as -max-response-policy says, counting both sides of -recompress-level decoding; 0 for no limit")
+	fs.StringVar(&c.MaxResponsePolicy, "max-response-policy", c.MaxResponsePolicy, "What to do with a response over -max-response-bytes: fail, answering 502 or cutting it off, or truncate")
+	fs.IntVar(&c.RecompressLevel, "recompress-level", c.RecompressLevel, "Decompress gzipped responses, counting their size, and gzip them again at this level (1-9) for public clients that accept it; 0 passes them on as they are")
+	fs.IntVar(&c.MaxHeaderBytes, "max-header-bytes", c.MaxHeaderBytes, "Largest response head in bytes accepted from a tunnel")
+	fs.IntVar(&c.CopyBufferSize, "copy-buffer-size", c.CopyBufferSize, "Buffer size in bytes for copying response bodies and spliced connections")
+	fs.Float64Var(&c.Rate, "rate", c.Rate, "Requests per second allowed through each tunnel; 0 for no limit")
+	fs.IntVar(&c.Burst, "burst", c.Burst, "Requests a tunnel may burst above -rate")
+	fs.IntVar(&c.CacheSize, "cache-size", c.CacheSize, "Number of cacheable GET responses to keep in memory; 0 disables caching")
+	fs.BoolVar(&c.Coalesce, "coalesce", c.Coalesce, "Send only one of a burst of identical cacheable GETs through the tunnel and share its response with the rest")
+	fs.StringVar(&c.HealthPath, "health-path", c.HealthPath, "Check each tunnel's home API by requesting this path through it, marking the tunnel degraded unless it answers 2xx")
+	fs.DurationVar(&c.HealthInterval, "health-interval", c.HealthInterval, "How often to check each tunnel's home API with -health-path")
+	fs.DurationVar(&c.HealthTimeout, "health-timeout", c.HealthTimeout, "How long a -health-path check may take before the tunnel is marked degraded")
+	fs.BoolVar(&c.SharedTunnels, "shared-tunnels", c.SharedTunnels, "Let several clients register the same tunnel name and share its requests, instead of the newest replacing the rest")
+	fs.StringVar(&c.Balance, "balance", c.Balance, "How a shared tunnel's requests are spread over its clients: affinity, roundrobin or random")
+	fs.StringVar(&c.AffinityCookie, "affinity-cookie", c.AffinityCookie, "Cookie that keeps a public client on one of a shared tunnel's clients with -balance affinity")
+	fs.StringVar(&c.AffinityHeader, "affinity-header", c.AffinityHeader, "Header that keeps a public client on one of a shared tunnel's clients with -balance affinity, if -affinity-cookie isn't sent")
+	fs.BoolVar(&c.Compress, "compress", c.Compress, "Let tunnel clients gzip their connection when they ask to")
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+
+	// Variables are expanded in the parsed values rather than the text,
+	// so whatever they hold stays inside the value that refers to them.
+	// The tree is written out again to decode it with unknown fields
+	// rejected, which decoding a node can't do.
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		return nil
+	}
+	if err := expandEnv(&doc); err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if data, err = yaml.Marshal(&doc); err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	tunnelAddr, publicAddr := c.TunnelAddr, c.PublicAddr
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	// The new key wins if a file has both
+	for _, old := range []struct {
+		key, use  string
+		value     *string
+		addr      *string
+		unchanged string
+	}{
+		{"tunnel_port", "tunnel_addr", &c.TunnelPort, &c.TunnelAddr, tunnelAddr},
+		{"public_port", "public_addr", &c.PublicPort, &c.PublicAddr, publicAddr},
+	} {
+		if *old.value == "" {
+			continue
+		}
+		if *old.addr == old.unchanged {
+			*old.addr = *old.value
+		}
+		*old.value = ""
+		c.deprecated = append(c.deprecated, deprecatedKey{old.key, old.use})
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	var errs []error
+	if c.Mode != "http" && c.Mode != "tcp" {
+		errs = append(errs, fmt.Errorf("unknown mode %q, want http or tcp", c.Mode))
+	}
+	switch c.Transport {
+	case "tcp":
+	case "quic":
+		if !c.TLS.Enabled {
+			errs = append(errs, errors.New("quic transport requires tls"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown transport %q, want tcp or quic", c.Transport))
+	}
+	switch c.MaxResponsePolicy {
+	case "fail", "truncate":
+	default:
+		errs = append(errs, fmt.Errorf("unknown max_response_policy %q, want fail or truncate", c.MaxResponsePolicy))
+	}
+	if c.RecompressLevel < 0 || c.RecompressLevel > 9 {
+		errs = append(errs, fmt.Errorf("recompress_level must be between 0 and 9, got %d", c.RecompressLevel))
+	}
+	if c.MaxResponseBytes < 0 {
+		errs = append(errs, errors.New("max_response_bytes must not be negative"))
+	}
+	switch c.Balance {
+	case "affinity", "roundrobin", "random":
+	default:
+		errs = append(errs, fmt.Errorf("unknown balance %q, want affinity, roundrobin or random", c.Balance))
+	}
+	if c.Mode == "tcp" && (c.TCP.Addr == "" || c.TCP.Tunnel == "") {
+		errs = append(errs, errors.New("tcp mode requires tcp addr and tunnel"))
+	}
+	if c.TunnelAddr == "" {
+		errs = append(errs, errors.New("tunnel_addr is required"))
+	}
+	if c.PublicAddr == "" {
+		errs = append(errs, errors.New("public_addr is required"))
+	}
+	for _, a := range []struct{ name, addr string }{
+		{"tunnel_addr", c.TunnelAddr},
+		{"public_addr", c.PublicAddr},
+		{"https.addr", c.HTTPS.Addr},
+		{"tcp.addr", c.TCP.Addr},
+		{"metrics_addr", c.MetricsAddr},
+		{"admin_addr", c.AdminAddr},
+	} {
+		if a.addr == "" {
+			continue
+		}
+		if err := checkListenAddr(a.addr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", a.name, err))
+		}
+	}
+	if c.TLS.Enabled && (c.TLS.Cert == "" || c.TLS.Key == "") {
+		errs = append(errs, errors.New("tls requires both cert and key"))
+	}
+	if c.TLS.ClientCA != "" && !c.TLS.Enabled {
+		errs = append(errs, errors.New("tls client_ca requires tls"))
+	}
+	if c.Pprof && c.AdminAddr == "" {
+		errs = append(errs, errors.New("pprof requires admin_addr"))
+	}
+	if c.RobotsTxt != "" && !c.WellKnown {
+		errs = append(errs, errors.New("robots_txt requires intercept_wellknown"))
+	}
+	if c.AdminAddr != "" && c.AuthToken == "" {
+		errs = append(errs, errors.New("admin_addr requires auth_token"))
+	}
+	for _, target := range c.Connect.Allow {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			errs = append(errs, fmt.Errorf("invalid connect allow entry: %w", err))
+		}
+	}
+	for _, cidrs := range [][]string{c.AllowCIDRs, c.DenyCIDRs, c.TrustedProxies} {
+		if _, err := parseCIDRs(cidrs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if !validBandwidth(c.BandwidthLimit) {
+		errs = append(errs, fmt.Errorf("bandwidth_limit must be 0 or at least %d bytes per second", minBandwidth))
+	}
+	if err := validAccessSample(c.Log.AccessSample); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Log.AccessMaxSize < 0 {
+		errs = append(errs, errors.New("access_max_size must not be negative"))
+	}
+	if err := parseBasicAuth(c.BasicAuth); err != nil {
+		errs = append(errs, err)
+	}
+	for i, l := range c.Listeners {
+		if l.AuthToken != "" && len(c.BasicAuth) > 0 {
+			errs = append(errs, fmt.Errorf("listeners[%d]: auth_token and basic_auth both use the Authorization header", i))
+		}
+		if err := checkListenAddr(l.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid listeners[%d].addr: %w", i, err))
+		}
+		for _, cidrs := range [][]string{l.AllowCIDRs, l.DenyCIDRs} {
+			if _, err := parseCIDRs(cidrs); err != nil {
+				errs = append(errs, fmt.Errorf("listeners[%d]: %w", i, err))
+			}
+		}
+		for _, name := range l.Tunnels {
+			if !tunnelNamePattern.MatchString(name) {
+				errs = append(errs, fmt.Errorf("listeners[%d]: invalid tunnel name %q", i, name))
+			}
+		}
+	}
+	if c.HealthPath != "" {
+		if !strings.HasPrefix(c.HealthPath, "/") {
+			errs = append(errs, fmt.Errorf("health_path %q must start with /", c.HealthPath))
+		}
+		if c.Mode != "http" {
+			errs = append(errs, errors.New("health_path only works in http mode"))
+		}
+		if c.HealthInterval <= 0 || c.HealthTimeout <= 0 {
+			errs = append(errs, errors.New("health_path requires a positive health_interval and health_timeout"))
+		}
+	}
+	if len(c.CORS.Origins) > 0 && len(c.CORS.Methods) == 0 {
+		errs = append(errs, errors.New("cors origins need at least one method"))
+	}
+	for _, o := range c.CORS.Origins {
+		if o != "*" && !strings.Contains(o, "://") {
+			errs = append(errs, fmt.Errorf("invalid cors origin %q, want scheme://host[:port] or *", o))
+		}
+	}
+	if c.Cluster.NodeURL != "" {
+		if err := validateNodeURL(c.Cluster.NodeURL); err != nil {
+			errs = append(errs, err)
+		}
+		if c.Cluster.Addr == "" {
+			errs = append(errs, errors.New("cluster node_url requires a cluster addr to listen on"))
+		}
+		if c.clusterSecret() == "" {
+			errs = append(errs, errors.New("cluster node_url requires a cluster token or auth_token, or anyone could send requests to the cluster listener"))
+		}
+		switch c.Cluster.Registry {
+		case "memory":
+		case "redis":
+			if _, err := newRedisRegistry(c.Cluster.Redis); err != nil {
+				errs = append(errs, err)
+			}
+		default:
+			errs = append(errs, fmt.Errorf("unknown cluster registry %q, want memory or redis", c.Cluster.Registry))
+		}
+		if c.Cluster.TTL <= 0 {
+			errs = append(errs, errors.New("cluster ttl must be positive"))
+		}
+	}
+	if c.MaxHeaderBytes <= 0 {
+		errs = append(errs, errors.New("max_header_bytes must be positive"))
+	}
+	if c.CopyBufferSize <= 0 {
+		errs = append(errs, errors.New("copy_buffer_size must be positive"))
+	}
+	if c.TunnelIdle > 0 && c.PingInterval > 0 && c.TunnelIdle <= c.PingInterval {
+		errs = append(errs, errors.New("tunnel_idle_timeout must be longer than ping_interval"))
+	}
+	if _, err := parseHeaderRewrites(c.RewriteHeaders); err != nil {
+		errs = append(errs, err)
+	}
+	if c.HTTPS.Enabled && c.Domain == "" {
+		errs = append(errs, errors.New("https requires domain"))
+	}
+	return errors.Join(errs...)
+}
+
+// envRef matches a ${NAME} reference in the config file, optionally
+// followed by :-default or :?message.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?:(:[-?])([^}]*))?\}`)
+
+// expandEnv replaces ${NAME} in the config's scalar values with the
+// environment variable's value, or "" if it is unset, as os.ExpandEnv
+// does. ${NAME:-default} falls back to default if NAME is unset or empty,
+// and ${NAME:?message} is an error then. A bare $NAME is left alone, so
+// secrets like passwords can hold a $. Keys aren't expanded.
+func expandEnv(node *yaml.Node) error {
+	var errs []error
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		switch n.Kind {
+		case yaml.DocumentNode, yaml.SequenceNode:
+			for _, c := range n.Content {
+				walk(c)
+			}
+		case yaml.MappingNode:
+			for i := 1; i < len(n.Content); i += 2 {
+				walk(n.Content[i])
+			}
+		case yaml.ScalarNode:
+			value := envRef.ReplaceAllStringFunc(n.Value, func(ref string) string {
+				m := envRef.FindStringSubmatch(ref)
+				name, op, arg := m[1], m[2], m[3]
+				if value := os.Getenv(name); value != "" {
+					return value
+				}
+				switch op {
+				case ":-":
+					return arg
+				case ":?":
+					if arg == "" {
+						arg = "not set"
+					}
+					errs = append(errs, fmt.Errorf("required variable %s: %s", name, arg))
+				}
+				return ""
+			})
+			// A plain value is resolved again from what it now holds,
+			// so ${PORT} can fill in a number
+			if value != n.Value && n.Style&(yaml.TaggedStyle|yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+				n.Tag = ""
+			}
+			n.Value = value
+		}
+		// An alias shares its anchor's node, expanded where it's defined
+	}
+	walk(node)
+	return errors.Join(errs...)
+}
+
+// checkListenAddr catches a malformed host:port before anything is bound,
+// so a typo is reported with the rest of the config errors. An empty host
+// listens on every interface and port 0 picks a free port.
+func checkListenAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return fmt.Errorf("unknown host %q", host)
+		}
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("bad port %q", port)
+	}
+	return nil
+}
+
+// stringList is a repeatable flag. Values from the config file are
+// replaced, not added to, once the flag is given.
+type stringList struct {
+	values *[]string
+	set    bool
+}
+
+func (l *stringList) String() string {
+	if l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	if !l.set {
+		*l.values = nil
+		l.set = true
+	}
+	*l.values = append(*l.values, v)
+	return nil
+}
+
+// commaList is a flag holding a comma-separated list, which replaces any
+// from the config file.
+type commaList struct {
+	values *[]string
+}
+
+func (l *commaList) String() string {
+	if l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l *commaList) Set(v string) error {
+	*l.values = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l.values = append(*l.values, item)
+		}
+	}
+	return nil
+}
+
+// configPath finds the -config flag's value without parsing the rest.
+func configPath(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file holding yaml and returns its path.
+func writeConfig(t testing.TB, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "intunja.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func parseConfig(args ...string) (*Config, error) {
+	return loadConfig(flag.NewFlagSet("intunja", flag.ContinueOnError), args)
+}
+
+func TestConfigFile(t *testing.T) {
+	path := writeConfig(t, `
+mode: http
+tunnel_addr: 127.0.0.1:7000
+public_addr: 127.0.0.1:7001
+auth_token: file-token
+domain: example.com
+tls:
+  enabled: true
+  cert: /etc/intunja/cert.pem
+  key: /etc/intunja/key.pem
+request_timeout: 15s
+max_concurrent: 10
+`)
+	c, err := parseConfig("-config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := defaultConfig()
+	want.TunnelAddr = "127.0.0.1:7000"
+	want.PublicAddr = "127.0.0.1:7001"
+	want.AuthToken = "file-token"
+	want.Domain = "example.com"
+	want.TLS = TLSConfig{Enabled: true, Cert: "/etc/intunja/cert.pem", Key: "/etc/intunja/key.pem"}
+	want.RequestTimeout = 15 * time.Second
+	want.MaxConcurrent = 10
+	if c.TunnelAddr != want.TunnelAddr || c.PublicAddr != want.PublicAddr || c.AuthToken != want.AuthToken ||
+		c.Domain != want.Domain || c.TLS != want.TLS || c.RequestTimeout != want.RequestTimeout ||
+		c.MaxConcurrent != want.MaxConcurrent {
+		t.Errorf("loaded %+v\nwant %+v", c, want)
+	}
+	// Anything the file leaves out keeps its default
+	if c.ShutdownTimeout != want.ShutdownTimeout || c.Balance != want.Balance {
+		t.Errorf("defaults lost: shutdown_timeout %s, balance %q", c.ShutdownTimeout, c.Balance)
+	}
+}
+
+func TestConfigFlagsOverrideFile(t *testing.T) {
+	path := writeConfig(t, `
+public_addr: 127.0.0.1:7001
+auth_token: file-token
+domain: example.com
+`)
+	c, err := parseConfig("-config", path, "-auth-token", "flag-token", "-public-addr", "127.0.0.1:7002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AuthToken != "flag-token" || c.PublicAddr != "127.0.0.1:7002" {
+		t.Errorf("flags didn't win: auth_token %q, public_addr %q", c.AuthToken, c.PublicAddr)
+	}
+	if c.Domain != "example.com" {
+		t.Errorf("domain = %q, want the file's example.com", c.Domain)
+	}
+	if c.TunnelAddr != defaultConfig().TunnelAddr {
+		t.Errorf("tunnel_addr = %q, want the default", c.TunnelAddr)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{"malformed", "tunnel_addr: [unclosed\n", "invalid config"},
+		{"unknown field", "tunnel_adress: :7000\n", "field tunnel_adress not found"},
+		{"wrong type", "max_concurrent: lots\n", "invalid config"},
+		{"failed validation", "mode: udp\ntls:\n  enabled: true\n", "unknown mode \"udp\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig("-config", writeConfig(t, tt.yaml))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+
+	// Every problem is reported at once
+	_, err := parseConfig("-config", writeConfig(t, "mode: udp\ntls:\n  enabled: true\n"))
+	if err == nil || !strings.Contains(err.Error(), "tls requires both cert and key") {
+		t.Errorf("error = %v, want the tls error too", err)
+	}
+
+	if _, err := parseConfig("-config", filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing config file accepted")
+	}
+}
+
+func TestConfigEnvExpansion(t *testing.T) {
+	t.Setenv("INTUNJA_TEST_TOKEN", "from-env")
+	t.Setenv("INTUNJA_TEST_EMPTY", "")
+	c, err := parseConfig("-config", writeConfig(t, `
+auth_token: ${INTUNJA_TEST_TOKEN}
+domain: ${INTUNJA_TEST_UNSET:-example.com}
+public_addr: 127.0.0.1:${INTUNJA_TEST_EMPTY:-7001}
+offline_page: ${INTUNJA_TEST_UNSET}
+basic_auth: ["admin:pa$$word"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct{ name, got, want string }{
+		{"resolved", c.AuthToken, "from-env"},
+		{"default for unset", c.Domain, "example.com"},
+		{"default for empty", c.PublicAddr, "127.0.0.1:7001"},
+		{"unset", c.OfflinePage, ""},
+		{"bare $", c.BasicAuth[0], "admin:pa$$word"},
+	} {
+		if f.got != f.want {
+			t.Errorf("%s: %q, want %q", f.name, f.got, f.want)
+		}
+	}
+}
+
+func TestConfigEnvRequired(t *testing.T) {
+	t.Setenv("INTUNJA_TEST_EMPTY", "")
+	_, err := parseConfig("-config", writeConfig(t, `
+auth_token: ${INTUNJA_TEST_UNSET:?set it to the shared secret}
+domain: ${INTUNJA_TEST_EMPTY:?}
+`))
+	if err == nil {
+		t.Fatal("missing required variables accepted")
+	}
+	for _, want := range []string{
+		"required variable INTUNJA_TEST_UNSET: set it to the shared secret",
+		"required variable INTUNJA_TEST_EMPTY: not set",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q, want it to contain %q", err, want)
+		}
+	}
+
+	t.Setenv("INTUNJA_TEST_UNSET", "secret")
+	t.Setenv("INTUNJA_TEST_EMPTY", "example.com")
+	c, err := parseConfig("-config", writeConfig(t, "auth_token: ${INTUNJA_TEST_UNSET:?required}\n"))
+	if err != nil {
+		t.Errorf("set required variable: %v", err)
+	} else if c.AuthToken != "secret" {
+		t.Errorf("set required variable: %q", c.AuthToken)
+	}
+}
+
+func TestConfigEnvValuesStayPut(t *testing.T) {
+	// Whatever a variable holds is its value's, and never YAML
+	for _, value := range []string{
+		"*s3cret",
+		"&anchor",
+		"key: value",
+		"pa#ss # not a comment",
+		"line one\nadmin_addr: :1",
+		"- item",
+		"'quoted\"",
+		"{flow: map}",
+	} {
+		t.Setenv("INTUNJA_TEST_TOKEN", value)
+		for _, yaml := range []string{
+			"auth_token: ${INTUNJA_TEST_TOKEN}\n",
+			"auth_token: \"${INTUNJA_TEST_TOKEN}\"\n",
+			"auth_token: '${INTUNJA_TEST_TOKEN}'\n",
+			"auth_token: |\n  ${INTUNJA_TEST_TOKEN}\n",
+		} {
+			c, err := parseConfig("-config", writeConfig(t, yaml+"basic_auth: [\"admin:${INTUNJA_TEST_TOKEN}\"]\n"))
+			if err != nil {
+				t.Errorf("%q in %q: %v", value, yaml, err)
+				continue
+			}
+			if got := strings.TrimSuffix(c.AuthToken, "\n"); got != value {
+				t.Errorf("%q in %q: auth_token %q", value, yaml, got)
+			}
+			if len(c.BasicAuth) != 1 || c.BasicAuth[0] != "admin:"+value {
+				t.Errorf("%q in %q: basic_auth %q", value, yaml, c.BasicAuth)
+			}
+			if c.AdminAddr != "" {
+				t.Errorf("%q in %q: admin_addr set to %q", value, yaml, c.AdminAddr)
+			}
+		}
+	}
+}
+
+func TestConfigEnvTypes(t *testing.T) {
+	// A plain reference takes the type of what it expands to, and a
+	// quoted one stays a string
+	t.Setenv("INTUNJA_TEST_NUMBER", "10")
+	c, err := parseConfig("-config", writeConfig(t, `
+max_concurrent: ${INTUNJA_TEST_NUMBER}
+compress: ${INTUNJA_TEST_UNSET:-true}
+auth_token: "${INTUNJA_TEST_NUMBER}"
+request_timeout: ${INTUNJA_TEST_NUMBER}s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MaxConcurrent != 10 || !c.Compress || c.AuthToken != "10" || c.RequestTimeout != 10*time.Second {
+		t.Errorf("max_concurrent %d, compress %v, auth_token %q, request_timeout %s", c.MaxConcurrent, c.Compress, c.AuthToken, c.RequestTimeout)
+	}
+
+	// Keys and aliases are left as written
+	c, err = parseConfig("-config", writeConfig(t, `
+auth_token: &token ${INTUNJA_TEST_NUMBER}
+domain: *token
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AuthToken != "10" || c.Domain != "10" {
+		t.Errorf("auth_token %q, domain %q", c.AuthToken, c.Domain)
+	}
+	if _, err := parseConfig("-config", writeConfig(t, "${INTUNJA_TEST_UNSET:-domain}: example.com\n")); err == nil {
+		t.Error("expanded a key")
+	}
+}
+
+func TestConfigOldAddrKeys(t *testing.T) {
+	// A file written before tunnel_port and public_port were renamed
+	c, err := parseConfig("-config", writeConfig(t, `
+tunnel_port: 127.0.0.1:7000
+public_port: :7001
+auth_token: file-token
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.TunnelAddr != "127.0.0.1:7000" || c.PublicAddr != ":7001" || c.AuthToken != "file-token" {
+		t.Errorf("tunnel_addr %q, public_addr %q, auth_token %q", c.TunnelAddr, c.PublicAddr, c.AuthToken)
+	}
+	logs := captureLogs(t)
+	c.warnDeprecated()
+	lines := logs.lines(t, "deprecated config key")
+	if len(lines) != 2 || lines[0]["key"] != "tunnel_port" || lines[0]["use"] != "tunnel_addr" || lines[1]["key"] != "public_port" {
+		t.Errorf("warned %v", lines)
+	}
+
+	// The new key wins, and a flag over both
+	c, err = parseConfig("-config", writeConfig(t, "tunnel_port: :7000\ntunnel_addr: :7002\n"))
+	if err != nil || c.TunnelAddr != ":7002" {
+		t.Errorf("both keys: tunnel_addr %q, %v", c.TunnelAddr, err)
+	}
+	c, err = parseConfig("-config", writeConfig(t, "tunnel_port: :7000\n"), "-tunnel-addr", ":7003")
+	if err != nil || c.TunnelAddr != ":7003" {
+		t.Errorf("flag: tunnel_addr %q, %v", c.TunnelAddr, err)
+	}
+
+	// Files using the new keys get no warning
+	c, err = parseConfig("-config", writeConfig(t, "tunnel_addr: :7000\n"))
+	if err != nil || len(c.deprecated) != 0 {
+		t.Errorf("new keys: deprecated %v, %v", c.deprecated, err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mindsgn-studio/intunja/internal/relay"
+)
+
+// withConnect sends CONNECT requests, which have no path for the mux to
+// route on, to connect.
+func withConnect(next, connect http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			connect.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleConnect makes the public server an HTTP CONNECT proxy into the
+// home network: the client on -connect-tunnel dials the target and the
+// public connection is spliced onto the stream. Only targets on
+// -connect-allow may be reached.
+func handleConnect(w http.ResponseWriter, r *http.Request) {
+	target := r.Host
+	id := uuid.NewString()
+	logger := slog.With("request_id", id, "target", target)
+
+	if !connectAllowed(target) {
+		logger.Warn("refused CONNECT to a target not on the allowlist", "remote_addr", r.RemoteAddr)
+		http.Error(w, "Forbidden - CONNECT target not allowed", http.StatusForbidden)
+		return
+	}
+
+	name := cfg.Connect.Tunnel
+	var tunnel *Tunnel
+	var ok bool
+	if policyOf(r).reaches(name) {
+		tunnel, ok = lookupTunnel(r.Context(), name, "")
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("Bad Gateway - no tunnel registered for %q", name), http.StatusBadGateway)
+		return
+	}
+	stream, err := tunnel.session.OpenStream()
+	if err != nil {
+		logger.Error("failed to open tunnel stream", "tunnel", name, "err", err)
+		http.Error(w, "Bad Gateway - tunnel error", http.StatusBadGateway)
+		return
+	}
+	defer stream.Close()
+
+	// Ask the client to dial the target
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: target},
+		Host:   target,
+		Header: http.Header{requestIDHeader: {id}},
+	}
+	if ip := remoteIP(r); ip != nil {
+		req.Header.Set(clientIPHeader, ip.String())
+	}
+	stream.SetDeadline(time.Now().Add(handshakeTimeout))
+	head := relay.NewHeadLimiter(stream, int64(cfg.MaxHeaderBytes))
+	br := bufio.NewReader(head)
+	var resp *http.Response
+	if err = req.Write(stream); err == nil {
+		resp, err = http.ReadResponse(br, req)
+	}
+	if err != nil {
+		if errors.Is(err, relay.ErrHeaderTooLarge) {
+			stream.Reset()
+		}
+		logger.Error("failed to relay CONNECT through tunnel", "tunnel", name, "err", err)
+		http.Error(w, "Bad Gateway - tunnel error", http.StatusBadGateway)
+		return
+	}
+	head.Release()
+	stream.SetDeadline(time.Time{})
+
+	if resp.StatusCode != http.StatusOK {
+		// The client refused or couldn't reach the target; pass its answer on
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		http.Error(w, strings.TrimSpace(string(msg)), resp.StatusCode)
+		return
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		logger.Error("failed to hijack connection for CONNECT", "err", err)
+		http.Error(w, "CONNECT not supported", http.StatusInternalServerError)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+
+	start := time.Now()
+	logger.Info("CONNECT opened", "tunnel", name, "remote_addr", r.RemoteAddr)
+	copyBuffers.Splice(relay.BufferedConn(conn, brw.Reader), relay.BufferedConn(stream, br))
+	logger.Info("CONNECT closed", "tunnel", name, "duration_ms", time.Since(start).Milliseconds())
+}
+
+// connectAllowed reports whether target, as host:port, matches an entry on
+// -connect-allow. An entry's host may be * or start with *. to match a
+// domain's subdomains, and its port may be *.
+func connectAllowed(target string) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range cfg.Connect.Allow {
+		h, p, _ := net.SplitHostPort(allowed)
+		if p != "*" && p != port {
+			continue
+		}
+		if suffix, ok := strings.CutPrefix(h, "*"); ok {
+			if suffix == "" || (strings.HasPrefix(suffix, ".") && len(host) > len(suffix) && strings.HasSuffix(strings.ToLower(host), strings.ToLower(suffix))) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
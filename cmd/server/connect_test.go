@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// dialConnect sends CONNECT target to the test server's public listener
+// and returns the connection with the response.
+func dialConnect(t *testing.T, s *testServer, target string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.public.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+func TestConnect(t *testing.T) {
+	echo := echoServer(t).Addr().String()
+	s := startServer(t, "-connect-allow", echo, "-connect-tunnel", "home")
+	s.connect(t, client.Options{Name: "home", Local: "http://127.0.0.1:1", AllowConnect: true})
+
+	conn, br, resp := dialConnect(t, s, echo)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT answered %d", resp.StatusCode)
+	}
+	for _, msg := range []string{"ping\n", "pong\n"} {
+		io.WriteString(conn, msg)
+		if got, err := br.ReadString('\n'); err != nil || got != msg {
+			t.Fatalf("echoed %q, %v; want %q", got, err, msg)
+		}
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	echo := echoServer(t).Addr().String()
+	s := startServer(t, "-connect-allow", echo, "-connect-tunnel", "home")
+	s.connect(t, client.Options{Name: "home", Local: "http://127.0.0.1:1", AllowConnect: true})
+
+	// Not on the allowlist
+	if _, _, resp := dialConnect(t, s, "127.0.0.1:22"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("disallowed target answered %d, want 403", resp.StatusCode)
+	}
+
+	// Allowed by the server, but the client doesn't dial for it
+	registry.Unregister("home")
+	s.connect(t, client.Options{Name: "home", Local: "http://127.0.0.1:1"})
+	if _, _, resp := dialConnect(t, s, echo); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("client without AllowConnect answered %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestConnectAllowed(t *testing.T) {
+	setupServer(t,
+		"-connect-allow", "db.internal:5432",
+		"-connect-allow", "*.example.com:443",
+		"-connect-allow", "10.0.0.5:*",
+	)
+	for target, want := range map[string]bool{
+		"db.internal:5432":    true,
+		"DB.internal:5432":    true,
+		"db.internal:5433":    false,
+		"api.example.com:443": true,
+		"example.com:443":     false,
+		"evilexample.com:443": false,
+		"api.example.com:80":  false,
+		"10.0.0.5:22":         true,
+		"10.0.0.6:22":         false,
+		"db.internal":         false,
+	} {
+		if got := connectAllowed(target); got != want {
+			t.Errorf("connectAllowed(%q) = %v, want %v", target, got, want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsMaxAge is how long browsers may cache a preflight answer.
+const corsMaxAge = 10 * time.Minute
+
+// corsPolicy answers CORS preflights at the edge, so they don't make the
+// round trip to the home server, and sets the CORS headers on the
+// responses that do.
+type corsPolicy struct {
+	origins   map[string]bool
+	anyOrigin bool
+	methods   string
+	headers   string // empty allows whatever the preflight asks for
+}
+
+// cors is nil unless -cors-origins is set.
+var cors *corsPolicy
+
+func newCORSPolicy(c CORSConfig) *corsPolicy {
+	if len(c.Origins) == 0 {
+		return nil
+	}
+	p := &corsPolicy{
+		origins: make(map[string]bool, len(c.Origins)),
+		methods: strings.Join(c.Methods, ", "),
+		headers: strings.Join(c.Headers, ", "),
+	}
+	for _, o := range c.Origins {
+		if o == "*" {
+			p.anyOrigin = true
+		}
+		p.origins[strings.TrimSuffix(o, "/")] = true
+	}
+	return p
+}
+
+func (p *corsPolicy) allows(origin string) bool {
+	return p.anyOrigin || p.origins[origin]
+}
+
+// wrap puts the policy in front of next. A nil policy leaves CORS to the
+// home servers.
+func (p *corsPolicy) wrap(next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !p.allows(origin) {
+				http.Error(w, "Forbidden - origin not allowed", http.StatusForbidden)
+				return
+			}
+			h := w.Header()
+			p.setOrigin(h, origin)
+			h.Set("Access-Control-Allow-Methods", p.methods)
+			if p.headers != "" {
+				h.Set("Access-Control-Allow-Headers", p.headers)
+			} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				h.Set("Access-Control-Allow-Headers", requested)
+				h.Add("Vary", "Access-Control-Request-Headers")
+			}
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if !p.allows(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&corsWriter{ResponseWriter: w, policy: p, origin: origin}, r)
+	})
+}
+
+func (p *corsPolicy) setOrigin(h http.Header, origin string) {
+	if p.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+// corsWriter sets the allowed origin on a response as its head is written,
+// in place of any the home server sent.
+type corsWriter struct {
+	http.ResponseWriter
+	policy *corsPolicy
+	origin string
+	wrote  bool
+}
+
+func (w *corsWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote = true
+		w.policy.setOrigin(w.Header(), w.origin)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *corsWriter) Write(p []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer for
+// flushing and hijacking.
+func (w *corsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
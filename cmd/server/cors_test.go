@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func corsRequest(t *testing.T, method, url, origin string, set ...string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Set("Origin", origin)
+	for i := 0; i+1 < len(set); i += 2 {
+		req.Header.Set(set[i], set[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCORSPreflight(t *testing.T) {
+	var reached atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached.Add(1) }))
+	defer backend.Close()
+	s := startServer(t, "-cors-origins", "https://app.example", "-cors-methods", "GET,PUT", "-cors-headers", "X-Token")
+	s.connect(t, client.Options{Name: "api", Local: backend.URL})
+
+	resp := corsRequest(t, http.MethodOptions, s.url("api", "/items"), "https://app.example",
+		"Access-Control-Request-Method", "PUT", "Access-Control-Request-Headers", "x-token")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("preflight status %d, want 204", resp.StatusCode)
+	}
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example",
+		"Access-Control-Allow-Methods": "GET, PUT",
+		"Access-Control-Allow-Headers": "X-Token",
+		"Access-Control-Max-Age":       "600",
+		"Vary":                         "Origin",
+	} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("%s: %q, want %q", name, got, want)
+		}
+	}
+	if resp := corsRequest(t, http.MethodOptions, s.url("api", "/items"), "https://evil.example",
+		"Access-Control-Request-Method", "PUT"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("preflight from another origin: %d, want 403", resp.StatusCode)
+	}
+	if n := reached.Load(); n != 0 {
+		t.Errorf("%d preflights reached the local API", n)
+	}
+}
+
+func TestCORSSimpleRequest(t *testing.T) {
+	var reached atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+		w.Header().Set("Access-Control-Allow-Origin", "https://stale.example")
+	}))
+	defer backend.Close()
+	s := startServer(t, "-cors-origins", "https://app.example")
+	s.connect(t, client.Options{Name: "api", Local: backend.URL})
+
+	resp := corsRequest(t, http.MethodGet, s.url("api", "/items"), "https://app.example")
+	if resp.StatusCode != http.StatusOK || reached.Load() != 1 {
+		t.Fatalf("status %d, %d requests reached the local API", resp.StatusCode, reached.Load())
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+		t.Errorf("Access-Control-Allow-Origin %q", got)
+	}
+	if got := resp.Header.Get("Vary"); got != "Origin" {
+		t.Errorf("Vary %q", got)
+	}
+
+	// Another origin is passed through as it is, for the browser to refuse
+	resp = corsRequest(t, http.MethodGet, s.url("api", "/items"), "https://evil.example")
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://stale.example" {
+		t.Errorf("another origin got Access-Control-Allow-Origin %q", got)
+	}
+}
+
+func TestCORSDisabled(t *testing.T) {
+	var reached atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached.Add(1) }))
+	defer backend.Close()
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "api", Local: backend.URL})
+
+	// Without -cors-origins the home server answers preflights itself
+	corsRequest(t, http.MethodOptions, s.url("api", "/"), "https://app.example", "Access-Control-Request-Method", "PUT")
+	if reached.Load() != 1 {
+		t.Error("the preflight didn't reach the local API")
+	}
+}
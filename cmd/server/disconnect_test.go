@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/mindsgn-studio/intunja/client"
+	"github.com/mindsgn-studio/intunja/internal/mux"
+	"github.com/mindsgn-studio/intunja/internal/protocol"
+)
+
+func TestDisconnectReason(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want string
+	}{
+		{errReplaced, "replaced"},
+		{fmt.Errorf("session: %w", errUnregistered), "admin"},
+		{errShuttingDown, "shutdown"},
+		{errExpired, "expired"},
+		{mux.ErrIdleTimeout, "idle"},
+		{mux.ErrKeepAliveTimeout, "timeout"},
+		{os.ErrDeadlineExceeded, "timeout"},
+		{io.EOF, "eof"},
+		{fmt.Errorf("read: %w", io.ErrUnexpectedEOF), "eof"},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, "reset"},
+		{errors.New("something else"), "error"},
+	} {
+		if got := disconnectReason(c.err); got != c.want {
+			t.Errorf("%v classed as %q, want %q", c.err, got, c.want)
+		}
+	}
+}
+
+func TestDisconnectReasons(t *testing.T) {
+	s := startServer(t, "-auth-token", "secret")
+	logs := captureLogs(t)
+	counted := func(reason string, cause func()) {
+		t.Helper()
+		before := testutil.ToFloat64(stats.TunnelDisconnects.WithLabelValues(reason))
+		cause()
+		waitFor(t, func() bool {
+			return testutil.ToFloat64(stats.TunnelDisconnects.WithLabelValues(reason)) == before+1
+		})
+	}
+	backend := newBackend(t, "home").URL
+
+	counted("auth", func() {
+		conn, err := net.Dial("tcp", s.tunnels.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "AUTH wrong\n")
+		hello := protocol.Hello{Flags: protocol.FlagHello, Version: protocol.Current}
+		mux.WriteFrame(conn, hello.Register(), []byte("home"))
+		io.Copy(io.Discard, conn)
+	})
+	counted("handshake", func() {
+		conn, err := net.Dial("tcp", s.tunnels.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// Gone before naming its tunnel
+		fmt.Fprintf(conn, "AUTH secret\nnot")
+		conn.(*net.TCPConn).CloseWrite()
+		io.Copy(io.Discard, conn)
+	})
+	counted("eof", func() {
+		s.register(t, "secret", "leaving").Close()
+	})
+
+	first := s.connect(t, client.Options{Name: "home", Local: backend})
+	counted("replaced", func() {
+		waiting := waitTunnel(t, "home")
+		second, err := client.New(client.Options{Name: "home", Local: backend, Remote: s.tunnels.Addr().String(), AuthToken: "secret", Logger: discardLogger()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		second.Start(context.Background())
+		t.Cleanup(second.Stop)
+		waitFor(t, func() bool {
+			tunnel, _ := registry.Lookup("home")
+			return tunnel != waiting
+		})
+		first.Stop()
+	})
+	counted("admin", func() {
+		registry.Unregister("home")
+	})
+
+	// Tunnels left over from earlier tests may log their own
+	logged := make(map[any]bool)
+	for _, line := range logs.lines(t, "tunnel disconnected") {
+		logged[line["reason"]] = true
+	}
+	for _, reason := range []string{"eof", "replaced", "admin"} {
+		if !logged[reason] {
+			t.Errorf("no disconnect logged with reason %s, got %v", reason, logged)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// slowHome registers a home server as name whose requests wait for
+// release, and returns its tunnel.
+func slowHome(t *testing.T, name string, arrived chan<- struct{}, release <-chan struct{}) *Tunnel {
+	t.Helper()
+	serverEnd, homeEnd := net.Pipe()
+	tunnelConns.Go(func() { handleTunnelConn(serverEnd) })
+	serveHome(t, homeEnd, name, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		io.WriteString(w, "old done")
+	}))
+	return waitTunnel(t, name)
+}
+
+// replace connects a client as name and waits for it to take over from old.
+func replace(t *testing.T, s *testServer, name string, old *Tunnel) {
+	t.Helper()
+	s.connect(t, client.Options{Name: name, Local: newBackend(t, "new").URL})
+	waitFor(t, func() bool {
+		tunnel, _ := registry.Lookup(name)
+		return tunnel != old
+	})
+}
+
+func TestReplacedTunnelDrains(t *testing.T) {
+	s := startServer(t)
+	arrived, release := make(chan struct{}, 1), make(chan struct{})
+	old := slowHome(t, "home", arrived, release)
+
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(s.url("home", "/slow"))
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		slow <- resp.Status + " " + string(body)
+	}()
+	<-arrived
+	replace(t, s, "home", old)
+
+	// New requests go to the new connection while the old one drains
+	if !old.retiring.Load() || old.closed() {
+		t.Error("the old tunnel isn't draining")
+	}
+	if code, body := get(t, mustRequest(t, s.url("home", "/fast"))); code != http.StatusOK || body != "new /fast" {
+		t.Errorf("new request got %d %q", code, body)
+	}
+
+	close(release)
+	if got := <-slow; got != "200 OK old done" {
+		t.Errorf("in-flight request got %q, want it finished by the old connection", got)
+	}
+	waitFor(t, old.closed)
+}
+
+func TestReplacedTunnelDrainTimeout(t *testing.T) {
+	s := startServer(t, "-drain-timeout", "200ms")
+	arrived, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	old := slowHome(t, "home", arrived, release)
+
+	go func() {
+		if resp, err := http.Get(s.url("home", "/stuck")); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-arrived
+	start := time.Now()
+	replace(t, s, "home", old)
+
+	waitFor(t, old.closed)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("old tunnel closed after %s, want about the 200ms drain timeout", elapsed)
+	}
+}
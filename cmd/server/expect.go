@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// errBodyNotWanted ends a held-back request body that the home server
+// answered without asking for.
+var errBodyNotWanted = errors.New("home server answered without 100 Continue")
+
+// expectsContinue reports whether the public client is waiting for
+// 100 Continue before it uploads the body of r.
+func expectsContinue(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Expect"), "100-continue") && r.ContentLength != 0
+}
+
+// continueGate holds back a request body until the home server answers
+// the forwarded expectation. Reading the body is also what makes net/http
+// send 100 Continue to the public client, so nothing is uploaded until the
+// local API has asked for it.
+type continueGate struct {
+	io.ReadCloser
+
+	once  sync.Once
+	ready chan struct{}
+	ok    bool
+}
+
+func newContinueGate(body io.ReadCloser) *continueGate {
+	return &continueGate{ReadCloser: body, ready: make(chan struct{})}
+}
+
+func (g *continueGate) Read(p []byte) (int, error) {
+	<-g.ready
+	if !g.ok {
+		return 0, errBodyNotWanted
+	}
+	return g.ReadCloser.Read(p)
+}
+
+// open lets the body through if ok, or ends it otherwise. Only the first
+// call has any effect.
+func (g *continueGate) open(ok bool) {
+	if g == nil {
+		return
+	}
+	g.once.Do(func() {
+		g.ok = ok
+		close(g.ready)
+	})
+}
+
+// refused reports whether the home server answered without asking for the
+// body.
+func (g *continueGate) refused() bool {
+	if g == nil {
+		return false
+	}
+	select {
+	case <-g.ready:
+		return !g.ok
+	default:
+		return false
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// uploadBackend takes the body on /upload, which makes net/http ask for
+// it, and refuses anything else without reading it.
+func uploadBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/upload" {
+			http.Error(w, "too big", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "got %d bytes", len(body))
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// sendExpecting writes the head of an upload to path that waits for
+// 100 Continue, and returns the connection and a reader for it.
+func sendExpecting(t *testing.T, s *testServer, path string, length int) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	u, _ := url.Parse(s.public.URL)
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST /big%s HTTP/1.1\r\nHost: %s\r\nExpect: 100-continue\r\nContent-Length: %d\r\n\r\n", path, u.Host, length)
+	return conn, bufio.NewReader(conn)
+}
+
+func TestExpectContinue(t *testing.T) {
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "big", Local: uploadBackend(t).URL})
+
+	const size = 256 << 10
+	conn, r := sendExpecting(t, s, "/upload", size)
+	// Nothing is uploaded until the local API has asked for it
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "HTTP/1.1 100 ") {
+		t.Fatalf("got %q, want 100 Continue first", line)
+	}
+	if blank, _ := r.ReadString('\n'); blank != "\r\n" {
+		t.Fatalf("100 Continue followed by %q", blank)
+	}
+
+	if _, err := io.WriteString(conn, strings.Repeat("x", size)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != fmt.Sprintf("got %d bytes", size) {
+		t.Errorf("got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestExpectContinueRefused(t *testing.T) {
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "big", Local: uploadBackend(t).URL})
+
+	// The final answer comes straight away, with no 100 before it
+	_, r := sendExpecting(t, s, "/elsewhere", 1<<20)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want the local API's 413", resp.StatusCode)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// freeAddr returns a local address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startInstance builds the server and runs it with args, as a second
+// instance beside the one set up in this process.
+func startInstance(t *testing.T, args ...string) {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), "intunja-server")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("build: %v\n%s", err, out)
+	}
+	cmd := exec.Command(bin, args...)
+	var logs bytes.Buffer
+	cmd.Stderr = &logs
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("other instance:\n%s", logs.String())
+		}
+	})
+}
+
+func TestClusterForwarding(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the server")
+	}
+	redis := startFakeRedis(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The instances' own headers would show up after the path
+		io.WriteString(w, "served at home "+r.URL.Path+r.Header.Get(forwardedByHeader)+r.Header.Get(clusterTokenHeader))
+	}))
+	defer backend.Close()
+
+	// The owner runs in its own process, with the tunnel connected to it
+	ownerTunnels, ownerCluster := freeAddr(t), freeAddr(t)
+	startInstance(t, "-tunnel-addr", ownerTunnels, "-public-addr", freeAddr(t),
+		"-cluster-addr", ownerCluster, "-node-url", "http://"+ownerCluster,
+		"-cluster-registry", "redis", "-redis-url", "redis://"+redis.addr,
+		"-auth-token", "secret", "-cluster-token", "mesh")
+	waitFor(t, func() bool {
+		conn, err := net.Dial("tcp", ownerTunnels)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	c, err := client.New(client.Options{Name: "home", Local: backend.URL, Remote: ownerTunnels, AuthToken: "secret", Logger: discardLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start(context.Background())
+	defer c.Stop()
+	waitFor(t, func() bool {
+		return strings.Contains(redis.exec([]string{"GET", redisKeyPrefix + "home"}), ownerCluster)
+	})
+
+	// This instance holds no tunnels and forwards to the owner
+	s := startServer(t, "-auth-token", "other", "-cluster-token", "mesh",
+		"-cluster-addr", "127.0.0.1:0", "-node-url", "http://127.0.0.1:1",
+		"-cluster-registry", "redis", "-redis-url", "redis://"+redis.addr)
+	if code, body := get(t, mustRequest(t, s.url("home", "/hello"))); code != http.StatusOK || body != "served at home /hello" {
+		t.Errorf("forwarded request: %d %q", code, body)
+	}
+	// A public client can't pass for another instance to keep its
+	// request here
+	forged := mustRequest(t, s.url("home", "/hello"))
+	forged.Header.Set(forwardedByHeader, "http://127.0.0.1:1")
+	forged.Header.Set(clusterTokenHeader, "mesh")
+	if code, body := get(t, forged); code != http.StatusOK || body != "served at home /hello" {
+		t.Errorf("request claiming to be forwarded: %d %q", code, body)
+	}
+	if code, _ := get(t, mustRequest(t, s.url("nowhere", "/"))); code != http.StatusNotFound {
+		t.Errorf("tunnel held by no instance: %d", code)
+	}
+
+	// A stale claim isn't forwarded back and forth
+	redis.exec([]string{"SET", redisKeyPrefix + "ghost", "http://" + ownerCluster, "PX", "60000"})
+	if code, _ := get(t, mustRequest(t, s.url("ghost", "/"))); code != http.StatusNotFound {
+		t.Errorf("stale claim: %d", code)
+	}
+
+	// The owner's cluster listener only takes forwarded requests with the
+	// cluster token
+	for _, tc := range []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"not forwarded", nil, http.StatusForbidden},
+		{"no token", map[string]string{forwardedByHeader: "http://127.0.0.1:1"}, http.StatusUnauthorized},
+		{"auth token", map[string]string{forwardedByHeader: "http://127.0.0.1:1", clusterTokenHeader: "secret"}, http.StatusUnauthorized},
+		{"cluster token", map[string]string{forwardedByHeader: "http://127.0.0.1:1", clusterTokenHeader: "mesh"}, http.StatusOK},
+	} {
+		req := mustRequest(t, "http://"+ownerCluster+"/home/")
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		if code, _ := get(t, req); code != tc.want {
+			t.Errorf("%s: %d, want %d", tc.name, code, tc.want)
+		}
+	}
+}
+
+func TestClusterSecretRequired(t *testing.T) {
+	cluster := []string{"-node-url", "http://10.0.0.5:7946", "-cluster-addr", ":7946"}
+	if _, err := parseConfig(cluster...); err == nil || !strings.Contains(err.Error(), "requires a cluster token or auth_token") {
+		t.Errorf("cluster without a secret: %v", err)
+	}
+	for _, secret := range [][]string{{"-auth-token", "secret"}, {"-cluster-token", "mesh"}} {
+		if _, err := parseConfig(append(cluster, secret...)...); err != nil {
+			t.Errorf("%q refused: %v", secret, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// forwardedBackend answers with the X-Forwarded-For it was given, and
+// fails if the tunnel's client IP header leaked through.
+func forwardedBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get(clientIPHeader); v != "" {
+			t.Errorf("the local API got %s: %q", clientIPHeader, v)
+		}
+		w.Write([]byte(r.Header.Get("X-Forwarded-For")))
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestClientIPReachesLocalAPI(t *testing.T) {
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "ip", Local: forwardedBackend(t).URL})
+
+	req := mustRequest(t, s.url("ip", "/"))
+	// A chain from an untrusted peer is dropped, and so is a forged
+	// client IP header
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	req.Header.Set(clientIPHeader, "198.51.100.1")
+	if _, body := get(t, req); body != "127.0.0.1" {
+		t.Errorf("X-Forwarded-For = %q, want the public client without its port", body)
+	}
+}
+
+func TestClientIPBehindTrustedProxy(t *testing.T) {
+	s := startServer(t, "-trusted-proxy", "127.0.0.0/8")
+	s.connect(t, client.Options{Name: "ip", Local: forwardedBackend(t).URL})
+
+	req := mustRequest(t, s.url("ip", "/"))
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	if _, body := get(t, req); body != "203.0.113.5, 127.0.0.1" {
+		t.Errorf("X-Forwarded-For = %q, want the proxy's chain extended", body)
+	}
+}
+
+func TestForgedForwardingHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s", r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Real-Ip"), r.Header.Get("Forwarded"))
+	}))
+	defer backend.Close()
+	forged := func(t *testing.T, s *testServer) string {
+		t.Helper()
+		req := mustRequest(t, s.url("ip", "/"))
+		req.Header.Set("X-Forwarded-For", "203.0.113.5")
+		req.Header.Set("X-Real-Ip", "203.0.113.5")
+		req.Header.Set("Forwarded", "for=203.0.113.5")
+		_, body := get(t, req)
+		return body
+	}
+
+	t.Run("untrusted", func(t *testing.T) {
+		s := startServer(t, "-trusted-proxies", "10.0.0.0/8")
+		s.connect(t, client.Options{Name: "ip", Local: backend.URL})
+		if got := forged(t, s); got != "127.0.0.1||" {
+			t.Errorf("got %q, want only the socket's address", got)
+		}
+	})
+	t.Run("trusted", func(t *testing.T) {
+		s := startServer(t, "-trusted-proxies", "10.0.0.0/8,127.0.0.0/8")
+		s.connect(t, client.Options{Name: "ip", Local: backend.URL})
+		if got := forged(t, s); got != "203.0.113.5, 127.0.0.1|203.0.113.5|for=203.0.113.5" {
+			t.Errorf("got %q, want the proxy's headers kept", got)
+		}
+	})
+}
+
+func TestTrustedProxiesIPFilter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	for _, c := range []struct {
+		trusted string
+		want    int
+	}{
+		{"10.0.0.0/8", http.StatusOK},                    // the forged header is ignored
+		{"10.0.0.0/8,127.0.0.0/8", http.StatusForbidden}, // the proxy's client is denied
+	} {
+		t.Run(c.trusted, func(t *testing.T) {
+			s := startServer(t, "-trusted-proxies", c.trusted, "-deny-cidr", "203.0.113.0/24")
+			s.connect(t, client.Options{Name: "ip", Local: backend.URL})
+			req := mustRequest(t, s.url("ip", "/"))
+			req.Header.Set("X-Forwarded-For", "203.0.113.5")
+			if code, _ := get(t, req); code != c.want {
+				t.Errorf("-trusted-proxies %s: %d, want %d", c.trusted, code, c.want)
+			}
+		})
+	}
+}
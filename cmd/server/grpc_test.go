@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// grpcMessage frames msg as a gRPC length-prefixed message.
+func grpcMessage(msg string) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// readGRPCMessage reads one length-prefixed message from r.
+func readGRPCMessage(r io.Reader) (string, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return "", err
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	_, err := io.ReadFull(r, msg)
+	return string(msg), err
+}
+
+// grpcEcho is a bidirectional streaming gRPC echo service over h2c: it
+// answers each message as it arrives, then ends the call with an OK
+// status in the trailers.
+func grpcEcho(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(w, "want gRPC over HTTP/2", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		flusher := http.NewResponseController(w)
+		flusher.Flush()
+		for {
+			msg, err := readGRPCMessage(r.Body)
+			if err != nil {
+				break
+			}
+			w.Write(grpcMessage("echo: " + msg))
+			flusher.Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGRPCStreaming(t *testing.T) {
+	s := startServer(t, "-h2c")
+	s.connect(t, client.Options{Name: "grpc", Local: grpcEcho(t).URL})
+	public := httptest.NewUnstartedServer(publicHandler(newMetricsHandler()))
+	public.Config.Protocols = new(http.Protocols)
+	public.Config.Protocols.SetUnencryptedHTTP2(true)
+	public.Start()
+	defer public.Close()
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	defer transport.CloseIdleConnections()
+
+	body, send := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, public.URL+"/grpc/echo.Echo/Chat", body)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := (&http.Client{Transport: transport}).Do(req)
+		done <- result{resp, err}
+	}()
+
+	// Each answer arrives while the request is still open
+	send.Write(grpcMessage("one"))
+	var r result
+	select {
+	case r = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response headers while the call was open")
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	defer r.resp.Body.Close()
+	if r.resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", r.resp.StatusCode)
+	}
+	replies := bufio.NewReader(r.resp.Body)
+	for _, msg := range []string{"one", "two", "three"} {
+		if msg != "one" {
+			send.Write(grpcMessage(msg))
+		}
+		got, err := readGRPCMessage(replies)
+		if err != nil || got != "echo: "+msg {
+			t.Fatalf("got %q, %v; want the echo of %q", got, err, msg)
+		}
+	}
+
+	send.Close()
+	if _, err := readGRPCMessage(replies); err != io.EOF {
+		t.Errorf("call ended with %v, want EOF", err)
+	}
+	if got := r.resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer %q, want 0", got)
+	}
+}
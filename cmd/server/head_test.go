@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func TestHead(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "1234")
+		w.Write([]byte(strings.Repeat("x", 1234)))
+	}))
+	defer backend.Close()
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "head", Local: backend.URL})
+
+	// On the wire, so a body sent after the head would show up
+	u, _ := url.Parse(s.public.URL)
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "HEAD /head/file HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", u.Host)
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodHead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Length") != "1234" || resp.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("got %d with %v, want 200 and the GET's headers", resp.StatusCode, resp.Header)
+	}
+	if rest, _ := io.ReadAll(r); len(rest) != 0 {
+		t.Errorf("%d bytes sent after the head of a HEAD response: %.40q", len(rest), rest)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/internal/mux"
+)
+
+func TestOversizedResponseHead(t *testing.T) {
+	s := startServer(t, "-max-header-bytes", "4096")
+	written := make(chan int, 1)
+	serverEnd, homeEnd := net.Pipe()
+	tunnelConns.Go(func() { handleTunnelConn(serverEnd) })
+	serveHomeStreams(t, homeEnd, "bloated", func(stream *mux.Stream) {
+		if _, err := http.ReadRequest(bufio.NewReader(stream)); err != nil {
+			return
+		}
+		// A head that never ends, until the server gives up on it
+		line := "X-Filler: " + strings.Repeat("a", 1000) + "\r\n"
+		n, err := fmt.Fprint(stream, "HTTP/1.1 200 OK\r\n")
+		for err == nil && n < 64<<20 {
+			var m int
+			m, err = fmt.Fprint(stream, line)
+			n += m
+		}
+		written <- n
+	})
+	waitTunnel(t, "bloated")
+
+	if code, _ := get(t, mustRequest(t, s.url("bloated", "/"))); code != http.StatusBadGateway {
+		t.Errorf("status %d, want 502", code)
+	}
+	if n := <-written; n >= 64<<20 {
+		t.Errorf("the home server wrote %d bytes without being reset", n)
+	}
+}
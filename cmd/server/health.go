@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/internal/version"
+)
+
+var (
+	startTime = time.Now()
+
+	// requestsServed counts public requests forwarded to any tunnel.
+	requestsServed atomic.Int64
+)
+
+type healthStatus struct {
+	Connected      bool       `json:"connected"`
+	Degraded       bool       `json:"degraded"`
+	HealthError    string     `json:"health_error,omitempty"`
+	TunnelName     string     `json:"tunnel_name"`
+	ConnectedSince *time.Time `json:"connected_since"`
+	RequestsServed int64      `json:"requests_served"`
+	UptimeSeconds  int64      `json:"uptime_seconds"`
+	Version        string     `json:"version"`
+}
+
+// handleHealth reports on the tunnel named by ?tunnel=, or on the only
+// tunnel when exactly one is connected, answering 503 if it is degraded.
+// Otherwise it reports whether any tunnel is connected. ?format=text gives
+// the old one-line answer.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{
+		Connected:      registry.Len() > 0,
+		RequestsServed: requestsServed.Load(),
+		UptimeSeconds:  int64(time.Since(startTime).Seconds()),
+		Version:        version.Version,
+	}
+
+	var tunnel *Tunnel
+	if name := r.URL.Query().Get("tunnel"); name != "" {
+		status.TunnelName = name
+		tunnel, status.Connected = registry.Lookup(name)
+	} else if tunnels := registry.List(); len(tunnels) == 1 {
+		tunnel = tunnels[0]
+	}
+	if tunnel != nil {
+		status.TunnelName = tunnel.name
+		status.ConnectedSince = &tunnel.connectedAt
+		status.RequestsServed = tunnel.requests.Load()
+		status.Degraded, status.HealthError = tunnel.degraded()
+	} else if status.TunnelName != "" {
+		status.RequestsServed = 0
+	}
+
+	code := http.StatusOK
+	if draining.Load() || !status.Connected || status.Degraded {
+		code = http.StatusServiceUnavailable
+	}
+
+	if r.URL.Query().Get("format") == "text" {
+		w.WriteHeader(code)
+		switch {
+		case draining.Load():
+			fmt.Fprintf(w, "Tunnel: Shutting down\n")
+		case status.Degraded:
+			fmt.Fprintf(w, "Tunnel: Degraded (%s)\n", status.HealthError)
+		case status.Connected:
+			fmt.Fprintf(w, "Tunnel: Connected (%d)\n", registry.Len())
+		default:
+			fmt.Fprintf(w, "Tunnel: Disconnected\n")
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// checkHealth asks /health with query and decodes the JSON answer.
+func checkHealth(t *testing.T, query string) (int, map[string]any) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleHealth(w, httptest.NewRequest(http.MethodGet, "/health"+query, nil))
+	var status map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("health is not JSON: %v: %s", err, w.Body)
+	}
+	return w.Code, status
+}
+
+func TestHealthDisconnected(t *testing.T) {
+	setupServer(t)
+	code, status := checkHealth(t, "")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", code)
+	}
+	for _, key := range []string{"connected", "tunnel_name", "connected_since", "requests_served", "uptime_seconds", "version"} {
+		if _, ok := status[key]; !ok {
+			t.Errorf("health has no %q: %v", key, status)
+		}
+	}
+	if status["connected"] != false || status["connected_since"] != nil {
+		t.Errorf("connected %v since %v, want false and null", status["connected"], status["connected_since"])
+	}
+}
+
+func TestHealthConnected(t *testing.T) {
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "healthy", Local: newBackend(t, "healthy").URL})
+	for range 2 {
+		req, _ := http.NewRequest(http.MethodGet, s.url("healthy", "/"), nil)
+		get(t, req)
+	}
+
+	code, status := checkHealth(t, "")
+	if code != http.StatusOK {
+		t.Errorf("status %d, want 200", code)
+	}
+	if status["connected"] != true || status["tunnel_name"] != "healthy" || status["connected_since"] == nil {
+		t.Errorf("health = %v, want connected tunnel healthy with a connect time", status)
+	}
+	if status["requests_served"] != 2.0 {
+		t.Errorf("requests_served = %v, want 2", status["requests_served"])
+	}
+
+	code, status = checkHealth(t, "?tunnel=missing")
+	if code != http.StatusServiceUnavailable || status["connected"] != false || status["tunnel_name"] != "missing" {
+		t.Errorf("health of a missing tunnel: %d %v", code, status)
+	}
+}
+
+func TestHealthText(t *testing.T) {
+	setupServer(t)
+	w := httptest.NewRecorder()
+	handleHealth(w, httptest.NewRequest(http.MethodGet, "/health?format=text", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.HasPrefix(w.Body.String(), "Tunnel: Disconnected") {
+		t.Errorf("got %d %q, want 503 Tunnel: Disconnected", w.Code, w.Body)
+	}
+}
+
+func TestBackendDegraded(t *testing.T) {
+	var status atomic.Int64
+	status.Store(http.StatusInternalServerError)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			w.WriteHeader(int(status.Load()))
+		}
+	}))
+	defer backend.Close()
+	s := startServer(t, "-auth-token", "secret", "-health-path", "/healthz", "-health-interval", "50ms", "-health-timeout", "200ms")
+	admin := httptest.NewServer(adminHandler())
+	defer admin.Close()
+	s.connect(t, client.Options{Name: "home", Local: backend.URL})
+	tunnel := waitTunnel(t, "home")
+
+	degraded := func() bool {
+		d, _ := tunnel.degraded()
+		return d
+	}
+	waitFor(t, degraded)
+	code, health := checkHealth(t, "?tunnel=home")
+	if code != http.StatusServiceUnavailable || health["degraded"] != true || !strings.Contains(health["health_error"].(string), "500") {
+		t.Errorf("health %d %v, want 503 degraded by the 500", code, health)
+	}
+	var list struct {
+		Tunnels []tunnelInfo `json:"tunnels"`
+	}
+	json.NewDecoder(adminRequest(t, admin, http.MethodGet, "/admin/tunnels").Body).Decode(&list)
+	if len(list.Tunnels) != 1 || !list.Tunnels[0].Degraded {
+		t.Errorf("admin lists %+v, want the tunnel degraded", list.Tunnels)
+	}
+
+	// Recovers once the home API does
+	status.Store(http.StatusNoContent)
+	waitFor(t, func() bool { return !degraded() })
+	if code, health := checkHealth(t, "?tunnel=home"); code != http.StatusOK || health["degraded"] != false {
+		t.Errorf("health %d %v after recovering", code, health)
+	}
+}
+
+func TestBackendHealthTimeout(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+	s := startServer(t, "-health-path", "/healthz", "-health-interval", "50ms", "-health-timeout", "100ms")
+	s.connect(t, client.Options{Name: "home", Local: backend.URL})
+	tunnel := waitTunnel(t, "home")
+
+	var why string
+	waitFor(t, func() bool {
+		var d bool
+		d, why = tunnel.degraded()
+		return d
+	})
+	if !strings.Contains(why, "no answer within 100ms") {
+		t.Errorf("degraded because %q, want the timeout", why)
+	}
+}
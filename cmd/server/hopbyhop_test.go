@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func TestHopByHopHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.Header().Set("Connection", "X-Reply-Hop")
+		w.Header().Set("X-Reply-Hop", "1")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Reply", "kept")
+	}))
+	defer backend.Close()
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "hops", Local: backend.URL})
+
+	req := mustRequest(t, s.url("hops", "/"))
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	req.Header.Set("X-End", "kept")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	h := <-received
+	for _, name := range []string{"X-Hop", "Keep-Alive", "Proxy-Authorization"} {
+		if v := h.Get(name); v != "" {
+			t.Errorf("request %s: %q reached the local API", name, v)
+		}
+	}
+	if h.Get("X-End") != "kept" {
+		t.Error("end-to-end request header dropped")
+	}
+	for _, name := range []string{"X-Reply-Hop", "Proxy-Authenticate"} {
+		if v := resp.Header.Get(name); v != "" {
+			t.Errorf("response %s: %q reached the caller", name, v)
+		}
+	}
+	if resp.Header.Get("X-Reply") != "kept" {
+		t.Error("end-to-end response header dropped")
+	}
+}
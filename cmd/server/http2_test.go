@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// protoBackend answers with the protocol the request reached it over and
+// the body it was sent.
+func protoBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.Proto, body)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// postOver sends a POST through the tunnel named name at public and
+// returns the protocol it was answered over and the body.
+func postOver(t *testing.T, c *http.Client, public, name string) (string, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, public+"/"+name+"/", strings.NewReader("payload"))
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	return resp.Proto, string(body)
+}
+
+func TestHTTP2(t *testing.T) {
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "h2", Local: protoBackend(t).URL})
+
+	public := httptest.NewUnstartedServer(publicHandler(newMetricsHandler()))
+	public.EnableHTTP2 = true
+	public.StartTLS()
+	defer public.Close()
+
+	proto, body := postOver(t, public.Client(), public.URL, "h2")
+	if proto != "HTTP/2.0" {
+		t.Errorf("answered over %s, want HTTP/2.0", proto)
+	}
+	// The tunnel only speaks HTTP/1.1
+	if body != "HTTP/1.1 payload" {
+		t.Errorf("the local API got %q, want an HTTP/1.1 request with the body", body)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	s := startServer(t, "-h2c")
+	s.connect(t, client.Options{Name: "h2c", Local: protoBackend(t).URL})
+
+	public := httptest.NewUnstartedServer(publicHandler(newMetricsHandler()))
+	public.Config.Protocols = new(http.Protocols)
+	public.Config.Protocols.SetHTTP1(true)
+	public.Config.Protocols.SetUnencryptedHTTP2(cfg.H2C)
+	public.Start()
+	defer public.Close()
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	defer transport.CloseIdleConnections()
+
+	proto, body := postOver(t, &http.Client{Transport: transport}, public.URL, "h2c")
+	if proto != "HTTP/2.0" || body != "HTTP/1.1 payload" {
+		t.Errorf("answered over %s with %q, want HTTP/2.0 and an HTTP/1.1 request", proto, body)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func newCertManager() *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.HTTPS.ACMECache),
+		HostPolicy: hostPolicy,
+	}
+}
+
+// hostPolicy only lets autocert request certificates for the subdomains
+// of tunnels that are currently registered.
+func hostPolicy(ctx context.Context, host string) error {
+	name, ok := subdomains.tunnelName(host)
+	if !ok || !strings.EqualFold(host, name+"."+subdomains.domain) {
+		return fmt.Errorf("host %q is not a tunnel subdomain of %q", host, subdomains.domain)
+	}
+	if _, ok := registry.Lookup(name); !ok {
+		return fmt.Errorf("no tunnel registered for %q", host)
+	}
+	return nil
+}
+
+func serveHTTPS(m *autocert.Manager, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:      cfg.HTTPS.Addr,
+		Handler:   handler,
+		TLSConfig: m.TLSConfig(),
+		Protocols: new(http.Protocols),
+	}
+	setPublicTimeouts(srv)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+
+	listener, err := net.Listen("tcp", cfg.HTTPS.Addr)
+	if err != nil {
+		fatal("failed to start public HTTPS", "err", err)
+	}
+	if cfg.ProxyProtocol {
+		listener = proxyListener{listener}
+	}
+	slog.Info("public HTTPS listening", "addr", listener.Addr().String(), "proxy_protocol", cfg.ProxyProtocol)
+	go func() {
+		if err := srv.ServeTLS(listener, "", ""); !errors.Is(err, http.ErrServerClosed) {
+			fatal("public HTTPS server failed", "err", err)
+		}
+	}()
+	return srv
+}
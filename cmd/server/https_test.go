@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHostPolicy(t *testing.T) {
+	s := startServer(t, "-domain", "example.com")
+	s.register(t, "", "myapp")
+	waitTunnel(t, "myapp")
+
+	tests := []struct {
+		host string
+		ok   bool
+	}{
+		{"myapp.example.com", true},
+		{"MYAPP.example.com", true},
+		{"other.example.com", false},
+		{"a.myapp.example.com", false},
+		{"example.com", false},
+		{"myapp.example.org", false},
+	}
+	for _, tt := range tests {
+		err := hostPolicy(context.Background(), tt.host)
+		if (err == nil) != tt.ok {
+			t.Errorf("hostPolicy(%q) = %v, want allowed %v", tt.host, err, tt.ok)
+		}
+	}
+}
+
+func TestACMEChallengeHandler(t *testing.T) {
+	setupServer(t, "-https", "-domain", "example.com")
+	handler := newCertManager().HTTPHandler(publicHandler(newMetricsHandler()))
+
+	// Challenges are only answered for hosts the policy allows
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/token", nil)
+	req.Host = "other.example.com"
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("challenge for unregistered host: status %d, want 403", w.Code)
+	}
+
+	// Everything else goes on to the tunnels
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/x", nil)
+	req.Host = "other.example.com"
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "Unknown subdomain") {
+		t.Errorf("plain request: got %d %q, want the tunnel router's 404", w.Code, w.Body)
+	}
+}
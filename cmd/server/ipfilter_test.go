@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// filterStatus runs a request from remoteAddr, with an optional
+// X-Forwarded-For, through f.
+func filterStatus(f *ipFilter, remoteAddr, forwardedFor string) int {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	w := httptest.NewRecorder()
+	f.wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(w, r)
+	return w.Code
+}
+
+func mustCIDRs(t *testing.T, values ...string) []*net.IPNet {
+	t.Helper()
+	nets, err := parseCIDRs(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+func TestIPFilter(t *testing.T) {
+	setupServer(t)
+	f := &ipFilter{
+		allow: mustCIDRs(t, "10.0.0.0/8", "2001:db8::/32"),
+		deny:  mustCIDRs(t, "10.1.0.0/16", "10.0.0.7"),
+	}
+	for addr, want := range map[string]int{
+		"10.2.3.4:5000":      http.StatusOK,
+		"[2001:db8::1]:5000": http.StatusOK,
+		"10.1.2.3:5000":      http.StatusForbidden, // denied inside an allowed network
+		"10.0.0.7:5000":      http.StatusForbidden, // a bare address is one host
+		"10.0.0.8:5000":      http.StatusOK,
+		"192.0.2.1:5000":     http.StatusForbidden, // outside every allowed network
+		"not-an-address":     http.StatusForbidden,
+	} {
+		if got := filterStatus(f, addr, ""); got != want {
+			t.Errorf("%s: status %d, want %d", addr, got, want)
+		}
+	}
+}
+
+func TestIPFilterForwardedFor(t *testing.T) {
+	setupServer(t, "-trusted-proxy", "192.0.2.0/24")
+	f := &ipFilter{deny: mustCIDRs(t, "203.0.113.0/24")}
+
+	// Behind a trusted proxy the forwarded client is checked
+	if got := filterStatus(f, "192.0.2.1:5000", "203.0.113.9"); got != http.StatusForbidden {
+		t.Errorf("denied client behind a trusted proxy: status %d, want 403", got)
+	}
+	if got := filterStatus(f, "192.0.2.1:5000", "198.51.100.1"); got != http.StatusOK {
+		t.Errorf("allowed client behind a trusted proxy: status %d, want 200", got)
+	}
+	// Anyone else's header is ignored
+	if got := filterStatus(f, "198.51.100.1:5000", "203.0.113.9"); got != http.StatusOK {
+		t.Errorf("forged X-Forwarded-For: status %d, want 200", got)
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets := mustCIDRs(t, "192.0.2.0/24", "198.51.100.7", "::1")
+	for _, c := range []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.200", true},
+		{"198.51.100.7", true},
+		{"198.51.100.8", false},
+		{"::1", true},
+		{"::2", false},
+	} {
+		if got := containsIP(nets, net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("contains %s = %v, want %v", c.ip, got, c.want)
+		}
+	}
+	for _, bad := range []string{"192.0.2.0/33", "example.com"} {
+		if _, err := parseCIDRs([]string{bad}); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestDenyCIDRFlag(t *testing.T) {
+	s := startServer(t, "-deny-cidr", "127.0.0.0/8")
+	s.connect(t, client.Options{Name: "private", Local: newBackend(t, "private").URL})
+	if code, _ := get(t, mustRequest(t, s.url("private", "/"))); code != http.StatusForbidden {
+		t.Errorf("status %d from a denied network, want 403", code)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/internal/mux"
+	"github.com/mindsgn-studio/intunja/internal/protocol"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSilentClientDetected(t *testing.T) {
+	s := startServer(t, "-ping-interval", "100ms", "-ping-timeout", "100ms")
+
+	// Register, then go quiet: nothing reads the pings, let alone answers
+	conn, err := net.Dial("tcp", s.tunnels.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "AUTH %s\n", cfg.AuthToken)
+	hello := protocol.Hello{Flags: protocol.FlagHello, Version: protocol.Current}
+	if err := mux.WriteFrame(conn, hello.Register(), []byte("silent")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protocol.ReadAnswer(conn); err != nil {
+		t.Fatal(err)
+	}
+	tunnel := waitTunnel(t, "silent")
+	start := time.Now()
+
+	select {
+	case <-tunnel.session.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the silent client was never disconnected")
+	}
+	// One interval to send the ping, one timeout to give up on it
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("disconnected after %s, want within 200ms or so", elapsed)
+	}
+	waitFor(t, func() bool {
+		_, ok := registry.Lookup("silent")
+		return !ok
+	})
+	if n := testutil.ToFloat64(stats.TunnelDisconnects.WithLabelValues("timeout")); n != 1 {
+		t.Errorf("%v timeout disconnects counted, want 1", n)
+	}
+}
+
+func TestHalfOpenTunnelEvicted(t *testing.T) {
+	// No pings, so only the idle timeout can notice
+	s := startServer(t, "-ping-interval", "0", "-tunnel-idle-timeout", "200ms")
+	before := testutil.ToFloat64(stats.TunnelDisconnects.WithLabelValues("idle"))
+
+	// Register, then vanish without closing the connection
+	conn, err := net.Dial("tcp", s.tunnels.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "AUTH %s\n", cfg.AuthToken)
+	hello := protocol.Hello{Flags: protocol.FlagHello, Version: protocol.Current}
+	if err := mux.WriteFrame(conn, hello.Register(), []byte("zombie")); err != nil {
+		t.Fatal(err)
+	}
+	tunnel := waitTunnel(t, "zombie")
+	start := time.Now()
+
+	select {
+	case <-tunnel.session.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the half-open tunnel was never evicted")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("evicted after %s, want about 200ms", elapsed)
+	}
+	waitFor(t, func() bool {
+		return testutil.ToFloat64(stats.TunnelDisconnects.WithLabelValues("idle")) == before+1
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Latencies are bucketed on a log scale: each bucket is latencyGrowth
+// times wider than the last, so a percentile is read to within 5% however
+// large it is, in constant memory.
+const (
+	minLatency    = 100 * time.Microsecond
+	latencyGrowth = 1.05
+	// Enough buckets to reach an hour; anything slower lands in the last.
+	latencyBuckets = 360
+)
+
+// latencyHistogram estimates percentiles of a tunnel's request latency.
+type latencyHistogram struct {
+	mu     sync.Mutex
+	counts [latencyBuckets]uint64
+	total  uint64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	if d > minLatency {
+		i = int(math.Log(float64(d)/float64(minLatency)) / math.Log(latencyGrowth))
+		i = min(i, latencyBuckets-1)
+	}
+
+	h.mu.Lock()
+	h.counts[i]++
+	h.total++
+	h.mu.Unlock()
+}
+
+// quantile returns the latency below which a fraction q of requests fell,
+// or 0 if none have been observed.
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.total)))
+	var seen uint64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= max(rank, 1) {
+			// Midway through the bucket, geometrically
+			return time.Duration(float64(minLatency) * math.Pow(latencyGrowth, float64(i)+0.5))
+		}
+	}
+	return time.Duration(float64(minLatency) * math.Pow(latencyGrowth, latencyBuckets))
+}
+
+// latencyPercentiles is how the admin API reports a histogram, in
+// milliseconds.
+type latencyPercentiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// percentiles returns nil until a request has been observed.
+func (h *latencyHistogram) percentiles() *latencyPercentiles {
+	h.mu.Lock()
+	total := h.total
+	h.mu.Unlock()
+	if total == 0 {
+		return nil
+	}
+
+	ms := func(d time.Duration) float64 {
+		return math.Round(float64(d)/float64(time.Millisecond)*100) / 100
+	}
+	return &latencyPercentiles{
+		P50: ms(h.quantile(0.50)),
+		P95: ms(h.quantile(0.95)),
+		P99: ms(h.quantile(0.99)),
+	}
+}
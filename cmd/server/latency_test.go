@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// near reports whether got is within the histogram's 5% of want.
+func near(got, want float64) bool {
+	return math.Abs(got-want) <= want*0.05
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	var h latencyHistogram
+	if h.percentiles() != nil {
+		t.Error("percentiles reported before any request")
+	}
+
+	// 1ms to 1000ms, one each
+	for i := 1; i <= 1000; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	p := h.percentiles()
+	for _, c := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"p50", p.P50, 500},
+		{"p95", p.P95, 950},
+		{"p99", p.P99, 990},
+	} {
+		if !near(c.got, c.want) {
+			t.Errorf("%s = %vms, want %vms ±5%%", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestLatencyExtremes(t *testing.T) {
+	var h latencyHistogram
+	h.observe(0)
+	h.observe(2 * time.Hour)
+	if q := h.quantile(0); q > minLatency*21/20 {
+		t.Errorf("fastest is %s, want it in the first bucket", q)
+	}
+	if q := h.quantile(1); q < time.Hour {
+		t.Errorf("slowest is %s, want it in the last bucket", q)
+	}
+}
+
+func TestAdminLatency(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer backend.Close()
+	s := startServer(t, "-auth-token", "secret")
+	admin := httptest.NewServer(adminHandler())
+	defer admin.Close()
+	c := s.connect(t, client.Options{Name: "timed", Local: backend.URL})
+
+	for range 5 {
+		get(t, mustRequest(t, s.url("timed", "/")))
+	}
+	latency := func() *latencyPercentiles {
+		var list struct {
+			Tunnels []tunnelInfo `json:"tunnels"`
+		}
+		json.NewDecoder(adminRequest(t, admin, http.MethodGet, "/admin/tunnels").Body).Decode(&list)
+		if len(list.Tunnels) != 1 {
+			t.Fatalf("listed %d tunnels", len(list.Tunnels))
+		}
+		return list.Tunnels[0].LatencyMS
+	}
+	if p := latency(); p == nil || p.P50 < 19 || p.P99 > 1000 {
+		t.Errorf("reported %+v, want about 20ms", p)
+	}
+
+	// A new connection starts a new histogram
+	c.Stop()
+	waitFor(t, func() bool {
+		_, ok := registry.Lookup("timed")
+		return !ok
+	})
+	s.connect(t, client.Options{Name: "timed", Local: backend.URL})
+	if p := latency(); p != nil {
+		t.Errorf("the new connection reported %+v before serving anything", p)
+	}
+}
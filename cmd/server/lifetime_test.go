@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func TestTunnelRotation(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Long enough for rotations to land mid-request
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	s := startServer(t, "-max-tunnel-lifetime", "300ms")
+	s.connect(t, client.Options{Name: "rotating", Local: backend.URL})
+
+	seen := make(map[*Tunnel]bool)
+	deadline := time.Now().Add(1500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if tunnel, ok := registry.Lookup("rotating"); ok {
+			seen[tunnel] = true
+		}
+		// Traffic carries on through every rotation
+		if code, body := get(t, mustRequest(t, s.url("rotating", "/"))); code != http.StatusOK || body != "ok" {
+			t.Fatalf("status %d: %s", code, body)
+		}
+	}
+	if len(seen) < 3 {
+		t.Errorf("served by %d connections in 1.5s, want one every 300ms", len(seen))
+	}
+	if n := testutil.ToFloat64(stats.TunnelDisconnects.WithLabelValues("expired")); n < 2 {
+		t.Errorf("%v expired disconnects counted", n)
+	}
+}
+
+func TestTunnelLifetimeDisabled(t *testing.T) {
+	s := startServer(t, "-max-tunnel-lifetime", "0")
+	s.connect(t, client.Options{Name: "steady", Local: newBackend(t, "steady").URL})
+	first := waitTunnel(t, "steady")
+
+	time.Sleep(300 * time.Millisecond)
+	if tunnel, _ := registry.Lookup("steady"); tunnel != first || first.retiring.Load() {
+		t.Error("tunnel rotated with no lifetime set")
+	}
+}
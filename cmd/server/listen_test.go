@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestListenAddrs(t *testing.T) {
+	setupServer(t)
+	logs := captureLogs(t)
+
+	tunnels := startTunnelServer()
+	defer tunnels.Close()
+	servers := startPublicServer()
+	defer func() {
+		for _, srv := range servers {
+			srv.Shutdown(context.Background())
+		}
+	}()
+
+	for msg, check := range map[string]func(addr string) error{
+		"tunnel server listening": func(addr string) error {
+			conn, err := net.Dial("tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		},
+		"public API listening": func(addr string) error {
+			resp, err := http.Get("http://" + addr + "/health")
+			if err == nil {
+				resp.Body.Close()
+			}
+			return err
+		},
+	} {
+		// The port picked for :0 is the one logged
+		addr, _ := logs.line(t, msg)["addr"].(string)
+		if !strings.HasPrefix(addr, "127.0.0.1:") || strings.HasSuffix(addr, ":0") {
+			t.Errorf("%s logged addr %q, want the bound 127.0.0.1 port", msg, addr)
+			continue
+		}
+		if err := check(addr); err != nil {
+			t.Errorf("%s at %s: %v", msg, addr, err)
+		}
+	}
+}
+
+func TestListenAddrInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{"-tunnel-addr", "8080"},
+		{"-public-addr", "127.0.0.1:http-alt-nope"},
+		{"-public-addr", "127.0.0.1:99999"},
+		{"-tunnel-addr", ""},
+	} {
+		if _, err := parseConfig(args...); err == nil {
+			t.Errorf("%q accepted", args)
+		}
+	}
+	for _, addr := range []string{":8080", "127.0.0.1:0", "[::1]:9090", "localhost:9090"} {
+		if _, err := parseConfig("-public-addr", addr); err != nil {
+			t.Errorf("%q refused: %v", addr, err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ListenerConfig is a public listener with its own rules, so that e.g. the
+// home network can be served without a token on one address while the
+// internet needs one on another.
+type ListenerConfig struct {
+	Addr       string   `yaml:"addr"`
+	AllowCIDRs []string `yaml:"allow_cidr"`
+	DenyCIDRs  []string `yaml:"deny_cidr"`
+	// AuthToken, if set, must be sent by public clients as a bearer token.
+	// It is removed before the request goes through the tunnel.
+	AuthToken string `yaml:"auth_token"`
+	// Rate limits each tunnel's requests through this listener; Burst
+	// defaults to the top-level burst.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// Tunnels limits the listener to these tunnels; empty reaches all.
+	Tunnels []string `yaml:"tunnels"`
+}
+
+// listenerPolicy is what a public listener enforces on the requests that
+// arrive on it.
+type listenerPolicy struct {
+	addr     string
+	filter   *ipFilter // nil admits everyone
+	token    string
+	tunnels  map[string]bool // nil reaches every tunnel
+	limiters *tunnelLimiters
+}
+
+// policies holds one entry per public listener, -public-addr's first.
+var policies []*listenerPolicy
+
+// mainListener is the -public-addr listener, configured by the top-level
+// settings.
+func (c *Config) mainListener() ListenerConfig {
+	return ListenerConfig{
+		Addr:       c.PublicAddr,
+		AllowCIDRs: c.AllowCIDRs,
+		DenyCIDRs:  c.DenyCIDRs,
+		Rate:       c.Rate,
+		Burst:      c.Burst,
+	}
+}
+
+// newListenerPolicy builds the policy for c, which has been validated.
+func newListenerPolicy(c ListenerConfig) *listenerPolicy {
+	burst := c.Burst
+	if burst == 0 {
+		burst = cfg.Burst
+	}
+	p := &listenerPolicy{
+		addr:     c.Addr,
+		token:    c.AuthToken,
+		limiters: newTunnelLimiters(c.Rate, burst),
+	}
+	if len(c.AllowCIDRs) > 0 || len(c.DenyCIDRs) > 0 {
+		p.filter = &ipFilter{}
+		p.filter.allow, _ = parseCIDRs(c.AllowCIDRs)
+		p.filter.deny, _ = parseCIDRs(c.DenyCIDRs)
+	}
+	if len(c.Tunnels) > 0 {
+		p.tunnels = make(map[string]bool, len(c.Tunnels))
+		for _, name := range c.Tunnels {
+			p.tunnels[name] = true
+		}
+	}
+	return p
+}
+
+type policyKey struct{}
+
+// wrap enforces the policy's address filter and token on next, and lets
+// the handlers further in find the policy with policyOf.
+func (p *listenerPolicy) wrap(next http.Handler) http.Handler {
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.token != "" {
+			presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || !tokensEqual(presented, p.token) {
+				slog.Warn("rejected public request without a valid token", "listener", p.addr, "remote_addr", r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="intunja"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			r.Header.Del("Authorization")
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), policyKey{}, p)))
+	})
+	if p.filter != nil {
+		h = p.filter.wrap(h)
+	}
+	return h
+}
+
+// reaches reports whether the policy lets requests through to the tunnel
+// name.
+func (p *listenerPolicy) reaches(name string) bool {
+	return p.tunnels == nil || p.tunnels[name]
+}
+
+// policyOf returns the policy of the listener r arrived on.
+func policyOf(r *http.Request) *listenerPolicy {
+	if p, ok := r.Context().Value(policyKey{}).(*listenerPolicy); ok {
+		return p
+	}
+	return policies[0]
+}
+
+// serveListener starts one of the configured extra listeners, with its policy
+// in front of every route.
+func serveListener(p *listenerPolicy) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/", cors.wrap(p.wrap(basicUsers.wrap(http.HandlerFunc(handlePublicRequest)))))
+	mux.HandleFunc("/health", handleHealth)
+	srv := &http.Server{
+		Addr:      p.addr,
+		Handler:   withConnect(mux, p.wrap(http.HandlerFunc(handleConnect))),
+		Protocols: new(http.Protocols),
+	}
+	setPublicTimeouts(srv)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(cfg.H2C)
+
+	listener, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		fatal("failed to start public listener", "addr", p.addr, "err", err)
+	}
+	slog.Info("public listener started", "addr", listener.Addr().String(), "filtered", p.filter != nil, "token", p.token != "", "tunnels", len(p.tunnels))
+	go func() {
+		if err := srv.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			fatal("public listener failed", "addr", p.addr, "err", err)
+		}
+	}()
+	return srv
+}
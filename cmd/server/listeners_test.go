@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func TestListenerPolicies(t *testing.T) {
+	path := writeConfig(t, `
+listeners:
+  - addr: 127.0.0.1:0
+    allow_cidr: [127.0.0.0/8]
+  - addr: 127.0.0.1:0
+    auth_token: external-token
+    rate: 0.001
+    burst: 2
+    tunnels: [home]
+  - addr: 127.0.0.1:0
+    allow_cidr: [10.0.0.0/8]
+`)
+	s := startServer(t, "-config", path)
+	logs := captureLogs(t)
+	for _, p := range policies[1:] {
+		srv := serveListener(p)
+		t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	}
+	var addrs []string
+	for _, line := range logs.lines(t, "public listener started") {
+		addrs = append(addrs, line["addr"].(string))
+	}
+	if len(addrs) != 3 {
+		t.Fatalf("%d listeners started, want 3", len(addrs))
+	}
+	internal, external, office := "http://"+addrs[0], "http://"+addrs[1], "http://"+addrs[2]
+	s.connect(t, client.Options{Name: "home", Local: newBackend(t, "home").URL})
+	s.connect(t, client.Options{Name: "admin", Local: newBackend(t, "admin").URL})
+
+	request := func(base, path, token string) int {
+		t.Helper()
+		req := mustRequest(t, base+path)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		code, _ := get(t, req)
+		return code
+	}
+
+	// Internal: no token, every tunnel, no rate limit
+	for range 5 {
+		if code := request(internal, "/admin/", ""); code != http.StatusOK {
+			t.Fatalf("internal listener answered %d", code)
+		}
+	}
+
+	// External: token required, only home, rate limited
+	if code := request(external, "/home/", ""); code != http.StatusUnauthorized {
+		t.Errorf("external listener without a token answered %d, want 401", code)
+	}
+	if code := request(external, "/home/", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("external listener with a wrong token answered %d, want 401", code)
+	}
+	if code := request(external, "/admin/", "external-token"); code != http.StatusNotFound {
+		t.Errorf("external listener reached a tunnel it doesn't list: %d", code)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if code := request(external, "/home/", "external-token"); code != want {
+			t.Errorf("external request %d answered %d, want %d", i+1, code, want)
+		}
+	}
+
+	// Office: not from here
+	if code := request(office, "/home/", ""); code != http.StatusForbidden {
+		t.Errorf("office listener answered %d from 127.0.0.1, want 403", code)
+	}
+	// The main listener keeps its own rules
+	if code := request(s.public.URL, "/admin/", ""); code != http.StatusOK {
+		t.Errorf("main listener answered %d", code)
+	}
+}
@@ -2,148 +2,1218 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mindsgn-studio/intunja/internal/compress"
+	"github.com/mindsgn-studio/intunja/internal/limit"
+	"github.com/mindsgn-studio/intunja/internal/logging"
+	"github.com/mindsgn-studio/intunja/internal/mux"
+	"github.com/mindsgn-studio/intunja/internal/protocol"
+	"github.com/mindsgn-studio/intunja/internal/quicconn"
+	"github.com/mindsgn-studio/intunja/internal/relay"
+	"github.com/mindsgn-studio/intunja/internal/sockopt"
+	"github.com/mindsgn-studio/intunja/internal/tracing"
+	"github.com/mindsgn-studio/intunja/internal/version"
 )
 
 const (
-	tunnelPort = ":8080"
-	publicPort = ":9090"
+	authTimeout      = 5 * time.Second
+	handshakeTimeout = 10 * time.Second
+
+	requestIDHeader = "X-Request-Id"
+	clientIPHeader  = "X-Intunja-Client-Ip"
+
+	compressionLogInterval = time.Minute
 )
 
-type Tunnel struct {
-	conn net.Conn
-	mu   sync.RWMutex
-}
+// Tunnel names double as URL path segments, so keep them to DNS label
+// characters.
+var tunnelNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
 
-var activeTunnel = &Tunnel{}
+var (
+	cfg        *Config
+	registry   = NewTunnelRegistry()
+	subdomains subdomainRouter
+	inFlight   limit.Semaphore
+	cache      *responseCache
+	// copyBuffers back the raw copies: response bodies, and spliced
+	// connections in tcp mode, CONNECT and WebSockets.
+	copyBuffers *relay.BufferPool
+
+	trustedProxies []*net.IPNet
+	headerRewrites []headerRewrite
+
+	// draining is set once shutdown starts; public requests that still
+	// arrive are turned away while in-flight ones finish.
+	draining atomic.Bool
+	// tunnelConns tracks the handleTunnelConn goroutines, which still
+	// log, count and release the cluster claim once a tunnel is closed.
+	tunnelConns sync.WaitGroup
+)
 
 func main() {
-	go startTunnelServer()
-	startPublicServer()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "tunnelctl":
+			os.Exit(runTunnelctl(os.Args[2:]))
+		}
+	}
+
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	var err error
+	cfg, err = loadConfig(flag.CommandLine, os.Args[1:])
+	if *showVersion {
+		fmt.Println("intunja server", version.String())
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	logger, err := logging.New(os.Stderr, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	cfg.warnDeprecated()
+
+	if authenticator == nil {
+		switch {
+		case cfg.TLS.ClientCA != "":
+			authenticator = clientCert{token: staticToken(cfg.AuthToken)}
+		case cfg.AuthToken == "":
+			slog.Warn("no auth token set, any client can register a tunnel")
+			fallthrough
+		default:
+			authenticator = staticToken(cfg.AuthToken)
+		}
+	}
+
+	subdomains = subdomainRouter{domain: cfg.Domain}
+	inFlight = limit.New(cfg.MaxConcurrent)
+	bandwidth = newBandwidthLimits(cfg.BandwidthLimit)
+	policies = []*listenerPolicy{newListenerPolicy(cfg.mainListener())}
+	for _, l := range cfg.Listeners {
+		policies = append(policies, newListenerPolicy(l))
+	}
+	cache = newResponseCache(cfg.CacheSize)
+	cors = newCORSPolicy(cfg.CORS)
+	basicUsers = newBasicAuth(cfg.BasicAuth)
+	if cluster, err = newClusterNode(cfg.Cluster); err != nil {
+		fatal("failed to set up cluster registry", "err", err)
+	}
+	copyBuffers = relay.NewBufferPool(cfg.CopyBufferSize)
+	if cfg.OfflinePage != "" {
+		if offline, err = loadOfflinePage(cfg.OfflinePage); err != nil {
+			fatal("failed to read offline page", "err", err)
+		}
+	}
+	if cfg.WellKnown {
+		if intercepted, err = loadWellKnown(cfg.RobotsTxt); err != nil {
+			fatal("failed to read robots.txt", "err", err)
+		}
+	}
+	if cfg.Record != "" {
+		if recorder, err = openRecorder(cfg.Record); err != nil {
+			fatal("failed to open request recording", "err", err)
+		}
+	}
+	if cfg.Log.Access != "" {
+		if accesses, err = openAccessLog(cfg.Log.Access, cfg.Log.AccessSample, cfg.Log.AccessMaxSize); err != nil {
+			fatal("failed to open access log", "err", err)
+		}
+		defer accesses.close()
+	}
+	// Already checked by loadConfig
+	trustedProxies, _ = parseCIDRs(cfg.TrustedProxies)
+	headerRewrites, _ = parseHeaderRewrites(cfg.RewriteHeaders)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "intunja-server", version.Version, cfg.OTLPEndpoint)
+	if err != nil {
+		fatal("failed to set up tracing", "err", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	listeners := []net.Listener{startTunnelServer()}
+	if cfg.Mode == "tcp" {
+		listeners = append(listeners, startTCPServer())
+	}
+	servers := startPublicServer()
+	go cluster.renew(ctx)
+
+	<-ctx.Done()
+	stop()
+	shutdown(listeners, servers)
+
+	// Send the spans still waiting to be exported
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Warn("failed to flush traces", "err", err)
+	}
+}
+
+// shutdown stops taking new tunnels and public connections, waits for
+// in-flight requests up to the shutdown timeout, then closes the tunnels.
+func shutdown(listeners []net.Listener, servers []*http.Server) {
+	slog.Info("shutting down", "timeout", cfg.ShutdownTimeout)
+	draining.Store(true)
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Go(func() {
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Warn("gave up waiting for in-flight requests", "addr", srv.Addr, "err", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	registry.CloseAll()
+	// Give the closed tunnels the rest of the timeout to release their
+	// cluster claims, rather than leave them to expire
+	released := make(chan struct{})
+	go func() {
+		tunnelConns.Wait()
+		close(released)
+	}()
+	select {
+	case <-released:
+	case <-ctx.Done():
+	}
+	slog.Info("server stopped")
 }
 
-func startTunnelServer() {
-	listener, err := net.Listen("tcp", tunnelPort)
+func startTunnelServer() net.Listener {
+	var tlsConfig *tls.Config
+	if cfg.TLS.Enabled {
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			fatal("failed to load TLS certificate", "err", err)
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		if cfg.TLS.ClientCA != "" {
+			if tlsConfig.ClientCAs, err = loadCertPool(cfg.TLS.ClientCA); err != nil {
+				fatal("failed to load TLS client CA", "err", err)
+			}
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	var listener net.Listener
+	var err error
+	if cfg.Transport == "quic" {
+		listener, err = quicconn.Listen(cfg.TunnelAddr, tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", cfg.TunnelAddr)
+		if err == nil && tlsConfig != nil {
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+	}
 	if err != nil {
-		log.Fatal("Failed to start tunnel server:", err)
+		fatal("failed to start tunnel server", "err", err)
 	}
-	defer listener.Close()
 
-	log.Printf("🔌 Tunnel server listening on %s", tunnelPort)
+	slog.Info("tunnel server listening", "addr", listener.Addr().String(), "transport", cfg.Transport, "tls", cfg.TLS.Enabled, "client_certs", cfg.TLS.ClientCA != "")
+	go acceptTunnels(listener)
+	return listener
+}
 
+func acceptTunnels(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("Accept error:", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("accept failed", "err", err)
 			continue
 		}
 
-		activeTunnel.mu.Lock()
-		if activeTunnel.conn != nil {
-			activeTunnel.conn.Close()
-			log.Println("⚠️  Closed previous tunnel connection")
-		}
-		activeTunnel.conn = conn
-		activeTunnel.mu.Unlock()
-
-		log.Println("✅ Home server connected via tunnel")
-
-		go func(c net.Conn) {
-			buf := make([]byte, 1)
-			for {
-				c.SetReadDeadline(time.Now().Add(30 * time.Second))
-				_, err := c.Read(buf)
-				if err != nil {
-					log.Println("🔌 Tunnel disconnected:", err)
-					activeTunnel.mu.Lock()
-					if activeTunnel.conn == c {
-						activeTunnel.conn = nil
-					}
-					activeTunnel.mu.Unlock()
-					c.Close()
-					return
-				}
-			}
-		}(conn)
+		opts := sockopt.Options{KeepAlive: cfg.TCPKeepAlive, NoDelay: cfg.NoDelay}
+		if err := opts.Apply(conn); err != nil {
+			slog.Warn("failed to set socket options", "remote_addr", conn.RemoteAddr().String(), "err", err)
+		}
+		tunnelConns.Go(func() { handleTunnelConn(conn) })
 	}
 }
 
-func startPublicServer() {
-	http.HandleFunc("/", handlePublicRequest)
-	http.HandleFunc("/health", handleHealth)
+func handleTunnelConn(conn net.Conn) {
+	// The client presents its credential before anything else
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	token, err := readAuthLine(conn)
+	if err != nil {
+		slog.Warn("rejected tunnel", "remote_addr", conn.RemoteAddr().String(), "reason", "auth", "err", err)
+		stats.TunnelDisconnects.WithLabelValues("auth").Inc()
+		conn.Close()
+		return
+	}
+
+	// The client names its tunnel in the first frame, using the stream ID
+	// field for its protocol Hello. Clients that report their version add
+	// it after the name, separated by a space.
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	flags, payload, err := mux.ReadFrame(conn)
+	if err != nil {
+		slog.Warn("tunnel handshake failed", "remote_addr", conn.RemoteAddr().String(), "reason", "handshake", "err", err)
+		stats.TunnelDisconnects.WithLabelValues("handshake").Inc()
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	hello := protocol.ParseRegister(flags)
+
+	name, clientVersion, _ := strings.Cut(string(payload), " ")
+	if !tunnelNamePattern.MatchString(name) {
+		slog.Warn("rejected tunnel with invalid name", "remote_addr", conn.RemoteAddr().String(), "tunnel", name, "reason", "handshake")
+		stats.TunnelDisconnects.WithLabelValues("handshake").Inc()
+		conn.Close()
+		return
+	}
+
+	local := protocol.Hello{Version: protocol.Current}
+	if cfg.Compress {
+		local.Features |= protocol.FeatureGzip
+	}
+	agreed, err := protocol.Negotiate(local, hello)
+	if err != nil {
+		slog.Warn("rejected tunnel", "remote_addr", conn.RemoteAddr().String(), "tunnel", name, "client_version", clientVersion, "reason", "protocol", "err", err)
+		stats.TunnelDisconnects.WithLabelValues("protocol").Inc()
+		refuseTunnel(conn, hello, 0, fmt.Errorf("%w; upgrade the client", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	principal, err := authenticator.Authenticate(ctx, Handshake{Token: token, Tunnel: name, RemoteAddr: conn.RemoteAddr(), Certificate: peerCertificate(conn)})
+	cancel()
+	if err != nil {
+		slog.Warn("rejected tunnel", "remote_addr", conn.RemoteAddr().String(), "tunnel", name, "reason", "auth", "err", err)
+		stats.TunnelDisconnects.WithLabelValues("auth").Inc()
+		refuseTunnel(conn, hello, agreed.Version, errAuthFailed)
+		return
+	}
+
+	// Version1 clients that didn't ask about compression don't wait for an
+	// answer
+	if hello.WantsAnswer() {
+		conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+		if _, err := conn.Write(agreed.Answer()); err != nil {
+			slog.Warn("tunnel handshake failed", "remote_addr", conn.RemoteAddr().String(), "reason", "handshake", "err", err)
+			stats.TunnelDisconnects.WithLabelValues("handshake").Inc()
+			conn.Close()
+			return
+		}
+		conn.SetWriteDeadline(time.Time{})
+	}
+	var zconn *compress.Conn
+	if agreed.Features&protocol.FeatureGzip != 0 {
+		zconn = compress.Gzip(conn)
+		conn = zconn
+	}
+
+	traffic := newTrafficConn(conn, name)
+	muxConfig := mux.DefaultConfig()
+	muxConfig.IdleTimeout = cfg.TunnelIdle
+	muxConfig.KeepAliveInterval = cfg.PingInterval
+	muxConfig.KeepAliveTimeout = cfg.PingTimeout
+	session := mux.Server(traffic, muxConfig)
+
+	tunnel, replaced, err := registry.Register(name, principal, session, traffic, cfg.SharedTunnels)
+	if err != nil {
+		slog.Warn("rejected tunnel", "remote_addr", conn.RemoteAddr().String(), "tunnel", name, "reason", "limit", "max", cfg.MaxTunnels)
+		stats.TunnelDisconnects.WithLabelValues("limit").Inc()
+		session.CloseWithReason(err)
+		bandwidth.remove(name)
+		return
+	}
+	cluster.claim(name)
+	if replaced {
+		slog.Warn("replacing previous tunnel connection", "tunnel", name, "drain_timeout", cfg.DrainTimeout)
+	}
+
+	slog.Info("tunnel connected", "tunnel", name, "principal", principal, "remote_addr", conn.RemoteAddr().String(), "client_version", clientVersion, "protocol", agreed.Version, "compressed", zconn != nil)
+	stats.TunnelConnects.Inc()
+	if zconn != nil {
+		go logCompression(session, zconn, name)
+	}
+	if cfg.MaxLifetime > 0 {
+		go rotateTunnel(tunnel, cfg.MaxLifetime)
+	}
+	if cfg.HealthPath != "" {
+		go checkBackend(tunnel)
+	}
 
-	log.Printf("🌐 Public API listening on %s", publicPort)
-	log.Fatal(http.ListenAndServe(publicPort, nil))
+	<-session.Closed()
+	reason := disconnectReason(session.Err())
+	slog.Info("tunnel disconnected", "tunnel", name, "principal", principal, "reason", reason, "err", session.Err())
+	stats.TunnelDisconnects.WithLabelValues(reason).Inc()
+	if registry.remove(tunnel) {
+		for _, p := range policies {
+			p.limiters.remove(name)
+		}
+		bandwidth.remove(name)
+	}
+	cluster.release(name)
 }
 
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	activeTunnel.mu.RLock()
-	connected := activeTunnel.conn != nil
-	activeTunnel.mu.RUnlock()
+// Reasons the server gives for closing a registered tunnel itself.
+var (
+	errReplaced     = errors.New("replaced by a new connection")
+	errUnregistered = errors.New("disconnected by admin")
+	errShuttingDown = errors.New("server shutting down")
+	errExpired      = errors.New("reached maximum tunnel lifetime")
+)
 
-	if connected {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "Tunnel: Connected\n")
-	} else {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		fmt.Fprintf(w, "Tunnel: Disconnected\n")
+// errAuthFailed is all a client turned away by the Authenticator is told.
+var errAuthFailed = errors.New("authentication failed")
+
+// refuseTunnel tells a client why its registration was refused, once it is
+// listening for the session, and hangs up. A client waiting for the
+// server's Hello first gets one with version, 0 if it was refused for its
+// protocol version, and compression declined.
+func refuseTunnel(conn net.Conn, hello protocol.Hello, version uint8, err error) {
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	if hello.WantsAnswer() {
+		answer := protocol.Hello{Flags: hello.Flags & protocol.FlagHello, Version: version}
+		if _, werr := conn.Write(answer.Answer()); werr != nil {
+			conn.Close()
+			return
+		}
 	}
+	mux.Server(conn, mux.DefaultConfig()).CloseWithReason(err)
 }
 
-func handlePublicRequest(w http.ResponseWriter, r *http.Request) {
-	activeTunnel.mu.RLock()
-	tunnel := activeTunnel.conn
-	activeTunnel.mu.RUnlock()
+// disconnectReason sorts a tunnel session's closing error into the reason
+// label for logs and metrics, telling deliberate closes apart from a
+// client going quiet or away.
+func disconnectReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errReplaced):
+		return "replaced"
+	case errors.Is(err, errUnregistered):
+		return "admin"
+	case errors.Is(err, errShuttingDown):
+		return "shutdown"
+	case errors.Is(err, errExpired):
+		return "expired"
+	case errors.Is(err, mux.ErrIdleTimeout):
+		return "idle"
+	case errors.Is(err, mux.ErrKeepAliveTimeout), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	default:
+		return "error"
+	}
+}
 
-	if tunnel == nil {
-		http.Error(w, "Service temporarily unavailable - tunnel not connected", http.StatusServiceUnavailable)
+// rotateTunnel retires t once it has been connected for lifetime, so its
+// client has to authenticate again: new requests stop going to it and the
+// client is asked to reconnect.
+func rotateTunnel(t *Tunnel, lifetime time.Duration) {
+	timer := time.NewTimer(lifetime)
+	defer timer.Stop()
+	select {
+	case <-t.session.Closed():
 		return
+	case <-timer.C:
 	}
 
-	log.Printf("📨 %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	slog.Info("rotating tunnel that reached its maximum lifetime", "tunnel", t.name, "lifetime", lifetime)
+	t.retiring.Store(true)
+	if err := t.session.GoAway(); err != nil {
+		return
+	}
 
-	clientConn, serverConn := net.Pipe()
-	defer clientConn.Close()
+	// The tunnel stays registered until the client's new connection is,
+	// so the name is never missing in between; it only drains after that
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-t.session.Closed():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	registry.Await(ctx, t.name, "", t, cfg.DrainTimeout)
+	drainTunnel(t, errExpired)
+}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+// drainTunnel closes a retiring tunnel with reason once the requests
+// already on it have finished, or -drain-timeout runs out.
+func drainTunnel(t *Tunnel, reason error) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(cfg.DrainTimeout)
+	for t.session.NumStreams() > 0 {
+		select {
+		case <-t.session.Closed():
+			return
+		case <-deadline:
+			slog.Warn("gave up waiting for requests on a retiring tunnel", "tunnel", t.name, "streams", t.session.NumStreams(), "reason", reason)
+			t.session.CloseWithError(reason)
+			return
+		case <-ticker.C:
+		}
+	}
+	t.session.CloseWithError(reason)
+}
+
+// logCompression reports how well a tunnel's traffic is compressing until
+// its session closes.
+func logCompression(session *mux.Session, conn *compress.Conn, name string) {
+	ticker := time.NewTicker(compressionLogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-session.Closed():
+			return
+		case <-ticker.C:
+			st := conn.Stats()
+			slog.Info("tunnel compression", "tunnel", name, "raw_bytes", st.Raw, "wire_bytes", st.Wire, "ratio", fmt.Sprintf("%.2f", st.Ratio()))
+		}
+	}
+}
+
+// startPublicServer starts every HTTP listener in the background and
+// returns them so they can be shut down together.
+func startPublicServer() []*http.Server {
+	var servers []*http.Server
+
+	metricsHandler := newMetricsHandler()
+	if cfg.MetricsAddr != "" {
+		servers = append(servers, serveMetrics(metricsHandler))
+	}
+
+	if cfg.AdminAddr != "" {
+		servers = append(servers, serveAdmin())
+	}
+
+	if cluster != nil {
+		servers = append(servers, serveCluster())
+	}
+
+	handler := publicHandler(metricsHandler)
+	if cfg.HTTPS.Enabled {
+		m := newCertManager()
+		servers = append(servers, serveHTTPS(m, handler))
 
+		// The plain listener must answer ACME HTTP-01 challenges
+		handler = m.HTTPHandler(handler)
+	}
+
+	listener, err := net.Listen("tcp", cfg.PublicAddr)
+	if err != nil {
+		fatal("failed to start public API", "err", err)
+	}
+	if cfg.ProxyProtocol {
+		listener = proxyListener{listener}
+	}
+	srv := &http.Server{Addr: cfg.PublicAddr, Handler: handler, Protocols: new(http.Protocols)}
+	setPublicTimeouts(srv)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(cfg.H2C)
+	slog.Info("public API listening", "addr", listener.Addr().String(), "proxy_protocol", cfg.ProxyProtocol)
 	go func() {
-		defer wg.Done()
-		defer serverConn.Close()
-		if err := r.Write(serverConn); err != nil {
-			log.Println("Error writing request to tunnel:", err)
+		if err := srv.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			fatal("public server failed", "err", err)
 		}
 	}()
 
-	go func() {
-		defer wg.Done()
+	servers = append(servers, srv)
+
+	for _, p := range policies[1:] {
+		servers = append(servers, serveListener(p))
+	}
+	return servers
+}
+
+// publicHandler serves the main public listener: requests for tunnels,
+// CONNECT, /health, and /metrics unless it has a listener of its own.
+func publicHandler(metricsHandler http.Handler) http.Handler {
+	// Preflights carry no credentials, so they are answered before any
+	// listener token is asked for
+	public := cors.wrap(policies[0].wrap(basicUsers.wrap(http.HandlerFunc(handlePublicRequest))))
+	connect := policies[0].wrap(http.HandlerFunc(handleConnect))
+	// Not http.DefaultServeMux, where net/http/pprof puts its handlers
+	routes := http.NewServeMux()
+	routes.Handle("/", public)
+	routes.HandleFunc("/health", handleHealth)
+	if cfg.MetricsAddr == "" {
+		routes.Handle("/metrics", metricsHandler)
+	}
+	return withConnect(routes, connect)
+}
+
+// setPublicTimeouts bounds how long the public listeners wait on slow
+// clients, so a connection trickling in headers can't be held open.
+func setPublicTimeouts(srv *http.Server) {
+	srv.ReadTimeout = cfg.ReadTimeout
+	srv.ReadHeaderTimeout = cfg.HeaderTimeout
+	srv.WriteTimeout = cfg.WriteTimeout
+	srv.IdleTimeout = cfg.IdleTimeout
+}
+
+func handlePublicRequest(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	stats.InFlight.Inc()
+	defer stats.InFlight.Dec()
+
+	// Headers about the public client's own connection end here, before
+	// any are added for the tunnel, as do those instances in a cluster
+	// send each other, which no public client or home API is to set or see
+	relay.RemoveHopByHop(r.Header)
+	r.Header.Del(forwardedByHeader)
+	r.Header.Del(clusterTokenHeader)
+
+	// Tag the request so its log lines on both ends can be matched up
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		id = uuid.NewString()
+		r.Header.Set(requestIDHeader, id)
+	}
+	w.Header().Set(requestIDHeader, id)
+
+	// Tell the client who connected so it can extend X-Forwarded-For; a
+	// value sent in by the public client is never passed on, nor is a
+	// chain that no trusted proxy vouches for
+	dropUntrustedForwarding(r)
+	if ip := remoteIP(r); ip != nil {
+		r.Header.Set(clientIPHeader, ip.String())
+	} else {
+		r.Header.Del(clientIPHeader)
+	}
+	logger := slog.With("request_id", id)
+
+	recording := recorder.start(r, id)
+	r, span := startSpan(r)
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	var name string
+	if draining.Load() {
+		rec.Header().Set("Connection", "close")
+		http.Error(rec, "Service Unavailable - server is shutting down", http.StatusServiceUnavailable)
+	} else if sem := inFlight; !sem.TryAcquire() {
+		logger.Warn("too many requests in flight, rejecting", "max", cfg.MaxConcurrent)
+		rec.Header().Set("Retry-After", "1")
+		http.Error(rec, "Service Unavailable - too many requests in flight", http.StatusServiceUnavailable)
+	} else {
+		// Released into the semaphore it was taken from, even if the
+		// server was set up again meanwhile
+		name = forwardRequest(rec, r, logger)
+		sem.Release()
+	}
+	duration := time.Since(start)
+	recorder.finish(recording, rec.status)
+	stats.ObserveRequest(name, rec.status, duration)
+	endSpan(span, name, rec.status)
+
+	logger.Info("request",
+		"tunnel", name,
+		"remote_addr", r.RemoteAddr,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", rec.status,
+		"duration_ms", duration.Milliseconds(),
+	)
+	accesses.log(r, id, rec, name, start, duration)
+
+	if rec.aborted {
+		// Drop the connection so the public client sees the response was
+		// cut off
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// forwardRequest sends r through the tunnel it is addressed to and returns
+// that tunnel's name, or "" if no registered tunnel matched.
+func forwardRequest(w http.ResponseWriter, r *http.Request, logger *slog.Logger) string {
+	var tunnel *Tunnel
+	var found bool
+	policy := policyOf(r)
+	affinity := affinityKey(r)
+	public := r
+	name, bySubdomain := subdomains.route(r)
+	if !bySubdomain {
+		name, r = routeByName(r)
+	}
+	// A tunnel this listener may not reach is as good as unregistered
+	if policy.reaches(name) {
+		tunnel, found = lookupTunnel(r.Context(), name, affinity)
+		if !found && cluster.forward(w, public, name) {
+			return name
+		}
+	}
+	if !found {
+		if offline != nil {
+			offline.serve(w, r)
+			return ""
+		}
+		if bySubdomain {
+			http.Error(w, fmt.Sprintf("Unknown subdomain %q - no tunnel is registered for it", name), http.StatusNotFound)
+		} else {
+			http.Error(w, fmt.Sprintf("No tunnel registered for %q", name), http.StatusNotFound)
+		}
+		return ""
+	}
+	if intercepted.serve(w, r) {
+		return name
+	}
+
+	if ok, wait := policy.limiters.allow(name); !ok {
+		w.Header().Set("Retry-After", retryAfter(wait))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return name
+	}
 
-		resp, err := http.ReadResponse(bufio.NewReader(clientConn), r)
+	tunnel.requests.Add(1)
+	defer func(start time.Time) { tunnel.latency.observe(time.Since(start)) }(time.Now())
+	requestsServed.Add(1)
+
+	key := cacheKey(name, r)
+	if e := cache.get(key, r); e != nil {
+		logger.Debug("serving cached response", "tunnel", name, "method", r.Method, "path", r.URL.Path)
+		e.serve(w, r, "HIT")
+		return name
+	}
+
+	logger.Debug("forwarding request", "tunnel", name, "method", r.Method, "path", r.URL.Path)
+
+	// The tunnel always speaks HTTP/1.1, whatever the public client used
+	if r.ProtoMajor != 1 {
+		r = r.Clone(r.Context())
+		r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+
+	// Oversized uploads are refused here rather than sent to the home server
+	if cfg.MaxBodyBytes > 0 {
+		if r.ContentLength > cfg.MaxBodyBytes {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return name
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
+	}
+
+	// Bodies are copied aside for logging as they are forwarded. A request
+	// without a body keeps http.NoBody so it is still sent without one.
+	var reqBody, respBody *bodyCapture
+	if cfg.Log.Bodies > 0 {
+		reqBody = &bodyCapture{limit: cfg.Log.Bodies}
+		respBody = &bodyCapture{limit: cfg.Log.Bodies}
+		if r.ContentLength != 0 {
+			r.Body = readCloser{io.TeeReader(r.Body, reqBody), r.Body}
+		}
+	}
+
+	if relay.IsWebSocketUpgrade(r.Header) {
+		stream, err := tunnel.session.OpenStream()
 		if err != nil {
-			log.Println("Error reading response from tunnel:", err)
-			return
+			logger.Error("failed to open tunnel stream", "tunnel", name, "err", err)
+			http.Error(w, "Bad Gateway - tunnel error", http.StatusBadGateway)
+			return name
+		}
+		proxyUpgrade(w, r, stream, logger)
+		return name
+	}
+
+	// A client that sent "Expect: 100-continue" has its body held back
+	// until the home server answers the expectation
+	var gate *continueGate
+	if expectsContinue(r) {
+		gate = newContinueGate(r.Body)
+		r.Body = gate
+	}
+
+	// Tear the stream down if the public client goes away or the home
+	// server takes too long to answer
+	ctx := r.Context()
+	if cfg.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.RequestTimeout)
+		defer cancel()
+	}
+
+	send := func() (*http.Response, func(), error) {
+		resp, done, err := roundTrip(ctx, tunnel, r, gate, logger)
+		if err != nil && cfg.ReconnectGrace > 0 && tunnel.closed() && replayable(r) {
+			// The tunnel dropped before the home server answered. A request
+			// that is safe to repeat is sent again if it comes back in time.
+			logger.Info("tunnel lost mid-request, waiting for it to reconnect", "tunnel", name, "grace", cfg.ReconnectGrace)
+			if next, ok := registry.Await(ctx, name, affinity, tunnel, cfg.ReconnectGrace); ok {
+				tunnel = next
+				resp, done, err = roundTrip(ctx, tunnel, r, gate, logger)
+			}
 		}
-		defer resp.Body.Close()
+		return resp, done, err
+	}
 
-		for k, v := range resp.Header {
-			for _, val := range v {
-				w.Header().Add(k, val)
+	var resp *http.Response
+	var done func()
+	var err error
+	if cfg.Coalesce && cacheableRequest(r) {
+		var shared *cacheEntry
+		var leader bool
+		if shared, leader, resp, done, err = coalesce(key, r, send); shared != nil {
+			var xcache string
+			if cache != nil {
+				xcache = "HIT"
+				if leader {
+					cache.store(shared)
+					xcache = "MISS"
+				}
 			}
+			logger.Debug("serving coalesced response", "tunnel", name, "method", r.Method, "path", r.URL.Path, "leader", leader)
+			shared.serve(w, r, xcache)
+			return name
+		}
+	}
+	if done == nil {
+		resp, done, err = send()
+	}
+	defer done()
+	if err != nil {
+		if errors.Is(err, errBodyTooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return name
+		}
+		if errors.Is(err, relay.ErrHeaderTooLarge) {
+			logger.Warn("tunnel response headers too large", "tunnel", name, "max", cfg.MaxHeaderBytes)
+			http.Error(w, "Bad Gateway - response headers too large", http.StatusBadGateway)
+			return name
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			logger.Warn("tunnel did not respond in time", "tunnel", name, "timeout", cfg.RequestTimeout)
+			http.Error(w, "Gateway Timeout - tunnel did not respond", http.StatusGatewayTimeout)
+			return name
+		}
+		if tunnel.retiring.Load() && tunnel.closed() {
+			// Its tunnel was replaced and closed before it could answer
+			logger.Warn("tunnel closed while draining", "tunnel", name, "err", err)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service Unavailable - tunnel reconnected, try again", http.StatusServiceUnavailable)
+			return name
+		}
+		logger.Error("failed to read response from tunnel", "tunnel", name, "err", err)
+		http.Error(w, "Bad Gateway - tunnel error", http.StatusBadGateway)
+		return name
+	}
+	defer resp.Body.Close()
+
+	limit, ok := limitResponse(resp)
+	if !ok {
+		logger.Warn("tunnel response too large", "tunnel", name, "content_length", resp.ContentLength, "max", cfg.MaxResponseBytes)
+		http.Error(w, "Bad Gateway - response too large", http.StatusBadGateway)
+		return name
+	}
+	var rbody io.Reader = resp.Body
+	if limit != nil {
+		rbody = limit
+	}
+
+	// Hold the head back briefly for the body to start, so a response the
+	// client resets straight away is still answered with a clean 502
+	first := startBody(rbody)
+	if first.failed() {
+		if errors.Is(first.err, errResponseTooLarge) {
+			logger.Warn("tunnel response too large", "tunnel", name, "max", cfg.MaxResponseBytes)
+			http.Error(w, "Bad Gateway - response too large", http.StatusBadGateway)
+			return name
+		}
+		logger.Error("tunnel response cut off", "tunnel", name, "err", first.err)
+		http.Error(w, "Bad Gateway - tunnel error", http.StatusBadGateway)
+		return name
+	}
+
+	// Those about the tunnel's own HTTP/1.1 hop end here too
+	relay.RemoveHopByHop(resp.Header)
+	rewriteHeaders(resp.Header, r)
+	// A response the cache keeps goes out as it came, so hits match it
+	_, fresh := cacheTTL(resp)
+	storing := fresh && cacheableRequest(r) && cache != nil
+	recode := passThrough
+	if !storing {
+		recode = recodeResponse(r, resp)
+	}
+	for k, v := range resp.Header {
+		if k == requestIDHeader {
+			// Already set from the public request
+			continue
+		}
+		for _, val := range v {
+			w.Header().Add(k, val)
+		}
+	}
+	if cache != nil {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	// Trailers are announced up front and filled in after the body
+	for k := range resp.Trailer {
+		w.Header().Add("Trailer", k)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	body := first.rest(w)
+	var captured *cappedBuffer
+	if storing {
+		captured = &cappedBuffer{limit: maxCachedBody}
+		body = io.TeeReader(body, captured)
+	}
+
+	if respBody != nil {
+		body = io.TeeReader(body, respBody)
+	}
+
+	out := w
+	var zw *gzipResponseWriter
+	var decoded *responseLimit
+	if recode != passThrough {
+		body = newGunzipReader(body, name)
+		// A small gzip can inflate to far more than it was, so the limit
+		// holds for what comes out of it too
+		if cfg.MaxResponseBytes > 0 {
+			decoded = newResponseLimit(body)
+			body = decoded
+		}
+	}
+	if recode == recompress {
+		zw = newGzipResponseWriter(w)
+		out = zw
+	}
+	err = copyResponse(out, body)
+	if zw != nil {
+		if ferr := zw.finish(err == nil); err == nil {
+			err = ferr
+		}
+	}
+	exceeded := limit.hit() || decoded.hit()
+	if exceeded {
+		logger.Warn("tunnel response too large", "tunnel", name, "max", cfg.MaxResponseBytes, "policy", cfg.MaxResponsePolicy, "decoded", decoded.hit())
+	}
+	if err != nil {
+		// Ending the response normally would pass off what arrived as
+		// the whole body
+		if !errors.Is(err, errResponseTooLarge) {
+			logger.Warn("failed to copy response body", "tunnel", name, "err", err)
 		}
-		w.WriteHeader(resp.StatusCode)
+		if rec, ok := w.(*statusRecorder); ok {
+			rec.aborted = true
+		}
+	} else if captured != nil && !captured.overflow && !exceeded {
+		cache.put(key, r, resp, captured.Bytes())
+	}
+	for k, v := range resp.Trailer {
+		// The prefix also lets through trailers that weren't announced
+		w.Header()[http.TrailerPrefix+k] = v
+	}
+
+	if reqBody != nil {
+		logger.Info("bodies",
+			"tunnel", name,
+			"request_headers", redacted(r.Header),
+			"request_body", reqBody,
+			"response_headers", redacted(resp.Header),
+			"response_body", respBody,
+		)
+	}
+
+	return name
+}
+
+// errBodyTooLarge means the public client sent more than -max-body-bytes.
+var errBodyTooLarge = errors.New("request body too large")
+
+// lookupTunnel picks a tunnel for name by affinity key, holding the
+// request for up to -reconnect-grace if the name's tunnel has just
+// dropped or is being rotated.
+func lookupTunnel(ctx context.Context, name, key string) (*Tunnel, bool) {
+	t, ok := registry.Pick(name, key)
+	if (ok && !t.retiring.Load()) || cfg.ReconnectGrace <= 0 {
+		return t, ok
+	}
+	if next, found := registry.Await(ctx, name, key, t, cfg.ReconnectGrace); found {
+		return next, true
+	}
+	return t, ok && !t.closed()
+}
 
-		if _, err := io.Copy(w, resp.Body); err != nil {
-			log.Println("Error copying response body:", err)
+// roundTrip sends r over a new stream on tunnel and reads the home
+// server's response. done closes the stream once the response has been
+// copied; it is never nil, and may be called more than once.
+//
+// A stream carries exactly one request, so responses can't be paired with
+// the wrong one. Requests a public client pipelines on one connection are
+// read by net/http one at a time, each after the last was answered, and so
+// get their own streams in turn.
+func roundTrip(ctx context.Context, tunnel *Tunnel, r *http.Request, gate *continueGate, logger *slog.Logger) (resp *http.Response, done func(), err error) {
+	stream, err := tunnel.session.OpenStream()
+	if err != nil {
+		return nil, func() {}, fmt.Errorf("failed to open tunnel stream: %w", err)
+	}
+
+	// The request is written concurrently with reading the response so a
+	// home server may answer before consuming the whole body.
+	writeDone := make(chan struct{})
+	var tooLarge bool
+	go func() {
+		defer close(writeDone)
+		if err := r.Write(stream); err != nil {
+			if gate.refused() {
+				return
+			}
+			if tooLarge = bodyTooLarge(r); tooLarge {
+				// Abandon the request; the home server sees a reset
+				stream.Close()
+				return
+			}
+			logger.Error("failed to write request to tunnel", "tunnel", tunnel.name, "err", err)
+			return
 		}
+		stream.CloseWrite()
 	}()
+	done = func() {
+		gate.open(false)
+		stream.Close()
+		<-writeDone
+	}
 
-	wg.Wait()
-	log.Printf("✅ %s %s -> completed", r.Method, r.URL.Path)
+	stopTeardown := context.AfterFunc(ctx, func() { stream.Close() })
+	head := relay.NewHeadLimiter(stream, int64(cfg.MaxHeaderBytes))
+	resp, err = readResponse(bufio.NewReader(head), r, gate)
+	stopTeardown()
+	if err != nil {
+		if errors.Is(err, relay.ErrHeaderTooLarge) {
+			// Stop the client end sending the rest
+			stream.Reset()
+		}
+		done()
+		if tooLarge {
+			return nil, done, errBodyTooLarge
+		}
+		return nil, done, err
+	}
+	head.Release()
+	return resp, done, nil
+}
+
+// replayable reports whether r can be sent again after the tunnel dropped
+// mid-request: it has no body to have been lost, and repeating it has no
+// further effect.
+func replayable(r *http.Request) bool {
+	if r.ContentLength != 0 {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// readResponse reads the home server's final response to r, opening gate
+// on 100 Continue and skipping any other interim responses.
+func readResponse(br *bufio.Reader, r *http.Request, gate *continueGate) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(br, r)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusContinue {
+			gate.open(true)
+			continue
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			gate.open(false)
+			return resp, nil
+		}
+	}
+}
+
+// headHold is how long a response head waits for its body. A body that
+// fails within it, even after it has started, gets a 502 in place of a
+// truncated response, while one that is slow or never finishes, such as
+// server-sent events, isn't held up for long.
+const headHold = 250 * time.Millisecond
+
+// bodyStart is what arrives of a response body within headHold, read
+// before the head is sent on.
+type bodyStart struct {
+	body    io.Reader
+	buf     []byte
+	n       int
+	err     error
+	reads   chan bodyRead
+	pending bool // a read was still waiting when the hold ended
+}
+
+type bodyRead struct {
+	n   int
+	err error
+}
+
+func startBody(body io.Reader) *bodyStart {
+	s := &bodyStart{body: body, buf: make([]byte, copyBuffers.Size()), reads: make(chan bodyRead, 1)}
+	s.read()
+	return s
+}
+
+// read fills the rest of buf in the background. Only one read is made at
+// a time, so buf past n is the reader's until it reports back.
+func (s *bodyStart) read() {
+	s.pending = true
+	go func(p []byte) {
+		n, err := s.body.Read(p)
+		s.reads <- bodyRead{n, err}
+	}(s.buf[s.n:])
+}
+
+// failed reads the body for up to headHold, until it ends or buf is full,
+// and reports whether it failed.
+func (s *bodyStart) failed() bool {
+	timer := time.NewTimer(headHold)
+	defer timer.Stop()
+	for {
+		select {
+		case r := <-s.reads:
+			s.pending = false
+			s.n += r.n
+			if r.err != nil {
+				s.err = r.err
+				return r.err != io.EOF
+			}
+			if s.n == len(s.buf) {
+				return false
+			}
+			s.read()
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// rest returns the whole body, with what was read put back in front. If
+// nothing was and a read is still waiting, the head is flushed to the
+// public client first.
+func (s *bodyStart) rest(w http.ResponseWriter) io.Reader {
+	held := bytes.NewReader(s.buf[:s.n])
+	switch {
+	case s.err == io.EOF:
+		return held
+	case s.err != nil:
+		return io.MultiReader(held, errorReader{s.err})
+	case !s.pending:
+		return io.MultiReader(held, s.body)
+	}
+	if s.n == 0 {
+		http.NewResponseController(w).Flush()
+	}
+	return io.MultiReader(held, &pendingRead{s: s}, s.body)
+}
+
+// pendingRead is the read still waiting when the hold ended.
+type pendingRead struct {
+	s    *bodyStart
+	data []byte
+	err  error
+	done bool
+}
+
+func (p *pendingRead) Read(b []byte) (int, error) {
+	if !p.done {
+		r := <-p.s.reads
+		p.data, p.err, p.done = p.s.buf[p.s.n:p.s.n+r.n], r.err, true
+		if p.err == nil {
+			p.err = io.EOF // on to the rest of the body
+		}
+	}
+	if len(p.data) > 0 {
+		n := copy(b, p.data)
+		p.data = p.data[n:]
+		return n, nil
+	}
+	return 0, p.err
+}
+
+type errorReader struct{ err error }
+
+func (r errorReader) Read([]byte) (int, error) { return 0, r.err }
+
+// copyResponse flushes after every read so streamed responses, such as
+// server-sent events, reach the public client as they come in.
+func copyResponse(w http.ResponseWriter, body io.Reader) error {
+	rc := http.NewResponseController(w)
+	pooled := copyBuffers.Get()
+	defer copyBuffers.Put(pooled)
+	buf := *pooled
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if ferr := rc.Flush(); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// bodyTooLarge reports whether r's body was cut off by -max-body-bytes.
+// Request.Write hides the body's read error, but the limiting reader keeps
+// returning it.
+func bodyTooLarge(r *http.Request) bool {
+	if cfg.MaxBodyBytes <= 0 {
+		return false
+	}
+	_, err := r.Body.Read(nil)
+	return errors.As(err, new(*http.MaxBytesError))
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
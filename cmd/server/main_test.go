@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+	"github.com/mindsgn-studio/intunja/internal/limit"
+	"github.com/mindsgn-studio/intunja/internal/logging"
+	"github.com/mindsgn-studio/intunja/internal/metrics"
+	"github.com/mindsgn-studio/intunja/internal/mux"
+	"github.com/mindsgn-studio/intunja/internal/protocol"
+	"github.com/mindsgn-studio/intunja/internal/relay"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(discardLogger())
+	os.Exit(m.Run())
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// setupServer loads a configuration from args and sets up the server's
+// globals from it as main does, without starting any listeners.
+func setupServer(t testing.TB, args ...string) {
+	t.Helper()
+	base := []string{"-tunnel-addr", "127.0.0.1:0", "-public-addr", "127.0.0.1:0"}
+	c, err := loadConfig(flag.NewFlagSet("intunja", flag.ContinueOnError), append(base, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = c
+
+	if cfg.TLS.ClientCA != "" {
+		authenticator = clientCert{token: staticToken(cfg.AuthToken)}
+	} else {
+		authenticator = staticToken(cfg.AuthToken)
+	}
+	registry = NewTunnelRegistry()
+	stats = metrics.New()
+	draining.Store(false)
+	subdomains = subdomainRouter{domain: cfg.Domain}
+	inFlight = limit.New(cfg.MaxConcurrent)
+	bandwidth = newBandwidthLimits(cfg.BandwidthLimit)
+	policies = []*listenerPolicy{newListenerPolicy(cfg.mainListener())}
+	for _, l := range cfg.Listeners {
+		policies = append(policies, newListenerPolicy(l))
+	}
+	cache = newResponseCache(cfg.CacheSize)
+	cors = newCORSPolicy(cfg.CORS)
+	basicUsers = newBasicAuth(cfg.BasicAuth)
+	if cluster, err = newClusterNode(cfg.Cluster); err != nil {
+		t.Fatal(err)
+	}
+	copyBuffers = relay.NewBufferPool(cfg.CopyBufferSize)
+	offline, intercepted, recorder, accesses = nil, nil, nil, nil
+	if cfg.OfflinePage != "" {
+		if offline, err = loadOfflinePage(cfg.OfflinePage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cfg.WellKnown {
+		if intercepted, err = loadWellKnown(cfg.RobotsTxt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cfg.Record != "" {
+		if recorder, err = openRecorder(cfg.Record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cfg.Log.Access != "" {
+		if accesses, err = openAccessLog(cfg.Log.Access, cfg.Log.AccessSample, cfg.Log.AccessMaxSize); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(accesses.close)
+	}
+	trustedProxies, _ = parseCIDRs(cfg.TrustedProxies)
+	headerRewrites, _ = parseHeaderRewrites(cfg.RewriteHeaders)
+
+	// The tunnels' goroutines read the globals the next test sets up
+	// again, so they have to be gone by then, as do the public handlers
+	// whose connections were hijacked, which the test servers don't wait
+	// for. Those end with the tunnel streams they are spliced to.
+	t.Cleanup(func() {
+		registry.CloseAll()
+		tunnelConns.Wait()
+		publicHandlers.Wait()
+	})
+}
+
+// publicHandlers tracks the requests the test servers' public listeners
+// are handling.
+var publicHandlers sync.WaitGroup
+
+func trackHandlers(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		publicHandlers.Add(1)
+		defer publicHandlers.Done()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// testServer is a tunnel server running in the test process.
+type testServer struct {
+	tunnels net.Listener
+	public  *httptest.Server
+}
+
+// startServer sets the server up from args and starts its tunnel listener
+// and main public listener on free local ports.
+func startServer(t testing.TB, args ...string) *testServer {
+	t.Helper()
+	setupServer(t, args...)
+
+	tunnels := startTunnelServer()
+	t.Cleanup(func() { tunnels.Close() })
+	public := httptest.NewServer(trackHandlers(publicHandler(newMetricsHandler())))
+	t.Cleanup(public.Close)
+	return &testServer{tunnels: tunnels, public: public}
+}
+
+// connect starts a client with opts for the test server and waits for its
+// tunnel to register.
+func (s *testServer) connect(t testing.TB, opts client.Options) *client.Client {
+	t.Helper()
+	opts.Remote = s.tunnels.Addr().String()
+	if opts.AuthToken == "" {
+		opts.AuthToken = cfg.AuthToken
+	}
+	if opts.Name == "" {
+		opts.Name = "default"
+	}
+	if opts.Logger == nil {
+		opts.Logger = discardLogger()
+	}
+	c, err := client.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start(context.Background())
+	t.Cleanup(c.Stop)
+	waitTunnel(t, opts.Name)
+	return c
+}
+
+// url returns the public URL of path on the tunnel called name.
+func (s *testServer) url(name, path string) string {
+	return s.public.URL + "/" + name + path
+}
+
+// waitTunnel waits for a tunnel to be registered under name.
+func waitTunnel(t testing.TB, name string) *Tunnel {
+	t.Helper()
+	var tunnel *Tunnel
+	waitFor(t, func() bool {
+		var ok bool
+		tunnel, ok = registry.Lookup(name)
+		return ok
+	})
+	return tunnel
+}
+
+// waitFor polls cond until it holds, failing the test after 5s.
+func waitFor(t testing.TB, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// serveHome plays a minimal home server on conn: it registers as name and
+// answers every request the server forwards with handler.
+func serveHome(t testing.TB, conn net.Conn, name string, handler http.Handler) *mux.Session {
+	t.Helper()
+	return serveHomeStreams(t, conn, name, func(stream *mux.Stream) { serveStream(stream, handler) })
+}
+
+// serveHomeStreams is serveHome for a home server that answers each
+// forwarded stream itself.
+func serveHomeStreams(t testing.TB, conn net.Conn, name string, serve func(*mux.Stream)) *mux.Session {
+	t.Helper()
+	if _, err := fmt.Fprintf(conn, "AUTH %s\n", cfg.AuthToken); err != nil {
+		t.Fatal(err)
+	}
+	hello := protocol.Hello{Flags: protocol.FlagHello, Version: protocol.Current}
+	if err := mux.WriteFrame(conn, hello.Register(), []byte(name)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protocol.ReadAnswer(conn); err != nil {
+		t.Fatal(err)
+	}
+	session := mux.Client(conn, mux.DefaultConfig())
+	t.Cleanup(func() { session.Close() })
+	go func() {
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			go serve(stream)
+		}
+	}()
+	return session
+}
+
+func serveStream(stream *mux.Stream, handler http.Handler) {
+	defer stream.Close()
+	req, err := http.ReadRequest(bufio.NewReader(stream))
+	if err != nil {
+		return
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	resp := rec.Result()
+	resp.ContentLength = int64(rec.Body.Len())
+	resp.Request = req
+	resp.Write(stream)
+}
+
+func TestForwardOverPipe(t *testing.T) {
+	setupServer(t)
+
+	serverEnd, homeEnd := net.Pipe()
+	tunnelConns.Go(func() { handleTunnelConn(serverEnd) })
+	serveHome(t, homeEnd, "home", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello from %s", r.URL.Path)
+	}))
+	waitTunnel(t, "home")
+
+	w := httptest.NewRecorder()
+	handlePublicRequest(w, httptest.NewRequest(http.MethodGet, "/home/greeting", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body)
+	}
+	if got, want := w.Body.String(), "hello from /greeting"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+// captureLogs sends the default logger's JSON lines to the returned buffer
+// until the test ends.
+func captureLogs(t testing.TB) *syncBuffer {
+	t.Helper()
+	buf := new(syncBuffer)
+	logger, err := logging.New(buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(discardLogger()) })
+	return buf
+}
+
+// syncBuffer is a bytes.Buffer that handlers on other goroutines can log
+// to while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines decodes the JSON lines logged with msg.
+func (b *syncBuffer) lines(t testing.TB, msg string) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var found []map[string]any
+	for _, l := range bytes.Split(bytes.TrimSpace(b.buf.Bytes()), []byte("\n")) {
+		if len(l) == 0 {
+			continue
+		}
+		var m map[string]any
+		if err := json.Unmarshal(l, &m); err != nil {
+			t.Fatalf("log line is not JSON: %v: %s", err, l)
+		}
+		if m["msg"] == msg {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// line returns the last line logged with msg, failing the test if there
+// is none.
+func (b *syncBuffer) line(t testing.TB, msg string) map[string]any {
+	t.Helper()
+	found := b.lines(t, msg)
+	if len(found) == 0 {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		t.Fatalf("no %q log line in:\n%s", msg, b.buf.Bytes())
+	}
+	return found[len(found)-1]
+}
+
+func TestRequestLog(t *testing.T) {
+	setupServer(t)
+	logs := captureLogs(t)
+
+	handlePublicRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nowhere/x", nil))
+
+	line := logs.line(t, "request")
+	for _, key := range []string{"request_id", "tunnel", "remote_addr", "method", "path", "status", "duration_ms"} {
+		if _, ok := line[key]; !ok {
+			t.Errorf("request log line has no %q: %v", key, line)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+		io.WriteString(w, "finished")
+	}))
+	defer backend.Close()
+
+	s := startServer(t, "-shutdown-timeout", "10s")
+	s.connect(t, client.Options{Name: "busy", Local: backend.URL})
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(s.url("busy", "/slow"))
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		inFlight <- result{resp.StatusCode, string(body), err}
+	}()
+	<-arrived
+
+	stopped := make(chan struct{})
+	go func() {
+		shutdown([]net.Listener{s.tunnels}, []*http.Server{s.public.Config})
+		close(stopped)
+	}()
+	waitFor(t, draining.Load)
+
+	// A request that gets in now is turned away
+	w := httptest.NewRecorder()
+	handlePublicRequest(w, httptest.NewRequest(http.MethodGet, "/busy/new", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("new request during shutdown: status %d, want 503", w.Code)
+	}
+	select {
+	case <-stopped:
+		t.Fatal("shutdown finished with a request in flight")
+	default:
+	}
+
+	close(release)
+	r := <-inFlight
+	if r.err != nil || r.status != http.StatusOK || r.body != "finished" {
+		t.Errorf("in-flight request: %d %q %v, want 200 finished", r.status, r.body, r.err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't finish after the last request")
+	}
+	if registry.Len() != 0 {
+		t.Errorf("%d tunnels still registered after shutdown", registry.Len())
+	}
+}
+
+// blockingBackend starts a local API that holds every request until
+// release is closed, announcing each on arrived.
+func blockingBackend(t testing.TB) (url string, arrived <-chan struct{}, release chan struct{}) {
+	t.Helper()
+	in := make(chan struct{}, 100)
+	release = make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		in <- struct{}{}
+		<-release
+		io.WriteString(w, "done")
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	return srv.URL, in, release
+}
+
+// saturate holds one request on the tunnel called name, then sends another
+// and returns its response before letting the first finish.
+func saturate(t *testing.T, s *testServer, name string, arrived <-chan struct{}, release chan struct{}) *http.Response {
+	t.Helper()
+	first := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(s.url(name, "/first"))
+		if err == nil {
+			resp.Body.Close()
+		}
+		first <- err
+	}()
+	<-arrived
+
+	resp, err := http.Get(s.url(name, "/second"))
+	close(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := <-first; err != nil {
+		t.Errorf("first request: %v", err)
+	}
+	return resp
+}
+
+func TestServerConcurrencyLimit(t *testing.T) {
+	local, arrived, release := blockingBackend(t)
+	s := startServer(t, "-max-concurrent", "1")
+	s.connect(t, client.Options{Name: "busy", Local: local})
+
+	resp := saturate(t, s, "busy", arrived, release)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("overflow request: status %d, Retry-After %q; want 503 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestClientConcurrencyLimit(t *testing.T) {
+	local, arrived, release := blockingBackend(t)
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "busy", Local: local, MaxConcurrent: 1})
+
+	resp := saturate(t, s, "busy", arrived, release)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("overflow request: status %d, Retry-After %q; want 503 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		fmt.Fprintf(w, "got %d bytes", n)
+	}))
+	defer backend.Close()
+
+	s := startServer(t, "-max-body-bytes", "1024")
+	s.connect(t, client.Options{Name: "upload", Local: backend.URL})
+
+	post := func(body io.Reader) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, s.url("upload", "/"), body)
+		return get(t, req)
+	}
+	// A reader of unknown size is sent chunked
+	chunked := func(n int) io.Reader { return io.MultiReader(strings.NewReader(strings.Repeat("x", n))) }
+
+	tests := []struct {
+		name   string
+		body   io.Reader
+		status int
+	}{
+		{"under", strings.NewReader(strings.Repeat("x", 1000)), http.StatusOK},
+		{"at", strings.NewReader(strings.Repeat("x", 1024)), http.StatusOK},
+		{"over", strings.NewReader(strings.Repeat("x", 1025)), http.StatusRequestEntityTooLarge},
+		{"chunked under", chunked(1000), http.StatusOK},
+		{"chunked over", chunked(100000), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		status, body := post(tt.body)
+		if status != tt.status {
+			t.Errorf("%s: status %d (%q), want %d", tt.name, status, body, tt.status)
+		}
+	}
+}
+
+func TestCompressedTunnel(t *testing.T) {
+	payload := strings.Repeat("a large and very repetitive response body\n", 100000)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, payload)
+	}))
+	defer backend.Close()
+
+	s := startServer(t, "-compress")
+	s.connect(t, client.Options{Name: "zipped", Local: backend.URL, Compress: true})
+
+	req, _ := http.NewRequest(http.MethodGet, s.url("zipped", "/"), nil)
+	status, body := get(t, req)
+	if status != http.StatusOK || body != payload {
+		t.Fatalf("got %d with %d bytes, want 200 with %d", status, len(body), len(payload))
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	seen := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Get(requestIDHeader)
+	}))
+	defer backend.Close()
+
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "traced", Local: backend.URL})
+
+	for _, sent := range []string{"", "from-the-public-client"} {
+		req, _ := http.NewRequest(http.MethodGet, s.url("traced", "/x"), nil)
+		if sent != "" {
+			req.Header.Set(requestIDHeader, sent)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		id := resp.Header.Get(requestIDHeader)
+		if id == "" || sent != "" && id != sent {
+			t.Errorf("sent ID %q, response has %q", sent, id)
+		}
+		if local := <-seen; local != id {
+			t.Errorf("local API saw ID %q, response has %q", local, id)
+		}
+	}
+}
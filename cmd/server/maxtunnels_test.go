@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/mindsgn-studio/intunja/internal/mux"
+)
+
+func TestMaxTunnels(t *testing.T) {
+	s := startServer(t, "-auth-token", "secret", "-max-tunnels", "2")
+	logs := captureLogs(t)
+	s.register(t, "secret", "first")
+	s.register(t, "secret", "second")
+	first := waitTunnel(t, "first")
+	waitTunnel(t, "second")
+
+	// The next name is turned away, and told why
+	third := s.register(t, "secret", "third")
+	select {
+	case <-third.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("a tunnel over the limit was kept")
+	}
+	var peer *mux.PeerError
+	if !errors.As(third.Err(), &peer) || peer.Reason != errTooManyTunnels.Error() {
+		t.Errorf("closed with %v, want the tunnel limit", third.Err())
+	}
+	if _, ok := registry.Lookup("third"); ok {
+		t.Error("the tunnel over the limit was registered")
+	}
+	if line := logs.line(t, "rejected tunnel"); line["tunnel"] != "third" || line["reason"] != "limit" {
+		t.Errorf("logged %v", line)
+	}
+	if n := testutil.ToFloat64(stats.TunnelDisconnects.WithLabelValues("limit")); n != 1 {
+		t.Errorf("%v limit disconnects counted", n)
+	}
+
+	// A name already registered may reconnect in its own place
+	again := s.register(t, "secret", "first")
+	waitFor(t, func() bool {
+		tunnel, ok := registry.Lookup("first")
+		return ok && tunnel != first
+	})
+	if err := again.Err(); err != nil {
+		t.Errorf("reconnecting tunnel closed: %v", err)
+	}
+}
+
+func TestMaxTunnelsUnlimited(t *testing.T) {
+	s := startServer(t, "-auth-token", "secret")
+	for _, name := range []string{"a", "b", "c", "d"} {
+		s.register(t, "secret", name)
+		waitTunnel(t, name)
+	}
+}
+
+func TestMaxTunnelsCountsConnections(t *testing.T) {
+	s := startServer(t, "-auth-token", "secret", "-max-tunnels", "2", "-shared-tunnels")
+	s.register(t, "secret", "home")
+	s.register(t, "secret", "home")
+	waitFor(t, func() bool { return len(registry.List()) == 2 })
+
+	// Sharing a name doesn't get round the limit, nor does another name
+	for _, name := range []string{"home", "media"} {
+		over := s.register(t, "secret", name)
+		select {
+		case <-over.Closed():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("a third connection, for %s, was kept", name)
+		}
+		var peer *mux.PeerError
+		if !errors.As(over.Err(), &peer) || peer.Reason != errTooManyTunnels.Error() {
+			t.Errorf("%s: closed with %v, want the tunnel limit", name, over.Err())
+		}
+	}
+	if n := len(registry.List()); n != 2 {
+		t.Errorf("%d tunnels registered, want 2", n)
+	}
+
+	// A connection that retires makes room for one to take over from it
+	first := registry.List()[0]
+	first.retiring.Store(true)
+	s.register(t, "secret", "home")
+	waitFor(t, func() bool { return len(registry.List()) == 3 })
+}
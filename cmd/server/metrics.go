@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/mindsgn-studio/intunja/internal/metrics"
+)
+
+var stats = metrics.New()
+
+func newMetricsHandler() http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	reg.MustRegister(stats.Collectors()...)
+
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
+
+func serveMetrics(handler http.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	srv := &http.Server{Addr: cfg.MetricsAddr, Handler: mux}
+
+	slog.Info("metrics listening", "addr", cfg.MetricsAddr)
+	go func() {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			fatal("metrics server failed", "err", err)
+		}
+	}()
+	return srv
+}
+
+// statusRecorder remembers the status code written through it, how many
+// body bytes followed, and whether the response was cut off after them.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	aborted bool
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer for
+// flushing and hijacking.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func TestMetrics(t *testing.T) {
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "counted", Local: newBackend(t, "counted").URL})
+
+	for range 3 {
+		req, _ := http.NewRequest(http.MethodGet, s.url("counted", "/x"), nil)
+		get(t, req)
+	}
+	req, _ := http.NewRequest(http.MethodGet, s.url("missing", "/x"), nil)
+	get(t, req)
+
+	if got := testutil.ToFloat64(stats.Requests.WithLabelValues("counted", "200")); got != 3 {
+		t.Errorf("requests through the tunnel = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(stats.Requests.WithLabelValues("", "404")); got != 1 {
+		t.Errorf("requests for no tunnel = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(stats.TunnelConnects); got != 1 {
+		t.Errorf("tunnel connects = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(stats.InFlight); got != 0 {
+		t.Errorf("requests in flight = %v, want 0", got)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, s.public.URL+"/metrics", nil)
+	status, body := get(t, req)
+	if status != http.StatusOK {
+		t.Fatalf("/metrics status = %d", status)
+	}
+	for _, want := range []string{
+		`intunja_requests_total{code="200",tunnel="counted"} 3`,
+		`intunja_tunnel_connects_total 1`,
+		`intunja_request_duration_seconds_count{tunnel="counted"} 3`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics is missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// mtlsServer starts a TLS tunnel server that requires client certificates
+// signed by ca, and returns it with the TLS config a client trusting it
+// starts from.
+func mtlsServer(t *testing.T, ca *testCert, args ...string) (*testServer, *tls.Config) {
+	t.Helper()
+	server := newCert(t, "intunja test", nil)
+	s := startServer(t, append([]string{"-tls", "-tls-cert", server.certFile, "-tls-key", server.keyFile, "-tls-client-ca", ca.certFile}, args...)...)
+	return s, &tls.Config{RootCAs: server.pool()}
+}
+
+// refused runs a client with opts against s until it reports an error,
+// and checks that it never registered.
+func refused(t *testing.T, s *testServer, opts client.Options) error {
+	t.Helper()
+	errs := make(chan error, 1)
+	opts.Remote = s.tunnels.Addr().String()
+	opts.Logger = discardLogger()
+	opts.OnError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	c, err := client.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start(t.Context())
+	defer c.Stop()
+	select {
+	case err = <-errs:
+	case <-time.After(15 * time.Second):
+		t.Fatal("the client got no error")
+	}
+	if registry.Len() != 0 {
+		t.Error("the client registered")
+	}
+	return err
+}
+
+func TestClientCertificate(t *testing.T) {
+	ca := newCert(t, "home CA", nil)
+	s, config := mtlsServer(t, ca)
+	config.Certificates = []tls.Certificate{newCert(t, "home-1", ca).tlsCertificate(t)}
+	s.connect(t, client.Options{Name: "home", Local: newBackend(t, "home").URL, TLS: config})
+
+	if tunnel := waitTunnel(t, "home"); tunnel.principal != "home-1" {
+		t.Errorf("principal %q, want the certificate's common name", tunnel.principal)
+	}
+	if code, body := get(t, mustRequest(t, s.url("home", "/x"))); code != http.StatusOK || body != "home /x" {
+		t.Errorf("got %d %q", code, body)
+	}
+}
+
+func TestClientCertificateUntrusted(t *testing.T) {
+	ca := newCert(t, "home CA", nil)
+	s, config := mtlsServer(t, ca)
+
+	// Signed by another CA
+	config.Certificates = []tls.Certificate{newCert(t, "home-1", newCert(t, "other CA", nil)).tlsCertificate(t)}
+	refused(t, s, client.Options{Name: "home", Local: "http://127.0.0.1:1", TLS: config})
+
+	// None at all
+	config.Certificates = nil
+	refused(t, s, client.Options{Name: "home", Local: "http://127.0.0.1:1", TLS: config})
+}
+
+func TestClientCertificateAndToken(t *testing.T) {
+	ca := newCert(t, "home CA", nil)
+	s, config := mtlsServer(t, ca, "-auth-token", "secret")
+	config.Certificates = []tls.Certificate{newCert(t, "home-1", ca).tlsCertificate(t)}
+
+	// The token is still checked alongside the certificate
+	if err := refused(t, s, client.Options{Name: "home", Local: "http://127.0.0.1:1", AuthToken: "wrong", TLS: config}); !errors.Is(err, client.AuthFailed) {
+		t.Errorf("wrong token: %v, want %v", err, client.AuthFailed)
+	}
+	s.connect(t, client.Options{Name: "home", Local: newBackend(t, "home").URL, AuthToken: "secret", TLS: config})
+	if tunnel := waitTunnel(t, "home"); tunnel.principal != "home-1" {
+		t.Errorf("principal %q, want the certificate's common name", tunnel.principal)
+	}
+}
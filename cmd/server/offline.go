@@ -0,0 +1,46 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// offlinePage is what public clients get, with a 503, when the tunnel they
+// asked for isn't connected.
+type offlinePage struct {
+	body        []byte
+	contentType string
+}
+
+// offline is nil unless -offline-page is set, which leaves the plain text
+// 404.
+var offline *offlinePage
+
+// loadOfflinePage reads the page at path, typed by its extension or, failing
+// that, its content.
+func loadOfflinePage(path string) (*offlinePage, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ct := mime.TypeByExtension(filepath.Ext(path))
+	if ct == "" {
+		ct = http.DetectContentType(body)
+	}
+	return &offlinePage{body: body, contentType: ct}, nil
+}
+
+func (p *offlinePage) serve(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Content-Type", p.contentType)
+	h.Set("Content-Length", strconv.Itoa(len(p.body)))
+	h.Set("Cache-Control", "no-store")
+	h.Set("Retry-After", "30")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method != http.MethodHead {
+		w.Write(p.body)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func TestOfflinePage(t *testing.T) {
+	for _, c := range []struct {
+		file, body, contentType string
+	}{
+		{"offline.html", "<h1>Back soon</h1>", "text/html; charset=utf-8"},
+		{"offline.json", `{"status":"maintenance"}`, "application/json"},
+		{"offline", "<!DOCTYPE html><p>Back soon</p>", "text/html; charset=utf-8"},
+	} {
+		t.Run(c.file, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), c.file)
+			if err := os.WriteFile(path, []byte(c.body), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			s := startServer(t, "-offline-page", path)
+
+			resp, err := http.Get(s.url("away", "/"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusServiceUnavailable || string(body) != c.body {
+				t.Errorf("%s: %d %q", c.file, resp.StatusCode, body)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != c.contentType {
+				t.Errorf("%s: Content-Type %q, want %q", c.file, ct, c.contentType)
+			}
+			if resp.Header.Get("Retry-After") == "" {
+				t.Errorf("%s: no Retry-After", c.file)
+			}
+		})
+	}
+}
+
+func TestOfflinePageOnlyWhenOffline(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "online")
+	}))
+	defer backend.Close()
+	path := filepath.Join(t.TempDir(), "offline.html")
+	os.WriteFile(path, []byte("<h1>Back soon</h1>"), 0o644)
+	s := startServer(t, "-offline-page", path)
+	s.connect(t, client.Options{Name: "home", Local: backend.URL})
+
+	if code, body := get(t, mustRequest(t, s.url("home", "/"))); code != http.StatusOK || body != "online" {
+		t.Errorf("connected tunnel: %d %q", code, body)
+	}
+	req, _ := http.NewRequest(http.MethodHead, s.url("away", "/"), nil)
+	if code, body := get(t, req); code != http.StatusServiceUnavailable || body != "" {
+		t.Errorf("HEAD: %d %q", code, body)
+	}
+}
+
+func TestOfflineDefault(t *testing.T) {
+	s := startServer(t)
+	resp, err := http.Get(s.url("away", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("without -offline-page: %d %s %q", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+}
+
+func TestOfflinePageMissing(t *testing.T) {
+	if _, err := loadOfflinePage(filepath.Join(t.TempDir(), "missing.html")); err == nil {
+		t.Error("missing page loaded")
+	}
+}
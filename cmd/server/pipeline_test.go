@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func TestPipelinedRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first answer is the slower, so a mix-up would show
+		if r.URL.Path == "/first" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		io.WriteString(w, "answer to "+r.URL.Path)
+	}))
+	defer backend.Close()
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "piped", Local: backend.URL})
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.public.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// Both requests go out before either answer comes back
+	if _, err := io.WriteString(conn, "GET /piped/first HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"GET /piped/second HTTP/1.1\r\nHost: x\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	for _, want := range []string{"answer to /first", "answer to /second"} {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != want {
+			t.Errorf("got %d %q, want %q", resp.StatusCode, body, want)
+		}
+	}
+}
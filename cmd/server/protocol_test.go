@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/internal/mux"
+	"github.com/mindsgn-studio/intunja/internal/protocol"
+)
+
+// handshakeWith registers name with hello as the client's, and returns
+// the connection with the server's answer read, if one was due.
+func (s *testServer) handshakeWith(t *testing.T, name string, hello protocol.Hello) (net.Conn, protocol.Hello) {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.tunnels.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "AUTH \n")
+	if err := mux.WriteFrame(conn, hello.Register(), []byte(name)); err != nil {
+		t.Fatal(err)
+	}
+	if !hello.WantsAnswer() {
+		return conn, protocol.Hello{}
+	}
+	answer, err := protocol.ReadAnswer(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn, answer
+}
+
+func TestHandshakeVersions(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		args  []string
+		hello protocol.Hello
+		want  protocol.Hello
+	}{
+		{
+			"matching",
+			[]string{"-compress"},
+			protocol.Hello{Flags: protocol.FlagHello | protocol.FlagGzip, Version: protocol.Current, Features: protocol.FeatureGzip},
+			protocol.Hello{Flags: protocol.FlagHello | protocol.FlagGzip, Version: protocol.Current, Features: protocol.FeatureGzip},
+		},
+		{
+			"newer client",
+			nil,
+			protocol.Hello{Flags: protocol.FlagHello | protocol.FlagGzip, Version: protocol.Current + 1, Features: protocol.FeatureGzip | 1<<9},
+			protocol.Hello{Flags: protocol.FlagHello, Version: protocol.Current},
+		},
+		{
+			"version 1 client asking for gzip",
+			[]string{"-compress"},
+			protocol.Hello{Flags: protocol.FlagGzip},
+			protocol.Hello{Flags: protocol.FlagGzip, Version: protocol.Version1, Features: protocol.FeatureGzip},
+		},
+		{
+			"version 1 client",
+			nil,
+			protocol.Hello{},
+			protocol.Hello{},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := startServer(t, c.args...)
+			_, answer := s.handshakeWith(t, "home", c.hello)
+			if answer != c.want {
+				t.Errorf("%s: answered %+v, want %+v", c.name, answer, c.want)
+			}
+			waitTunnel(t, "home")
+		})
+	}
+}
+
+func TestHandshakeIncompatible(t *testing.T) {
+	s := startServer(t)
+	conn, answer := s.handshakeWith(t, "home", protocol.Hello{Flags: protocol.FlagHello, Version: 0})
+	if answer.Version != 0 {
+		t.Fatalf("answered %+v, want version 0", answer)
+	}
+
+	// The reason follows on the session
+	session := mux.Client(conn, mux.DefaultConfig())
+	select {
+	case <-session.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session was never closed")
+	}
+	var peer *mux.PeerError
+	if !errors.As(session.Err(), &peer) || !strings.Contains(peer.Reason, "version 0") || !strings.Contains(peer.Reason, "upgrade the client") {
+		t.Errorf("closed with %v, want the protocol versions", session.Err())
+	}
+	if _, ok := registry.Lookup("home"); ok {
+		t.Error("the incompatible client was registered")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a v2 header for the PROXY command from src to dst.
+func proxyV2(src, dst *net.TCPAddr) []byte {
+	family, ip := byte(0x11), 4 // AF_INET, STREAM
+	if src.IP.To4() == nil {
+		family, ip = 0x21, 16
+	}
+	body := append(append([]byte{}, ipBytes(src.IP, ip)...), ipBytes(dst.IP, ip)...)
+	body = binary.BigEndian.AppendUint16(body, uint16(src.Port))
+	body = binary.BigEndian.AppendUint16(body, uint16(dst.Port))
+
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, 0x21, family) // version 2, PROXY
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(body)))
+	return append(hdr, body...)
+}
+
+func ipBytes(ip net.IP, n int) []byte {
+	if n == 4 {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	local := append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0, 0)
+	for _, c := range []struct {
+		name   string
+		header string
+		want   string // "" for no address
+	}{
+		{"v1 TCP4", "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n", "203.0.113.7:56324"},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::7 2001:db8::1 56324 443\r\n", "[2001:db8::7]:56324"},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", ""},
+		{"v2 IPv4", string(proxyV2(&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443})), "203.0.113.7:56324"},
+		{"v2 IPv6", string(proxyV2(&net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443})), "[2001:db8::7]:56324"},
+		{"v2 LOCAL", string(local), ""},
+		{"none", "", ""},
+	} {
+		br := bufio.NewReader(strings.NewReader(c.header + "GET / HTTP/1.1\r\n"))
+		addr, err := readProxyHeader(br)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got := fmt.Sprint(addr); (c.want == "" && addr != nil) || (c.want != "" && got != c.want) {
+			t.Errorf("%s: address %v, want %q", c.name, addr, c.want)
+		}
+		// Whatever follows the header is left for HTTP
+		if rest, _ := br.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%s: left %q", c.name, rest)
+		}
+	}
+}
+
+func TestReadProxyHeaderMalformed(t *testing.T) {
+	for _, header := range []string{
+		"PROXY TCP4 203.0.113.7 10.0.0.1 56324\r\n",
+		"PROXY TCP4 not-an-ip 10.0.0.1 56324 443\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\n",
+		"PROXY " + strings.Repeat("x", 200) + "\r\n",
+		string(proxyV2Signature) + "\x11\x11\x00\x04abcd", // version 1 in a v2 header
+	} {
+		if _, err := readProxyHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("accepted %q", header)
+		}
+	}
+}
+
+// remoteAddrServer serves, on l, the RemoteAddr of each request.
+func remoteAddrServer(t *testing.T, l net.Listener) {
+	t.Helper()
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	})}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+}
+
+// remoteAddrOf sends prefix then a request to addr and returns the
+// RemoteAddr it was served with.
+func remoteAddrOf(t *testing.T, addr string, prefix []byte) (int, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(prefix)
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestProxyListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteAddrServer(t, proxyListener{l})
+	addr := l.Addr().String()
+
+	if _, got := remoteAddrOf(t, addr, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n")); got != "203.0.113.7:56324" {
+		t.Errorf("v1: served as %s", got)
+	}
+	v2 := proxyV2(&net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 4000}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443})
+	if _, got := remoteAddrOf(t, addr, v2); got != "198.51.100.2:4000" {
+		t.Errorf("v2: served as %s", got)
+	}
+	// A connection without a header keeps the peer's address
+	if _, got := remoteAddrOf(t, addr, nil); !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("no header: served as %s", got)
+	}
+}
+
+func TestProxyProtocolDisabled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteAddrServer(t, l)
+
+	// Without -proxy-protocol a header is not trusted, and is no request
+	code, got := remoteAddrOf(t, l.Addr().String(), []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n"))
+	if code == http.StatusOK || strings.Contains(got, "203.0.113.7") {
+		t.Errorf("header honoured while disabled: %d %s", code, got)
+	}
+	if _, got := remoteAddrOf(t, l.Addr().String(), nil); !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("plain request served as %s", got)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// startQUICServer starts a test server taking tunnels over QUIC, and
+// returns it with TLS settings for clients that trust it.
+func startQUICServer(t *testing.T) (*testServer, *tls.Config) {
+	t.Helper()
+	cert := newCert(t, "intunja test", nil)
+	s := startServer(t, "-transport", "quic", "-tls", "-tls-cert", cert.certFile, "-tls-key", cert.keyFile)
+	if s.tunnels.Addr().Network() != "udp" {
+		t.Fatalf("tunnels listening on %s", s.tunnels.Addr().Network())
+	}
+	return s, &tls.Config{RootCAs: cert.pool()}
+}
+
+func TestQUICTunnel(t *testing.T) {
+	s, tlsConfig := startQUICServer(t)
+	s.connect(t, client.Options{Name: "mobile", Local: newBackend(t, "mobile").URL, TLS: tlsConfig, QUIC: true})
+
+	for _, path := range []string{"/a", "/b"} {
+		if status, body := get(t, mustRequest(t, s.url("mobile", path))); status != http.StatusOK || body != "mobile "+path {
+			t.Errorf("got %d %q", status, body)
+		}
+	}
+}
+
+func TestQUICCheckRemote(t *testing.T) {
+	s, tlsConfig := startQUICServer(t)
+	opts := client.Options{Name: "probe", Local: "http://127.0.0.1:1", Remote: s.tunnels.Addr().String(), TLS: tlsConfig, Logger: discardLogger()}
+
+	// What the self-test dials: QUIC reaches the server, TCP doesn't
+	for quic, want := range map[bool]bool{true: true, false: false} {
+		opts.QUIC = quic
+		c, err := client.New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.CheckRemote(t.Context()); (err == nil) != want {
+			t.Errorf("QUIC %v: %v", quic, err)
+		}
+	}
+}
+
+// udpRelay passes datagrams between one client and upstream. rebind sends
+// the client's packets on from a new port, as a NAT that rebinds would;
+// replies to the old port still get through.
+type udpRelay struct {
+	conn     *net.UDPConn
+	upstream *net.UDPAddr
+
+	mu     sync.Mutex
+	client *net.UDPAddr
+	out    *net.UDPConn
+	ports  []*net.UDPConn
+}
+
+func newUDPRelay(t *testing.T, upstream string) *udpRelay {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp", upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &udpRelay{conn: conn, upstream: addr}
+	t.Cleanup(func() {
+		conn.Close()
+		r.mu.Lock()
+		for _, out := range r.ports {
+			out.Close()
+		}
+		r.mu.Unlock()
+	})
+	r.rebind(t)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.client = from
+			out := r.out
+			r.mu.Unlock()
+			out.WriteToUDP(buf[:n], r.upstream)
+		}
+	}()
+	return r
+}
+
+func (r *udpRelay) rebind(t *testing.T) {
+	t.Helper()
+	out, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	r.out = out
+	r.ports = append(r.ports, out)
+	r.mu.Unlock()
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := out.Read(buf)
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			client := r.client
+			r.mu.Unlock()
+			r.conn.WriteToUDP(buf[:n], client)
+		}
+	}()
+}
+
+func TestQUICAddressChange(t *testing.T) {
+	s, tlsConfig := startQUICServer(t)
+	relay := newUDPRelay(t, s.tunnels.Addr().String())
+	c, err := client.New(client.Options{
+		Name:   "mobile",
+		Local:  newBackend(t, "mobile").URL,
+		Remote: relay.conn.LocalAddr().String(),
+		TLS:    tlsConfig,
+		QUIC:   true,
+		Logger: discardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start(context.Background())
+	defer c.Stop()
+	tunnel := waitTunnel(t, "mobile")
+	before := tunnel.session.RemoteAddr().String()
+
+	// The client's packets now arrive from somewhere else
+	relay.rebind(t)
+	if status, body := get(t, mustRequest(t, s.url("mobile", "/after"))); status != http.StatusOK || body != "mobile /after" {
+		t.Errorf("got %d %q after the address changed", status, body)
+	}
+	if now, _ := registry.Lookup("mobile"); now != tunnel {
+		t.Errorf("the tunnel reconnected instead of moving from %s", before)
+	}
+	waitFor(t, func() bool { return tunnel.session.RemoteAddr().String() != before })
+}
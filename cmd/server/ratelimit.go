@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// tunnelLimiters keeps a token bucket per tunnel name. Buckets are created
+// on a tunnel's first request and dropped when it disconnects.
+type tunnelLimiters struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// newTunnelLimiters returns nil, which allows everything, if perSecond is
+// not positive.
+func newTunnelLimiters(perSecond float64, burst int) *tunnelLimiters {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &tunnelLimiters{
+		limit:    rate.Limit(perSecond),
+		burst:    max(burst, 1),
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// allow takes a token for name. If none is available it returns false and
+// how long until one will be.
+func (l *tunnelLimiters) allow(name string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	lim, ok := l.limiters[name]
+	if !ok {
+		lim = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[name] = lim
+	}
+	l.mu.Unlock()
+
+	res := lim.Reserve()
+	if delay := res.Delay(); delay > 0 {
+		res.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+func (l *tunnelLimiters) remove(name string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	delete(l.limiters, name)
+	l.mu.Unlock()
+}
+
+// retryAfter formats d for a Retry-After header, in whole seconds.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
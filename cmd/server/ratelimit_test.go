@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func TestRateLimit(t *testing.T) {
+	s := startServer(t, "-rate", "1", "-burst", "3")
+	s.connect(t, client.Options{Name: "limited", Local: newBackend(t, "limited").URL})
+	s.connect(t, client.Options{Name: "other", Local: newBackend(t, "other").URL})
+
+	var passed, limited int
+	for range 10 {
+		resp, err := http.Get(s.url("limited", "/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			passed++
+		case http.StatusTooManyRequests:
+			limited++
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || secs < 1 {
+				t.Errorf("Retry-After %q, want whole seconds", resp.Header.Get("Retry-After"))
+			}
+		default:
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+	}
+	// The burst passes, plus at most one token refilled on a slow machine
+	if passed < 3 || passed > 4 || limited == 0 {
+		t.Errorf("%d passed and %d limited, want the burst of 3 to pass", passed, limited)
+	}
+
+	// Each tunnel has its own bucket
+	if code, _ := get(t, mustRequest(t, s.url("other", "/"))); code != http.StatusOK {
+		t.Errorf("another tunnel got %d, want 200", code)
+	}
+}
+
+func TestTunnelLimiters(t *testing.T) {
+	l := newTunnelLimiters(1, 2)
+	for i := range 2 {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("request %d within the burst refused", i)
+		}
+	}
+	ok, wait := l.allow("a")
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("past the burst: allowed %v, wait %s", ok, wait)
+	}
+
+	// A tunnel that reconnects starts with a full bucket
+	l.remove("a")
+	if len(l.limiters) != 0 {
+		t.Errorf("%d limiters left after remove", len(l.limiters))
+	}
+	if ok, _ := l.allow("a"); !ok {
+		t.Error("refused after remove")
+	}
+}
+
+func TestTunnelLimitersDisabled(t *testing.T) {
+	l := newTunnelLimiters(0, 10)
+	if l != nil {
+		t.Fatal("a zero rate made a limiter")
+	}
+	for range 100 {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatal("the nil limiter refused")
+		}
+	}
+	l.remove("a")
+}
+
+func TestRetryAfter(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		time.Millisecond:        "1",
+		time.Second:             "1",
+		1500 * time.Millisecond: "2",
+	} {
+		if got := retryAfter(d); got != want {
+			t.Errorf("retryAfter(%s) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+// mustRequest builds a GET for url.
+func mustRequest(t *testing.T, url string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
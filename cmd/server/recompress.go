@@ -0,0 +1,158 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// recoding is what -recompress-level does to a response body.
+type recoding int
+
+const (
+	passThrough recoding = iota
+	// decompress sends the body on decompressed, to a public client that
+	// doesn't take gzip
+	decompress
+	// recompress gzips the body again at -recompress-level
+	recompress
+)
+
+// recodeResponse decides how resp's body reaches the public client that
+// sent r, and fixes up resp's headers to match. Only bodies gzipped by the
+// home server and nothing else are recoded, and never a partial one.
+func recodeResponse(r *http.Request, resp *http.Response) recoding {
+	if cfg.RecompressLevel == 0 || resp.Body == http.NoBody || resp.StatusCode == http.StatusPartialContent {
+		return passThrough
+	}
+	if enc := resp.Header.Values("Content-Encoding"); len(enc) != 1 || !strings.EqualFold(strings.TrimSpace(enc[0]), "gzip") {
+		return passThrough
+	}
+
+	resp.Header.Del("Content-Length")
+	if !varies(resp.Header, "Accept-Encoding") {
+		resp.Header.Add("Vary", "Accept-Encoding")
+	}
+	// The bytes sent are no longer the ones the tag was made for
+	if etag := resp.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("Etag", "W/"+etag)
+	}
+	if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		return recompress
+	}
+	resp.Header.Del("Content-Encoding")
+	return decompress
+}
+
+// varies reports whether h already lists field in Vary.
+func varies(h http.Header, field string) bool {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f == "*" || strings.EqualFold(f, field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptsGzip reports whether an Accept-Encoding value allows gzip, named
+// or through *, with a weight above zero.
+func acceptsGzip(accept string) bool {
+	gzipQ, starQ := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			starQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return starQ > 0
+}
+
+// gunzipReader decompresses a gzipped body, counting what comes out
+// toward the tunnel's decoded bytes. The gzip header is only read on the
+// first Read, so a bad one fails the copy like any other body error.
+type gunzipReader struct {
+	src     io.Reader
+	zr      *gzip.Reader
+	err     error
+	decoded prometheus.Counter
+}
+
+func newGunzipReader(src io.Reader, tunnel string) *gunzipReader {
+	return &gunzipReader{src: src, decoded: stats.DecodedBytes.WithLabelValues(tunnel)}
+}
+
+func (g *gunzipReader) Read(p []byte) (int, error) {
+	if g.zr == nil && g.err == nil {
+		g.zr, g.err = gzip.NewReader(g.src)
+	}
+	if g.err != nil {
+		return 0, g.err
+	}
+	n, err := g.zr.Read(p)
+	g.decoded.Add(float64(n))
+	return n, err
+}
+
+// gzipWriters pools writers at -recompress-level; each holds on to a
+// sizeable compression window.
+var gzipWriters sync.Pool
+
+// gzipResponseWriter gzips what is written through it. Flushing flushes
+// the compressor first, so streamed responses still arrive as they come.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	zw *gzip.Writer
+}
+
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	zw, _ := gzipWriters.Get().(*gzip.Writer)
+	if zw == nil {
+		// The level was checked by loadConfig
+		zw, _ = gzip.NewWriterLevel(w, cfg.RecompressLevel)
+	} else {
+		zw.Reset(w)
+	}
+	return &gzipResponseWriter{ResponseWriter: w, zw: zw}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	return g.zw.Write(p)
+}
+
+func (g *gzipResponseWriter) FlushError() error {
+	if err := g.zw.Flush(); err != nil {
+		return err
+	}
+	return http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// finish ends the gzip stream if the body was copied whole, and returns
+// the compressor to the pool either way.
+func (g *gzipResponseWriter) finish(complete bool) error {
+	var err error
+	if complete {
+		err = g.zw.Close()
+	}
+	g.zw.Reset(io.Discard)
+	gzipWriters.Put(g.zw)
+	return err
+}
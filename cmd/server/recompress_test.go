@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// gzipped compresses body.
+func gzipped(t *testing.T, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(body)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// gzipBackend answers every request with body, gzipped.
+func gzipBackend(t *testing.T, body []byte) string {
+	t.Helper()
+	z := gzipped(t, body)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Etag", `"v1"`)
+		w.Write(z)
+	}))
+	t.Cleanup(backend.Close)
+	return backend.URL
+}
+
+// rawGet sends a GET for url with the Accept-Encoding given and returns
+// the response with its body as sent, not decompressed.
+func rawGet(t *testing.T, url, accept string) (*http.Response, []byte, error) {
+	t.Helper()
+	req := mustRequest(t, url)
+	req.Header.Set("Accept-Encoding", accept)
+	c := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+func gunzip(t *testing.T, z []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(z))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+var textBody = []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 1000))
+
+func TestRecompressPassthrough(t *testing.T) {
+	s := startServer(t, "-recompress-level", "9")
+	s.connect(t, client.Options{Name: "app", Local: gzipBackend(t, textBody)})
+
+	// A client that doesn't take gzip gets the body decompressed. One
+	// that says nothing at all is left to the client's transport, which
+	// asks for gzip itself and decompresses before the server sees it.
+	for _, accept := range []string{"identity", "gzip;q=0", "br, *;q=0"} {
+		resp, body, err := rawGet(t, s.url("app", "/"), accept)
+		if err != nil || !bytes.Equal(body, textBody) {
+			t.Errorf("Accept-Encoding %q: %d bytes, %v; want the body decompressed", accept, len(body), err)
+		}
+		if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+			t.Errorf("Accept-Encoding %q: Content-Encoding %q", accept, enc)
+		}
+		if !varies(resp.Header, "Accept-Encoding") || resp.Header.Get("Etag") != `W/"v1"` {
+			t.Errorf("Accept-Encoding %q: Vary %q, Etag %q", accept, resp.Header.Values("Vary"), resp.Header.Get("Etag"))
+		}
+	}
+	if got := testutil.ToFloat64(stats.DecodedBytes.WithLabelValues("app")); got != float64(3*len(textBody)) {
+		t.Errorf("counted %v decoded bytes, want %d", got, 3*len(textBody))
+	}
+}
+
+func TestRecompressGzip(t *testing.T) {
+	s := startServer(t, "-recompress-level", "1")
+	s.connect(t, client.Options{Name: "app", Local: gzipBackend(t, textBody)})
+
+	for _, accept := range []string{"gzip", "gzip, deflate, br", "*"} {
+		resp, body, err := rawGet(t, s.url("app", "/"), accept)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+			t.Fatalf("Accept-Encoding %q: Content-Encoding %q, want gzip", accept, enc)
+		}
+		if got := gunzip(t, body); !bytes.Equal(got, textBody) {
+			t.Errorf("Accept-Encoding %q: %d bytes once decompressed, want %d", accept, len(got), len(textBody))
+		}
+		if resp.Header.Get("Etag") != `W/"v1"` {
+			t.Errorf("Accept-Encoding %q: Etag %q", accept, resp.Header.Get("Etag"))
+		}
+	}
+	if got := testutil.ToFloat64(stats.DecodedBytes.WithLabelValues("app")); got != float64(3*len(textBody)) {
+		t.Errorf("counted %v decoded bytes, want %d", got, 3*len(textBody))
+	}
+}
+
+func TestRecompressOff(t *testing.T) {
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "app", Local: gzipBackend(t, textBody)})
+
+	// Whatever the client takes, the home server's bytes go through
+	resp, body, err := rawGet(t, s.url("app", "/"), "identity")
+	if err != nil || !bytes.Equal(body, gzipped(t, textBody)) || resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Etag") != `"v1"` {
+		t.Errorf("got %d bytes, %v, headers %v; want the response untouched", len(body), err, resp.Header)
+	}
+}
+
+func TestRecompressGzipBomb(t *testing.T) {
+	// 64MiB of zeros squeezes into well under a megabyte
+	bomb := make([]byte, 64<<20)
+	backend := gzipBackend(t, bomb)
+	const limit = 1 << 20
+
+	for _, c := range []struct {
+		policy, accept string
+	}{
+		{"fail", "identity"},
+		{"fail", "gzip"},
+		{"truncate", "identity"},
+		{"truncate", "gzip"},
+	} {
+		t.Run(c.policy+" "+c.accept, func(t *testing.T) {
+			s := startServer(t, "-recompress-level", "6", "-max-response-bytes", "1048576", "-max-response-policy", c.policy)
+			s.connect(t, client.Options{Name: "app", Local: backend})
+			logs := captureLogs(t)
+
+			resp, body, err := rawGet(t, s.url("app", "/"), c.accept)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s %s: %d", c.policy, c.accept, resp.StatusCode)
+			}
+			decoded := int64(len(body))
+			if c.accept == "gzip" {
+				zr, zerr := gzip.NewReader(bytes.NewReader(body))
+				if zerr == nil {
+					decoded, zerr = io.Copy(io.Discard, zr)
+				}
+				if err == nil {
+					err = zerr
+				}
+			}
+			if decoded > limit {
+				t.Errorf("%s %s: %d bytes decoded, want at most %d", c.policy, c.accept, decoded, limit)
+			}
+			if c.policy == "fail" && err == nil {
+				t.Errorf("%s %s: the response ended cleanly, want it cut off", c.policy, c.accept)
+			}
+			if c.policy == "truncate" && (err != nil || decoded != limit) {
+				t.Errorf("%s %s: %d bytes, %v; want truncated at %d", c.policy, c.accept, decoded, err, limit)
+			}
+			waitFor(t, func() bool {
+				lines := logs.lines(t, "tunnel response too large")
+				return len(lines) == 1 && lines[0]["decoded"] == true
+			})
+		})
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                   false,
+		"identity":           false,
+		"gzip":               true,
+		"GZIP":               true,
+		"x-gzip":             true,
+		"deflate, gzip;q=.5": true,
+		"gzip;q=0":           false,
+		"*":                  true,
+		"*;q=0":              false,
+		"gzip;q=0, *":        false,
+		"br, *;q=0.1":        true,
+	} {
+		if got := acceptsGzip(accept); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", accept, got, want)
+		}
+	}
+}
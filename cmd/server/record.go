@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/internal/relay"
+)
+
+// maxRecordedBody is the largest request body -record keeps. Bigger ones
+// are marked truncated, and replay skips them.
+const maxRecordedBody = 1 << 20
+
+// recordedRequest is one line of a -record file.
+type recordedRequest struct {
+	Time      time.Time   `json:"time"`
+	RequestID string      `json:"request_id"`
+	Method    string      `json:"method"`
+	Host      string      `json:"host"`
+	URL       string      `json:"url"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+	Status    int         `json:"status"`
+
+	body *cappedBuffer
+}
+
+// requestRecorder appends public requests to the -record file. The file
+// holds whatever credentials the requests carried, so it is only readable
+// by its owner.
+type requestRecorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// recorder is nil unless -record is set.
+var recorder *requestRecorder
+
+func openRecorder(path string) (*requestRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &requestRecorder{enc: json.NewEncoder(f)}, nil
+}
+
+// start begins recording r, teeing its body aside as it is forwarded.
+// WebSocket upgrades aren't recorded.
+func (rr *requestRecorder) start(r *http.Request, id string) *recordedRequest {
+	if rr == nil || relay.IsWebSocketUpgrade(r.Header) {
+		return nil
+	}
+	rec := &recordedRequest{
+		Time:      time.Now().UTC(),
+		RequestID: id,
+		Method:    r.Method,
+		Host:      r.Host,
+		URL:       r.RequestURI,
+		Header:    r.Header.Clone(),
+		body:      &cappedBuffer{limit: maxRecordedBody},
+	}
+	// Both are set afresh for each request
+	rec.Header.Del(requestIDHeader)
+	rec.Header.Del(clientIPHeader)
+	if r.ContentLength != 0 {
+		r.Body = readCloser{io.TeeReader(r.Body, rec.body), r.Body}
+	}
+	return rec
+}
+
+// finish appends rec, answered with status, to the file.
+func (rr *requestRecorder) finish(rec *recordedRequest, status int) {
+	if rec == nil {
+		return
+	}
+	rec.Status = status
+	if rec.body.overflow {
+		rec.Truncated = true
+	} else {
+		rec.Body = rec.body.Bytes()
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if err := rr.enc.Encode(rec); err != nil {
+		slog.Warn("failed to record request", "request_id", rec.RequestID, "err", err)
+	}
+}
+
+// runReplay is the replay subcommand: it sends the requests in a -record
+// file to the public endpoint again, in order, and reports those answered
+// with a different status than when they were recorded.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:9090", "Public endpoint to send the recorded requests to")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: server replay [-target URL] FILE")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer f.Close()
+	// Stop at the current end, so requests recorded while replaying to a
+	// server that is still recording aren't sent too
+	info, err := f.Stat()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	base := strings.TrimSuffix(*target, "/")
+	var sent, mismatched, failed, skipped int
+	sc := bufio.NewScanner(io.LimitReader(f, info.Size()))
+	sc.Buffer(nil, 4*maxRecordedBody)
+	for sc.Scan() {
+		var rec recordedRequest
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			fmt.Fprintf(os.Stderr, "skipping unreadable line: %v\n", err)
+			skipped++
+			continue
+		}
+		if rec.Truncated {
+			fmt.Printf("skip %s %s: body was too large to record\n", rec.Method, rec.URL)
+			skipped++
+			continue
+		}
+
+		req, err := http.NewRequest(rec.Method, base+rec.URL, bytes.NewReader(rec.Body))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "skipping %s %s: %v\n", rec.Method, rec.URL, err)
+			skipped++
+			continue
+		}
+		req.Header = rec.Header
+		req.Host = rec.Host
+		sent++
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Printf("FAIL %s %s: %v\n", rec.Method, rec.URL, err)
+			failed++
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != rec.Status {
+			fmt.Printf("DIFF %s %s: %d, recorded %d\n", rec.Method, rec.URL, resp.StatusCode, rec.Status)
+			mismatched++
+			continue
+		}
+		fmt.Printf("ok   %s %s: %d\n", rec.Method, rec.URL, resp.StatusCode)
+	}
+	if err := sc.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	fmt.Printf("%d replayed, %d differed, %d failed, %d skipped\n", sent, mismatched, failed, skipped)
+	if mismatched > 0 || failed > 0 {
+		return 1
+	}
+	return 0
+}
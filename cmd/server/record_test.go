@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// discardStdout sends what the replay subcommand prints nowhere until the
+// test ends.
+func discardStdout(t *testing.T) {
+	t.Helper()
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	t.Cleanup(func() {
+		os.Stdout = stdout
+		devNull.Close()
+	})
+}
+
+func TestRecordReplay(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	failing := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		seen = append(seen, r.Method+" "+r.URL.RequestURI()+" "+r.Header.Get("X-Trace")+" "+string(body))
+		fail := failing
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case fail:
+			http.Error(w, "broken", http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	s := startServer(t, "-record", path)
+	s.connect(t, client.Options{Name: "home", Local: backend.URL})
+
+	get(t, mustRequest(t, s.url("home", "/a?x=1")))
+	post, _ := http.NewRequest(http.MethodPost, s.url("home", "/b"), strings.NewReader(`{"n":1}`))
+	post.Header.Set("X-Trace", "abc")
+	get(t, post)
+	get(t, mustRequest(t, s.url("home", "/missing")))
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recorded []recordedRequest
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var rec recordedRequest
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("unreadable line %q: %v", sc.Text(), err)
+		}
+		recorded = append(recorded, rec)
+	}
+	if len(recorded) != 3 {
+		t.Fatalf("recorded %d requests, want 3", len(recorded))
+	}
+	if r := recorded[1]; r.Method != http.MethodPost || r.URL != "/home/b" || string(r.Body) != `{"n":1}` || r.Header.Get("X-Trace") != "abc" || r.Status != http.StatusOK {
+		t.Errorf("recorded %+v", r)
+	}
+	if r := recorded[2]; r.Status != http.StatusNotFound {
+		t.Errorf("recorded status %d for /missing", r.Status)
+	}
+
+	// Replayed, the local API sees the same requests and answers the same
+	discardStdout(t)
+	mu.Lock()
+	original := seen
+	seen = nil
+	mu.Unlock()
+	if code := runReplay([]string{"-target", s.public.URL, path}); code != 0 {
+		t.Errorf("replay exited %d, want 0", code)
+	}
+	mu.Lock()
+	replayed := seen
+	mu.Unlock()
+	if strings.Join(replayed, "\n") != strings.Join(original, "\n") {
+		t.Errorf("replayed %q, recorded %q", replayed, original)
+	}
+
+	// A changed answer is reported
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	if code := runReplay([]string{"-target", s.public.URL, path}); code != 1 {
+		t.Errorf("replay against a broken API exited %d, want 1", code)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/internal/mux"
+)
+
+type Tunnel struct {
+	id          uint64
+	name        string
+	principal   string // who the Authenticator says registered it
+	session     *mux.Session
+	traffic     *trafficConn
+	connectedAt time.Time
+
+	// requests counts public requests forwarded through the tunnel.
+	requests atomic.Int64
+	// latency covers requests served since this connection registered.
+	latency latencyHistogram
+	// retiring is set once the tunnel has been replaced or has outlived
+	// -max-tunnel-lifetime, and is finishing its requests before being
+	// closed.
+	retiring atomic.Bool
+	// health is the last -health-path check, nil until one has run.
+	health atomic.Pointer[backendHealth]
+}
+
+func (t *Tunnel) closed() bool {
+	select {
+	case <-t.session.Closed():
+		return true
+	default:
+		return false
+	}
+}
+
+// TunnelRegistry maps tunnel names to the home servers connected under
+// them. Normally a name has one connection; with -shared-tunnels several
+// clients may serve it at once.
+type TunnelRegistry struct {
+	mu      sync.RWMutex
+	tunnels map[string]*tunnelSet
+	lost    map[string]time.Time // when a name's last tunnel went away
+	changed chan struct{}        // closed on every registration
+	nextID  uint64
+}
+
+func NewTunnelRegistry() *TunnelRegistry {
+	return &TunnelRegistry{
+		tunnels: make(map[string]*tunnelSet),
+		lost:    make(map[string]time.Time),
+		changed: make(chan struct{}),
+	}
+}
+
+// tunnelSet is the connections registered under one name, oldest first.
+// It is replaced rather than modified when they change.
+type tunnelSet struct {
+	members []*Tunnel
+	ring    hashRing
+	next    atomic.Uint64 // round robin for requests without an affinity key
+}
+
+func newTunnelSet(members []*Tunnel) *tunnelSet {
+	return &tunnelSet{members: members, ring: newHashRing(members)}
+}
+
+// pick chooses a live tunnel other than skip as -balance says: the one key
+// hashes to, a random one, or the next in turn. Round robin is also used
+// for requests without an affinity key. Dead and retiring tunnels are
+// passed over without their share landing on a neighbour.
+func (s *tunnelSet) pick(key string, skip *Tunnel) *Tunnel {
+	usable := func(t *Tunnel) bool { return t != skip && !t.closed() && !t.retiring.Load() }
+	if cfg.Balance == "affinity" && key != "" {
+		return s.ring.get(key, usable)
+	}
+
+	n := uint64(len(s.members))
+	for range n {
+		var i uint64
+		if cfg.Balance == "random" {
+			i = rand.Uint64N(n)
+		} else {
+			i = s.next.Add(1) % n
+		}
+		if t := s.members[i]; usable(t) {
+			return t
+		}
+	}
+	for _, t := range s.members {
+		if usable(t) {
+			return t
+		}
+	}
+	return nil
+}
+
+// errTooManyTunnels refuses a new tunnel connection once -max-tunnels are
+// registered.
+var errTooManyTunnels = errors.New("server has reached its tunnel limit")
+
+// Register adds session, running over traffic, as a tunnel for name,
+// registered by principal. Unless
+// shared, tunnels already registered under the name are replaced: they
+// stop getting requests and are closed once those they have are done.
+// A connection that would add to the tunnels serving requests, rather than
+// replace one, is refused with errTooManyTunnels once -max-tunnels are.
+func (r *TunnelRegistry) Register(name, principal string, session *mux.Session, traffic *trafficConn, shared bool) (t *Tunnel, replaced bool, err error) {
+	r.mu.Lock()
+	if _, ok := r.tunnels[name]; (shared || !ok) && cfg.MaxTunnels > 0 && r.serving() >= cfg.MaxTunnels {
+		r.mu.Unlock()
+		return nil, false, errTooManyTunnels
+	}
+	r.nextID++
+	t = &Tunnel{id: r.nextID, name: name, principal: principal, session: session, traffic: traffic, connectedAt: time.Now()}
+	var prev []*Tunnel
+	if set, ok := r.tunnels[name]; ok {
+		prev = set.members
+	}
+	if shared {
+		r.tunnels[name] = newTunnelSet(append(slices.Clip(prev), t))
+		prev = nil
+	} else {
+		r.tunnels[name] = newTunnelSet([]*Tunnel{t})
+	}
+	delete(r.lost, name)
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.mu.Unlock()
+
+	for _, p := range prev {
+		if !p.retiring.Swap(true) {
+			go drainTunnel(p, errReplaced)
+			replaced = true
+		}
+	}
+	return t, replaced, nil
+}
+
+// serving counts the tunnels registered under every name, leaving out
+// those retiring, which are already on their way out. r.mu must be held.
+func (r *TunnelRegistry) serving() int {
+	var n int
+	for _, set := range r.tunnels {
+		for _, t := range set.members {
+			if !t.retiring.Load() {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Lookup returns the oldest live tunnel registered under name.
+func (r *TunnelRegistry) Lookup(name string) (*Tunnel, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	set, ok := r.tunnels[name]
+	if !ok {
+		return nil, false
+	}
+	for _, t := range set.members {
+		if !t.closed() {
+			return t, true
+		}
+	}
+	return set.members[0], true
+}
+
+// Pick chooses a tunnel registered under name for a request. Requests with
+// the same affinity key go to the same tunnel for as long as it stays
+// connected; those without one take turns.
+func (r *TunnelRegistry) Pick(name, key string) (*Tunnel, bool) {
+	r.mu.RLock()
+	set, ok := r.tunnels[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	if t := set.pick(key, nil); t != nil {
+		return t, true
+	}
+	// All are on their way out; let the caller find that out
+	return set.members[0], true
+}
+
+// List returns the registered tunnels sorted by name, then by when they
+// connected.
+func (r *TunnelRegistry) List() []*Tunnel {
+	r.mu.RLock()
+	var tunnels []*Tunnel
+	for _, set := range r.tunnels {
+		tunnels = append(tunnels, set.members...)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(tunnels, func(i, j int) bool {
+		if tunnels[i].name != tunnels[j].name {
+			return tunnels[i].name < tunnels[j].name
+		}
+		return tunnels[i].id < tunnels[j].id
+	})
+	return tunnels
+}
+
+// Unregister removes and closes every tunnel registered under name.
+func (r *TunnelRegistry) Unregister(name string) bool {
+	r.mu.Lock()
+	set, ok := r.tunnels[name]
+	delete(r.tunnels, name)
+	r.mu.Unlock()
+
+	if ok {
+		for _, t := range set.members {
+			t.session.CloseWithError(errUnregistered)
+		}
+	}
+	return ok
+}
+
+// CloseAll removes and closes every registered tunnel.
+func (r *TunnelRegistry) CloseAll() {
+	r.mu.Lock()
+	tunnels := r.tunnels
+	r.tunnels = make(map[string]*tunnelSet)
+	r.mu.Unlock()
+
+	for _, set := range tunnels {
+		for _, t := range set.members {
+			t.session.CloseWithError(errShuttingDown)
+		}
+	}
+}
+
+// remove drops t once its connection has gone away. It reports whether
+// that left the name free, rather than still served by other tunnels or
+// already replaced.
+func (r *TunnelRegistry) remove(t *Tunnel) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	set, ok := r.tunnels[t.name]
+	if !ok {
+		return false
+	}
+	i := slices.Index(set.members, t)
+	if i < 0 {
+		return false
+	}
+	if len(set.members) > 1 {
+		r.tunnels[t.name] = newTunnelSet(slices.Delete(slices.Clone(set.members), i, i+1))
+		return false
+	}
+	delete(r.tunnels, t.name)
+	if cfg.ReconnectGrace > 0 {
+		r.forgetLost(cfg.ReconnectGrace)
+		r.lost[t.name] = time.Now()
+	}
+	return true
+}
+
+// forgetLost drops the names lost longer than grace ago, which nothing will
+// wait for any more, so names that never come back don't pile up.
+// r.mu must be held.
+func (r *TunnelRegistry) forgetLost(grace time.Duration) {
+	for name, lostAt := range r.lost {
+		if time.Since(lostAt) > grace {
+			delete(r.lost, name)
+		}
+	}
+}
+
+// Await waits up to grace for a live tunnel other than stale to be
+// registered under name, and picks one for key. Without a stale tunnel, it
+// only waits for a name whose last tunnel went away within the last grace
+// period, so requests for names that were never connected are answered at
+// once.
+func (r *TunnelRegistry) Await(ctx context.Context, name, key string, stale *Tunnel, grace time.Duration) (*Tunnel, bool) {
+	ctx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+
+	for {
+		r.mu.Lock()
+		set, ok := r.tunnels[name]
+		lostAt, lost := r.lost[name]
+		if lost && time.Since(lostAt) > grace {
+			delete(r.lost, name)
+			lost = false
+		}
+		changed := r.changed
+		r.mu.Unlock()
+
+		if ok {
+			if t := set.pick(key, stale); t != nil {
+				return t, true
+			}
+		}
+		if stale == nil && !ok && !lost {
+			return nil, false
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+func (r *TunnelRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.tunnels)
+}
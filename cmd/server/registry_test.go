@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+	"github.com/mindsgn-studio/intunja/internal/mux"
+)
+
+// registerPipe registers a tunnel for name over an in-memory connection
+// nobody is at the other end of.
+func registerPipe(t *testing.T, name string) *Tunnel {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { b.Close() })
+	session := mux.Server(a, mux.DefaultConfig())
+	t.Cleanup(func() { session.Close() })
+	tunnel, _, err := registry.Register(name, "", session, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tunnel
+}
+
+func TestRegistryLostWithoutGrace(t *testing.T) {
+	setupServer(t, "-reconnect-grace", "0")
+	for _, name := range []string{"a", "b", "c"} {
+		registry.remove(registerPipe(t, name))
+	}
+	if n := len(registry.lost); n != 0 {
+		t.Errorf("%d lost names kept with no grace to wait for them", n)
+	}
+}
+
+func TestRegistryLostPruned(t *testing.T) {
+	setupServer(t, "-reconnect-grace", "50ms")
+	registry.remove(registerPipe(t, "old"))
+	time.Sleep(60 * time.Millisecond)
+	registry.remove(registerPipe(t, "new"))
+
+	if _, ok := registry.lost["old"]; ok {
+		t.Error("a name lost longer than the grace ago is still kept")
+	}
+	if _, ok := registry.lost["new"]; !ok {
+		t.Error("the name just lost isn't kept")
+	}
+
+	// Only a name lost within the grace is waited for
+	start := time.Now()
+	if _, ok := registry.Await(context.Background(), "old", "", nil, time.Second); ok {
+		t.Error("found a tunnel that never came back")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("waited %s for a name lost long ago", elapsed)
+	}
+}
+
+func TestReconnectMidRequest(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			// The tunnel drops while this one is being answered
+			tunnel, _ := registry.Lookup("blip")
+			tunnel.session.Close()
+			return
+		}
+		w.Write([]byte("answered after reconnecting"))
+	}))
+	defer backend.Close()
+	s := startServer(t, "-reconnect-grace", "5s")
+	s.connect(t, client.Options{Name: "blip", Local: backend.URL, ReconnectDelay: 50 * time.Millisecond})
+
+	code, body := get(t, mustRequest(t, s.url("blip", "/")))
+	if code != http.StatusOK || body != "answered after reconnecting" {
+		t.Errorf("got %d %q, want the answer through the new connection", code, body)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("the local API got %d requests, want 2", n)
+	}
+}
+
+func TestClientRestartKeepsName(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	s := startServer(t, "-reconnect-grace", "5s")
+	opts := client.Options{Name: "home", Local: backend.URL}
+	first := s.connect(t, opts)
+	before := waitTunnel(t, "home")
+
+	// The client goes away, and requests arrive before it is back
+	first.Stop()
+	waitFor(t, func() bool {
+		tunnel, ok := registry.Lookup("home")
+		return !ok || tunnel != before
+	})
+	codes := make(chan int, 5)
+	for range cap(codes) {
+		go func() {
+			code, _ := get(t, mustRequest(t, s.url("home", "/")))
+			codes <- code
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// Restarted with the same name and nothing carried over
+	s.connect(t, opts)
+	if after := waitTunnel(t, "home"); after == before {
+		t.Fatal("still the old tunnel")
+	}
+	for range cap(codes) {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("request during the restart got %d, want 200", code)
+		}
+	}
+	if code, body := get(t, mustRequest(t, s.url("home", "/"))); code != http.StatusOK || body != "ok" {
+		t.Errorf("after the restart: %d %q", code, body)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/internal/mux"
+)
+
+// resettingHome registers name as a home server that sends a response
+// head, then written, then resets the stream.
+func resettingHome(t *testing.T, name, written string) {
+	t.Helper()
+	serverEnd, homeEnd := net.Pipe()
+	tunnelConns.Go(func() { handleTunnelConn(serverEnd) })
+	serveHomeStreams(t, homeEnd, name, func(stream *mux.Stream) {
+		if _, err := http.ReadRequest(bufio.NewReader(stream)); err != nil {
+			stream.Reset()
+			return
+		}
+		io.WriteString(stream, "HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n"+written)
+		stream.Reset()
+	})
+	waitTunnel(t, name)
+}
+
+func TestTunnelResetAfterHead(t *testing.T) {
+	s := startServer(t)
+	resettingHome(t, "cutoff", "")
+
+	resp, err := http.Get(s.url("cutoff", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status %d, want 502 for a response cut off after its head", resp.StatusCode)
+	}
+}
+
+func TestTunnelResetMidBody(t *testing.T) {
+	s := startServer(t)
+	resettingHome(t, "cutoff", "partial")
+
+	resp, err := http.Get(s.url("cutoff", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// Either a 502, or a read that fails rather than ending quietly
+	body, err := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadGateway && err == nil {
+		t.Errorf("status %d body %q read to a clean end", resp.StatusCode, body)
+	}
+}
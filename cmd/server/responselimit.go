@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// errResponseTooLarge means a home server sent more than
+// -max-response-bytes.
+var errResponseTooLarge = errors.New("response body too large")
+
+// overResponseLimit reports whether a body of n bytes is too large to
+// pass on whole.
+func overResponseLimit(n int64) bool {
+	return cfg.MaxResponseBytes > 0 && n > cfg.MaxResponseBytes
+}
+
+// responseLimit ends a response body at -max-response-bytes: cleanly if
+// truncating, otherwise with errResponseTooLarge so the response is cut
+// off, or, if it is still held back, answered with a 502.
+type responseLimit struct {
+	r        io.Reader
+	left     int64
+	truncate bool
+	exceeded bool
+}
+
+func newResponseLimit(r io.Reader) *responseLimit {
+	return &responseLimit{r: r, left: cfg.MaxResponseBytes, truncate: cfg.MaxResponsePolicy == "truncate"}
+}
+
+func (l *responseLimit) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, l.end()
+	}
+	// Ask for one byte past the limit to tell a body that ends on it from
+	// one that goes on
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.left {
+		n, l.left, l.exceeded = int(l.left), 0, true
+		return n, l.end()
+	}
+	l.left -= int64(n)
+	return n, err
+}
+
+// hit reports whether the body went past the limit; false for a nil l.
+func (l *responseLimit) hit() bool {
+	return l != nil && l.exceeded
+}
+
+func (l *responseLimit) end() error {
+	if l.truncate {
+		return io.EOF
+	}
+	return errResponseTooLarge
+}
+
+// limitResponse applies -max-response-bytes to resp, reporting false if
+// it is known to be too large and should be refused outright. A response
+// that will be truncated is sent with the limit as its length. Answers to
+// HEAD, and statuses that never have a body, are left alone.
+func limitResponse(resp *http.Response) (*responseLimit, bool) {
+	if cfg.MaxResponseBytes <= 0 || resp.Body == http.NoBody {
+		return nil, true
+	}
+	limit := newResponseLimit(resp.Body)
+	if overResponseLimit(resp.ContentLength) {
+		if !limit.truncate {
+			return nil, false
+		}
+		resp.Header.Set("Content-Length", strconv.FormatInt(cfg.MaxResponseBytes, 10))
+	}
+	return limit, true
+}
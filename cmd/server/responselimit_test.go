@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// sizedBackend answers /fixed/N with N bytes and a Content-Length, and
+// /chunked/N with N bytes streamed without one.
+func sizedBackend(t *testing.T) string {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind, size, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		n, _ := strconv.Atoi(size)
+		body := bytes.Repeat([]byte("x"), n)
+		if kind == "fixed" {
+			w.Header().Set("Content-Length", size)
+			w.Write(body)
+			return
+		}
+		for len(body) > 0 {
+			chunk := body[:min(len(body), 4096)]
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+			body = body[len(chunk):]
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend.URL
+}
+
+// fetchSized gets url and returns the status, the body length and the
+// error it ended with, if it was cut off.
+func fetchSized(t *testing.T, url string) (int, int, error) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, len(body), err
+}
+
+func TestResponseUnderLimit(t *testing.T) {
+	for _, policy := range []string{"fail", "truncate"} {
+		t.Run(policy, func(t *testing.T) {
+			s := startServer(t, "-max-response-bytes", "1000", "-max-response-policy", policy)
+			s.connect(t, client.Options{Name: "app", Local: sizedBackend(t)})
+			logs := captureLogs(t)
+
+			for _, path := range []string{"/fixed/1000", "/chunked/1000", "/fixed/10", "/chunked/0"} {
+				code, n, err := fetchSized(t, s.url("app", path))
+				want, _ := strconv.Atoi(path[strings.LastIndex(path, "/")+1:])
+				if code != http.StatusOK || n != want || err != nil {
+					t.Errorf("%s %s: %d, %d bytes, %v", policy, path, code, n, err)
+				}
+			}
+			if lines := logs.lines(t, "tunnel response too large"); len(lines) != 0 {
+				t.Errorf("%s: warned %v", policy, lines)
+			}
+		})
+	}
+}
+
+func TestResponseTruncated(t *testing.T) {
+	s := startServer(t, "-max-response-bytes", "1000", "-max-response-policy", "truncate")
+	s.connect(t, client.Options{Name: "app", Local: sizedBackend(t)})
+	logs := captureLogs(t)
+
+	for _, path := range []string{"/fixed/1001", "/fixed/1000000", "/chunked/1001", "/chunked/1000000"} {
+		code, n, err := fetchSized(t, s.url("app", path))
+		if code != http.StatusOK || n != 1000 || err != nil {
+			t.Errorf("%s: %d, %d bytes, %v; want 200 and 1000 bytes", path, code, n, err)
+		}
+	}
+	waitFor(t, func() bool { return len(logs.lines(t, "tunnel response too large")) == 4 })
+}
+
+func TestResponseTooLargeFails(t *testing.T) {
+	s := startServer(t, "-max-response-bytes", "1000")
+	s.connect(t, client.Options{Name: "app", Local: sizedBackend(t)})
+	logs := captureLogs(t)
+
+	// Known to be too large from the length, or before the head is sent
+	for _, path := range []string{"/fixed/1001", "/fixed/1000000", "/chunked/1001"} {
+		if code, _, _ := fetchSized(t, s.url("app", path)); code != http.StatusBadGateway {
+			t.Errorf("%s: %d, want 502", path, code)
+		}
+	}
+	waitFor(t, func() bool { return len(logs.lines(t, "tunnel response too large")) == 3 })
+}
+
+func TestResponseTooLargeCutOff(t *testing.T) {
+	// Past the first copy buffer, so the head has gone out by the time
+	// the limit is reached
+	s := startServer(t, "-max-response-bytes", "1000000", "-copy-buffer-size", "4096")
+	s.connect(t, client.Options{Name: "app", Local: sizedBackend(t)})
+	logs := captureLogs(t)
+
+	code, n, err := fetchSized(t, s.url("app", "/chunked/10000000"))
+	if code != http.StatusOK || err == nil || n > 1000000 {
+		t.Errorf("%d, %d bytes, %v; want the response cut off by 1000000 bytes", code, n, err)
+	}
+	waitFor(t, func() bool { return len(logs.lines(t, "tunnel response too large")) == 1 })
+}
+
+func TestResponseLimitReader(t *testing.T) {
+	for _, c := range []struct {
+		policy, body, want string
+		err                error
+	}{
+		{"fail", "hello", "hello", nil},
+		{"fail", "hello!", "hello", errResponseTooLarge},
+		{"truncate", "hello", "hello", nil},
+		{"truncate", "hello, world", "hello", nil},
+	} {
+		t.Run(c.policy+" "+c.body, func(t *testing.T) {
+			setupServer(t, "-max-response-bytes", "5", "-max-response-policy", c.policy)
+			l := newResponseLimit(strings.NewReader(c.body))
+			got, err := io.ReadAll(l)
+			if string(got) != c.want || !errors.Is(err, c.err) {
+				t.Errorf("%s %q: read %q, %v", c.policy, c.body, got, err)
+			}
+			if l.exceeded != (len(c.body) > 5) {
+				t.Errorf("%s %q: exceeded %v", c.policy, c.body, l.exceeded)
+			}
+		})
+	}
+}
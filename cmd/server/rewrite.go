@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// headerRewrite replaces text in one response header, e.g. to swap the
+// home network's hostnames in Location or Set-Cookie for public ones.
+type headerRewrite struct {
+	name     string
+	from, to string
+}
+
+// parseHeaderRewrites parses -rewrite-header values written as
+// Name:from=>to.
+func parseHeaderRewrites(values []string) ([]headerRewrite, error) {
+	rewrites := make([]headerRewrite, 0, len(values))
+	for _, v := range values {
+		name, rule, ok := strings.Cut(v, ":")
+		from, to, ok2 := strings.Cut(rule, "=>")
+		if !ok || !ok2 || strings.TrimSpace(name) == "" || from == "" {
+			return nil, fmt.Errorf("invalid header rewrite %q, want Name:from=>to", v)
+		}
+		rewrites = append(rewrites, headerRewrite{
+			name: http.CanonicalHeaderKey(strings.TrimSpace(name)),
+			from: from,
+			to:   to,
+		})
+	}
+	return rewrites, nil
+}
+
+// rewriteHeaders applies the rewrites to a response for r. A {host} in the
+// replacement stands for the host the public client asked for, so
+//
+//	Location:http://localhost:3000=>https://{host}
+//
+// points redirects back through the tunnel.
+func rewriteHeaders(h http.Header, r *http.Request) {
+	for _, rw := range headerRewrites {
+		values := h[rw.name]
+		to := strings.ReplaceAll(rw.to, "{host}", r.Host)
+		for i, v := range values {
+			values[i] = strings.ReplaceAll(v, rw.from, to)
+		}
+	}
+}
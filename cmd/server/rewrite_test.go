@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// noRedirects is a client that hands back redirects instead of following
+// them.
+var noRedirects = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}}
+
+func TestRewriteLocation(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost:3000/login?next=/", http.StatusFound)
+	}))
+	defer backend.Close()
+	s := startServer(t, "-rewrite-header", "Location:http://localhost:3000=>http://{host}/home")
+	s.connect(t, client.Options{Name: "home", Local: backend.URL})
+
+	resp, err := noRedirects.Get(s.url("home", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	want := s.public.URL + "/home/login?next=/"
+	if got := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || got != want {
+		t.Errorf("%d to %q, want 302 to %q", resp.StatusCode, got, want)
+	}
+}
+
+func TestRewriteCookieDomain(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "sid=abc; Domain=api.internal.lan; Path=/")
+		w.Header().Add("Set-Cookie", "theme=dark; Path=/")
+		// Other headers mentioning the name are left alone
+		w.Header().Set("X-Upstream", "api.internal.lan")
+	}))
+	defer backend.Close()
+	s := startServer(t, "-rewrite-header", "set-cookie:Domain=api.internal.lan=>Domain=tunnel.example.com")
+	s.connect(t, client.Options{Name: "home", Local: backend.URL})
+
+	resp, err := http.Get(s.url("home", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) != 2 || cookies[0] != "sid=abc; Domain=tunnel.example.com; Path=/" || cookies[1] != "theme=dark; Path=/" {
+		t.Errorf("cookies %q", cookies)
+	}
+	if got := resp.Header.Get("X-Upstream"); got != "api.internal.lan" {
+		t.Errorf("X-Upstream rewritten to %q", got)
+	}
+}
+
+func TestParseHeaderRewrites(t *testing.T) {
+	for _, v := range []string{"Location", "Location:from", ":a=>b", "Location:=>b"} {
+		if _, err := parseHeaderRewrites([]string{v}); err == nil {
+			t.Errorf("%q accepted", v)
+		}
+	}
+	rewrites, err := parseHeaderRewrites([]string{" location :http://a:1=>https://b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rw := rewrites[0]; rw.name != "Location" || rw.from != "http://a:1" || rw.to != "https://b" {
+		t.Errorf("parsed %+v", rw)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// subdomainRouter maps <name>.<domain> hosts to the tunnel called name.
+type subdomainRouter struct {
+	domain string
+}
+
+// route returns the tunnel name for r's Host, or false if the host is not
+// a subdomain of the configured domain.
+func (sr subdomainRouter) route(r *http.Request) (string, bool) {
+	return sr.tunnelName(r.Host)
+}
+
+func (sr subdomainRouter) tunnelName(host string) (string, bool) {
+	if sr.domain == "" {
+		return "", false
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	sub, ok := strings.CutSuffix(host, "."+strings.ToLower(sr.domain))
+	if !ok || sub == "" {
+		return "", false
+	}
+
+	// Only the leftmost label names the tunnel
+	name, _, _ := strings.Cut(sub, ".")
+	return name, true
+}
+
+// routeByName picks the tunnel a public request is for: the X-Tunnel-Name
+// header if present, otherwise the first path segment, which is stripped
+// before the request is forwarded.
+func routeByName(r *http.Request) (string, *http.Request) {
+	if name := r.Header.Get("X-Tunnel-Name"); name != "" {
+		r2 := r.Clone(r.Context())
+		r2.Header.Del("X-Tunnel-Name")
+		return name, r2
+	}
+
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = "/" + rest
+	if r.URL.RawPath != "" {
+		_, rawRest, _ := strings.Cut(strings.TrimPrefix(r.URL.RawPath, "/"), "/")
+		r2.URL.RawPath = "/" + rawRest
+	}
+	return name, r2
+}
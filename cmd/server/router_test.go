@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// newBackend starts a local API that answers every request with its name
+// and the path it was asked for.
+func newBackend(t testing.TB, name string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// get sends req and returns the response status and body.
+func get(t testing.TB, req *http.Request) (int, string) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestRouteByName(t *testing.T) {
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "alpha", Local: newBackend(t, "alpha").URL})
+	s.connect(t, client.Options{Name: "beta", Local: newBackend(t, "beta").URL})
+
+	byHeader := func(name, path string) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, s.public.URL+path, nil)
+		req.Header.Set("X-Tunnel-Name", name)
+		return req
+	}
+	byPath := func(name, path string) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, s.url(name, path), nil)
+		return req
+	}
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+		body   string
+	}{
+		{"path alpha", byPath("alpha", "/x"), http.StatusOK, "alpha /x"},
+		{"path beta", byPath("beta", "/y/z"), http.StatusOK, "beta /y/z"},
+		{"header alpha", byHeader("alpha", "/x"), http.StatusOK, "alpha /x"},
+		{"header beta", byHeader("beta", "/x"), http.StatusOK, "beta /x"},
+		{"unregistered", byPath("gamma", "/x"), http.StatusNotFound, "No tunnel registered for \"gamma\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := get(t, tt.req)
+			if status != tt.status || body != tt.body {
+				t.Errorf("got %d %q, want %d %q", status, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestSubdomainName(t *testing.T) {
+	sr := subdomainRouter{domain: "example.com"}
+	tests := []struct {
+		host string
+		name string
+		ok   bool
+	}{
+		{"myapp.example.com", "myapp", true},
+		{"myapp.example.com:9090", "myapp", true},
+		{"MyApp.Example.com.", "myapp", true},
+		{"a.b.example.com", "a", true},
+		{"example.com", "", false},
+		{"example.com:9090", "", false},
+		{"myapp.other.com", "", false},
+		{"myappexample.com", "", false},
+	}
+	for _, tt := range tests {
+		name, ok := sr.tunnelName(tt.host)
+		if name != tt.name || ok != tt.ok {
+			t.Errorf("tunnelName(%q) = %q, %v; want %q, %v", tt.host, name, ok, tt.name, tt.ok)
+		}
+	}
+}
+
+func TestRouteBySubdomain(t *testing.T) {
+	s := startServer(t, "-domain", "example.com")
+	s.connect(t, client.Options{Name: "myapp", Local: newBackend(t, "myapp").URL})
+
+	tests := []struct {
+		host   string
+		status int
+		body   string
+	}{
+		{"myapp.example.com", http.StatusOK, "myapp /x"},
+		{"myapp.example.com:9090", http.StatusOK, "myapp /x"},
+		{"other.example.com:9090", http.StatusNotFound, "Unknown subdomain \"other\" - no tunnel is registered for it\n"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, s.public.URL+"/x", nil)
+		req.Host = tt.host
+		status, body := get(t, req)
+		if status != tt.status || body != tt.body {
+			t.Errorf("Host %s: got %d %q, want %d %q", tt.host, status, body, tt.status, tt.body)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// startTCPServer listens for raw TCP connections in tcp mode. Each one is
+// spliced onto a new stream of the -tcp-tunnel tunnel without any HTTP
+// parsing.
+func startTCPServer() net.Listener {
+	listener, err := net.Listen("tcp", cfg.TCP.Addr)
+	if err != nil {
+		fatal("failed to start TCP server", "err", err)
+	}
+
+	slog.Info("public TCP listening", "addr", cfg.TCP.Addr, "tunnel", cfg.TCP.Tunnel)
+	go acceptTCP(listener)
+	return listener
+}
+
+func acceptTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("accept failed", "err", err)
+			continue
+		}
+
+		go handleTCPConn(conn)
+	}
+}
+
+func handleTCPConn(conn net.Conn) {
+	name := cfg.TCP.Tunnel
+	remote := conn.RemoteAddr().String()
+
+	tunnel, ok := registry.Pick(name, "")
+	if !ok {
+		slog.Warn("no tunnel registered for TCP connection", "tunnel", name, "remote_addr", remote)
+		conn.Close()
+		return
+	}
+
+	stream, err := tunnel.session.OpenStream()
+	if err != nil {
+		slog.Error("failed to open tunnel stream", "tunnel", name, "err", err)
+		conn.Close()
+		return
+	}
+
+	start := time.Now()
+	slog.Info("TCP connection opened", "tunnel", name, "remote_addr", remote)
+	copyBuffers.Splice(conn, stream)
+	slog.Info("TCP connection closed", "tunnel", name, "remote_addr", remote, "duration_ms", time.Since(start).Milliseconds())
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// echoServer starts a TCP service that sends back whatever it is sent.
+func echoServer(t testing.TB) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTCPEcho(t *testing.T) {
+	echo := echoServer(t)
+	s := startServer(t, "-mode", "tcp", "-tcp-addr", "127.0.0.1:0", "-tcp-tunnel", "raw")
+	public := startTCPServer()
+	defer public.Close()
+	s.connect(t, client.Options{Name: "raw", Mode: "tcp", Local: echo.Addr().String()})
+
+	conn, err := net.Dial("tcp", public.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Nothing here is HTTP, and it is answered line by line
+	r := bufio.NewReader(conn)
+	for _, line := range []string{"HELO intunja\n", "\x00\x01\x02 binary\n", "QUIT\n"} {
+		if _, err := io.WriteString(conn, line); err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != line {
+			t.Errorf("echoed %q, want %q", got, line)
+		}
+	}
+
+	// Closing our side closes the local connection, which closes ours
+	conn.(*net.TCPConn).CloseWrite()
+	if rest, err := io.ReadAll(r); err != nil || len(rest) != 0 {
+		t.Errorf("after close: %q, %v", rest, err)
+	}
+}
+
+func TestTCPCopyBufferSizes(t *testing.T) {
+	echo := echoServer(t)
+	data := make([]byte, 300_000)
+	rand.Read(data)
+	for _, size := range []string{"5", "4096", "1048576"} {
+		t.Run(size, func(t *testing.T) {
+			s := startServer(t, "-mode", "tcp", "-tcp-addr", "127.0.0.1:0", "-tcp-tunnel", "raw", "-copy-buffer-size", size)
+			public := startTCPServer()
+			n, _ := strconv.Atoi(size)
+			c := s.connect(t, client.Options{Name: "raw", Mode: "tcp", Local: echo.Addr().String(), CopyBufferSize: n})
+
+			conn, err := net.Dial("tcp", public.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			go conn.Write(data)
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Errorf("-copy-buffer-size %s: %v", size, err)
+			} else if !bytes.Equal(got, data) {
+				t.Errorf("-copy-buffer-size %s: echo differs", size)
+			}
+			conn.Close()
+			public.Close()
+			c.Stop()
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	setupServer(t, "-request-timeout", "200ms")
+
+	// A home server that takes the request and never answers
+	release := make(chan struct{})
+	defer close(release)
+	serverEnd, homeEnd := net.Pipe()
+	tunnelConns.Go(func() { handleTunnelConn(serverEnd) })
+	serveHome(t, homeEnd, "hung", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-release
+	}))
+	tunnel := waitTunnel(t, "hung")
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handlePublicRequest(w, httptest.NewRequest(http.MethodGet, "/hung/", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status %d, want 504", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("answered after %s, want about the 200ms timeout", elapsed)
+	}
+
+	// The stream is torn down, not left open with the home server
+	waitFor(t, func() bool { return tunnel.session.NumStreams() == 0 })
+	if tunnel.session.Err() != nil {
+		t.Error("the timeout closed the whole tunnel")
+	}
+}
+
+func TestRequestTimeoutDisabled(t *testing.T) {
+	setupServer(t, "-request-timeout", "0")
+
+	serverEnd, homeEnd := net.Pipe()
+	tunnelConns.Go(func() { handleTunnelConn(serverEnd) })
+	serveHome(t, homeEnd, "slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("eventually"))
+	}))
+	waitTunnel(t, "slow")
+
+	w := httptest.NewRecorder()
+	handlePublicRequest(w, httptest.NewRequest(http.MethodGet, "/slow/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "eventually" {
+		t.Errorf("got %d %q, want the slow answer", w.Code, w.Body)
+	}
+}
+
+func TestSlowHeadersCutOff(t *testing.T) {
+	setupServer(t, "-read-header-timeout", "200ms", "-read-timeout", "10s")
+	logs := captureLogs(t)
+	tunnels := startTunnelServer()
+	defer tunnels.Close()
+	for _, srv := range startPublicServer() {
+		defer srv.Shutdown(context.Background())
+	}
+	addr, _ := logs.line(t, "public API listening")["addr"].(string)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	// Headers that never finish
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(io.Discard, conn)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("connection closed after %s, want about the 200ms header timeout", elapsed)
+	}
+}
+
+func TestPublicTimeoutDefaults(t *testing.T) {
+	c, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a header timeout a trickling client holds its connection
+	// for good
+	for name, d := range map[string]time.Duration{
+		"read-header-timeout": c.HeaderTimeout,
+		"idle-timeout":        c.IdleTimeout,
+	} {
+		if d <= 0 {
+			t.Errorf("-%s defaults to %s", name, d)
+		}
+	}
+}
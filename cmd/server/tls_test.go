@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+// testCert is a certificate and key written to PEM files.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newCert issues a certificate for 127.0.0.1 with common name cn, signed
+// by parent or, if parent is nil, by itself as a CA.
+func newCert(t testing.TB, cn string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, "cert.pem"),
+		keyFile:  filepath.Join(dir, "key.pem"),
+	}
+	writePEM(t, c.certFile, "CERTIFICATE", der)
+	writePEM(t, c.keyFile, "EC PRIVATE KEY", keyDER)
+	return c
+}
+
+func writePEM(t testing.TB, path, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pool returns a pool trusting c.
+func (c *testCert) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return pool
+}
+
+// tlsCertificate returns c for presenting in a TLS handshake.
+func (c *testCert) tlsCertificate(t testing.TB) tls.Certificate {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestTLSTunnel(t *testing.T) {
+	cert := newCert(t, "intunja test", nil)
+	s := startServer(t, "-tls", "-tls-cert", cert.certFile, "-tls-key", cert.keyFile)
+	s.connect(t, client.Options{
+		Name:  "secure",
+		Local: newBackend(t, "secure").URL,
+		TLS:   &tls.Config{RootCAs: cert.pool()},
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, s.url("secure", "/x"), nil)
+	if status, body := get(t, req); status != http.StatusOK || body != "secure /x" {
+		t.Errorf("got %d %q, want 200 %q", status, body, "secure /x")
+	}
+}
+
+func TestTLSTunnelRejectsPlainClient(t *testing.T) {
+	cert := newCert(t, "intunja test", nil)
+	s := startServer(t, "-tls", "-tls-cert", cert.certFile, "-tls-key", cert.keyFile)
+
+	errs := make(chan error, 1)
+	c, err := client.New(client.Options{
+		Remote: s.tunnels.Addr().String(),
+		Local:  "http://127.0.0.1:1",
+		Logger: discardLogger(),
+		OnError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start(t.Context())
+	defer c.Stop()
+	select {
+	case <-errs:
+	case <-time.After(15 * time.Second):
+		t.Fatal("plain client got no error from a TLS server")
+	}
+	if registry.Len() != 0 {
+		t.Error("plain client registered with a TLS server")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+var (
+	spansOnce sync.Once
+	spans     = tracetest.NewInMemoryExporter()
+)
+
+// recordSpans sends the spans both ends record to an in-memory exporter.
+// The global tracers only take the first provider set, so it is set once
+// and emptied for each test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	spansOnce.Do(func() {
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))
+	})
+	spans.Reset()
+	t.Cleanup(spans.Reset)
+	return spans
+}
+
+func TestTraceLinkage(t *testing.T) {
+	exporter := recordSpans(t)
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("Traceparent")
+	}))
+	defer backend.Close()
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "traced", Local: backend.URL})
+
+	// A trace started in front of the server
+	const traceID, callerID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := mustRequest(t, s.url("traced", "/orders"))
+	req.Header.Set("Traceparent", "00-"+traceID+"-"+callerID+"-01")
+	if code, body := get(t, req); code != http.StatusOK {
+		t.Fatalf("status %d: %s", code, body)
+	}
+	forwarded := <-received
+
+	var server, home tracetest.SpanStub
+	waitFor(t, func() bool {
+		for _, span := range exporter.GetSpans() {
+			switch span.SpanKind {
+			case trace.SpanKindServer:
+				server = span
+			case trace.SpanKindClient:
+				home = span
+			}
+		}
+		return server.SpanContext.IsValid() && home.SpanContext.IsValid()
+	})
+
+	if got := server.SpanContext.TraceID().String(); got != traceID {
+		t.Errorf("server span in trace %s, want the caller's %s", got, traceID)
+	}
+	if got := server.Parent.SpanID().String(); got != callerID {
+		t.Errorf("server span's parent is %s, want the caller's %s", got, callerID)
+	}
+	if home.SpanContext.TraceID() != server.SpanContext.TraceID() || home.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("client span %s/%s has parent %s, want a child of server span %s",
+			home.SpanContext.TraceID(), home.SpanContext.SpanID(), home.Parent.SpanID(), server.SpanContext.SpanID())
+	}
+	// The local API continues from the client's span
+	if want := "00-" + traceID + "-" + home.SpanContext.SpanID().String() + "-01"; forwarded != want {
+		t.Errorf("local API got traceparent %q, want %q", forwarded, want)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// trafficConn counts the bytes moved over one tunnel connection, both for
+// the admin API and for the per-tunnel Prometheus counters, and holds them
+// to the tunnel's bandwidth limit.
+type trafficConn struct {
+	net.Conn
+
+	in, out           atomic.Int64
+	inTotal, outTotal prometheus.Counter
+
+	buckets *bandwidthBuckets
+	ctx     context.Context // cancelled on Close, ending a wait for tokens
+	cancel  context.CancelFunc
+}
+
+func newTrafficConn(conn net.Conn, name string) *trafficConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &trafficConn{
+		Conn:     conn,
+		inTotal:  stats.TunnelBytes.WithLabelValues(name, "in"),
+		outTotal: stats.TunnelBytes.WithLabelValues(name, "out"),
+		buckets:  bandwidth.get(name),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Read takes the tokens for what it read afterwards, so a tunnel over its
+// limit is left unread until the client has to slow down.
+func (c *trafficConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.Add(int64(n))
+	c.inTotal.Add(float64(n))
+	if werr := throttle(c.ctx, c.buckets.in, n); werr != nil && err == nil {
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *trafficConn) Write(p []byte) (int, error) {
+	if err := throttle(c.ctx, c.buckets.out, len(p)); err != nil {
+		return 0, net.ErrClosed
+	}
+	n, err := c.Conn.Write(p)
+	c.out.Add(int64(n))
+	c.outTotal.Add(float64(n))
+	return n, err
+}
+
+func (c *trafficConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
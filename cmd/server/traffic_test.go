@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// framed reports whether counted is n bytes plus at most 5% and a few
+// kilobytes of headers and framing.
+func framed(counted int64, n int) bool {
+	return counted >= int64(n) && counted <= int64(n)+int64(n)/20+4096
+}
+
+func TestTrafficCounters(t *testing.T) {
+	const up, down = 1 << 20, 2 << 20
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write(bytes.Repeat([]byte{'d'}, down))
+	}))
+	defer backend.Close()
+	s := startServer(t)
+	c := s.connect(t, client.Options{Name: "counted", Local: backend.URL})
+	tunnel := waitTunnel(t, "counted")
+	inBefore, outBefore := tunnel.traffic.in.Load(), tunnel.traffic.out.Load()
+
+	resp, err := http.Post(s.url("counted", "/"), "application/octet-stream", strings.NewReader(strings.Repeat("u", up)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if n != down {
+		t.Fatalf("downloaded %d bytes, want %d", n, down)
+	}
+
+	// In is from the client, so it carries the response
+	in, out := tunnel.traffic.in.Load()-inBefore, tunnel.traffic.out.Load()-outBefore
+	if !framed(in, down) {
+		t.Errorf("counted %d bytes in for a %d byte response", in, down)
+	}
+	if !framed(out, up) {
+		t.Errorf("counted %d bytes out for a %d byte request", out, up)
+	}
+	if got := testutil.ToFloat64(stats.TunnelBytes.WithLabelValues("counted", "in")); got != float64(tunnel.traffic.in.Load()) {
+		t.Errorf("Prometheus counted %v bytes in, the tunnel %d", got, tunnel.traffic.in.Load())
+	}
+
+	// A new connection under the name starts from zero
+	c.Stop()
+	waitFor(t, func() bool {
+		_, ok := registry.Lookup("counted")
+		return !ok
+	})
+	s.connect(t, client.Options{Name: "counted", Local: backend.URL})
+	again := waitTunnel(t, "counted")
+	if again.traffic.in.Load() >= in || again.traffic.out.Load() >= out {
+		t.Errorf("the new connection starts at %d in and %d out", again.traffic.in.Load(), again.traffic.out.Load())
+	}
+}
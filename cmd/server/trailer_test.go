@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func TestTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("message"))
+		w.Header().Set("Grpc-Status", "0")
+		// Not announced beforehand
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+	}))
+	defer backend.Close()
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "grpcish", Local: backend.URL})
+
+	resp, err := http.Get(s.url("grpcish", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "message" {
+		t.Errorf("body %q", body)
+	}
+	// Trailers are only known once the body has been read
+	if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "done" {
+		t.Errorf("trailers %v, want Grpc-Status and Grpc-Message", resp.Trailer)
+	}
+}
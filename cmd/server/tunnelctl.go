@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runTunnelctl queries the admin API of a running server.
+func runTunnelctl(args []string) int {
+	// As with the server, the config file supplies the flag defaults
+	conf := defaultConfig()
+	if path := configPath(args); path != "" {
+		if err := conf.loadFile(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	fs := flag.NewFlagSet("tunnelctl", flag.ExitOnError)
+	fs.String("config", "", "Server config file to take the admin address and token from")
+	addr := fs.String("admin-addr", conf.AdminAddr, "Admin API address of the server")
+	// The token is left out of the defaults so usage doesn't print it
+	token := fs.String("auth-token", "", "Admin API token (default auth_token from -config, or $INTUNJA_TOKEN)")
+	output := fs.String("o", "table", "Output format: table or json")
+	watch := fs.Bool("watch", false, "With stats, print a sample every second until interrupted instead of just one")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: server tunnelctl [flags] list | kick NAME | stats NAME")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *token == "" {
+		*token = conf.AuthToken
+	}
+	if *token == "" {
+		*token = os.Getenv("INTUNJA_TOKEN")
+	}
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q, want table or json\n", *output)
+		return 2
+	}
+	if *addr == "" {
+		fmt.Fprintln(os.Stderr, "tunnelctl needs -admin-addr or a config file with admin_addr")
+		return 2
+	}
+	cmd, rest := fs.Arg(0), fs.Args()[min(1, fs.NArg()):]
+	want := 1
+	if cmd == "list" {
+		want = 0
+	}
+	if cmd != "list" && cmd != "kick" && cmd != "stats" || len(rest) != want {
+		fs.Usage()
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	c := &adminClient{base: adminURL(*addr), token: *token, json: *output == "json", out: os.Stdout}
+	var err error
+	switch cmd {
+	case "list":
+		err = c.list(ctx)
+	case "kick":
+		err = c.kick(ctx, rest[0])
+	case "stats":
+		err = c.stats(ctx, rest[0], *watch)
+	}
+	if err != nil && ctx.Err() == nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// adminURL turns an admin listen address such as :9091 into the URL to
+// reach it at.
+func adminURL(addr string) string {
+	if strings.Contains(addr, "://") {
+		return strings.TrimSuffix(addr, "/")
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// adminClient makes the admin API requests behind tunnelctl and prints
+// their results as a table or, with json, as JSON.
+type adminClient struct {
+	base  string
+	token string
+	json  bool
+	out   io.Writer
+}
+
+// do sends a request and returns the response if it succeeded, or the
+// error the server gave.
+func (c *adminClient) do(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (c *adminClient) list(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, "/admin/tunnels")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Tunnels []tunnelInfo `json:"tunnels"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("failed to read tunnel list: %w", err)
+	}
+	if c.json {
+		return c.printJSON(body.Tunnels)
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPRINCIPAL\tREMOTE\tUPTIME\tIN-FLIGHT\tBYTES IN\tBYTES OUT\tBANDWIDTH\tP95 MS\tHEALTH")
+	for _, t := range body.Tunnels {
+		limit, p95, health := "-", "-", "ok"
+		if t.Bandwidth > 0 {
+			limit = formatBytes(t.Bandwidth) + "/s"
+		}
+		if t.LatencyMS != nil {
+			p95 = strconv.FormatFloat(t.LatencyMS.P95, 'f', 1, 64)
+		}
+		if t.Degraded {
+			health = "degraded: " + t.HealthError
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			t.Name, t.Principal, t.RemoteAddr, time.Since(t.ConnectedAt).Round(time.Second),
+			t.InFlight, formatBytes(t.BytesIn), formatBytes(t.BytesOut), limit, p95, health)
+	}
+	return tw.Flush()
+}
+
+func (c *adminClient) kick(ctx context.Context, name string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/admin/tunnels/"+url.PathEscape(name))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if c.json {
+		return c.printJSON(map[string]any{"name": name, "disconnected": true})
+	}
+	fmt.Fprintf(c.out, "disconnected %s\n", name)
+	return nil
+}
+
+// stats prints the first sample of the tunnel's stats stream, or with
+// watch every one until ctx is done.
+func (c *adminClient) stats(ctx context.Context, name string, watch bool) error {
+	resp, err := c.do(ctx, http.MethodGet, "/admin/tunnels/"+url.PathEscape(name)+"/stats")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	const row = "%-8s  %7s  %9s  %8s  %9s  %9s  %10s  %10s  %10s\n"
+	if !c.json {
+		fmt.Fprintf(c.out, row, "TIME", "TUNNELS", "IN-FLIGHT", "REQ/S", "IN/S", "OUT/S", "REQUESTS", "BYTES IN", "BYTES OUT")
+	}
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		data, ok := strings.CutPrefix(sc.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var s tunnelStats
+		if err := json.Unmarshal([]byte(data), &s); err != nil {
+			return fmt.Errorf("failed to read stats: %w", err)
+		}
+		if c.json {
+			if err := c.printJSON(s); err != nil {
+				return err
+			}
+		} else {
+			fmt.Fprintf(c.out, row, s.Time.Local().Format(time.TimeOnly), strconv.Itoa(s.Tunnels), strconv.Itoa(s.InFlight),
+				strconv.FormatFloat(s.RequestsPerSecond, 'f', 1, 64), formatBytes(int64(s.BytesInPerSecond)), formatBytes(int64(s.BytesOutPerSecond)),
+				strconv.FormatInt(s.Requests, 10), formatBytes(s.BytesIn), formatBytes(s.BytesOut))
+		}
+		if !watch {
+			return nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return errors.New("stats stream ended")
+}
+
+func (c *adminClient) printJSON(v any) error {
+	return json.NewEncoder(c.out).Encode(v)
+}
+
+// formatBytes writes n in the largest binary unit that keeps it at or
+// above 1.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + "B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAdmin plays a server's admin API with two tunnels, home and media,
+// and records the tunnels kicked.
+type fakeAdmin struct {
+	*httptest.Server
+	mu     sync.Mutex
+	kicked []string
+}
+
+func startFakeAdmin(t *testing.T) *fakeAdmin {
+	t.Helper()
+	a := new(fakeAdmin)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		// Connected as of the request, so the uptimes come out whole
+		now := time.Now()
+		tunnels := []tunnelInfo{
+			{Name: "home", Principal: "shared-token", RemoteAddr: "198.51.100.7:52000", ConnectedAt: now.Add(-time.Hour), InFlight: 2, BytesIn: 1536, BytesOut: 2 << 20, LatencyMS: &latencyPercentiles{P95: 12.5}},
+			{Name: "media", Principal: "home-1", RemoteAddr: "203.0.113.9:41000", ConnectedAt: now, BytesIn: 10, Degraded: true, HealthError: "503 from /healthz", Bandwidth: 1 << 20},
+		}
+		json.NewEncoder(w).Encode(map[string]any{"tunnels": tunnels})
+	})
+	mux.HandleFunc("DELETE /admin/tunnels/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("name") != "home" {
+			http.Error(w, "tunnel not found", http.StatusNotFound)
+			return
+		}
+		a.mu.Lock()
+		a.kicked = append(a.kicked, r.PathValue("name"))
+		a.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /admin/tunnels/{name}/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range 3 {
+			s := tunnelStats{Time: time.Date(2026, 1, 2, 3, 4, 5+i, 0, time.UTC), Tunnels: 1, InFlight: i, Requests: int64(10 * (i + 1)), RequestsPerSecond: 10, BytesIn: 4096, BytesInPerSecond: 2048}
+			data, _ := json.Marshal(s)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+	})
+	a.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(a.Close)
+	return a
+}
+
+// runCtl runs tunnelctl with args and returns its exit code and what it
+// printed to stdout and stderr.
+func runCtl(t *testing.T, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	dir := t.TempDir()
+	outFile, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errFile, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outFile.Close()
+	defer errFile.Close()
+
+	savedOut, savedErr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = outFile, errFile
+	code = runTunnelctl(args)
+	os.Stdout, os.Stderr = savedOut, savedErr
+
+	out, _ := os.ReadFile(outFile.Name())
+	errOut, _ := os.ReadFile(errFile.Name())
+	return code, string(out), string(errOut)
+}
+
+func TestTunnelctlList(t *testing.T) {
+	a := startFakeAdmin(t)
+	code, out, stderr := runCtl(t, "-admin-addr", a.URL, "-auth-token", "secret", "list")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("printed %d lines:\n%s", len(lines), out)
+	}
+	for i, want := range [][]string{
+		{"NAME", "PRINCIPAL", "REMOTE", "UPTIME", "IN-FLIGHT", "BYTES IN", "BYTES OUT", "BANDWIDTH", "P95 MS", "HEALTH"},
+		{"home", "shared-token", "198.51.100.7:52000", "1h0m0s", "2", "1.5KiB", "2.0MiB", "-", "12.5", "ok"},
+		{"media", "home-1", "203.0.113.9:41000", "0s", "0", "10B", "0B", "1.0MiB/s", "-", "degraded: 503 from /healthz"},
+	} {
+		for _, field := range want {
+			if !strings.Contains(lines[i], field) {
+				t.Errorf("line %d %q lacks %q", i, lines[i], field)
+			}
+		}
+	}
+	// The columns line up
+	if strings.Index(lines[0], "PRINCIPAL") != strings.Index(lines[1], "shared-token") {
+		t.Errorf("columns don't line up:\n%s", out)
+	}
+}
+
+func TestTunnelctlListJSON(t *testing.T) {
+	a := startFakeAdmin(t)
+	code, out, stderr := runCtl(t, "-admin-addr", a.URL, "-auth-token", "secret", "-o", "json", "list")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	var got []tunnelInfo
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("%v in %s", err, out)
+	}
+	if len(got) != 2 || got[0].Name != "home" || got[0].BytesOut != 2<<20 || got[1].HealthError != "503 from /healthz" {
+		t.Errorf("listed %+v", got)
+	}
+}
+
+func TestTunnelctlKick(t *testing.T) {
+	a := startFakeAdmin(t)
+	code, out, stderr := runCtl(t, "-admin-addr", a.URL, "-auth-token", "secret", "kick", "home")
+	if code != 0 || out != "disconnected home\n" {
+		t.Errorf("exit %d, printed %q: %s", code, out, stderr)
+	}
+	if len(a.kicked) != 1 || a.kicked[0] != "home" {
+		t.Errorf("kicked %v", a.kicked)
+	}
+
+	code, out, _ = runCtl(t, "-admin-addr", a.URL, "-auth-token", "secret", "-o", "json", "kick", "home")
+	if code != 0 || out != `{"disconnected":true,"name":"home"}`+"\n" {
+		t.Errorf("json: exit %d, printed %q", code, out)
+	}
+
+	// The server's error is passed on
+	code, _, stderr = runCtl(t, "-admin-addr", a.URL, "-auth-token", "secret", "kick", "nobody")
+	if code != 1 || !strings.Contains(stderr, "404") || !strings.Contains(stderr, "tunnel not found") {
+		t.Errorf("unknown tunnel: exit %d, %q", code, stderr)
+	}
+}
+
+func TestTunnelctlStats(t *testing.T) {
+	a := startFakeAdmin(t)
+	code, out, stderr := runCtl(t, "-admin-addr", a.URL, "-auth-token", "secret", "stats", "home")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	// Without -watch, only the first sample
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "TIME") {
+		t.Fatalf("printed:\n%s", out)
+	}
+	if fields := strings.Fields(lines[1]); len(fields) != 9 || fields[3] != "10.0" || fields[4] != "2.0KiB" || fields[6] != "10" || fields[7] != "4.0KiB" {
+		t.Errorf("sample %q", lines[1])
+	}
+
+	code, out, _ = runCtl(t, "-admin-addr", a.URL, "-auth-token", "secret", "-o", "json", "-watch", "stats", "home")
+	// The fake stream ends after three samples
+	if code != 1 {
+		t.Errorf("exit %d when the stream ended", code)
+	}
+	dec := json.NewDecoder(strings.NewReader(out))
+	var n int
+	for ; ; n++ {
+		var s tunnelStats
+		if err := dec.Decode(&s); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if s.InFlight != n {
+			t.Errorf("sample %d: %+v", n, s)
+		}
+	}
+	if n != 3 {
+		t.Errorf("watched %d samples, want 3", n)
+	}
+}
+
+func TestTunnelctlConfig(t *testing.T) {
+	a := startFakeAdmin(t)
+	path := writeConfig(t, fmt.Sprintf("admin_addr: %q\nauth_token: secret\n", a.URL))
+	if code, _, stderr := runCtl(t, "-config", path, "list"); code != 0 {
+		t.Errorf("exit %d: %s", code, stderr)
+	}
+
+	// A wrong token is the server's to refuse
+	code, _, stderr := runCtl(t, "-config", path, "-auth-token", "wrong", "list")
+	if code != 1 || !strings.Contains(stderr, "401") {
+		t.Errorf("wrong token: exit %d, %q", code, stderr)
+	}
+}
+
+func TestTunnelctlUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{"list"},
+		{"-admin-addr", "localhost:9091", "kick"},
+		{"-admin-addr", "localhost:9091", "list", "extra"},
+		{"-admin-addr", "localhost:9091", "restart"},
+		{"-admin-addr", "localhost:9091", "-o", "yaml", "list"},
+	} {
+		if code, _, _ := runCtl(t, args...); code != 2 {
+			t.Errorf("%v: exit %d, want 2", args, code)
+		}
+	}
+}
+
+func TestAdminURL(t *testing.T) {
+	for addr, want := range map[string]string{
+		":9091":                  "http://localhost:9091",
+		"0.0.0.0:9091":           "http://localhost:9091",
+		"[::]:9091":              "http://localhost:9091",
+		"10.0.0.5:9091":          "http://10.0.0.5:9091",
+		"https://admin.example/": "https://admin.example",
+	} {
+		if got := adminURL(addr); got != want {
+			t.Errorf("adminURL(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:             "0B",
+		1023:          "1023B",
+		1024:          "1.0KiB",
+		1536:          "1.5KiB",
+		5 << 30:       "5.0GiB",
+		3 << 50:       "3.0PiB",
+		1<<62 + 1<<61: "6144.0PiB",
+	} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// heapGrowth samples the heap until the test ends, and returns a func
+// giving how far its peak has grown past where it started.
+func heapGrowth(t *testing.T) func() int64 {
+	t.Helper()
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		var m runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > peak.Load() {
+				peak.Store(m.HeapAlloc)
+			}
+		}
+	}()
+	return func() int64 { return int64(peak.Load()) - int64(before.HeapAlloc) }
+}
+
+func TestChunkedUploadBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("uploads 512MB")
+	}
+	const size = 512 << 20
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		fmt.Fprintf(w, "%d %v %q %v", n, r.ContentLength, r.TransferEncoding, err)
+	}))
+	defer backend.Close()
+	s := startServer(t, "-request-timeout", "2m")
+	s.connect(t, client.Options{Name: "upload", Local: backend.URL})
+	grown := heapGrowth(t)
+
+	// Every hop, public listener to server to mux stream to client to local
+	// API, is in this process, so one heap covers them all
+	req, _ := http.NewRequest(http.MethodPost, s.url("upload", "/"), io.LimitReader(zeros{}, size))
+	req.ContentLength = -1
+	code, body := get(t, req)
+	if want := fmt.Sprintf(`%d -1 ["chunked"] <nil>`, size); code != http.StatusOK || body != want {
+		t.Fatalf("the local API got %d %q, want %q", code, body, want)
+	}
+	if g := grown(); g > 32<<20 {
+		t.Errorf("heap grew by %d MB forwarding a %d MB upload", g>>20, size>>20)
+	}
+}
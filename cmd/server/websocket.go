@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/mindsgn-studio/intunja/internal/mux"
+	"github.com/mindsgn-studio/intunja/internal/relay"
+)
+
+// proxyUpgrade forwards a WebSocket handshake and then splices the raw
+// connection onto the stream. The home server's response, whether a 101 or
+// an error, is relayed as bytes rather than parsed.
+func proxyUpgrade(w http.ResponseWriter, r *http.Request, stream *mux.Stream, logger *slog.Logger) {
+	defer stream.Close()
+
+	if err := r.Write(stream); err != nil {
+		logger.Error("failed to write upgrade request to tunnel", "err", err)
+		http.Error(w, "Bad Gateway - tunnel error", http.StatusBadGateway)
+		return
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		logger.Error("failed to hijack connection for upgrade", "err", err)
+		http.Error(w, "Upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	// The public server's read and write timeouts don't apply to a
+	// long-lived upgraded connection
+	conn.SetDeadline(time.Time{})
+
+	copyBuffers.Splice(relay.BufferedConn(conn, brw.Reader), stream)
+}
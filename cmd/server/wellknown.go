@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// defaultRobots keeps crawlers off tunnels unless -robots-txt says
+// otherwise: most are someone's machine at home, not a site to index.
+const defaultRobots = "User-agent: *\nDisallow: /\n"
+
+// wellKnown answers /robots.txt and /favicon.ico for every tunnel at the
+// edge, so the crawlers and browsers that keep asking for them don't cost
+// a trip to the home server.
+type wellKnown struct {
+	robots []byte
+}
+
+// intercepted is nil unless -intercept-wellknown is set.
+var intercepted *wellKnown
+
+// loadWellKnown serves the robots.txt at path, or defaultRobots if path is
+// empty.
+func loadWellKnown(path string) (*wellKnown, error) {
+	if path == "" {
+		return &wellKnown{robots: []byte(defaultRobots)}, nil
+	}
+	robots, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &wellKnown{robots: robots}, nil
+}
+
+// serve answers r if it asks for one of the paths, and reports whether it
+// did. r's path is the one the home server would have seen.
+func (k *wellKnown) serve(w http.ResponseWriter, r *http.Request) bool {
+	if k == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	h := w.Header()
+	switch r.URL.Path {
+	case "/robots.txt":
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		h.Set("Content-Length", strconv.Itoa(len(k.robots)))
+		h.Set("Cache-Control", "public, max-age=3600")
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(k.robots)
+		}
+	case "/favicon.ico":
+		// Cached for a day so the browser stops asking
+		h.Set("Cache-Control", "public, max-age=86400")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		return false
+	}
+	return true
+}
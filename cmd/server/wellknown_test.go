@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mindsgn-studio/intunja/client"
+)
+
+func TestInterceptWellKnown(t *testing.T) {
+	robots := filepath.Join(t.TempDir(), "robots.txt")
+	if err := os.WriteFile(robots, []byte("User-agent: *\nAllow: /\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		args   []string
+		robots string
+	}{
+		{[]string{"-intercept-wellknown"}, defaultRobots},
+		{[]string{"-intercept-wellknown", "-robots-txt", robots}, "User-agent: *\nAllow: /\n"},
+	} {
+		t.Run(strings.Join(c.args, " "), func(t *testing.T) {
+			backend, hits := countingBackend(t)
+			s := startServer(t, c.args...)
+			s.connect(t, client.Options{Name: "app", Local: backend.URL})
+
+			if code, body := get(t, mustRequest(t, s.url("app", "/robots.txt"))); code != http.StatusOK || body != c.robots {
+				t.Errorf("%v: robots.txt %d %q", c.args, code, body)
+			}
+			if code, body := get(t, mustRequest(t, s.url("app", "/favicon.ico"))); code != http.StatusNoContent || body != "" {
+				t.Errorf("%v: favicon.ico %d %q", c.args, code, body)
+			}
+			head, _ := http.NewRequest("HEAD", s.url("app", "/robots.txt"), nil)
+			if code, body := get(t, head); code != http.StatusOK || body != "" {
+				t.Errorf("%v: HEAD robots.txt %d %q", c.args, code, body)
+			}
+			if n := hits("/robots.txt") + hits("/favicon.ico"); n != 0 {
+				t.Errorf("%v: %d requests reached the backend", c.args, n)
+			}
+
+			// Anything else still goes through, and so does a POST to the paths
+			if _, body := get(t, mustRequest(t, s.url("app", "/robots.txt.bak"))); body != "/robots.txt.bak #1" {
+				t.Errorf("%v: other path got %q", c.args, body)
+			}
+			post, _ := http.NewRequest("POST", s.url("app", "/favicon.ico"), nil)
+			if _, body := get(t, post); body != "/favicon.ico #1" {
+				t.Errorf("%v: POST got %q", c.args, body)
+			}
+		})
+	}
+}
+
+func TestInterceptWellKnownOff(t *testing.T) {
+	backend, _ := countingBackend(t)
+	s := startServer(t)
+	s.connect(t, client.Options{Name: "app", Local: backend.URL})
+
+	for _, path := range []string{"/robots.txt", "/favicon.ico"} {
+		if _, body := get(t, mustRequest(t, s.url("app", path))); body != path+" #1" {
+			t.Errorf("%s got %q, want the backend's", path, body)
+		}
+	}
+}
+
+func TestRobotsTxtRequiresIntercept(t *testing.T) {
+	if _, err := parseConfig("-robots-txt", "robots.txt"); err == nil {
+		t.Error("-robots-txt accepted without -intercept-wellknown")
+	}
+}
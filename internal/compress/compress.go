@@ -0,0 +1,99 @@
+// Package compress gzips everything sent over a tunnel connection.
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Conn compresses writes to, and decompresses reads from, the underlying
+// connection. Every Write is flushed so frames are never held back.
+type Conn struct {
+	net.Conn
+
+	readOnce sync.Once
+	zr       *gzip.Reader
+	readErr  error
+	zw       *gzip.Writer
+
+	rawIn, wireIn   atomic.Int64
+	rawOut, wireOut atomic.Int64
+}
+
+// Gzip wraps conn. Both ends of the connection must be wrapped.
+func Gzip(conn net.Conn) *Conn {
+	c := &Conn{Conn: conn}
+	c.zw = gzip.NewWriter(&countingWriter{w: conn, n: &c.wireOut})
+	return c
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	// gzip.NewReader blocks on the stream header, so wait for the first read
+	c.readOnce.Do(func() {
+		c.zr, c.readErr = gzip.NewReader(&countingReader{r: c.Conn, n: &c.wireIn})
+	})
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	n, err := c.zr.Read(p)
+	c.rawIn.Add(int64(n))
+	return n, err
+}
+
+// Write is not safe for concurrent use; the mux session serialises its
+// frame writes already.
+func (c *Conn) Write(p []byte) (int, error) {
+	n, err := c.zw.Write(p)
+	c.rawOut.Add(int64(n))
+	if err != nil {
+		return n, err
+	}
+	return n, c.zw.Flush()
+}
+
+// Stats reports the bytes carried so far.
+type Stats struct {
+	// Raw counts uncompressed bytes, Wire what was actually sent or
+	// received on the connection.
+	Raw, Wire int64
+}
+
+// Ratio is the wire size as a fraction of the raw size.
+func (s Stats) Ratio() float64 {
+	if s.Raw == 0 {
+		return 1
+	}
+	return float64(s.Wire) / float64(s.Raw)
+}
+
+func (c *Conn) Stats() Stats {
+	return Stats{
+		Raw:  c.rawIn.Load() + c.rawOut.Load(),
+		Wire: c.wireIn.Load() + c.wireOut.Load(),
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
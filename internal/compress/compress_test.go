@@ -0,0 +1,48 @@
+package compress
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := Gzip(a), Gzip(b)
+	defer client.Close()
+	defer server.Close()
+
+	payload := bytes.Repeat([]byte("the same line over and over\n"), 64*1024)
+	go func() {
+		// Several writes, as the mux session makes them
+		for chunk := range slices.Chunk(payload, 32*1024) {
+			if _, err := client.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("payload corrupted in transit")
+	}
+
+	sent, received := client.Stats(), server.Stats()
+	if sent.Raw != int64(len(payload)) || received.Raw != int64(len(payload)) {
+		t.Errorf("raw bytes sent %d, received %d; want %d", sent.Raw, received.Raw, len(payload))
+	}
+	if ratio := received.Ratio(); ratio > 0.1 {
+		t.Errorf("repetitive payload compressed to %.2f of its size", ratio)
+	}
+}
+
+func TestRatioEmpty(t *testing.T) {
+	if r := (Stats{}).Ratio(); r != 1 {
+		t.Errorf("ratio with nothing sent = %v, want 1", r)
+	}
+}
@@ -0,0 +1,34 @@
+// Package limit caps how much work is handled at once.
+package limit
+
+// Semaphore bounds the number of concurrent holders. A nil Semaphore has
+// no limit.
+type Semaphore chan struct{}
+
+// New returns a Semaphore with n slots, or nil if n is not positive.
+func New(n int) Semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(Semaphore, n)
+}
+
+// TryAcquire takes a slot without waiting and reports whether it got one.
+func (s Semaphore) TryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release frees a slot taken by TryAcquire.
+func (s Semaphore) Release() {
+	if s != nil {
+		<-s
+	}
+}
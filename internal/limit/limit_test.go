@@ -0,0 +1,29 @@
+package limit
+
+import "testing"
+
+func TestSemaphore(t *testing.T) {
+	s := New(2)
+	if !s.TryAcquire() || !s.TryAcquire() {
+		t.Fatal("refused a free slot")
+	}
+	if s.TryAcquire() {
+		t.Fatal("took a third of two slots")
+	}
+	s.Release()
+	if !s.TryAcquire() {
+		t.Fatal("refused a released slot")
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		s := New(n)
+		for range 1000 {
+			if !s.TryAcquire() {
+				t.Fatalf("New(%d) refused a slot", n)
+			}
+		}
+		s.Release()
+	}
+}
@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("request", "method", "GET", "path", "/x", "status", 200, "duration_ms", 12)
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line is not JSON: %v: %s", err, buf.Bytes())
+	}
+	for _, key := range []string{"time", "level", "msg", "method", "path", "status", "duration_ms"} {
+		if _, ok := line[key]; !ok {
+			t.Errorf("log line has no %q: %s", key, buf.Bytes())
+		}
+	}
+	if line["msg"] != "request" || line["level"] != "INFO" {
+		t.Errorf("msg, level = %v, %v; want request, INFO", line["msg"], line["level"])
+	}
+}
+
+func TestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "text", "warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("hidden debug")
+	logger.Info("hidden info")
+	logger.Warn("shown warning")
+	logger.Error("shown error")
+
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Errorf("logged below the warn level:\n%s", out)
+	}
+	if !strings.Contains(out, "shown warning") || !strings.Contains(out, "shown error") {
+		t.Errorf("dropped warn or error lines:\n%s", out)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Error("accepted format xml")
+	}
+	if _, err := New(&bytes.Buffer{}, "json", "loud"); err == nil {
+		t.Error("accepted level loud")
+	}
+}
@@ -0,0 +1,83 @@
+// Package metrics defines the Prometheus collectors exported by the
+// tunnel server.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "intunja"
+
+type Metrics struct {
+	Requests          *prometheus.CounterVec
+	InFlight          prometheus.Gauge
+	RequestDuration   *prometheus.HistogramVec
+	TunnelConnects    prometheus.Counter
+	TunnelDisconnects *prometheus.CounterVec
+	TunnelBytes       *prometheus.CounterVec
+	DecodedBytes      *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	return &Metrics{
+		Requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Public requests handled, by tunnel and status code.",
+		}, []string{"tunnel", "code"}),
+		InFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "requests_in_flight",
+			Help:      "Public requests currently being served.",
+		}),
+		RequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time to serve public requests through the tunnel.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"tunnel"}),
+		TunnelConnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tunnel_connects_total",
+			Help:      "Tunnels registered.",
+		}),
+		TunnelDisconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tunnel_disconnects_total",
+			Help:      "Tunnel connections ended, or refused before registering, by reason.",
+		}, []string{"reason"}),
+		TunnelBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tunnel_bytes_total",
+			Help:      "Bytes carried over tunnel connections, by tunnel and direction (in from the client, out to it).",
+		}, []string{"tunnel", "direction"}),
+		DecodedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "response_decoded_bytes_total",
+			Help:      "Bytes of gzipped response bodies once decompressed with -recompress-level, by tunnel.",
+		}, []string{"tunnel"}),
+	}
+}
+
+func (m *Metrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.Requests,
+		m.InFlight,
+		m.RequestDuration,
+		m.TunnelConnects,
+		m.TunnelDisconnects,
+		m.TunnelBytes,
+		m.DecodedBytes,
+	}
+}
+
+// ObserveRequest records a completed public request. tunnel is empty when
+// the request didn't resolve to a registered tunnel, which keeps arbitrary
+// names out of the label set.
+func (m *Metrics) ObserveRequest(tunnel string, code int, d time.Duration) {
+	m.Requests.WithLabelValues(tunnel, strconv.Itoa(code)).Inc()
+	m.RequestDuration.WithLabelValues(tunnel).Observe(d.Seconds())
+}
@@ -0,0 +1,78 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every frame starts with an 8 byte header: a 4 byte stream ID followed by
+// a 4 byte payload length, both big endian.
+//
+// Stream 0 is the control stream. Its payloads start with an op byte and
+// carry session-level messages (stream open/reset, flow control, pings,
+// going away, closing with a reason).
+// On any other stream a non-empty payload is data and an empty payload
+// marks the end of the sender's half of the stream.
+const (
+	headerSize     = 8
+	maxPayloadSize = 32 * 1024
+
+	controlStreamID = 0
+)
+
+const (
+	opOpen byte = iota + 1
+	opReset
+	opWindowUpdate
+	opPing
+	opPong
+	opGoAway
+	opClose
+)
+
+var errFrameTooLarge = errors.New("mux: frame exceeds maximum payload size")
+
+// WriteFrame writes a single frame to w.
+func WriteFrame(w io.Writer, streamID uint32, payload []byte) error {
+	if len(payload) > maxPayloadSize {
+		return errFrameTooLarge
+	}
+	buf := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], streamID)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	copy(buf[headerSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads a single frame from r.
+func ReadFrame(r io.Reader) (streamID uint32, payload []byte, err error) {
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	streamID = binary.BigEndian.Uint32(hdr[0:4])
+	length := binary.BigEndian.Uint32(hdr[4:8])
+	if length > maxPayloadSize {
+		return 0, nil, fmt.Errorf("%w: %d bytes", errFrameTooLarge, length)
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return streamID, payload, nil
+}
+
+func controlFrame(op byte, args ...uint32) []byte {
+	buf := make([]byte, 1+4*len(args))
+	buf[0] = op
+	for i, arg := range args {
+		binary.BigEndian.PutUint32(buf[1+4*i:], arg)
+	}
+	return buf
+}
@@ -0,0 +1,431 @@
+// Package mux multiplexes independent byte streams over a single
+// connection so that concurrent tunnel requests don't interleave.
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionClosed    = errors.New("mux: session closed")
+	ErrStreamClosed     = errors.New("mux: stream closed")
+	ErrStreamReset      = errors.New("mux: stream reset by peer")
+	ErrKeepAliveTimeout = errors.New("mux: keep-alive timed out")
+	ErrIdleTimeout      = errors.New("mux: nothing received within idle timeout")
+	errProtocol         = errors.New("mux: protocol error")
+)
+
+// PeerError is the reason the peer gave for closing the session.
+type PeerError struct {
+	Reason string
+}
+
+func (e *PeerError) Error() string { return "mux: closed by peer: " + e.Reason }
+
+type Config struct {
+	// KeepAliveInterval is how often a ping is sent to the peer. Zero
+	// disables keep-alives.
+	KeepAliveInterval time.Duration
+
+	// KeepAliveTimeout closes the session when a ping goes unanswered for
+	// this long. Zero sends pings without waiting for the answer.
+	KeepAliveTimeout time.Duration
+
+	// IdleTimeout closes the session when nothing has been received from
+	// the peer for this long. Zero disables it.
+	IdleTimeout time.Duration
+
+	// WriteTimeout bounds how long a single frame write may block before
+	// the connection is considered dead.
+	WriteTimeout time.Duration
+
+	// AcceptBacklog is the number of opened streams that may wait for
+	// AcceptStream before new ones are refused.
+	AcceptBacklog int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		WriteTimeout:  10 * time.Second,
+		AcceptBacklog: 256,
+	}
+}
+
+type Session struct {
+	conn   net.Conn
+	config Config
+	reader *bufio.Reader
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+
+	acceptCh   chan *Stream
+	pongCh     chan uint32
+	closed     chan struct{}
+	closeOnce  sync.Once
+	closeErr   error
+	goingAway  chan struct{}
+	goAwayOnce sync.Once
+}
+
+// Client starts a session on the dialing side of conn. Streams opened by
+// the client use odd IDs.
+func Client(conn net.Conn, config Config) *Session {
+	return newSession(conn, config, 1)
+}
+
+// Server starts a session on the accepting side of conn. Streams opened by
+// the server use even IDs.
+func Server(conn net.Conn, config Config) *Session {
+	return newSession(conn, config, 2)
+}
+
+func newSession(conn net.Conn, config Config, firstID uint32) *Session {
+	if config.AcceptBacklog <= 0 {
+		config.AcceptBacklog = DefaultConfig().AcceptBacklog
+	}
+
+	s := &Session{
+		conn:      conn,
+		config:    config,
+		reader:    bufio.NewReader(conn),
+		streams:   make(map[uint32]*Stream),
+		nextID:    firstID,
+		acceptCh:  make(chan *Stream, config.AcceptBacklog),
+		pongCh:    make(chan uint32, 1),
+		closed:    make(chan struct{}),
+		goingAway: make(chan struct{}),
+	}
+
+	go s.recvLoop()
+	if config.KeepAliveInterval > 0 {
+		go s.keepAlive()
+	}
+	return s
+}
+
+// OpenStream opens a new stream to the peer. It doesn't wait to hear back:
+// the stream starts with a full window, so the peer learns of it from the
+// frame sent ahead of the first data and a new stream costs no round trip.
+// That is why each request gets its own stream rather than a pooled one.
+func (s *Session) OpenStream() (*Stream, error) {
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeControl(opOpen, id); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for the peer to open a stream.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.closed:
+		return nil, s.Err()
+	}
+}
+
+// Close tears down the session and every stream on it.
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+// CloseWithError is Close, with err as the reason Err reports.
+func (s *Session) CloseWithError(err error) {
+	s.closeWithError(err)
+}
+
+// CloseWithReason is CloseWithError, first telling the peer err as the
+// reason: its session closes with a *PeerError. Peers that don't know the
+// message just see the connection close.
+func (s *Session) CloseWithReason(err error) {
+	reason := []byte(err.Error())
+	if len(reason) > maxPayloadSize-1 {
+		reason = reason[:maxPayloadSize-1]
+	}
+	s.writeFrame(controlStreamID, append([]byte{opClose}, reason...))
+	s.closeWithError(err)
+}
+
+// GoAway asks the peer to move to a new session. Streams already open
+// carry on; the peer should expect this one to be closed once they are
+// done.
+func (s *Session) GoAway() error {
+	return s.writeControl(opGoAway)
+}
+
+// GoingAway is closed once the peer has sent GoAway.
+func (s *Session) GoingAway() <-chan struct{} {
+	return s.goingAway
+}
+
+// Closed is closed once the session has shut down.
+func (s *Session) Closed() <-chan struct{} {
+	return s.closed
+}
+
+// Err reports why the session was closed, or nil while it is open.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeErr
+}
+
+// NumStreams returns the number of streams currently open.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *Session) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closeErr = err
+		s.mu.Unlock()
+
+		close(s.closed)
+		s.conn.Close()
+	})
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) writeFrame(streamID uint32, payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.isClosed() {
+		return ErrSessionClosed
+	}
+	if s.config.WriteTimeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+	}
+	if err := WriteFrame(s.conn, streamID, payload); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) writeControl(op byte, args ...uint32) error {
+	return s.writeFrame(controlStreamID, controlFrame(op, args...))
+}
+
+func (s *Session) recvLoop() {
+	for {
+		if s.config.IdleTimeout > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(s.config.IdleTimeout))
+		}
+
+		id, payload, err := ReadFrame(s.reader)
+		if err != nil {
+			var netErr net.Error
+			if s.config.IdleTimeout > 0 && errors.As(err, &netErr) && netErr.Timeout() {
+				err = ErrIdleTimeout
+			}
+			s.closeWithError(err)
+			return
+		}
+
+		if id == controlStreamID {
+			err = s.handleControl(payload)
+		} else {
+			err = s.handleData(id, payload)
+		}
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+// handleControl runs on the receive loop, so any reply is written from a
+// separate goroutine: blocking here on a full connection while the peer
+// does the same would deadlock both sides.
+func (s *Session) handleControl(payload []byte) error {
+	if len(payload) == 0 {
+		return fmt.Errorf("%w: empty control frame", errProtocol)
+	}
+	op, args := payload[0], payload[1:]
+
+	arg := func(i int) (uint32, error) {
+		if len(args) < 4*(i+1) {
+			return 0, fmt.Errorf("%w: short control frame (op %d)", errProtocol, op)
+		}
+		return binary.BigEndian.Uint32(args[4*i:]), nil
+	}
+
+	switch op {
+	case opOpen:
+		id, err := arg(0)
+		if err != nil {
+			return err
+		}
+		st := newStream(s, id)
+		s.mu.Lock()
+		if id%2 == s.nextID%2 {
+			s.mu.Unlock()
+			return fmt.Errorf("%w: peer opened stream %d with our parity", errProtocol, id)
+		}
+		if _, exists := s.streams[id]; exists {
+			s.mu.Unlock()
+			return fmt.Errorf("%w: stream %d opened twice", errProtocol, id)
+		}
+		s.streams[id] = st
+		s.mu.Unlock()
+
+		select {
+		case s.acceptCh <- st:
+		default:
+			s.removeStream(id)
+			go s.writeControl(opReset, id)
+		}
+
+	case opReset:
+		id, err := arg(0)
+		if err != nil {
+			return err
+		}
+		if st := s.stream(id); st != nil {
+			st.handleReset()
+		}
+
+	case opWindowUpdate:
+		id, err := arg(0)
+		if err != nil {
+			return err
+		}
+		delta, err := arg(1)
+		if err != nil {
+			return err
+		}
+		if st := s.stream(id); st != nil {
+			st.handleWindowUpdate(delta)
+		}
+
+	case opPing:
+		nonce, err := arg(0)
+		if err != nil {
+			return err
+		}
+		go s.writeControl(opPong, nonce)
+
+	case opPong:
+		nonce, err := arg(0)
+		if err != nil {
+			return err
+		}
+		select {
+		case s.pongCh <- nonce:
+		default:
+		}
+
+	case opGoAway:
+		s.goAwayOnce.Do(func() { close(s.goingAway) })
+
+	case opClose:
+		return &PeerError{Reason: string(args)}
+	}
+
+	return nil
+}
+
+func (s *Session) handleData(id uint32, payload []byte) error {
+	st := s.stream(id)
+	if st == nil {
+		// The stream was closed or reset locally; late frames are dropped.
+		return nil
+	}
+	if len(payload) == 0 {
+		st.handleFin()
+		return nil
+	}
+	return st.handleData(payload)
+}
+
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(s.config.KeepAliveInterval)
+	defer ticker.Stop()
+
+	var nonce uint32
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			nonce++
+			if err := s.writeControl(opPing, nonce); err != nil {
+				return
+			}
+			if s.config.KeepAliveTimeout > 0 && !s.awaitPong(nonce) {
+				return
+			}
+		}
+	}
+}
+
+// awaitPong waits for the answer to ping nonce, closing the session if it
+// doesn't come within the keep-alive timeout.
+func (s *Session) awaitPong(nonce uint32) bool {
+	timer := time.NewTimer(s.config.KeepAliveTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return false
+		case got := <-s.pongCh:
+			if got == nonce {
+				return true
+			}
+		case <-timer.C:
+			s.closeWithError(ErrKeepAliveTimeout)
+			return false
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package mux
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeSessions returns a client and server session talking over an
+// in-memory connection.
+func pipeSessions(t testing.TB, config Config) (client, server *Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	client = Client(a, config)
+	server = Server(b, config)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// echo answers every stream accepted on s with "echo: " and what was sent
+// on it.
+func echo(s *Session) {
+	for {
+		stream, err := s.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			body, err := io.ReadAll(stream)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(stream, "echo: %s", body)
+		}()
+	}
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	client, server := pipeSessions(t, DefaultConfig())
+	go echo(server)
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := range n {
+		wg.Go(func() {
+			stream, err := client.OpenStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer stream.Close()
+
+			// Big enough to be split across frames and interleaved
+			body := fmt.Sprintf("request %d %0*d", i, 3*maxPayloadSize, i)
+			if _, err := io.WriteString(stream, body); err != nil {
+				errs <- err
+				return
+			}
+			stream.CloseWrite()
+			got, err := io.ReadAll(stream)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if want := "echo: " + body; string(got) != want {
+				errs <- fmt.Errorf("request %d got a response of %d bytes starting %.20q", i, len(got), got)
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestKeepAliveSilentPeer(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	// The peer takes whatever is sent and never answers
+	go io.Copy(io.Discard, b)
+
+	config := DefaultConfig()
+	config.KeepAliveInterval = 50 * time.Millisecond
+	config.KeepAliveTimeout = 100 * time.Millisecond
+	start := time.Now()
+	s := Server(a, config)
+	defer s.Close()
+
+	select {
+	case <-s.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("a silent peer was never noticed")
+	}
+	if !errors.Is(s.Err(), ErrKeepAliveTimeout) {
+		t.Errorf("closed with %v, want %v", s.Err(), ErrKeepAliveTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("noticed after %s, want within one interval and timeout", elapsed)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	// Half-open: whatever is sent vanishes and nothing comes back
+	go io.Copy(io.Discard, b)
+
+	config := DefaultConfig()
+	config.KeepAliveInterval = 0
+	config.IdleTimeout = 100 * time.Millisecond
+	start := time.Now()
+	s := Server(a, config)
+	defer s.Close()
+
+	select {
+	case <-s.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("an idle peer was never evicted")
+	}
+	if !errors.Is(s.Err(), ErrIdleTimeout) {
+		t.Errorf("closed with %v, want %v", s.Err(), ErrIdleTimeout)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("evicted after %s, want about 100ms", elapsed)
+	}
+}
+
+func TestIdleTimeoutPingsCount(t *testing.T) {
+	config := DefaultConfig()
+	config.KeepAliveInterval = 20 * time.Millisecond
+	config.IdleTimeout = 100 * time.Millisecond
+	client, server := pipeSessions(t, config)
+
+	// No streams, but the pings and their answers are traffic
+	time.Sleep(300 * time.Millisecond)
+	if err := server.Err(); err != nil {
+		t.Errorf("server closed: %v", err)
+	}
+	if err := client.Err(); err != nil {
+		t.Errorf("client closed: %v", err)
+	}
+}
+
+func TestKeepAliveAnswered(t *testing.T) {
+	config := DefaultConfig()
+	config.KeepAliveInterval = 20 * time.Millisecond
+	config.KeepAliveTimeout = 50 * time.Millisecond
+	client, server := pipeSessions(t, config)
+
+	// Idle, but both sides answer each other's pings
+	time.Sleep(300 * time.Millisecond)
+	if err := server.Err(); err != nil {
+		t.Fatalf("server closed: %v", err)
+	}
+	if err := client.Err(); err != nil {
+		t.Fatalf("client closed: %v", err)
+	}
+
+	// Pings don't show up on streams
+	go echo(server)
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(stream, "data")
+	stream.CloseWrite()
+	got, err := io.ReadAll(stream)
+	if err != nil || string(got) != "echo: data" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestCloseWithReason(t *testing.T) {
+	client, server := pipeSessions(t, DefaultConfig())
+	server.CloseWithReason(errors.New("server has reached its tunnel limit"))
+
+	select {
+	case <-client.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the peer never closed")
+	}
+	var peer *PeerError
+	if !errors.As(client.Err(), &peer) || peer.Reason != "server has reached its tunnel limit" {
+		t.Errorf("closed with %v, want the peer's reason", client.Err())
+	}
+}
@@ -0,0 +1,297 @@
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// initialWindow is how many unread bytes a stream buffers before the
+// sender has to wait for a window update.
+const initialWindow = 256 * 1024
+
+// Stream is a single bidirectional byte stream within a Session. It
+// implements net.Conn.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu            sync.Mutex
+	recvBuf       bytes.Buffer
+	recvWindow    uint32
+	unacked       uint32
+	sendWindow    uint32
+	readDeadline  time.Time
+	writeDeadline time.Time
+	localFin      bool
+	remoteFin     bool
+	closed        bool
+	resetErr      error
+
+	readNotify  chan struct{}
+	writeNotify chan struct{}
+}
+
+var _ net.Conn = (*Stream)(nil)
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:          id,
+		session:     s,
+		recvWindow:  initialWindow,
+		sendWindow:  initialWindow,
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+	}
+}
+
+func (st *Stream) ID() uint32 { return st.id }
+
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(p)
+			update := st.consumed(n)
+			st.mu.Unlock()
+			if update > 0 {
+				st.session.writeControl(opWindowUpdate, st.id, update)
+			}
+			return n, nil
+		}
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		case st.remoteFin:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.resetErr != nil:
+			err := st.resetErr
+			st.mu.Unlock()
+			return 0, err
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.readNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// consumed returns the window to hand back to the peer after n buffered
+// bytes have been read. Updates are batched to avoid a frame per Read.
+func (st *Stream) consumed(n int) uint32 {
+	st.unacked += uint32(n)
+	if st.remoteFin || st.unacked < initialWindow/2 {
+		return 0
+	}
+	update := st.unacked
+	st.recvWindow += update
+	st.unacked = 0
+	return update
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		switch {
+		case st.closed || st.localFin:
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		case st.resetErr != nil:
+			err := st.resetErr
+			st.mu.Unlock()
+			return written, err
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writeNotify, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(p)-written, int(st.sendWindow), maxPayloadSize)
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(st.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite signals the end of this side's data. The peer's reads return
+// io.EOF once they have drained everything written before it.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.closed || st.localFin || st.resetErr != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localFin = true
+	st.mu.Unlock()
+
+	return st.session.writeFrame(st.id, nil)
+}
+
+// Close closes both directions of the stream. If the peer is still
+// sending, the stream is reset so it stops.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	sendFin := !st.localFin && st.resetErr == nil
+	sendReset := !st.remoteFin && st.resetErr == nil
+	st.localFin = true
+	st.recvBuf.Reset()
+	st.mu.Unlock()
+
+	st.notify(st.readNotify)
+	st.notify(st.writeNotify)
+	st.session.removeStream(st.id)
+
+	var err error
+	if sendFin {
+		err = st.session.writeFrame(st.id, nil)
+	}
+	if sendReset {
+		if rerr := st.session.writeControl(opReset, st.id); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// Reset aborts the stream in both directions. Unlike Close it sends no end
+// of data, so the peer's reads fail with ErrStreamReset once they have
+// drained what arrived first, and a cut-off stream can't be mistaken for a
+// complete one.
+func (st *Stream) Reset() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	sendReset := st.resetErr == nil
+	st.localFin = true
+	st.recvBuf.Reset()
+	st.mu.Unlock()
+
+	st.notify(st.readNotify)
+	st.notify(st.writeNotify)
+	st.session.removeStream(st.id)
+
+	if sendReset {
+		return st.session.writeControl(opReset, st.id)
+	}
+	return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return st.session.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr { return st.session.RemoteAddr() }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	st.notify(st.readNotify)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	st.notify(st.writeNotify)
+	return nil
+}
+
+func (st *Stream) wait(notify chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-notify:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.closed:
+		return ErrSessionClosed
+	}
+}
+
+func (st *Stream) notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) handleData(p []byte) error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	if uint32(len(p)) > st.recvWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("%w: stream %d exceeded its receive window", errProtocol, st.id)
+	}
+	st.recvWindow -= uint32(len(p))
+	st.recvBuf.Write(p)
+	st.mu.Unlock()
+
+	st.notify(st.readNotify)
+	return nil
+}
+
+func (st *Stream) handleFin() {
+	st.mu.Lock()
+	st.remoteFin = true
+	st.mu.Unlock()
+	st.notify(st.readNotify)
+}
+
+func (st *Stream) handleReset() {
+	st.mu.Lock()
+	st.resetErr = ErrStreamReset
+	st.mu.Unlock()
+
+	st.notify(st.readNotify)
+	st.notify(st.writeNotify)
+	st.session.removeStream(st.id)
+}
+
+func (st *Stream) handleWindowUpdate(delta uint32) {
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+	st.notify(st.writeNotify)
+}
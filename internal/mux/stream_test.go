@@ -0,0 +1,162 @@
+package mux
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// exchange sends body on a new stream of s and returns the answer.
+func exchange(t testing.TB, s *Session, body string) string {
+	t.Helper()
+	stream, err := s.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	io.WriteString(stream, body)
+	stream.CloseWrite()
+	got, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(got)
+}
+
+func TestOpenStreamNoRoundTrip(t *testing.T) {
+	client, server := pipeSessions(t, DefaultConfig())
+
+	// Nothing on the server accepts yet, and the request goes out anyway
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := io.WriteString(stream, "request"); err != nil {
+		t.Fatalf("writing before the peer accepted: %v", err)
+	}
+	stream.CloseWrite()
+
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(accepted); string(got) != "request" {
+		t.Errorf("accepted %q", got)
+	}
+}
+
+func TestStreamsRemovedWhenDone(t *testing.T) {
+	client, server := pipeSessions(t, DefaultConfig())
+	go echo(server)
+
+	first, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+	last := first.ID()
+
+	// Sequential requests each take a stream, which goes once it's done:
+	// there is nothing left behind to pool or evict
+	for i := range 100 {
+		if got := exchange(t, client, "ping"); got != "echo: ping" {
+			t.Fatalf("request %d got %q", i, got)
+		}
+	}
+	waitStreams(t, client, 0)
+	waitStreams(t, server, 0)
+
+	// and IDs aren't reused, so a late frame for an old stream can't land
+	// on a new one
+	for range 3 {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stream.ID() <= last {
+			t.Errorf("stream %d opened after %d", stream.ID(), last)
+		}
+		last = stream.ID()
+		stream.Close()
+	}
+}
+
+func TestResetStreamLeavesSessionUsable(t *testing.T) {
+	client, server := pipeSessions(t, DefaultConfig())
+	accepted := make(chan *Stream, 1)
+	go func() {
+		stream, err := server.AcceptStream()
+		if err == nil {
+			accepted <- stream
+		}
+		echo(server)
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(stream, "cut off")
+	peer := <-accepted
+	peer.Reset()
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(stream); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("read on a reset stream: %v", err)
+	}
+	stream.Close()
+
+	// The failure was the stream's alone
+	if got := exchange(t, client, "next"); got != "echo: next" {
+		t.Errorf("after a reset: %q", got)
+	}
+	waitStreams(t, client, 0)
+}
+
+func waitStreams(t testing.TB, s *Session, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for s.NumStreams() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams open, want %d", s.NumStreams(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// BenchmarkNewStreamPerRequest is what the tunnel does: one stream per
+// request. Compare it with BenchmarkReusedStream, the best a pool of
+// streams could do, to see what opening and closing a stream costs.
+func BenchmarkNewStreamPerRequest(b *testing.B) {
+	client, server := pipeSessions(b, DefaultConfig())
+	go echo(server)
+	b.ReportAllocs()
+	for range b.N {
+		exchange(b, client, "ping")
+	}
+}
+
+func BenchmarkReusedStream(b *testing.B) {
+	client, server := pipeSessions(b, DefaultConfig())
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		io.Copy(stream, stream)
+	}()
+	stream, err := client.OpenStream()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer stream.Close()
+	buf := make([]byte, len("ping"))
+	b.ReportAllocs()
+	for range b.N {
+		io.WriteString(stream, "ping")
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Package protocol versions the tunnel handshake, so clients and servers
+// from different releases can settle on what they both speak.
+//
+// A client opens with an AUTH line, then registers its tunnel in a frame
+// whose stream ID field carries its Hello. The server answers with its
+// own Hello, holding the version and features it picked, before the mux
+// session starts.
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Versions of the tunnel protocol.
+const (
+	// Version1 is the handshake from before versions were negotiated: the
+	// register frame carries only flags, and the server answers with one
+	// byte, and only if the client asked about compression.
+	Version1 uint8 = 1
+
+	// Version2 adds the client's version and features to the register
+	// frame, and the server always answers with the ones it picked.
+	Version2 uint8 = 2
+)
+
+// Current is the newest version this build speaks, Oldest the oldest it
+// still accepts from a peer.
+const (
+	Current = Version2
+	Oldest  = Version1
+)
+
+// Flags in the low byte of a Hello.
+const (
+	// FlagGzip asks for, or in an answer agrees to, a gzip link.
+	FlagGzip uint8 = 1 << 0
+
+	// FlagHello marks a versioned Hello. Without it the rest of the Hello
+	// is zero and the peer speaks Version1.
+	FlagHello uint8 = 1 << 7
+)
+
+// Features is a bitmask of optional capabilities. Only the features both
+// sides announce are used.
+type Features uint16
+
+const (
+	// FeatureGzip compresses the tunnel connection.
+	FeatureGzip Features = 1 << iota
+)
+
+func (f Features) String() string {
+	if f == 0 {
+		return "none"
+	}
+	var names []string
+	if f&FeatureGzip != 0 {
+		names = append(names, "gzip")
+		f &^= FeatureGzip
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint16(f)))
+	}
+	return strings.Join(names, ",")
+}
+
+// Hello is what each side announces in the handshake. From a client,
+// Version is the newest it speaks; from a server, the version picked for
+// the connection, or 0 if it turned the client away for speaking none it
+// accepts.
+type Hello struct {
+	Flags    uint8
+	Version  uint8
+	Features Features
+}
+
+// pack lays h out flags first, then version, then features.
+func (h Hello) pack() uint32 {
+	return uint32(h.Flags) | uint32(h.Version)<<8 | uint32(h.Features)<<16
+}
+
+func unpack(v uint32) Hello {
+	return Hello{Flags: uint8(v), Version: uint8(v >> 8), Features: Features(v >> 16)}
+}
+
+// version1 fills in what a peer that sent only flags speaks.
+func version1(flags uint8) Hello {
+	h := Hello{Flags: flags, Version: Version1}
+	if flags&FlagGzip != 0 {
+		h.Features = FeatureGzip
+	}
+	return h
+}
+
+// Register returns h as the stream ID field of the client's register
+// frame.
+func (h Hello) Register() uint32 { return h.pack() }
+
+// ParseRegister reads the client's Hello from its register frame.
+func ParseRegister(flags uint32) Hello {
+	h := unpack(flags)
+	if h.Flags&FlagHello == 0 {
+		return version1(h.Flags)
+	}
+	return h
+}
+
+// WantsAnswer reports whether a client that sent h waits for the server's
+// Hello. Version1 clients that didn't ask about compression go straight
+// to the mux session.
+func (h Hello) WantsAnswer() bool {
+	return h.Flags&(FlagHello|FlagGzip) != 0
+}
+
+// Answer returns h as the server sends it: the flags byte alone to a
+// Version1 client, the whole Hello to one that sent FlagHello.
+func (h Hello) Answer() []byte {
+	if h.Flags&FlagHello == 0 {
+		return []byte{h.Flags}
+	}
+	return binary.LittleEndian.AppendUint32(nil, h.pack())
+}
+
+// ReadAnswer reads the server's Hello. A server that only speaks Version1
+// answers with a single flags byte, which comes first either way.
+func ReadAnswer(r io.Reader) (Hello, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return Hello{}, err
+	}
+	if b[0]&FlagHello == 0 {
+		return version1(b[0]), nil
+	}
+	if _, err := io.ReadFull(r, b[1:]); err != nil {
+		return Hello{}, err
+	}
+	return unpack(binary.LittleEndian.Uint32(b[:])), nil
+}
+
+// IncompatibleError is returned when the peer speaks no version this side
+// accepts.
+type IncompatibleError struct {
+	Peer    string // "client" or "server"
+	Version uint8
+}
+
+func (e *IncompatibleError) Error() string {
+	want := fmt.Sprint(Current)
+	if Oldest != Current {
+		want = fmt.Sprintf("%d to %d", Oldest, Current)
+	}
+	return fmt.Sprintf("%s speaks tunnel protocol version %d, want %s", e.Peer, e.Version, want)
+}
+
+// Negotiate is the server's side: it picks the newest version both local
+// and the client speak, and the features both have.
+func Negotiate(local, client Hello) (Hello, error) {
+	version := min(local.Version, client.Version)
+	if version < Oldest {
+		return Hello{}, &IncompatibleError{Peer: "client", Version: client.Version}
+	}
+	agreed := Hello{Version: version, Features: local.Features & client.Features}
+	if client.Flags&FlagHello != 0 {
+		agreed.Flags |= FlagHello
+	}
+	if agreed.Features&FeatureGzip != 0 {
+		agreed.Flags |= FlagGzip
+	}
+	return agreed, nil
+}
+
+// Check is the client's side: it makes sure the version the server
+// picked is one it speaks.
+func Check(server Hello) error {
+	if server.Version < Oldest || server.Version > Current {
+		return &IncompatibleError{Peer: "server", Version: server.Version}
+	}
+	return nil
+}
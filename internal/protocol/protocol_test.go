@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	server := Hello{Version: Current, Features: FeatureGzip}
+	for _, c := range []struct {
+		name   string
+		client Hello
+		want   Hello
+	}{
+		{
+			"matching",
+			Hello{Flags: FlagHello | FlagGzip, Version: Current, Features: FeatureGzip},
+			Hello{Flags: FlagHello | FlagGzip, Version: Current, Features: FeatureGzip},
+		},
+		{
+			"matching without gzip",
+			Hello{Flags: FlagHello | FlagGzip, Version: Current},
+			Hello{Flags: FlagHello, Version: Current},
+		},
+		{
+			// A newer client falls back to our version, and features we
+			// don't know are dropped
+			"newer client",
+			Hello{Flags: FlagHello, Version: Current + 1, Features: FeatureGzip | 1<<9},
+			Hello{Flags: FlagHello | FlagGzip, Version: Current, Features: FeatureGzip},
+		},
+		{
+			"version 1 client",
+			ParseRegister(uint32(FlagGzip)),
+			Hello{Flags: FlagGzip, Version: Version1, Features: FeatureGzip},
+		},
+	} {
+		got, err := Negotiate(server, c.client)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: agreed %+v, want %+v", c.name, got, c.want)
+		}
+		if err := Check(got); err != nil {
+			t.Errorf("%s: the client rejects the answer: %v", c.name, err)
+		}
+	}
+}
+
+func TestNegotiateIncompatible(t *testing.T) {
+	_, err := Negotiate(Hello{Version: Current}, Hello{Flags: FlagHello, Version: 0})
+	var incompatible *IncompatibleError
+	if !errors.As(err, &incompatible) || incompatible.Peer != "client" {
+		t.Fatalf("got %v, want an IncompatibleError for the client", err)
+	}
+	if want := "client speaks tunnel protocol version 0, want 1 to 2"; err.Error() != want {
+		t.Errorf("message %q, want %q", err, want)
+	}
+
+	// A server that picked a version newer than ours is turned down too
+	err = Check(Hello{Flags: FlagHello, Version: Current + 1})
+	if !errors.As(err, &incompatible) || incompatible.Peer != "server" {
+		t.Errorf("got %v, want an IncompatibleError for the server", err)
+	}
+}
+
+func TestAnswerRoundTrip(t *testing.T) {
+	for _, h := range []Hello{
+		{Flags: FlagHello | FlagGzip, Version: Current, Features: FeatureGzip},
+		{Flags: FlagHello, Version: Current},
+		{Flags: FlagGzip, Version: Version1, Features: FeatureGzip},
+		{Version: Version1},
+	} {
+		// What follows the answer is left unread
+		r := bytes.NewReader(append(h.Answer(), "session"...))
+		got, err := ReadAnswer(r)
+		if err != nil {
+			t.Errorf("%+v: %v", h, err)
+			continue
+		}
+		if got != h {
+			t.Errorf("sent %+v, read %+v", h, got)
+		}
+		if r.Len() != len("session") {
+			t.Errorf("%+v: read %d bytes too many", h, len("session")-r.Len())
+		}
+	}
+}
+
+func TestRegisterRoundTrip(t *testing.T) {
+	h := Hello{Flags: FlagHello | FlagGzip, Version: Current, Features: FeatureGzip}
+	if got := ParseRegister(h.Register()); got != h {
+		t.Errorf("sent %+v, parsed %+v", h, got)
+	}
+	// A version 1 client sends only its flags
+	if got := ParseRegister(0); got != (Hello{Version: Version1}) || got.WantsAnswer() {
+		t.Errorf("version 1 client parsed as %+v", got)
+	}
+}
@@ -0,0 +1,169 @@
+// Package quicconn carries tunnel connections over QUIC instead of TCP.
+// Each QUIC connection holds one stream, which is used exactly like a TCP
+// connection, so the handshake and mux layer run over it unchanged, while
+// QUIC keeps the connection alive when the client's address changes, as
+// it does on a mobile link.
+package quicconn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN is the protocol tunnel clients and servers agree on during the
+// TLS handshake.
+const ALPN = "intunja"
+
+const (
+	// streamTimeout is how long a new connection gets to open its stream.
+	streamTimeout = 10 * time.Second
+	// closeTimeout is how long a closed connection waits for the peer to
+	// read what was last sent.
+	closeTimeout = 5 * time.Second
+)
+
+var config = &quic.Config{
+	MaxIdleTimeout:  time.Minute,
+	KeepAlivePeriod: 15 * time.Second,
+}
+
+// Listen accepts tunnel connections over QUIC on addr, a UDP address. The
+// TLS config must have a certificate; QUIC always encrypts.
+func Listen(addr string, tlsConf *tls.Config) (net.Listener, error) {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{ALPN}
+	ql, err := quic.ListenAddr(addr, tlsConf, config)
+	if err != nil {
+		return nil, err
+	}
+	l := &listener{ql: ql, conns: make(chan net.Conn), done: make(chan struct{})}
+	go l.acceptLoop()
+	return l, nil
+}
+
+type listener struct {
+	ql    *quic.Listener
+	conns chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// acceptLoop hands on each connection once its stream has been opened, so
+// one slow client can't hold up the rest.
+func (l *listener) acceptLoop() {
+	for {
+		qc, err := l.ql.Accept(context.Background())
+		if err != nil {
+			l.Close()
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(qc.Context(), streamTimeout)
+			defer cancel()
+			stream, err := qc.AcceptStream(ctx)
+			if err != nil {
+				qc.CloseWithError(0, "no stream opened")
+				return
+			}
+			select {
+			case l.conns <- &conn{Stream: stream, qc: qc}:
+			case <-l.done:
+				qc.CloseWithError(0, "server closed")
+			}
+		}()
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.ql.Close()
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr { return l.ql.Addr() }
+
+// Dial opens a tunnel connection over QUIC to addr.
+func Dial(ctx context.Context, addr string, tlsConf *tls.Config) (net.Conn, error) {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{ALPN}
+	qc, err := quic.DialAddr(ctx, addr, tlsConf, config)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		qc.CloseWithError(0, "")
+		return nil, err
+	}
+	return &conn{Stream: stream, qc: qc}, nil
+}
+
+// conn is a QUIC connection's stream as a net.Conn. Closing it closes the
+// whole connection.
+type conn struct {
+	*quic.Stream
+	qc  *quic.Conn
+	eof atomic.Bool // the peer has finished sending
+}
+
+// Read reports the peer closing the connection normally as io.EOF, as
+// TCP would.
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.Stream.Read(p)
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode == 0 {
+		err = io.EOF
+	}
+	if err == io.EOF {
+		c.eof.Store(true)
+	}
+	return n, err
+}
+
+// ConnectionState reports on the connection's TLS handshake, as a
+// *tls.Conn does.
+func (c *conn) ConnectionState() tls.ConnectionState {
+	return c.qc.ConnectionState().TLS
+}
+
+// Close ends the stream and then the connection. Closing the connection
+// at once would discard data still on its way, so unless the peer has
+// already finished, it is left to close the connection when it reads the
+// end of the stream.
+func (c *conn) Close() error {
+	c.Stream.Close()
+	if c.eof.Load() {
+		return c.qc.CloseWithError(0, "")
+	}
+	go func() {
+		select {
+		case <-c.qc.Context().Done():
+		case <-time.After(closeTimeout):
+			c.qc.CloseWithError(0, "")
+		}
+	}()
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.qc.LocalAddr() }
+func (c *conn) RemoteAddr() net.Addr { return c.qc.RemoteAddr() }
@@ -0,0 +1,220 @@
+// Package relay copies raw bytes between connections once HTTP parsing
+// has been left behind, e.g. after a protocol upgrade.
+package relay
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// DefaultBufferSize is the copy buffer size of the package-level Splice.
+const DefaultBufferSize = 32 * 1024
+
+var defaultPool = NewBufferPool(DefaultBufferSize)
+
+// BufferPool hands out copy buffers of one size, reusing them so that
+// long-running relays don't allocate one per copy.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBufferPool returns a pool of size-byte buffers; DefaultBufferSize if
+// size is not positive.
+func NewBufferPool(size int) *BufferPool {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	p := &BufferPool{size: size}
+	p.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// Size is the length of the pool's buffers.
+func (p *BufferPool) Size() int { return p.size }
+
+// Get returns a buffer, which should be given back with Put once nothing
+// refers to it.
+func (p *BufferPool) Get() *[]byte { return p.pool.Get().(*[]byte) }
+
+func (p *BufferPool) Put(buf *[]byte) { p.pool.Put(buf) }
+
+// Copy is io.CopyBuffer with a buffer from the pool.
+func (p *BufferPool) Copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := p.Get()
+	defer p.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// Splice copies between a and b in both directions until both are done,
+// then closes them. A clean EOF on one side is passed on as a half-close
+// where the other side supports it.
+func (p *BufferPool) Splice(a, b io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.copyHalf(a, b)
+	}()
+	go func() {
+		defer wg.Done()
+		p.copyHalf(b, a)
+	}()
+	wg.Wait()
+
+	a.Close()
+	b.Close()
+}
+
+func (p *BufferPool) copyHalf(dst, src io.ReadWriteCloser) {
+	if _, err := p.Copy(dst, src); err != nil {
+		// Unblock the other direction too
+		dst.Close()
+		src.Close()
+		return
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// Splice is BufferPool.Splice with DefaultBufferSize buffers.
+func Splice(a, b io.ReadWriteCloser) {
+	defaultPool.Splice(a, b)
+}
+
+// BufferedConn returns a net.Conn that first reads whatever r has already
+// buffered from conn.
+func BufferedConn(conn net.Conn, r *bufio.Reader) net.Conn {
+	return &bufferedConn{Conn: conn, r: r}
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// IsWebSocketUpgrade reports whether h asks to switch to the WebSocket
+// protocol.
+func IsWebSocketUpgrade(h http.Header) bool {
+	if !strings.EqualFold(h.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range h.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hopByHop are the headers that only apply to the connection they arrive
+// on (RFC 7230, section 6.1).
+var hopByHop = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopByHop deletes the hop-by-hop headers from h, along with any
+// others its Connection header names, so they aren't passed on to the
+// next hop. "TE: trailers" is kept, since gRPC needs it end to end, and a
+// WebSocket upgrade keeps the Connection and Upgrade headers it is made of.
+func RemoveHopByHop(h http.Header) {
+	upgrade := IsWebSocketUpgrade(h)
+	trailers := false
+	for _, v := range h.Values("Te") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "trailers") {
+				trailers = true
+			}
+		}
+	}
+
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHop {
+		h.Del(name)
+	}
+
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+	if upgrade {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", "websocket")
+	}
+}
+
+// ErrHeaderTooLarge is returned by a HeadLimiter once a message head has
+// run past its limit.
+var ErrHeaderTooLarge = errors.New("message head too large")
+
+// HeadLimiter caps how much is read from a connection while an HTTP
+// message head is parsed from it, so a peer can't have an endless head
+// buffered. Release lifts the cap for the body.
+type HeadLimiter struct {
+	r io.Reader
+	n int64 // left to read; negative once released
+}
+
+// NewHeadLimiter limits the head read from r to max bytes.
+func NewHeadLimiter(r io.Reader, max int64) *HeadLimiter {
+	return &HeadLimiter{r: r, n: max}
+}
+
+func (l *HeadLimiter) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return l.r.Read(p)
+	}
+	if l.n == 0 {
+		return 0, ErrHeaderTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// Release lifts the limit once the head has been read.
+func (l *HeadLimiter) Release() { l.n = -1 }
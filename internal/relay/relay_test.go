@@ -0,0 +1,141 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// onlyReader and onlyWriter hide WriterTo and ReaderFrom, so copies go
+// through the buffer.
+type onlyReader struct{ io.Reader }
+
+type onlyWriter struct {
+	io.Writer
+	largest int
+}
+
+func (w *onlyWriter) Write(p []byte) (int, error) {
+	w.largest = max(w.largest, len(p))
+	return w.Writer.Write(p)
+}
+
+func TestCopyBufferSizes(t *testing.T) {
+	data := make([]byte, 200_000)
+	rand.Read(data)
+	for _, size := range []int{1, 7, 4096, DefaultBufferSize, 1 << 20} {
+		p := NewBufferPool(size)
+		var out bytes.Buffer
+		w := &onlyWriter{Writer: &out}
+		n, err := p.Copy(w, onlyReader{bytes.NewReader(data)})
+		if err != nil || n != int64(len(data)) {
+			t.Errorf("size %d: copied %d, %v", size, n, err)
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("size %d: copy differs", size)
+		}
+		if w.largest > size {
+			t.Errorf("size %d: wrote %d bytes at once", size, w.largest)
+		}
+	}
+	if got := NewBufferPool(0).Size(); got != DefaultBufferSize {
+		t.Errorf("size 0 gave %d-byte buffers, want the default", got)
+	}
+}
+
+func TestSpliceBufferSizes(t *testing.T) {
+	data := make([]byte, 100_000)
+	rand.Read(data)
+	for _, size := range []int{3, 1024, DefaultBufferSize} {
+		// client <-> a ... b <-> echo, spliced between a and b
+		client, a := net.Pipe()
+		b, echo := net.Pipe()
+		go io.Copy(echo, echo)
+		go NewBufferPool(size).Splice(a, b)
+
+		go client.Write(data)
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(client, got); err != nil {
+			t.Errorf("size %d: %v", size, err)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("size %d: echo differs", size)
+		}
+		client.Close()
+		echo.Close()
+	}
+}
+
+func BenchmarkCopy(b *testing.B) {
+	data := make([]byte, 64*1024)
+	b.Run("io.Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			io.Copy(&onlyWriter{Writer: io.Discard}, onlyReader{bytes.NewReader(data)})
+		}
+	})
+	b.Run("pool", func(b *testing.B) {
+		p := NewBufferPool(DefaultBufferSize)
+		b.ReportAllocs()
+		for range b.N {
+			p.Copy(&onlyWriter{Writer: io.Discard}, onlyReader{bytes.NewReader(data)})
+		}
+	})
+}
+
+func TestRemoveHopByHop(t *testing.T) {
+	h := http.Header{
+		"Connection":          {"keep-alive, X-Hop"},
+		"Keep-Alive":          {"timeout=5"},
+		"Proxy-Authorization": {"Basic Zm9vOmJhcg=="},
+		"Transfer-Encoding":   {"chunked"},
+		"Upgrade":             {"h2c"},
+		"Te":                  {"trailers, deflate"},
+		"X-Hop":               {"1"},
+		"Content-Type":        {"text/plain"},
+		"Authorization":       {"Bearer t"},
+	}
+	RemoveHopByHop(h)
+	want := http.Header{
+		"Te":            {"trailers"},
+		"Content-Type":  {"text/plain"},
+		"Authorization": {"Bearer t"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("left %v, want %v", h, want)
+	}
+
+	// A WebSocket upgrade keeps what it is made of
+	ws := http.Header{
+		"Connection":        {"keep-alive, Upgrade"},
+		"Upgrade":           {"websocket"},
+		"Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="},
+	}
+	RemoveHopByHop(ws)
+	if !IsWebSocketUpgrade(ws) || ws.Get("Sec-Websocket-Key") == "" {
+		t.Errorf("upgrade left as %v", ws)
+	}
+}
+
+func TestHeadLimiter(t *testing.T) {
+	head := "GET / HTTP/1.1\r\nHost: x\r\n\r\n"
+	l := NewHeadLimiter(strings.NewReader(head+"body"), int64(len(head)))
+	got := make([]byte, len(head))
+	if _, err := io.ReadFull(l, got); err != nil || string(got) != head {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	if _, err := l.Read(make([]byte, 1)); !errors.Is(err, ErrHeaderTooLarge) {
+		t.Errorf("read past the limit: %v", err)
+	}
+	// Released, the body is read
+	l.Release()
+	if rest, err := io.ReadAll(l); err != nil || string(rest) != "body" {
+		t.Errorf("after release: %q, %v", rest, err)
+	}
+}
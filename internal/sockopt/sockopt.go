@@ -0,0 +1,40 @@
+// Package sockopt tunes the TCP connections tunnels run over.
+package sockopt
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Options are applied to each tunnel connection.
+type Options struct {
+	// KeepAlive is the TCP keep-alive probe period; 0 turns keep-alives
+	// off.
+	KeepAlive time.Duration
+	// NoDelay sends small writes at once instead of coalescing them
+	// (Nagle's algorithm), which is what keeps short requests quick.
+	NoDelay bool
+}
+
+// Apply sets o on conn, looking through TLS and other wrappers for the
+// *net.TCPConn underneath. Connections that aren't TCP are left alone.
+func (o Options) Apply(conn net.Conn) error {
+	for {
+		w, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = w.NetConn()
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	err := tc.SetKeepAlive(o.KeepAlive > 0)
+	if o.KeepAlive > 0 {
+		err = errors.Join(err, tc.SetKeepAlivePeriod(o.KeepAlive))
+	}
+	return errors.Join(err, tc.SetNoDelay(o.NoDelay))
+}
@@ -0,0 +1,100 @@
+package sockopt
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (client, server *net.TCPConn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// sockopt reads an integer socket option off conn.
+func sockopt(t *testing.T, conn *net.TCPConn, level, opt int) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var gerr error
+	if err := raw.Control(func(fd uintptr) { v, gerr = syscall.GetsockoptInt(int(fd), level, opt) }); err != nil {
+		t.Fatal(err)
+	}
+	if gerr != nil {
+		t.Fatal(gerr)
+	}
+	return v
+}
+
+func TestApply(t *testing.T) {
+	_, conn := tcpPair(t)
+	if err := (Options{KeepAlive: 7 * time.Second, NoDelay: true}).Apply(conn); err != nil {
+		t.Fatal(err)
+	}
+	if sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0 {
+		t.Error("keep-alive off")
+	}
+	if got := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); got != 7 {
+		t.Errorf("keep-alive idle %ds, want 7s", got)
+	}
+	if sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0 {
+		t.Error("TCP_NODELAY not set")
+	}
+}
+
+func TestApplyOff(t *testing.T) {
+	_, conn := tcpPair(t)
+	if err := (Options{}).Apply(conn); err != nil {
+		t.Fatal(err)
+	}
+	if sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0 {
+		t.Error("keep-alive left on")
+	}
+	if sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0 {
+		t.Error("TCP_NODELAY left on, so Nagle is off")
+	}
+}
+
+func TestApplyThroughTLS(t *testing.T) {
+	_, conn := tcpPair(t)
+	wrapped := tls.Client(conn, &tls.Config{})
+	if err := (Options{NoDelay: true}).Apply(wrapped); err != nil {
+		t.Fatal(err)
+	}
+	if sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0 {
+		t.Error("TCP_NODELAY not set under TLS")
+	}
+
+	// Anything that isn't TCP is left alone
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if err := (Options{NoDelay: true}).Apply(a); err != nil {
+		t.Errorf("pipe: %v", err)
+	}
+}
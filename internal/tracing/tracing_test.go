@@ -0,0 +1,24 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSetupWithoutEndpoint(t *testing.T) {
+	shutdown, err := Setup(context.Background(), "test", "dev", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
+
+func TestSetupInvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"localhost:4318", "://nope", "http://"} {
+		if _, err := Setup(context.Background(), "test", "dev", endpoint); err == nil {
+			t.Errorf("%q accepted", endpoint)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+// Package version describes the running build. The variables are set at
+// link time, e.g.
+//
+//	go build -ldflags "-X github.com/mindsgn-studio/intunja/internal/version.Version=v1.2.0"
+package version
+
+import "fmt"
+
+var (
+	Version = "dev"
+	Commit  = "unknown"
+	Date    = "unknown"
+)
+
+// String describes the build on one line, for -version.
+func String() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", Version, Commit, Date)
+}
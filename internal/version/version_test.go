@@ -0,0 +1,37 @@
+package version
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	if got, want := String(), "dev (commit unknown, built unknown)"; got != want {
+		t.Errorf("unstamped build is %q, want %q", got, want)
+	}
+}
+
+func TestLinkerFlags(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the client")
+	}
+	const pkg = "github.com/mindsgn-studio/intunja/internal/version"
+	bin := filepath.Join(t.TempDir(), "intunja-client")
+	build := exec.Command("go", "build", "-o", bin, "-ldflags",
+		"-X "+pkg+".Version=v1.2.3 -X "+pkg+".Commit=abc1234 -X "+pkg+".Date=2026-01-02T03:04:05Z",
+		"github.com/mindsgn-studio/intunja/cmd/client")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("build: %v\n%s", err, out)
+	}
+
+	out, err := exec.Command(bin, "-version").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "intunja client v1.2.3 (commit abc1234, built 2026-01-02T03:04:05Z)"
+	if got := strings.TrimSpace(string(out)); got != want {
+		t.Errorf("-version printed %q, want %q", got, want)
+	}
+}